@@ -0,0 +1,835 @@
+package cider
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Categories of every supported command, keyed by command or command|subcommand.
+var commandCategories = map[string][]string{
+	"SET":                     {"write", "string", "slow"},
+	"GET":                     {"read", "string", "fast"},
+	"DEL":                     {"keyspace", "write", "slow"},
+	"EXISTS":                  {"keyspace", "read", "fast"},
+	"EXPIRE":                  {"keyspace", "write", "fast"},
+	"EXPIREAT":                {"keyspace", "write", "fast"},
+	"INCR":                    {"write", "string", "fast"},
+	"DECR":                    {"write", "string", "fast"},
+	"AUTH":                    {"fast", "connection"},
+	"ACL":                     {"admin", "slow", "dangerous"},
+	"ACL|WHOAMI":              {"slow"},
+	"ACL|CAT":                 {"slow"},
+	"ACL|GETUSER":             {"admin", "slow", "dangerous"},
+	"CLIENT":                  {"admin", "slow", "dangerous", "connection"},
+	"CLIENT|ID":               {"slow", "connection"},
+	"CLIENT|INFO":             {"slow", "connection"},
+	"CLIENT|GETNAME":          {"slow", "connection"},
+	"CLIENT|SETNAME":          {"slow", "connection"},
+	"OBJECT":                  {"keyspace", "read", "slow"},
+	"MEMORY":                  {"slow"},
+	"MEMORY|USAGE":            {"read", "slow"},
+	"INFO":                    {"slow", "dangerous"},
+	"SLOWLOG":                 {"admin", "slow", "dangerous"},
+	"LATENCY":                 {"admin", "slow", "dangerous"},
+	"MONITOR":                 {"admin", "slow", "dangerous"},
+	"CONFIG":                  {"admin", "slow", "dangerous"},
+	"PING":                    {"fast", "connection"},
+	"REPLICAOF":               {"admin", "slow", "dangerous"},
+	"ROLE":                    {"admin", "fast", "dangerous"},
+	"REPLCONF":                {"admin", "slow", "dangerous"},
+	"PSYNC":                   {"admin", "slow", "dangerous"},
+	"SENTINEL":                {"admin", "slow", "dangerous"},
+	"WAIT":                    {"slow", "connection"},
+	"WAITAOF":                 {"slow", "connection"},
+	"CLUSTER":                 {"admin", "slow", "dangerous"},
+	"CLUSTER|INFO":            {"slow"},
+	"CLUSTER|MYID":            {"slow"},
+	"CLUSTER|NODES":           {"slow"},
+	"CLUSTER|SLOTS":           {"slow"},
+	"CLUSTER|SHARDS":          {"slow"},
+	"CLUSTER|KEYSLOT":         {"slow"},
+	"CLUSTER|COUNTKEYSINSLOT": {"slow"},
+	"CLUSTER|GETKEYSINSLOT":   {"slow"},
+	"ASKING":                  {"fast", "connection"},
+	"DUMP":                    {"keyspace", "read", "slow"},
+	"RESTORE":                 {"keyspace", "write", "slow", "dangerous"},
+	"MIGRATE":                 {"keyspace", "write", "slow", "dangerous"},
+	"PFADD":                   {"write", "hyperloglog", "fast"},
+	"PFCOUNT":                 {"read", "hyperloglog", "slow"},
+	"PFMERGE":                 {"write", "hyperloglog", "slow"},
+	"GEOADD":                  {"write", "geo", "slow"},
+	"GEOPOS":                  {"read", "geo", "slow"},
+	"GEODIST":                 {"read", "geo", "slow"},
+	"GEOHASH":                 {"read", "geo", "slow"},
+	"GEOSEARCH":               {"read", "geo", "slow"},
+	"GEOSEARCHSTORE":          {"write", "geo", "slow"},
+	"FUNCTION":                {"write", "slow", "scripting"},
+	"FUNCTION|LIST":           {"slow", "scripting"},
+	"FUNCTION|DUMP":           {"slow", "scripting"},
+	"FUNCTION|KILL":           {"slow", "scripting"},
+	"FUNCTION|STATS":          {"slow", "scripting"},
+	"FUNCTION|HELP":           {"slow", "scripting"},
+	"FCALL":                   {"slow", "scripting"},
+	"FCALL_RO":                {"slow", "scripting"},
+}
+
+var aclCategories = []string{
+	"keyspace", "read", "write", "string", "hyperloglog", "geo", "scripting", "fast", "slow", "admin",
+	"dangerous", "connection",
+}
+
+// Maximum number of entries kept in the ACL log.
+const aclLogMaxLen = 128
+
+type aclKeyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string
+	// command rules in the order they were applied, last matching rule wins
+	commands []string
+	keys     []aclKeyPattern
+	channels []string
+	deleted  bool
+}
+
+type aclLogEntry struct {
+	count    int64
+	reason   string
+	context  string
+	object   string
+	username string
+	client   string
+	created  time.Time
+	updated  time.Time
+}
+
+type acl struct {
+	mu    *sync.RWMutex
+	users map[string]*aclUser
+	log   []*aclLogEntry
+	file  string
+	// authenticate TLS clients as the user named by their certificate common name
+	certificateUsers bool
+}
+
+func NewACL() *acl {
+	def := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		def.applyRule(rule)
+	}
+
+	return &acl{
+		mu:    &sync.RWMutex{},
+		users: map[string]*aclUser{"default": def},
+	}
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name: name,
+	}
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func categoriesFor(name string, subcommand string) []string {
+	if subcommand != "" {
+		if cats, ok := commandCategories[name+"|"+subcommand]; ok {
+			return cats
+		}
+	}
+	return commandCategories[name]
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = slices.Clone(u.passwords)
+	c.commands = slices.Clone(u.commands)
+	c.keys = slices.Clone(u.keys)
+	c.channels = slices.Clone(u.channels)
+	return &c
+}
+
+// Applies a single ACL rule such as on, >password, ~pattern or +@category.
+func (u *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.keys = []aclKeyPattern{{pattern: "*", read: true, write: true}}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.channels = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		u.commands = []string{"+@all"}
+		return nil
+	case "nocommands":
+		u.commands = nil
+		return nil
+	case "reset":
+		*u = aclUser{name: u.name}
+		return nil
+	}
+
+	if rule == "" {
+		return errors.New("empty rule")
+	}
+
+	switch rule[0] {
+	case '>':
+		hash := hashPassword(rule[1:])
+		if !slices.Contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+		return nil
+	case '#':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return errors.New("the password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if !slices.Contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+		return nil
+	case '<':
+		hash := hashPassword(rule[1:])
+		if !slices.Contains(u.passwords, hash) {
+			return errors.New("no such password")
+		}
+		u.passwords = slices.DeleteFunc(u.passwords, func(p string) bool { return p == hash })
+		return nil
+	case '!':
+		hash := strings.ToLower(rule[1:])
+		if !slices.Contains(u.passwords, hash) {
+			return errors.New("no such password")
+		}
+		u.passwords = slices.DeleteFunc(u.passwords, func(p string) bool { return p == hash })
+		return nil
+	case '~':
+		u.keys = append(u.keys, aclKeyPattern{pattern: rule[1:], read: true, write: true})
+		return nil
+	case '%':
+		perms, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || perms == "" {
+			return errors.New("syntax error")
+		}
+		kp := aclKeyPattern{pattern: pattern}
+		for _, c := range strings.ToUpper(perms) {
+			switch c {
+			case 'R':
+				kp.read = true
+			case 'W':
+				kp.write = true
+			default:
+				return errors.New("syntax error")
+			}
+		}
+		u.keys = append(u.keys, kp)
+		return nil
+	case '&':
+		u.channels = append(u.channels, rule[1:])
+		return nil
+	case '+', '-':
+		body := strings.ToUpper(rule[1:])
+		if strings.HasPrefix(body, "@") {
+			category := strings.ToLower(body[1:])
+			if category != "all" && !slices.Contains(aclCategories, category) {
+				return errors.New("unknown command category")
+			}
+			u.commands = append(u.commands, rule[:1]+"@"+category)
+			return nil
+		}
+		name, _, _ := strings.Cut(body, "|")
+		if _, ok := commandCategories[name]; !ok {
+			return errors.New("unknown command")
+		}
+		u.commands = append(u.commands, rule[:1]+strings.ToLower(body))
+		return nil
+	}
+
+	return errors.New("syntax error")
+}
+
+// Checks whether the user may run a command by evaluating the command rules in order.
+func (u *aclUser) canRun(name string, subcommand string) bool {
+	name = strings.ToLower(name)
+	subcommand = strings.ToLower(subcommand)
+	categories := categoriesFor(strings.ToUpper(name), strings.ToUpper(subcommand))
+
+	allowed := false
+	for _, rule := range u.commands {
+		target := rule[1:]
+		matches := false
+		switch {
+		case target == "@all":
+			matches = true
+		case strings.HasPrefix(target, "@"):
+			matches = slices.Contains(categories, target[1:])
+		case strings.Contains(target, "|"):
+			matches = target == name+"|"+subcommand
+		default:
+			matches = target == name
+		}
+		if matches {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+func (u *aclUser) canAccessKey(key string, read bool, write bool) bool {
+	for _, kp := range u.keys {
+		if (read && !kp.read) || (write && !kp.write) {
+			continue
+		}
+		if matchPattern(kp.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	return slices.Contains(u.passwords, hashPassword(password))
+}
+
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) commandsString() string {
+	if len(u.commands) > 0 && (u.commands[0] == "+@all" || u.commands[0] == "-@all") {
+		return strings.Join(u.commands, " ")
+	}
+	return strings.Join(append([]string{"-@all"}, u.commands...), " ")
+}
+
+func (u *aclUser) keysString() string {
+	var parts []string
+	for _, kp := range u.keys {
+		switch {
+		case kp.read && kp.write:
+			parts = append(parts, "~"+kp.pattern)
+		case kp.read:
+			parts = append(parts, "%R~"+kp.pattern)
+		case kp.write:
+			parts = append(parts, "%W~"+kp.pattern)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) channelsString() string {
+	var parts []string
+	for _, c := range u.channels {
+		parts = append(parts, "&"+c)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Describes the user as a list of rules, the format used by ACL LIST and the ACL file.
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name}
+	parts = append(parts, u.flags()...)
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if keys := u.keysString(); keys != "" {
+		parts = append(parts, keys)
+	} else {
+		parts = append(parts, "resetkeys")
+	}
+	if channels := u.channelsString(); channels != "" {
+		parts = append(parts, channels)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.commandsString())
+	return strings.Join(parts, " ")
+}
+
+// Requires a password for the default user, like the requirepass directive.
+func (a *acl) SetRequirePass(password string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	def := a.users["default"]
+	def.applyRule("resetpass")
+	if password == "" {
+		def.applyRule("nopass")
+		return
+	}
+	def.applyRule(">" + password)
+}
+
+func parseACLUsers(lines []string) (map[string]*aclUser, error) {
+	users := make(map[string]*aclUser)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: should start with user keyword followed by the username", i+1)
+		}
+		name := fields[1]
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user '%s' found", i+1, name)
+		}
+		user := newACLUser(name)
+		for _, rule := range fields[2:] {
+			err := user.applyRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: error in user declaration '%s': %s", i+1, rule, err)
+			}
+		}
+		users[name] = user
+	}
+
+	if _, ok := users["default"]; !ok {
+		users["default"] = NewACL().users["default"]
+	}
+
+	return users, nil
+}
+
+// Loads users from an ACL file and remembers the path for ACL LOAD and ACL SAVE.
+func (a *acl) LoadFile(path string) error {
+	a.mu.Lock()
+	a.file = path
+	a.mu.Unlock()
+
+	return a.load()
+}
+
+func (a *acl) load() error {
+	a.mu.RLock()
+	path := a.file
+	a.mu.RUnlock()
+
+	if path == "" {
+		return errors.New("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	users, err := parseACLUsers(lines)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// update existing users in place so authenticated sessions pick up the new rules
+	for name, old := range a.users {
+		updated, ok := users[name]
+		if !ok {
+			old.deleted = true
+			continue
+		}
+		*old = *updated
+		users[name] = old
+	}
+	a.users = users
+
+	return nil
+}
+
+func (a *acl) save() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.file == "" {
+		return errors.New("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+	}
+
+	var sb strings.Builder
+	for _, name := range a.usernames() {
+		sb.WriteString(a.users[name].describe() + "\n")
+	}
+
+	tmp := a.file + ".tmp"
+	err := os.WriteFile(tmp, []byte(sb.String()), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.file)
+}
+
+// Sorted user names, caller must hold the lock.
+func (a *acl) usernames() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (a *acl) authenticate(username string, password string) (*aclUser, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	user, ok := a.users[username]
+	if !ok || !user.enabled || !user.checkPassword(password) {
+		return nil, newCodedError("WRONGPASS", "invalid username-password pair or user is disabled.")
+	}
+	return user, nil
+}
+
+// Maps verified TLS client certificates to the user named by the certificate common name.
+func (a *acl) SetCertificateUsers(enabled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.certificateUsers = enabled
+}
+
+// Returns the enabled user matching a client certificate common name.
+func (a *acl) certificateUser(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.certificateUsers || name == "" {
+		return nil
+	}
+	user, ok := a.users[name]
+	if !ok || !user.enabled {
+		return nil
+	}
+	return user
+}
+
+// Returns the default user if it can be used without authenticating.
+func (a *acl) defaultUser() *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	def, ok := a.users["default"]
+	if !ok || !def.enabled || !def.nopass {
+		return nil
+	}
+	return def
+}
+
+// Checks command and key permissions of a user for an operation, failures are recorded in the ACL log.
+func (a *acl) check(user *aclUser, op any, client string) error {
+	name, subcommand := commandName(op)
+
+	a.mu.RLock()
+	username := user.name
+	if !user.canRun(name, subcommand) {
+		a.mu.RUnlock()
+
+		object := strings.ToLower(name)
+		if subcommand != "" {
+			object += "|" + strings.ToLower(subcommand)
+		}
+		a.addLog("command", object, username, client)
+		return newCodedError("NOPERM", fmt.Sprintf("User %s has no permissions to run the '%s' command", username, object))
+	}
+
+	categories := categoriesFor(name, subcommand)
+	read := slices.Contains(categories, "read")
+	write := slices.Contains(categories, "write")
+	if !read && !write {
+		read, write = true, true
+	}
+
+	for _, key := range commandKeys(op) {
+		if !user.canAccessKey(key, read, write) {
+			a.mu.RUnlock()
+
+			a.addLog("key", key, username, client)
+			return newCodedError("NOPERM", "No permissions to access a key")
+		}
+	}
+	a.mu.RUnlock()
+
+	return nil
+}
+
+func (a *acl) addLog(reason string, object string, username string, client string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for _, entry := range a.log {
+		// similar entries within a minute are merged
+		if entry.reason == reason && entry.object == object && entry.username == username &&
+			entry.client == client && now.Sub(entry.updated) < time.Minute {
+			entry.count++
+			entry.updated = now
+			return
+		}
+	}
+
+	entry := &aclLogEntry{
+		count:    1,
+		reason:   reason,
+		context:  "toplevel",
+		object:   object,
+		username: username,
+		client:   client,
+		created:  now,
+		updated:  now,
+	}
+	a.log = append([]*aclLogEntry{entry}, a.log...)
+	if len(a.log) > aclLogMaxLen {
+		a.log = a.log[:aclLogMaxLen]
+	}
+}
+
+func (s *Session) handleACL(op opACL) []byte {
+	a := s.acl
+
+	switch op.subcommand {
+	case "WHOAMI":
+		return replyString([]byte(s.user.name))
+
+	case "USERS":
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+
+		var names [][]byte
+		for _, name := range a.usernames() {
+			names = append(names, replyString([]byte(name)))
+		}
+		return replyArray(names)
+
+	case "LIST":
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+
+		var users [][]byte
+		for _, name := range a.usernames() {
+			users = append(users, replyString([]byte(a.users[name].describe())))
+		}
+		return replyArray(users)
+
+	case "GETUSER":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for ACL GETUSER"))
+		}
+
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+
+		user, ok := a.users[op.args[0]]
+		if !ok {
+			return replyNil()
+		}
+
+		var flags, passwords [][]byte
+		for _, f := range user.flags() {
+			flags = append(flags, replyString([]byte(f)))
+		}
+		for _, p := range user.passwords {
+			passwords = append(passwords, replyString([]byte(p)))
+		}
+		return replyArray([][]byte{
+			replyString([]byte("flags")), replyArray(flags),
+			replyString([]byte("passwords")), replyArray(passwords),
+			replyString([]byte("commands")), replyString([]byte(user.commandsString())),
+			replyString([]byte("keys")), replyString([]byte(user.keysString())),
+			replyString([]byte("channels")), replyString([]byte(user.channelsString())),
+			replyString([]byte("selectors")), replyArray(nil),
+		})
+
+	case "SETUSER":
+		if len(op.args) < 1 {
+			return replyError(errors.New("wrong number of arguments for ACL SETUSER"))
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		name := op.args[0]
+		existing, ok := a.users[name]
+		user := newACLUser(name)
+		if ok {
+			user = existing.clone()
+		}
+		// rules are applied to a copy so a failing rule leaves the user untouched
+		for _, rule := range op.args[1:] {
+			err := user.applyRule(rule)
+			if err != nil {
+				return replyError(fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err))
+			}
+		}
+		if ok {
+			*existing = *user
+		} else {
+			a.users[name] = user
+		}
+		return replyOK()
+
+	case "DELUSER":
+		if len(op.args) < 1 {
+			return replyError(errors.New("wrong number of arguments for ACL DELUSER"))
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		deleted := int64(0)
+		for _, name := range op.args {
+			if name == "default" {
+				return replyError(errors.New("The 'default' user cannot be removed"))
+			}
+		}
+		for _, name := range op.args {
+			if user, ok := a.users[name]; ok {
+				user.deleted = true
+				delete(a.users, name)
+				deleted++
+			}
+		}
+		return replyInteger(deleted)
+
+	case "CAT":
+		if len(op.args) == 0 {
+			var cats [][]byte
+			for _, c := range aclCategories {
+				cats = append(cats, replyString([]byte(c)))
+			}
+			return replyArray(cats)
+		}
+
+		category := strings.ToLower(op.args[0])
+		if !slices.Contains(aclCategories, category) {
+			return replyError(fmt.Errorf("Unknown category '%s'", category))
+		}
+		var names []string
+		for name, cats := range commandCategories {
+			if slices.Contains(cats, category) {
+				names = append(names, strings.ToLower(name))
+			}
+		}
+		slices.Sort(names)
+		var commands [][]byte
+		for _, name := range names {
+			commands = append(commands, replyString([]byte(name)))
+		}
+		return replyArray(commands)
+
+	case "LOG":
+		count := aclLogMaxLen
+		if len(op.args) > 0 {
+			if strings.ToUpper(op.args[0]) == "RESET" {
+				a.mu.Lock()
+				a.log = nil
+				a.mu.Unlock()
+				return replyOK()
+			}
+			n, err := strconv.Atoi(op.args[0])
+			if err != nil || n < 0 {
+				return replyError(errors.New("value is out of range, must be positive"))
+			}
+			count = n
+		}
+
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+
+		var entries [][]byte
+		for i, entry := range a.log {
+			if i >= count {
+				break
+			}
+			age := float64(time.Since(entry.created).Milliseconds()) / 1000
+			entries = append(entries, replyArray([][]byte{
+				replyString([]byte("count")), replyInteger(entry.count),
+				replyString([]byte("reason")), replyString([]byte(entry.reason)),
+				replyString([]byte("context")), replyString([]byte(entry.context)),
+				replyString([]byte("object")), replyString([]byte(entry.object)),
+				replyString([]byte("username")), replyString([]byte(entry.username)),
+				replyString([]byte("age-seconds")), replyString([]byte(strconv.FormatFloat(age, 'f', 3, 64))),
+				replyString([]byte("client-info")), replyString([]byte(entry.client)),
+				replyString([]byte("timestamp-created")), replyInteger(entry.created.UnixMilli()),
+				replyString([]byte("timestamp-last-updated")), replyInteger(entry.updated.UnixMilli()),
+			}))
+		}
+		return replyArray(entries)
+
+	case "LOAD":
+		err := a.load()
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+
+	case "SAVE":
+		err := a.save()
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
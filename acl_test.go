@@ -0,0 +1,159 @@
+package cider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	type tc struct {
+		pattern string
+		input   string
+		want    bool
+	}
+
+	tcs := []tc{
+		{pattern: "*", input: "anything", want: true},
+		{pattern: "foo:*", input: "foo:bar", want: true},
+		{pattern: "foo:*", input: "bar:foo", want: false},
+		{pattern: "h?llo", input: "hello", want: true},
+		{pattern: "h?llo", input: "hllo", want: false},
+		{pattern: "h[ae]llo", input: "hallo", want: true},
+		{pattern: "h[^e]llo", input: "hello", want: false},
+		{pattern: "h[a-b]llo", input: "hbllo", want: true},
+		{pattern: "h\\*llo", input: "h*llo", want: true},
+		{pattern: "h\\*llo", input: "hello", want: false},
+	}
+
+	for _, tc := range tcs {
+		got := matchPattern(tc.pattern, tc.input)
+		if got != tc.want {
+			t.Errorf("pattern %s input %s: want %v, got %v", tc.pattern, tc.input, tc.want, got)
+		}
+	}
+}
+
+func TestACLDefaultUser(t *testing.T) {
+	acl := NewACL()
+
+	user := acl.defaultUser()
+	if user == nil {
+		t.Fatal("default user should not require a password")
+	}
+
+	err := acl.check(user, opSet{key: "foo"}, "test")
+	if err != nil {
+		t.Error(err)
+	}
+
+	acl.SetRequirePass("secret")
+	if acl.defaultUser() != nil {
+		t.Error("default user should require a password")
+	}
+
+	_, err = acl.authenticate("default", "wrong")
+	if err == nil {
+		t.Error("want error for wrong password")
+	}
+
+	_, err = acl.authenticate("default", "secret")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	acl := NewACL()
+
+	user := newACLUser("alice")
+	for _, rule := range []string{"on", ">pass", "~cache:*", "%R~ro:*", "+@read", "-exists", "+set"} {
+		err := user.applyRule(rule)
+		if err != nil {
+			t.Fatalf("rule %s: %s", rule, err)
+		}
+	}
+
+	type tc struct {
+		op      any
+		allowed bool
+	}
+
+	tcs := []tc{
+		{op: opGet{key: "cache:1"}, allowed: true},
+		{op: opGet{key: "ro:1"}, allowed: true},
+		{op: opGet{key: "other"}, allowed: false},
+		{op: opSet{key: "cache:1"}, allowed: true},
+		{op: opSet{key: "ro:1"}, allowed: false},
+		{op: opExists{keys: []string{"cache:1"}}, allowed: false},
+		{op: opDel{keys: []string{"cache:1"}}, allowed: false},
+		{op: opACL{subcommand: "WHOAMI"}, allowed: false},
+	}
+
+	for _, tc := range tcs {
+		err := acl.check(user, tc.op, "test")
+		if tc.allowed && err != nil {
+			t.Errorf("%#v: want allowed, got %s", tc.op, err)
+		}
+		if !tc.allowed && err == nil {
+			t.Errorf("%#v: want denied", tc.op)
+		}
+	}
+
+	if len(acl.log) == 0 {
+		t.Error("denied commands should be logged")
+	}
+
+	err := user.applyRule("+nosuchcommand")
+	if err == nil {
+		t.Error("want error for unknown command")
+	}
+
+	if !user.checkPassword("pass") || user.checkPassword("nope") {
+		t.Error("password check failed")
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	content := "user default on nopass ~* &* +@all\nuser bob on >hunter2 ~bob:* -@all +get\n"
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := NewACL()
+	err = acl.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := acl.authenticate("bob", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = acl.check(bob, opGet{key: "bob:1"}, "test")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = acl.check(bob, opSet{key: "bob:1"}, "test")
+	if err == nil {
+		t.Error("want set to be denied")
+	}
+
+	err = acl.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = acl.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acl.authenticate("bob", "hunter2"); err != nil {
+		t.Error(err)
+	}
+}
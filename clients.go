@@ -0,0 +1,446 @@
+package cider
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry of connected sessions, used by the CLIENT command and on shutdown.
+type clients struct {
+	mu       *sync.RWMutex
+	lastID   int64
+	sessions map[int64]*Session
+	// commands are held back until pauseUntil, only writes when pauseWrites is set
+	pauseUntil  time.Time
+	pauseWrites bool
+	unpause     chan struct{}
+}
+
+func newClients() *clients {
+	return &clients{
+		mu:       &sync.RWMutex{},
+		sessions: make(map[int64]*Session),
+		unpause:  make(chan struct{}),
+	}
+}
+
+// Registers a session and assigns its client id.
+func (c *clients) add(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastID++
+	s.id = c.lastID
+	c.sessions[s.id] = s
+}
+
+func (c *clients) remove(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.sessions, s.id)
+}
+
+// Sessions ordered by client id.
+func (c *clients) list() []*Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return int(a.id - b.id)
+	})
+	return sessions
+}
+
+func (c *clients) count() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.sessions)
+}
+
+func (c *clients) pause(timeout time.Duration, writes bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	until := time.Now().Add(timeout)
+	// a pause never shortens or narrows one already in effect
+	if c.pauseUntil.After(time.Now()) {
+		if until.Before(c.pauseUntil) {
+			until = c.pauseUntil
+		}
+		writes = writes && c.pauseWrites
+	}
+	c.pauseUntil = until
+	c.pauseWrites = writes
+}
+
+func (c *clients) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pauseUntil = time.Time{}
+	close(c.unpause)
+	c.unpause = make(chan struct{})
+}
+
+// Blocks while clients are paused for the kind of command about to run.
+func (s *Session) waitPause(write bool) {
+	c := s.server.clients
+	for {
+		c.mu.RLock()
+		until, writes, unpause := c.pauseUntil, c.pauseWrites, c.unpause
+		c.mu.RUnlock()
+
+		wait := time.Until(until)
+		if wait <= 0 || (writes && !write) {
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-unpause:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// Records the command being run for CLIENT LIST.
+func (s *Session) touch(op any) {
+	cmd := commandLabel(op)
+
+	s.mu.Lock()
+	s.lastCommand = cmd
+	s.lastInteraction = time.Now()
+	s.queryBuffer = s.reader.Buffered()
+	s.mu.Unlock()
+}
+
+// Closes the connection right away, pending replies are dropped.
+func (s *Session) kill() {
+	s.cancel()
+	s.out.close()
+	s.conn.Close()
+}
+
+func (s *Session) username() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user == nil {
+		return ""
+	}
+	return s.user.name
+}
+
+// Gets the type matched by the TYPE filters of CLIENT LIST and CLIENT KILL. Like
+// redis, monitors are normal clients and no client is a pubsub one.
+func (s *Session) clientType() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.master:
+		return "master"
+	case s.replica:
+		return "replica"
+	}
+	return "normal"
+}
+
+// Parses the client type of a TYPE filter, slave is an alias of replica.
+func parseClientType(name string) (string, error) {
+	switch t := strings.ToLower(name); t {
+	case "normal", "master", "replica", "pubsub":
+		return t, nil
+	case "slave":
+		return "replica", nil
+	}
+	return "", fmt.Errorf("Unknown client type '%s'", name)
+}
+
+// Describes the session in the CLIENT LIST format.
+func (s *Session) describe() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flags := "N"
+	switch {
+	case s.monitor:
+		flags = "O"
+	case s.replica:
+		flags = "S"
+	case s.master:
+		flags = "M"
+	}
+	if s.noEvict {
+		flags += "e"
+	}
+	user := "default"
+	if s.user != nil {
+		user = s.user.name
+	}
+	now := time.Now()
+	queued, size := s.out.stats()
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=-1 name=%s age=%d idle=%d flags=%s db=0 sub=0 psub=0 ssub=0 multi=-1 qbuf=%d qbuf-free=%d rbs=%d obl=0 oll=%d omem=%d events=r cmd=%s user=%s redir=-1 resp=2",
+		s.id, s.conn.RemoteAddr(), s.conn.LocalAddr(), s.name,
+		int64(now.Sub(s.created).Seconds()), int64(now.Sub(s.lastInteraction).Seconds()), flags,
+		s.queryBuffer, sessionBufferSize-s.queryBuffer, sessionBufferSize, queued, size,
+		s.lastCommand, user)
+}
+
+func (s *Session) handleClient(op opClient) []byte {
+	c := s.server.clients
+
+	switch op.subcommand {
+	case "ID":
+		return replyInteger(s.id)
+
+	case "INFO":
+		return replyString([]byte(s.describe() + "\n"))
+
+	case "LIST":
+		var ids []int64
+		var clientType string
+		for i := 0; i < len(op.args); i++ {
+			switch strings.ToUpper(op.args[i]) {
+			case "TYPE":
+				if i+1 >= len(op.args) {
+					return replyError(errors.New("syntax error"))
+				}
+				i++
+				t, err := parseClientType(op.args[i])
+				if err != nil {
+					return replyError(err)
+				}
+				clientType = t
+			case "ID":
+				for _, arg := range op.args[i+1:] {
+					id, err := strconv.ParseInt(arg, 10, 64)
+					if err != nil || id <= 0 {
+						return replyError(errors.New("Invalid client ID"))
+					}
+					ids = append(ids, id)
+				}
+				i = len(op.args)
+			default:
+				return replyError(errors.New("syntax error"))
+			}
+		}
+
+		var sb strings.Builder
+		for _, session := range c.list() {
+			if ids != nil && !slices.Contains(ids, session.id) {
+				continue
+			}
+			if clientType != "" && session.clientType() != clientType {
+				continue
+			}
+			sb.WriteString(session.describe() + "\n")
+		}
+		return replyString([]byte(sb.String()))
+
+	case "GETNAME":
+		s.mu.Lock()
+		name := s.name
+		s.mu.Unlock()
+
+		if name == "" {
+			return replyNil()
+		}
+		return replyString([]byte(name))
+
+	case "SETNAME":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for CLIENT SETNAME"))
+		}
+		for _, r := range op.args[0] {
+			if r <= ' ' || r > '~' {
+				return replyError(errors.New("Client names cannot contain spaces, newlines or special characters."))
+			}
+		}
+
+		s.mu.Lock()
+		s.name = op.args[0]
+		s.mu.Unlock()
+		return replyOK()
+
+	case "KILL":
+		return s.clientKill(op.args)
+
+	case "PAUSE":
+		if len(op.args) < 1 || len(op.args) > 2 {
+			return replyError(errors.New("wrong number of arguments for CLIENT PAUSE"))
+		}
+		ms, err := strconv.ParseInt(op.args[0], 10, 64)
+		if err != nil || ms < 0 {
+			return replyError(errors.New("timeout is not an integer or out of range"))
+		}
+		writes := false
+		if len(op.args) == 2 {
+			switch strings.ToUpper(op.args[1]) {
+			case "WRITE":
+				writes = true
+			case "ALL":
+			default:
+				return replyError(errors.New("syntax error"))
+			}
+		}
+		c.pause(time.Duration(ms)*time.Millisecond, writes)
+		return replyOK()
+
+	case "UNPAUSE":
+		c.resume()
+		return replyOK()
+
+	case "NO-EVICT":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for CLIENT NO-EVICT"))
+		}
+		var enabled bool
+		switch strings.ToUpper(op.args[0]) {
+		case "ON":
+			enabled = true
+		case "OFF":
+		default:
+			return replyError(errors.New("syntax error"))
+		}
+
+		s.mu.Lock()
+		s.noEvict = enabled
+		s.mu.Unlock()
+		return replyOK()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
+
+func (s *Session) clientKill(args []string) []byte {
+	c := s.server.clients
+
+	// old form, CLIENT KILL addr
+	if len(args) == 1 {
+		for _, session := range c.list() {
+			if session.conn.RemoteAddr().String() == args[0] {
+				session.kill()
+				return replyOK()
+			}
+		}
+		return replyError(errors.New("No such client"))
+	}
+
+	if len(args) == 0 || len(args)%2 != 0 {
+		return replyError(errors.New("syntax error"))
+	}
+
+	var (
+		id         int64
+		addr       string
+		laddr      string
+		user       string
+		clientType string
+		maxage     time.Duration
+		skipme     = true
+		hasFilter  bool
+	)
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return replyError(errors.New("client-id should be greater than 0"))
+			}
+			id = n
+		case "ADDR":
+			addr = value
+		case "LADDR":
+			laddr = value
+		case "USER":
+			user = value
+		case "TYPE":
+			t, err := parseClientType(value)
+			if err != nil {
+				return replyError(err)
+			}
+			clientType = t
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			default:
+				return replyError(errors.New("syntax error"))
+			}
+			continue
+		case "MAXAGE":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 || n > math.MaxInt64/int64(time.Second) {
+				return replyError(errors.New("maxage is not an integer or out of range"))
+			}
+			maxage = time.Duration(n) * time.Second
+		default:
+			return replyError(errors.New("syntax error"))
+		}
+		hasFilter = true
+	}
+	if !hasFilter {
+		return replyError(errors.New("syntax error"))
+	}
+
+	killed := int64(0)
+	self := false
+	for _, session := range c.list() {
+		if id != 0 && session.id != id {
+			continue
+		}
+		if addr != "" && session.conn.RemoteAddr().String() != addr {
+			continue
+		}
+		if laddr != "" && session.conn.LocalAddr().String() != laddr {
+			continue
+		}
+		if user != "" && session.username() != user {
+			continue
+		}
+		if clientType != "" && session.clientType() != clientType {
+			continue
+		}
+		// only clients connected for longer than maxage
+		if maxage != 0 && time.Since(session.created) <= maxage {
+			continue
+		}
+		if session == s {
+			if skipme {
+				continue
+			}
+			// the reply is sent before the connection is closed
+			self = true
+			killed++
+			continue
+		}
+		session.kill()
+		killed++
+	}
+	if self {
+		s.cancel()
+	}
+
+	return replyInteger(killed)
+}
@@ -0,0 +1,139 @@
+package cider
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientCommands(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	address := server.Addrs()[0].String()
+
+	first := dialTestClient(t, "tcp", address)
+	second := dialTestClient(t, "tcp", address)
+
+	if reply := first.do(t, "CLIENT ID"); reply != ":1\r\n" {
+		t.Errorf("want: :1, got %q", reply)
+	}
+	if reply := second.do(t, "CLIENT ID"); reply != ":2\r\n" {
+		t.Errorf("want: :2, got %q", reply)
+	}
+
+	if reply := first.do(t, "CLIENT GETNAME"); reply != "_\r\n" {
+		t.Errorf("want nil, got %q", reply)
+	}
+	if reply := first.do(t, "CLIENT SETNAME worker"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	if reply := first.do(t, "CLIENT GETNAME"); reply != "$6\r\nworker\r\n" {
+		t.Errorf("want worker, got %q", reply)
+	}
+
+	list := second.do(t, "CLIENT LIST")
+	if !strings.Contains(list, "id=1 ") || !strings.Contains(list, "name=worker") || !strings.Contains(list, "cmd=client|list") {
+		t.Errorf("unexpected client list %q", list)
+	}
+
+	info := first.do(t, "CLIENT INFO")
+	if !strings.Contains(info, "id=1 ") || strings.Contains(info, "id=2 ") {
+		t.Errorf("unexpected client info %q", info)
+	}
+
+	if reply := second.do(t, "CLIENT KILL ID 1"); reply != ":1\r\n" {
+		t.Errorf("want: :1, got %q", reply)
+	}
+	first.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := first.reader.ReadByte(); err == nil {
+		t.Error("want killed connection to be closed")
+	}
+
+	// skipme defaults to yes
+	if reply := second.do(t, "CLIENT KILL ID 2"); reply != ":0\r\n" {
+		t.Errorf("want: :0, got %q", reply)
+	}
+	if reply := second.do(t, "CLIENT KILL 1.2.3.4:5"); !strings.HasPrefix(reply, "-ERR No such client") {
+		t.Errorf("want error, got %q", reply)
+	}
+	if reply := second.do(t, "CLIENT KILL TYPE nope"); reply != "-ERR Unknown client type 'nope'\r\n" {
+		t.Errorf("want unknown type error, got %q", reply)
+	}
+	if reply := second.do(t, "CLIENT LIST TYPE pubsub"); reply != "$0\r\n\r\n" {
+		t.Errorf("want no pubsub clients, got %q", reply)
+	}
+}
+
+func TestClientKillMaxAge(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	address := server.Addrs()[0].String()
+
+	old := dialTestClient(t, "tcp", address)
+	old.do(t, "PING")
+	time.Sleep(1100 * time.Millisecond)
+	admin := dialTestClient(t, "tcp", address)
+
+	if reply := admin.do(t, "CLIENT KILL MAXAGE 0"); !strings.HasPrefix(reply, "-ERR maxage") {
+		t.Errorf("want maxage error, got %q", reply)
+	}
+	if reply := admin.do(t, "CLIENT KILL MAXAGE 60 SKIPME no"); reply != ":0\r\n" {
+		t.Errorf("want: :0, got %q", reply)
+	}
+	// only the client connected for more than a second
+	if reply := admin.do(t, "CLIENT KILL MAXAGE 1 SKIPME no"); reply != ":1\r\n" {
+		t.Errorf("want: :1, got %q", reply)
+	}
+	old.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := old.reader.ReadByte(); err == nil {
+		t.Error("want killed connection to be closed")
+	}
+	if reply := admin.do(t, "PING"); reply != "+PONG\r\n" {
+		t.Errorf("want: +PONG, got %q", reply)
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	address := server.Addrs()[0].String()
+
+	admin := dialTestClient(t, "tcp", address)
+	writer := dialTestClient(t, "tcp", address)
+
+	if reply := admin.do(t, "CLIENT PAUSE 10000 WRITE"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+
+	// reads are not paused in WRITE mode
+	if reply := writer.do(t, "GET foo"); reply != "_\r\n" {
+		t.Errorf("want nil, got %q", reply)
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		reply, _ := readTestReply(writer.reader)
+		done <- reply
+	}()
+	writer.conn.Write([]byte("SET foo bar\r\n"))
+
+	select {
+	case reply := <-done:
+		t.Fatalf("write should be paused, got %q", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	admin.do(t, "CLIENT UNPAUSE")
+
+	select {
+	case reply := <-done:
+		if reply != "+OK\r\n" {
+			t.Errorf("want: +OK, got %q", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write should resume after unpause")
+	}
+}
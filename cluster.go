@@ -0,0 +1,981 @@
+package cider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	clusterSlots = 16384
+	// Every known node is sent a gossip message this often.
+	clusterPingPeriod = 500 * time.Millisecond
+
+	defaultClusterNodeTimeout = 15 * time.Second
+)
+
+// CRC16/XMODEM lookup table, the checksum redis maps keys to slots with.
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(data string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// Hash slot of a key. When the key has a non empty hash tag, the part between
+// the first { and the next }, only the tag is hashed so related keys share a slot.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+// A node of the cluster, including this one.
+type clusterNode struct {
+	id string
+	// the ip of this node is empty until it connects to or is reached by another node
+	ip   string
+	port int
+	// epoch of the last slot configuration change of the node
+	configEpoch int64
+	myself      bool
+	// met with CLUSTER MEET or learned from gossip, but did not reply yet
+	handshake bool
+	created   time.Time
+	// when the pending gossip message was sent, zero when none is pending
+	pingSent time.Time
+	lastPong time.Time
+
+	// guards link, which is used without holding the cluster lock
+	linkMu *sync.Mutex
+	link   *link
+	cancel context.CancelFunc
+}
+
+func newClusterNode(id string, ip string, port int) *clusterNode {
+	return &clusterNode{
+		id:      id,
+		ip:      ip,
+		port:    port,
+		created: time.Now(),
+		linkMu:  &sync.Mutex{},
+	}
+}
+
+func (node *clusterNode) address() string {
+	return net.JoinHostPort(node.ip, strconv.Itoa(node.port))
+}
+
+func (node *clusterNode) closeLink() {
+	node.linkMu.Lock()
+	defer node.linkMu.Unlock()
+
+	if node.link != nil {
+		node.link.Close()
+		node.link = nil
+	}
+}
+
+// Cluster mode, keys are sharded over hash slots owned by the nodes. There is
+// no cluster bus, nodes gossip with a CLUSTER GOSSIP command on the client port.
+type cluster struct {
+	srv *Server
+	// guards everything below and the state of every node
+	mu           *sync.Mutex
+	currentEpoch int64
+	myself       *clusterNode
+	// known nodes by id, nodes in handshake are keyed by a random id until they reply
+	nodes map[string]*clusterNode
+	slots [clusterSlots]*clusterNode
+	// slots moving from this node to another one, and from another one to this node
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+	ctx       context.Context
+}
+
+func newCluster(srv *Server) *cluster {
+	myself := newClusterNode(srv.runID, "", 0)
+	myself.myself = true
+	return &cluster{
+		srv:       srv,
+		mu:        &sync.Mutex{},
+		myself:    myself,
+		nodes:     map[string]*clusterNode{myself.id: myself},
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+	}
+}
+
+// Starts gossiping with the known nodes until ctx is done, port is the one other nodes connect to.
+func (cl *cluster) start(ctx context.Context, port int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.ctx = ctx
+	cl.myself.port = port
+	for _, node := range cl.nodes {
+		if !node.myself {
+			cl.startWatch(node)
+		}
+	}
+}
+
+func (cl *cluster) nodeTimeout() time.Duration {
+	if timeout := cl.srv.options().ClusterNodeTimeout; timeout > 0 {
+		return timeout
+	}
+	return defaultClusterNodeTimeout
+}
+
+// Caller must hold mu.
+func (cl *cluster) addNode(id string, ip string, port int) *clusterNode {
+	node := newClusterNode(id, ip, port)
+	node.handshake = true
+	cl.nodes[id] = node
+	if cl.ctx != nil {
+		cl.startWatch(node)
+	}
+	return node
+}
+
+// Caller must hold mu.
+func (cl *cluster) startWatch(node *clusterNode) {
+	var ctx context.Context
+	ctx, node.cancel = context.WithCancel(cl.ctx)
+	go cl.watch(ctx, node)
+}
+
+// Caller must hold mu.
+func (cl *cluster) forget(node *clusterNode) {
+	if cl.nodes[node.id] == node {
+		delete(cl.nodes, node.id)
+	}
+	if node.cancel != nil {
+		node.cancel()
+	}
+	for slot, owner := range cl.slots {
+		if owner == node {
+			cl.slots[slot] = nil
+		}
+	}
+}
+
+// Sends gossip messages to a node until ctx is done.
+func (cl *cluster) watch(ctx context.Context, node *clusterNode) {
+	defer node.closeLink()
+
+	ticker := time.NewTicker(clusterPingPeriod)
+	defer ticker.Stop()
+	for {
+		cl.ping(ctx, node)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the connection to a node, connecting when needed.
+func (cl *cluster) nodeLink(ctx context.Context, node *clusterNode) (*link, error) {
+	node.linkMu.Lock()
+	defer node.linkMu.Unlock()
+
+	if node.link != nil {
+		return node.link, nil
+	}
+
+	cl.mu.Lock()
+	address := node.address()
+	cl.mu.Unlock()
+
+	opts := cl.srv.options()
+	l, err := dialLink(ctx, address, cl.nodeTimeout()/2, opts.MasterUser, opts.MasterAuth)
+	if err != nil {
+		return nil, err
+	}
+	node.link = l
+	return l, nil
+}
+
+// Exchanges gossip messages with a node. Nodes that never replied are forgotten after the node timeout.
+func (cl *cluster) ping(ctx context.Context, node *clusterNode) {
+	cl.mu.Lock()
+	if node.handshake && time.Since(node.created) > cl.nodeTimeout() {
+		log.Warn().Msgf("cluster node %s did not reply, forgetting it", node.address())
+		cl.forget(node)
+		cl.mu.Unlock()
+		return
+	}
+	cl.mu.Unlock()
+
+	l, err := cl.nodeLink(ctx, node)
+	if err != nil {
+		return
+	}
+	// other nodes reach this one on the address it connects from
+	ip, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+
+	cl.mu.Lock()
+	if cl.myself.ip == "" {
+		cl.myself.ip = ip
+	}
+	if node.pingSent.IsZero() {
+		node.pingSent = time.Now()
+	}
+	args := append([]string{"CLUSTER", "GOSSIP"}, cl.gossip()...)
+	cl.mu.Unlock()
+
+	reply, err := l.do(args...)
+	var rerr replyErr
+	if err != nil && !errors.As(err, &rerr) {
+		node.closeLink()
+	}
+	if err != nil {
+		return
+	}
+
+	values, _ := reply.([]any)
+	fields := make([]string, 0, len(values))
+	for _, value := range values {
+		field, _ := value.(string)
+		fields = append(fields, field)
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	err = cl.receive(node, fields)
+	if err != nil {
+		log.Warn().Err(err).Msgf("invalid gossip from cluster node %s", node.address())
+	}
+}
+
+// Describes this node and the nodes it knows as: id, ip, port, current epoch,
+// config epoch, owned slot ranges, then id and address pairs. Caller must hold mu.
+func (cl *cluster) gossip() []string {
+	ranges := make([]string, 0)
+	for _, r := range cl.slotRanges(cl.myself) {
+		if r[0] == r[1] {
+			ranges = append(ranges, strconv.Itoa(r[0]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	slots := strings.Join(ranges, ",")
+	if slots == "" {
+		slots = "-"
+	}
+
+	fields := []string{
+		cl.myself.id, cl.myself.ip, strconv.Itoa(cl.myself.port),
+		strconv.FormatInt(cl.currentEpoch, 10), strconv.FormatInt(cl.myself.configEpoch, 10), slots,
+	}
+	for _, node := range cl.sortedNodes() {
+		if !node.myself && !node.handshake {
+			fields = append(fields, node.id, node.address())
+		}
+	}
+	return fields
+}
+
+// Applies a gossip message, sent by another node or received as the reply of
+// node from. Slots claimed with a newer config epoch than their current owner's
+// are reassigned. Caller must hold mu.
+func (cl *cluster) receive(from *clusterNode, fields []string) error {
+	if len(fields) < 6 || len(fields)%2 != 0 {
+		return errors.New("invalid gossip message")
+	}
+	id, ip := fields[0], fields[1]
+	port, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return err
+	}
+	epoch, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return err
+	}
+	configEpoch, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return err
+	}
+	claimed, err := parseSlotRanges(fields[5])
+	if err != nil {
+		return err
+	}
+
+	if id == cl.myself.id {
+		// an address of this node was met
+		if from != nil && from.handshake {
+			cl.forget(from)
+		}
+		return nil
+	}
+
+	node := cl.nodes[id]
+	if node == nil && from != nil && from.handshake {
+		// the handshake is done, the node is known by its id from now on
+		delete(cl.nodes, from.id)
+		from.id = id
+		cl.nodes[id] = from
+		node = from
+	}
+	if node == nil {
+		node = cl.addNode(id, ip, port)
+	}
+	if from != nil && from != node {
+		// the same node met on two addresses
+		cl.forget(from)
+	}
+	if node.handshake {
+		log.Info().Msgf("cluster node %s %s joined", id, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+	node.ip, node.port = ip, port
+	node.handshake = false
+	node.lastPong = time.Now()
+	if from != nil {
+		node.pingSent = time.Time{}
+	}
+	node.configEpoch = configEpoch
+	cl.currentEpoch = max(cl.currentEpoch, epoch)
+
+	for _, slot := range claimed {
+		owner := cl.slots[slot]
+		if owner == node || (owner != nil && owner.configEpoch >= configEpoch) {
+			continue
+		}
+		cl.slots[slot] = node
+		if owner == cl.myself {
+			delete(cl.migrating, slot)
+		}
+	}
+
+	for i := 6; i < len(fields); i += 2 {
+		id := fields[i]
+		host, p, err := net.SplitHostPort(fields[i+1])
+		if err != nil {
+			return err
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return err
+		}
+		if _, ok := cl.nodes[id]; ok || cl.nodeAt(host, port) != nil {
+			continue
+		}
+		cl.addNode(id, host, port)
+	}
+	return nil
+}
+
+// Parses comma separated slots and slot ranges, or - for none.
+func parseSlotRanges(value string) ([]int, error) {
+	if value == "-" {
+		return nil, nil
+	}
+	var slots []int
+	for _, r := range strings.Split(value, ",") {
+		first, last, ok := strings.Cut(r, "-")
+		if !ok {
+			last = first
+		}
+		start, err := parseSlot(first)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseSlot(last)
+		if err != nil {
+			return nil, err
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+func parseSlot(value string) (int, error) {
+	slot, err := strconv.Atoi(value)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, errors.New("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// Node listening on ip and port, if known. Caller must hold mu.
+func (cl *cluster) nodeAt(ip string, port int) *clusterNode {
+	for _, node := range cl.nodes {
+		if node.ip == ip && node.port == port {
+			return node
+		}
+	}
+	return nil
+}
+
+// Nodes ordered by id. Caller must hold mu.
+func (cl *cluster) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cl.nodes))
+	for _, node := range cl.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.SortFunc(nodes, func(a, b *clusterNode) int {
+		return strings.Compare(a.id, b.id)
+	})
+	return nodes
+}
+
+// Ranges of consecutive slots owned by node. Caller must hold mu.
+func (cl *cluster) slotRanges(node *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cl.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// Checks that the keys of a command are served by this node. Returns a MOVED
+// or ASK redirect, or a CROSSSLOT, TRYAGAIN or CLUSTERDOWN error otherwise.
+func (cl *cluster) route(ctx context.Context, store Storer, keys []string, asking bool) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			return newCodedError("CROSSSLOT", "Keys in request don't hash to the same slot")
+		}
+	}
+
+	cl.mu.Lock()
+	owner := cl.slots[slot]
+	migrating := cl.migrating[slot]
+	_, importing := cl.importing[slot]
+	var address string
+	if owner != nil {
+		address = owner.address()
+	}
+	if migrating != nil {
+		address = migrating.address()
+	}
+	myself := owner == cl.myself
+	cl.mu.Unlock()
+
+	switch {
+	case owner == nil:
+		return newCodedError("CLUSTERDOWN", "Hash slot not served")
+	case myself && migrating != nil:
+		// keys that are not here anymore have been moved to the target
+		found, err := store.Exists(ctx, keys)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			return newCodedError("ASK", fmt.Sprintf("%d %s", slot, address))
+		}
+		if found < int64(len(keys)) {
+			return newCodedError("TRYAGAIN", "Multiple keys request during rehashing of slot")
+		}
+	case !myself:
+		if importing && asking {
+			return nil
+		}
+		return newCodedError("MOVED", fmt.Sprintf("%d %s", slot, address))
+	}
+	return nil
+}
+
+// Describes cluster mode for INFO.
+func (srv *Server) clusterInfo(field func(name string, value any)) {
+	enabled := 0
+	if srv.cluster != nil {
+		enabled = 1
+	}
+	field("cluster_enabled", enabled)
+}
+
+// Ip shown for this node before another node told it, the one the client connected to.
+func (s *Session) localIP() string {
+	if ip, _, err := net.SplitHostPort(s.conn.LocalAddr().String()); err == nil {
+		return ip
+	}
+	return "127.0.0.1"
+}
+
+// Caller must hold mu.
+func (cl *cluster) nodeIP(s *Session, node *clusterNode) string {
+	if node.ip == "" {
+		return s.localIP()
+	}
+	return node.ip
+}
+
+// Caller must hold mu.
+func (cl *cluster) failing(node *clusterNode) bool {
+	return !node.myself && !node.pingSent.IsZero() && time.Since(node.pingSent) > cl.nodeTimeout()
+}
+
+// Caller must hold mu.
+func (cl *cluster) nodesLine(s *Session, node *clusterNode) string {
+	flags := "master"
+	switch {
+	case node.myself:
+		flags = "myself,master"
+	case node.handshake:
+		flags = "handshake"
+	case cl.failing(node):
+		flags = "master,fail?"
+	}
+	linkState := "connected"
+	if !node.myself && (node.handshake || cl.failing(node)) {
+		linkState = "disconnected"
+	}
+	var pingSent, pongRecv int64
+	if !node.pingSent.IsZero() {
+		pingSent = node.pingSent.UnixMilli()
+	}
+	if !node.lastPong.IsZero() {
+		pongRecv = node.lastPong.UnixMilli()
+	}
+
+	// the cluster bus is the client port
+	ip := cl.nodeIP(s, node)
+	line := fmt.Sprintf("%s %s:%d@%d %s - %d %d %d %s",
+		node.id, ip, node.port, node.port, flags, pingSent, pongRecv, node.configEpoch, linkState)
+	for _, r := range cl.slotRanges(node) {
+		if r[0] == r[1] {
+			line += fmt.Sprintf(" %d", r[0])
+		} else {
+			line += fmt.Sprintf(" %d-%d", r[0], r[1])
+		}
+	}
+	if node.myself {
+		for _, slot := range sortedSlots(cl.migrating) {
+			line += fmt.Sprintf(" [%d->-%s]", slot, cl.migrating[slot].id)
+		}
+		for _, slot := range sortedSlots(cl.importing) {
+			line += fmt.Sprintf(" [%d-<-%s]", slot, cl.importing[slot].id)
+		}
+	}
+	return line
+}
+
+func sortedSlots(slots map[int]*clusterNode) []int {
+	sorted := make([]int, 0, len(slots))
+	for slot := range slots {
+		sorted = append(sorted, slot)
+	}
+	slices.Sort(sorted)
+	return sorted
+}
+
+// There is no index of keys by slot, every key is visited.
+func countKeysInSlot(ctx context.Context, store Storer, slot int) int64 {
+	n := int64(0)
+	rangeKeys(ctx, store, func(key string) bool {
+		if keySlot(key) == slot {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// Parses slot arguments, rejecting duplicates.
+func parseSlotArgs(args []string) ([]int, error) {
+	seen := make(map[int]bool)
+	var slots []int
+	for _, arg := range args {
+		slot, err := parseSlot(arg)
+		if err != nil {
+			return nil, err
+		}
+		if seen[slot] {
+			return nil, fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+// Parses start and end slot pairs, rejecting overlaps.
+func parseSlotRangeArgs(args []string) ([]int, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("wrong number of arguments for CLUSTER ADDSLOTSRANGE")
+	}
+	var slots []string
+	for i := 0; i < len(args); i += 2 {
+		start, err := parseSlot(args[i])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseSlot(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if start > end {
+			return nil, fmt.Errorf("start slot number %d is greater than end slot number %d", start, end)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, strconv.Itoa(slot))
+		}
+	}
+	return parseSlotArgs(slots)
+}
+
+func (s *Session) handleCluster(store Storer, op opCluster) []byte {
+	cl := s.server.cluster
+	if cl == nil {
+		return replyError(errors.New("This instance has cluster support disabled"))
+	}
+
+	switch op.subcommand {
+	case "KEYSLOT":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for CLUSTER KEYSLOT"))
+		}
+		return replyInteger(int64(keySlot(op.args[0])))
+
+	case "COUNTKEYSINSLOT":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for CLUSTER COUNTKEYSINSLOT"))
+		}
+		slot, err := parseSlot(op.args[0])
+		if err != nil {
+			return replyError(errors.New("Invalid slot"))
+		}
+		return replyInteger(countKeysInSlot(s.ctx, store, slot))
+
+	case "GETKEYSINSLOT":
+		if len(op.args) != 2 {
+			return replyError(errors.New("wrong number of arguments for CLUSTER GETKEYSINSLOT"))
+		}
+		slot, err := parseSlot(op.args[0])
+		if err != nil {
+			return replyError(errors.New("Invalid slot"))
+		}
+		count, err := strconv.Atoi(op.args[1])
+		if err != nil || count < 0 {
+			return replyError(errors.New("Invalid number of keys"))
+		}
+		var keys []string
+		rangeKeys(s.ctx, store, func(key string) bool {
+			if keySlot(key) == slot {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		slices.Sort(keys)
+		replies := make([][]byte, 0, min(count, len(keys)))
+		for _, key := range keys[:min(count, len(keys))] {
+			replies = append(replies, replyString([]byte(key)))
+		}
+		return replyArray(replies)
+
+	case "MYID":
+		return replyString([]byte(cl.myself.id))
+
+	case "ADDSLOTS", "ADDSLOTSRANGE":
+		parse := parseSlotArgs
+		if op.subcommand == "ADDSLOTSRANGE" {
+			parse = parseSlotRangeArgs
+		}
+		if len(op.args) == 0 {
+			return replyError(fmt.Errorf("wrong number of arguments for CLUSTER %s", op.subcommand))
+		}
+		slots, err := parse(op.args)
+		if err != nil {
+			return replyError(err)
+		}
+
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		for _, slot := range slots {
+			if cl.slots[slot] != nil {
+				return replyError(fmt.Errorf("Slot %d is already busy", slot))
+			}
+		}
+		for _, slot := range slots {
+			cl.slots[slot] = cl.myself
+			delete(cl.importing, slot)
+		}
+		return replyOK()
+
+	case "DELSLOTS":
+		if len(op.args) == 0 {
+			return replyError(errors.New("wrong number of arguments for CLUSTER DELSLOTS"))
+		}
+		slots, err := parseSlotArgs(op.args)
+		if err != nil {
+			return replyError(err)
+		}
+
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		for _, slot := range slots {
+			if cl.slots[slot] == nil {
+				return replyError(fmt.Errorf("Slot %d is already unassigned", slot))
+			}
+		}
+		for _, slot := range slots {
+			cl.slots[slot] = nil
+			delete(cl.migrating, slot)
+			delete(cl.importing, slot)
+		}
+		return replyOK()
+
+	case "SETSLOT":
+		return s.handleSetSlot(store, op)
+
+	case "MEET":
+		if len(op.args) != 2 && len(op.args) != 3 {
+			return replyError(errors.New("wrong number of arguments for CLUSTER MEET"))
+		}
+		ip := op.args[0]
+		port, err := strconv.Atoi(op.args[1])
+		if err != nil || port <= 0 || port > 65535 || net.ParseIP(ip) == nil {
+			return replyError(fmt.Errorf("Invalid node address specified: %s:%s", op.args[0], op.args[1]))
+		}
+
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		if cl.nodeAt(ip, port) == nil {
+			// keyed by a random id until the node replies with its own
+			cl.addNode(newReplID(), ip, port)
+		}
+		return replyOK()
+
+	case "GOSSIP":
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		if cl.myself.ip == "" {
+			cl.myself.ip = s.localIP()
+		}
+		err := cl.receive(nil, op.args)
+		if err != nil {
+			return replyError(err)
+		}
+		fields := cl.gossip()
+		// the ip this node is reached on by the sender
+		fields[1] = s.localIP()
+		replies := make([][]byte, 0, len(fields))
+		for _, field := range fields {
+			replies = append(replies, replyString([]byte(field)))
+		}
+		return replyArray(replies)
+
+	case "INFO":
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		assigned, failing := 0, 0
+		owners := make(map[*clusterNode]bool)
+		for _, owner := range cl.slots {
+			if owner == nil {
+				continue
+			}
+			assigned++
+			owners[owner] = true
+			if cl.failing(owner) {
+				failing++
+			}
+		}
+		state := "ok"
+		if assigned < clusterSlots {
+			state = "fail"
+		}
+
+		var sb strings.Builder
+		field := func(name string, value any) {
+			fmt.Fprintf(&sb, "%s:%v\r\n", name, value)
+		}
+		field("cluster_state", state)
+		field("cluster_slots_assigned", assigned)
+		field("cluster_slots_ok", assigned-failing)
+		field("cluster_slots_pfail", failing)
+		field("cluster_slots_fail", 0)
+		field("cluster_known_nodes", len(cl.nodes))
+		field("cluster_size", len(owners))
+		field("cluster_current_epoch", cl.currentEpoch)
+		field("cluster_my_epoch", cl.myself.configEpoch)
+		return replyString([]byte(sb.String()))
+
+	case "NODES":
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		var sb strings.Builder
+		for _, node := range cl.sortedNodes() {
+			sb.WriteString(cl.nodesLine(s, node))
+			sb.WriteString("\n")
+		}
+		return replyString([]byte(sb.String()))
+
+	case "SLOTS":
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		var ranges [][]byte
+		for slot := 0; slot < clusterSlots; {
+			owner := cl.slots[slot]
+			end := slot
+			for end+1 < clusterSlots && cl.slots[end+1] == owner {
+				end++
+			}
+			if owner != nil {
+				ranges = append(ranges, replyArray([][]byte{
+					replyInteger(int64(slot)),
+					replyInteger(int64(end)),
+					replyArray([][]byte{
+						replyString([]byte(cl.nodeIP(s, owner))),
+						replyInteger(int64(owner.port)),
+						replyString([]byte(owner.id)),
+					}),
+				}))
+			}
+			slot = end + 1
+		}
+		return replyArray(ranges)
+
+	case "SHARDS":
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		// every node is a primary without replicas, so each one is a shard
+		var shards [][]byte
+		for _, node := range cl.sortedNodes() {
+			if node.handshake {
+				continue
+			}
+			var slots [][]byte
+			for _, r := range cl.slotRanges(node) {
+				slots = append(slots, replyInteger(int64(r[0])), replyInteger(int64(r[1])))
+			}
+			health := "online"
+			if cl.failing(node) {
+				health = "failed"
+			}
+			ip := cl.nodeIP(s, node)
+			shards = append(shards, replyArray([][]byte{
+				replyString([]byte("slots")),
+				replyArray(slots),
+				replyString([]byte("nodes")),
+				replyArray([][]byte{replyArray([][]byte{
+					replyString([]byte("id")), replyString([]byte(node.id)),
+					replyString([]byte("port")), replyInteger(int64(node.port)),
+					replyString([]byte("ip")), replyString([]byte(ip)),
+					replyString([]byte("endpoint")), replyString([]byte(ip)),
+					replyString([]byte("role")), replyString([]byte("master")),
+					replyString([]byte("replication-offset")), replyInteger(0),
+					replyString([]byte("health")), replyString([]byte(health)),
+				})}),
+			}))
+		}
+		return replyArray(shards)
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
+
+// CLUSTER SETSLOT <slot> IMPORTING|MIGRATING|NODE <id> or STABLE, used to move a slot between nodes.
+func (s *Session) handleSetSlot(store Storer, op opCluster) []byte {
+	cl := s.server.cluster
+	if len(op.args) < 2 {
+		return replyError(errors.New("wrong number of arguments for CLUSTER SETSLOT"))
+	}
+	slot, err := parseSlot(op.args[0])
+	if err != nil {
+		return replyError(err)
+	}
+	action := strings.ToUpper(op.args[1])
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if action == "STABLE" {
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+		return replyOK()
+	}
+	if len(op.args) != 3 {
+		return replyError(errors.New("wrong number of arguments for CLUSTER SETSLOT"))
+	}
+	node, ok := cl.nodes[op.args[2]]
+	if !ok || node.handshake {
+		return replyError(fmt.Errorf("I don't know about node %s", op.args[2]))
+	}
+
+	switch action {
+	case "MIGRATING":
+		if cl.slots[slot] != cl.myself {
+			return replyError(fmt.Errorf("I'm not the owner of hash slot %d", slot))
+		}
+		if node.myself {
+			return replyError(errors.New("Target node is myself"))
+		}
+		cl.migrating[slot] = node
+	case "IMPORTING":
+		if cl.slots[slot] == cl.myself {
+			return replyError(fmt.Errorf("I'm already the owner of hash slot %d", slot))
+		}
+		if node.myself {
+			return replyError(errors.New("Source node is myself"))
+		}
+		cl.importing[slot] = node
+	case "NODE":
+		if cl.slots[slot] == cl.myself && !node.myself && countKeysInSlot(s.ctx, store, slot) > 0 {
+			return replyError(fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		delete(cl.migrating, slot)
+		if node.myself && cl.importing[slot] != nil {
+			// the import is done, claim the slot with a new epoch so every node adopts it
+			delete(cl.importing, slot)
+			cl.currentEpoch++
+			cl.myself.configEpoch = cl.currentEpoch
+		}
+		cl.slots[slot] = node
+	default:
+		return replyError(errors.New("Invalid CLUSTER SETSLOT action or number of arguments"))
+	}
+	return replyOK()
+}
@@ -0,0 +1,142 @@
+package cider
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"somekey", 11058},
+		// only the hash tag is hashed
+		{"{foo}.bar", 12182},
+		{"user{foo}", 12182},
+		// an empty tag hashes the whole key
+		{"{}foo", int(crc16("{}foo") % clusterSlots)},
+	}
+	for _, test := range tests {
+		if got := keySlot(test.key); got != test.slot {
+			t.Errorf("%s: want %d, got %d", test.key, test.slot, got)
+		}
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Error("want keys with the same hash tag in the same slot")
+	}
+	if keySlot("foo{}{bar}") == keySlot("bar") {
+		t.Error("want the first tag only to be considered")
+	}
+}
+
+func TestCluster(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	var nodes []*testClient
+	var addrs, ids []string
+	for i := 0; i < 3; i++ {
+		server := startTestServer(t, ServerOptions{Listeners: listeners, ClusterEnabled: true})
+		client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+		nodes = append(nodes, client)
+		addrs = append(addrs, server.Addrs()[0].String())
+		id := strings.Split(client.do(t, "CLUSTER MYID"), "\r\n")[1]
+		ids = append(ids, id)
+	}
+
+	ranges := []string{"0 5460", "5461 10922", "10923 16383"}
+	for i, node := range nodes {
+		if reply := node.do(t, "CLUSTER ADDSLOTSRANGE "+ranges[i]); reply != "+OK\r\n" {
+			t.Fatalf("want: +OK, got %q", reply)
+		}
+	}
+	if reply := nodes[0].do(t, "CLUSTER ADDSLOTS 1"); reply != "-ERR Slot 1 is already busy\r\n" {
+		t.Errorf("want busy slot, got %q", reply)
+	}
+
+	// the third node is learned through gossip
+	host, port, _ := strings.Cut(addrs[1], ":")
+	nodes[0].do(t, "CLUSTER MEET "+host+" "+port)
+	host, port, _ = strings.Cut(addrs[2], ":")
+	nodes[1].do(t, "CLUSTER MEET "+host+" "+port)
+	for _, node := range nodes {
+		waitForReply(t, node, "CLUSTER INFO", "cluster_state:ok")
+		waitForReply(t, node, "CLUSTER INFO", "cluster_known_nodes:3")
+	}
+
+	// foo hashes to 12182 on the third node
+	if reply := nodes[0].do(t, "SET foo bar"); reply != "-MOVED 12182 "+addrs[2]+"\r\n" {
+		t.Errorf("want MOVED, got %q", reply)
+	}
+	if reply := nodes[2].do(t, "SET foo bar"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	if reply := nodes[2].do(t, "DEL foo bar"); !strings.HasPrefix(reply, "-CROSSSLOT") {
+		t.Errorf("want CROSSSLOT, got %q", reply)
+	}
+	if reply := nodes[2].do(t, "EXISTS foo {foo}.bar"); reply != ":1\r\n" {
+		t.Errorf("want keys with the same tag to be allowed, got %q", reply)
+	}
+	if reply := nodes[0].do(t, "CLUSTER KEYSLOT foo"); reply != ":12182\r\n" {
+		t.Errorf("want: 12182, got %q", reply)
+	}
+	if reply := nodes[2].do(t, "CLUSTER COUNTKEYSINSLOT 12182"); reply != ":1\r\n" {
+		t.Errorf("want: 1, got %q", reply)
+	}
+	if reply := nodes[2].do(t, "CLUSTER GETKEYSINSLOT 12182 10"); reply != "*1\r\n$3\r\nfoo\r\n" {
+		t.Errorf("want: foo, got %q", reply)
+	}
+
+	slots := nodes[1].do(t, "CLUSTER SLOTS")
+	for i, r := range ranges {
+		start, end, _ := strings.Cut(r, " ")
+		want := fmt.Sprintf("*3\r\n:%s\r\n:%s\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$40\r\n%s\r\n", start, end, strings.Split(addrs[i], ":")[1], ids[i])
+		if !strings.Contains(slots, want) {
+			t.Errorf("want slots to contain %q, got %q", want, slots)
+		}
+	}
+	shards := nodes[1].do(t, "CLUSTER SHARDS")
+	if !strings.HasPrefix(shards, "*3\r\n") || strings.Count(shards, "$5\r\nslots\r\n") != 3 {
+		t.Errorf("want three shards, got %q", shards)
+	}
+	clusterNodes := nodes[0].do(t, "CLUSTER NODES")
+	if !strings.Contains(clusterNodes, ids[0]+" "+addrs[0]+"@") || !strings.Contains(clusterNodes, "myself,master - 0 0 0 connected 0-5460") {
+		t.Errorf("want this node in the node list, got %q", clusterNodes)
+	}
+
+	// move the slot of foo from the third node to the first one
+	nodes[0].do(t, "CLUSTER SETSLOT 12182 IMPORTING "+ids[2])
+	nodes[2].do(t, "CLUSTER SETSLOT 12182 MIGRATING "+ids[0])
+	if reply := nodes[2].do(t, "GET foo"); reply != "$3\r\nbar\r\n" {
+		t.Errorf("want keys still on the source to be served, got %q", reply)
+	}
+	if reply := nodes[2].do(t, "GET {foo}.moved"); reply != "-ASK 12182 "+addrs[0]+"\r\n" {
+		t.Errorf("want ASK, got %q", reply)
+	}
+	if reply := nodes[0].do(t, "SET {foo}.moved value"); !strings.HasPrefix(reply, "-MOVED") {
+		t.Errorf("want MOVED without ASKING, got %q", reply)
+	}
+	nodes[0].do(t, "ASKING")
+	if reply := nodes[0].do(t, "SET {foo}.moved value"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK after ASKING, got %q", reply)
+	}
+	if reply := nodes[0].do(t, "GET {foo}.moved"); !strings.HasPrefix(reply, "-MOVED") {
+		t.Errorf("want ASKING to apply to one command, got %q", reply)
+	}
+
+	nodes[2].do(t, "DEL foo")
+	nodes[0].do(t, "CLUSTER SETSLOT 12182 NODE "+ids[0])
+	nodes[2].do(t, "CLUSTER SETSLOT 12182 NODE "+ids[0])
+	if reply := nodes[0].do(t, "GET {foo}.moved"); reply != "$5\r\nvalue\r\n" {
+		t.Errorf("want the slot to be served by its new owner, got %q", reply)
+	}
+	// the new owner claims the slot with a bumped epoch, the other nodes follow
+	waitForReply(t, nodes[1], "GET foo", "-MOVED 12182 "+addrs[0])
+
+	if reply := nodes[0].do(t, "REPLICAOF 127.0.0.1 6379"); !strings.HasPrefix(reply, "-ERR REPLICAOF not allowed in cluster mode") {
+		t.Errorf("want replicaof to be refused, got %q", reply)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"net"
+	"context"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -12,28 +15,58 @@ import (
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	address, ok := os.LookupEnv("ADDRESS")
-	if !ok {
-		log.Fatal().Msg("unable to read environment variable ADDRESS")
+	// config file, environment variables and flags, e.g. cider /etc/cider.conf --maxmemory 1gb
+	opts, err := cider.LoadConfig(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load configuration")
 	}
 
-	store := cider.NewStore()
+	if len(opts.Listeners) == 0 {
+		log.Fatal().Msg("unable to read address, tls-address or unixsocket from the configuration")
+	}
 
-	listener, err := net.Listen("tcp", address)
+	server, err := cider.NewServer(opts)
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to listen")
+		log.Fatal().Err(err).Msg("unable to create server")
 	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Error().Err(err).Msg("unable to accept connection")
-			continue
+	// certificates are reloaded on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			err := server.ReloadTLS()
+			if err != nil {
+				log.Error().Err(err).Msg("unable to reload tls configuration")
+				continue
+			}
+			log.Info().Msg("tls configuration reloaded")
 		}
+	}()
+
+	// prometheus metrics are served over http when metrics-address is set
+	if address := opts.MetricsAddress; address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.MetricsHandler())
+		metrics := &http.Server{Addr: address, Handler: mux}
+		go func() {
+			log.Info().Msgf("serving metrics on %s", address)
+			err := metrics.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("unable to serve metrics")
+			}
+		}()
+		defer metrics.Close()
+	}
+
+	// SIGINT and SIGTERM shut the server down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		session := cider.NewSession(conn)
-		go session.HandleOut()
-		go session.HandleIn(store)
+	err = server.ListenAndServe(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to serve")
 	}
 
+	log.Info().Msg("server stopped")
 }
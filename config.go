@@ -0,0 +1,1159 @@
+package cider
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Parameter of the config file, also served by CONFIG GET and CONFIG SET.
+type configParam struct {
+	name string
+	// environment variable overriding the config file
+	env string
+	// can be changed with CONFIG SET
+	live bool
+	// value is a list of arguments written unquoted, e.g. save 900 1
+	list bool
+	set  func(opts *ServerOptions, value string) error
+	// nil for directives that can be repeated, they are only read from the config file
+	get func(opts *ServerOptions) string
+}
+
+var configParams = []configParam{
+	{
+		name: "address", env: "ADDRESS",
+		set: func(opts *ServerOptions, value string) error {
+			configListener(opts, "tcp", false).Address = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if l := findListener(opts, "tcp", false); l != nil {
+				return l.Address
+			}
+			return ""
+		},
+	},
+	{
+		name: "tls-address", env: "TLS_ADDRESS",
+		set: func(opts *ServerOptions, value string) error {
+			configListener(opts, "tcp", true).Address = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if l := findListener(opts, "tcp", true); l != nil {
+				return l.Address
+			}
+			return ""
+		},
+	},
+	tlsParam("tls-cert-file", "TLS_CERT_FILE", func(tls *TLSOptions) *string { return &tls.CertFile }),
+	tlsParam("tls-key-file", "TLS_KEY_FILE", func(tls *TLSOptions) *string { return &tls.KeyFile }),
+	tlsParam("tls-ca-cert-file", "TLS_CA_CERT_FILE", func(tls *TLSOptions) *string { return &tls.CAFile }),
+	tlsParam("tls-auth-clients", "TLS_AUTH_CLIENTS", func(tls *TLSOptions) *string { return &tls.AuthClients }),
+	tlsParam("tls-min-version", "TLS_MIN_VERSION", func(tls *TLSOptions) *string { return &tls.MinVersion }),
+	{
+		name: "tls-ciphers", env: "TLS_CIPHERS",
+		set: func(opts *ServerOptions, value string) error {
+			tls := configListener(opts, "tcp", true).TLS
+			tls.CipherSuites = nil
+			if value != "" {
+				tls.CipherSuites = strings.Split(value, ",")
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if l := findListener(opts, "tcp", true); l != nil {
+				return strings.Join(l.TLS.CipherSuites, ",")
+			}
+			return ""
+		},
+	},
+	{
+		name: "tls-auth-clients-user", env: "TLS_AUTH_CLIENTS_USER",
+		set: func(opts *ServerOptions, value string) error {
+			switch strings.ToLower(value) {
+			case "cn":
+				opts.TLSClientCertUser = true
+			case "off", "":
+				opts.TLSClientCertUser = false
+			default:
+				return errors.New("argument must be 'CN' or 'off'")
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.TLSClientCertUser {
+				return "CN"
+			}
+			return "off"
+		},
+	},
+	{
+		name: "unixsocket", env: "UNIX_SOCKET",
+		set: func(opts *ServerOptions, value string) error {
+			configListener(opts, "unix", false).Address = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if l := findListener(opts, "unix", false); l != nil {
+				return l.Address
+			}
+			return ""
+		},
+	},
+	{
+		name: "unixsocketperm", env: "UNIX_SOCKET_PERM",
+		set: func(opts *ServerOptions, value string) error {
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return errors.New("argument must be an octal file mode")
+			}
+			configListener(opts, "unix", false).Permissions = os.FileMode(mode)
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if l := findListener(opts, "unix", false); l != nil && l.Permissions != 0 {
+				return strconv.FormatUint(uint64(l.Permissions), 8)
+			}
+			return "700"
+		},
+	},
+	{
+		name: "requirepass", env: "REQUIREPASS", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			opts.RequirePass = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.RequirePass
+		},
+	},
+	{
+		name: "aclfile", env: "ACLFILE",
+		set: func(opts *ServerOptions, value string) error {
+			opts.ACLFile = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.ACLFile
+		},
+	},
+	{
+		name: "timeout", env: "TIMEOUT", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 0)
+			if err != nil {
+				return err
+			}
+			opts.Timeout = time.Duration(n) * time.Second
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return strconv.FormatInt(int64(opts.Timeout.Seconds()), 10)
+		},
+	},
+	{
+		name: "tcp-keepalive", env: "TCP_KEEPALIVE", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 0)
+			if err != nil {
+				return err
+			}
+			opts.TCPKeepAlive = time.Duration(n) * time.Second
+			// zero disables keepalive like redis, while the option defaults to 300 seconds
+			if n == 0 {
+				opts.TCPKeepAlive = -1
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			switch {
+			case opts.TCPKeepAlive < 0:
+				return "0"
+			case opts.TCPKeepAlive == 0:
+				return strconv.FormatInt(int64(defaultTCPKeepAlive.Seconds()), 10)
+			}
+			return strconv.FormatInt(int64(opts.TCPKeepAlive.Seconds()), 10)
+		},
+	},
+	{
+		name: "maxclients", env: "MAXCLIENTS", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 1)
+			if err != nil {
+				return err
+			}
+			opts.MaxClients = int(n)
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.MaxClients == 0 {
+				return strconv.Itoa(defaultMaxClients)
+			}
+			return strconv.Itoa(opts.MaxClients)
+		},
+	},
+	{
+		name: "client-output-buffer-limit", env: "CLIENT_OUTPUT_BUFFER_LIMIT", live: true, list: true,
+		set: func(opts *ServerOptions, value string) error {
+			fields := strings.Fields(value)
+			// the environment variable has no class, only normal clients exist
+			if len(fields) == 3 {
+				fields = append([]string{"normal"}, fields...)
+			}
+			if len(fields) == 0 || len(fields)%4 != 0 {
+				return errors.New("wrong number of arguments")
+			}
+			for i := 0; i < len(fields); i += 4 {
+				class := strings.ToLower(fields[i])
+				if class != "normal" && class != "replica" && class != "slave" && class != "pubsub" {
+					return fmt.Errorf("invalid client class %s", fields[i])
+				}
+				hard, err := parseMemory(fields[i+1])
+				if err != nil {
+					return err
+				}
+				soft, err := parseMemory(fields[i+2])
+				if err != nil {
+					return err
+				}
+				seconds, err := parseConfigInt(fields[i+3], 0)
+				if err != nil {
+					return err
+				}
+				if class == "normal" {
+					opts.OutputBufferLimit = OutputBufferLimit{
+						Hard:         hard,
+						Soft:         soft,
+						SoftDuration: time.Duration(seconds) * time.Second,
+					}
+				}
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			limit := opts.OutputBufferLimit
+			return fmt.Sprintf("normal %d %d %d", limit.Hard, limit.Soft, int64(limit.SoftDuration.Seconds()))
+		},
+	},
+	{
+		name: "maxmemory", env: "MAXMEMORY", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			opts.MaxMemory = n
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return strconv.FormatInt(opts.MaxMemory, 10)
+		},
+	},
+	{
+		name: "maxmemory-policy", env: "MAXMEMORY_POLICY", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			value = strings.ToLower(value)
+			if !slices.Contains(evictionPolicies, value) {
+				return fmt.Errorf("invalid maxmemory-policy %s", value)
+			}
+			opts.MaxMemoryPolicy = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.MaxMemoryPolicy == "" {
+				return "noeviction"
+			}
+			return opts.MaxMemoryPolicy
+		},
+	},
+	{
+		name: "maxmemory-samples", env: "MAXMEMORY_SAMPLES", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 1)
+			if err != nil {
+				return err
+			}
+			opts.MaxMemorySamples = int(n)
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.MaxMemorySamples == 0 {
+				return strconv.Itoa(defaultMaxMemorySamples)
+			}
+			return strconv.Itoa(opts.MaxMemorySamples)
+		},
+	},
+	{
+		name: "slowlog-log-slower-than", env: "SLOWLOG_LOG_SLOWER_THAN", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New("argument must be an integer")
+			}
+			// zero logs every command like redis, while the option defaults to 10ms
+			switch {
+			case n == 0:
+				opts.SlowlogLogSlowerThan = time.Nanosecond
+			case n < 0:
+				opts.SlowlogLogSlowerThan = -1
+			default:
+				opts.SlowlogLogSlowerThan = time.Duration(n) * time.Microsecond
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			switch {
+			case opts.SlowlogLogSlowerThan < 0:
+				return "-1"
+			case opts.SlowlogLogSlowerThan == 0:
+				return strconv.FormatInt(defaultSlowlogLogSlowerThan.Microseconds(), 10)
+			}
+			return strconv.FormatInt(opts.SlowlogLogSlowerThan.Microseconds(), 10)
+		},
+	},
+	{
+		name: "slowlog-max-len", env: "SLOWLOG_MAX_LEN", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 1)
+			if err != nil {
+				return err
+			}
+			opts.SlowlogMaxLen = int(n)
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.SlowlogMaxLen == 0 {
+				return strconv.Itoa(defaultSlowlogMaxLen)
+			}
+			return strconv.Itoa(opts.SlowlogMaxLen)
+		},
+	},
+	{
+		name: "latency-monitor-threshold", env: "LATENCY_MONITOR_THRESHOLD", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 0)
+			if err != nil {
+				return err
+			}
+			opts.LatencyMonitorThreshold = time.Duration(n) * time.Millisecond
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return strconv.FormatInt(opts.LatencyMonitorThreshold.Milliseconds(), 10)
+		},
+	},
+	{
+		// REPLICAOF changes it at runtime
+		name: "replicaof", env: "REPLICAOF", list: true,
+		set: func(opts *ServerOptions, value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				opts.ReplicaOf = ""
+				return nil
+			}
+			if len(fields) != 2 {
+				return errors.New("replicaof expects a host and a port")
+			}
+			if _, err := parseConfigInt(fields[1], 1); err != nil {
+				return err
+			}
+			opts.ReplicaOf = net.JoinHostPort(fields[0], fields[1])
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			host, port, err := net.SplitHostPort(opts.ReplicaOf)
+			if err != nil {
+				return ""
+			}
+			return host + " " + port
+		},
+	},
+	{
+		name: "masterauth", env: "MASTERAUTH", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			opts.MasterAuth = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.MasterAuth
+		},
+	},
+	{
+		name: "masteruser", env: "MASTERUSER", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			opts.MasterUser = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.MasterUser
+		},
+	},
+	{
+		name: "repl-backlog-size", env: "REPL_BACKLOG_SIZE", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 16*1024 {
+				return errors.New("repl-backlog-size must be at least 16kb")
+			}
+			opts.ReplBacklogSize = n
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.ReplBacklogSize == 0 {
+				return strconv.Itoa(defaultReplBacklogSize)
+			}
+			return strconv.FormatInt(opts.ReplBacklogSize, 10)
+		},
+	},
+	{
+		// sentinel mode, e.g. sentinel monitor mymaster 127.0.0.1 6379 2
+		name: "sentinel", list: true,
+		set: setSentinelDirective,
+	},
+	{
+		name: "cluster-enabled", env: "CLUSTER_ENABLED",
+		set: func(opts *ServerOptions, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				opts.ClusterEnabled = true
+			case "no":
+				opts.ClusterEnabled = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.ClusterEnabled {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	{
+		name: "cluster-node-timeout", env: "CLUSTER_NODE_TIMEOUT", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 1)
+			if err != nil {
+				return err
+			}
+			opts.ClusterNodeTimeout = time.Duration(n) * time.Millisecond
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.ClusterNodeTimeout == 0 {
+				return strconv.FormatInt(defaultClusterNodeTimeout.Milliseconds(), 10)
+			}
+			return strconv.FormatInt(opts.ClusterNodeTimeout.Milliseconds(), 10)
+		},
+	},
+	{
+		name: "hll-sparse-max-bytes", env: "HLL_SPARSE_MAX_BYTES", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 1 {
+				return errors.New("argument must be at least 1")
+			}
+			opts.HLLSparseMaxBytes = n
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.HLLSparseMaxBytes == 0 {
+				return strconv.Itoa(defaultHLLSparseMaxBytes)
+			}
+			return strconv.FormatInt(opts.HLLSparseMaxBytes, 10)
+		},
+	},
+	{
+		name: "zset-max-listpack-entries", env: "ZSET_MAX_LISTPACK_ENTRIES", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 0)
+			if err != nil {
+				return err
+			}
+			opts.ZSetMaxListpackEntries = int(n)
+			if n == 0 {
+				opts.ZSetMaxListpackEntries = -1
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return strconv.Itoa(zsetLimitsOf(opts).entries)
+		},
+	},
+	{
+		name: "zset-max-listpack-value", env: "ZSET_MAX_LISTPACK_VALUE", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			n, err := parseConfigInt(value, 0)
+			if err != nil {
+				return err
+			}
+			opts.ZSetMaxListpackValue = int(n)
+			if n == 0 {
+				opts.ZSetMaxListpackValue = -1
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return strconv.Itoa(zsetLimitsOf(opts).value)
+		},
+	},
+	{
+		name: "event-loop", env: "EVENT_LOOP",
+		set: func(opts *ServerOptions, value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				opts.EventLoop = true
+			case "no":
+				opts.EventLoop = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.EventLoop {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	{
+		name: "metrics-address", env: "METRICS_ADDRESS",
+		set: func(opts *ServerOptions, value string) error {
+			opts.MetricsAddress = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.MetricsAddress
+		},
+	},
+	{
+		name: "loglevel", env: "LOGLEVEL", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			value = strings.ToLower(value)
+			_, err := parseLogLevel(value)
+			if err != nil {
+				return err
+			}
+			opts.LogLevel = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if opts.LogLevel == "" {
+				return "notice"
+			}
+			return opts.LogLevel
+		},
+	},
+	{
+		name: "save", env: "SAVE", live: true, list: true,
+		set: func(opts *ServerOptions, value string) error {
+			fields := strings.Fields(value)
+			if len(fields)%2 != 0 {
+				return errors.New("invalid save parameters")
+			}
+			for _, field := range fields {
+				if _, err := parseConfigInt(field, 0); err != nil {
+					return errors.New("invalid save parameters")
+				}
+			}
+			opts.Save = strings.Join(fields, " ")
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.Save
+		},
+	},
+	{
+		name: "notify-keyspace-events", env: "NOTIFY_KEYSPACE_EVENTS", live: true,
+		set: func(opts *ServerOptions, value string) error {
+			for _, c := range value {
+				if !strings.ContainsRune(keyspaceEventFlags, c) {
+					return fmt.Errorf("invalid event class character '%c'", c)
+				}
+			}
+			opts.NotifyKeyspaceEvents = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			return opts.NotifyKeyspaceEvents
+		},
+	},
+}
+
+// Event class characters accepted by notify-keyspace-events.
+const keyspaceEventFlags = "KEg$lshzxeAtmdn"
+
+func tlsParam(name string, env string, field func(tls *TLSOptions) *string) configParam {
+	return configParam{
+		name: name,
+		env:  env,
+		set: func(opts *ServerOptions, value string) error {
+			*field(configListener(opts, "tcp", true).TLS) = value
+			return nil
+		},
+		get: func(opts *ServerOptions) string {
+			if l := findListener(opts, "tcp", true); l != nil {
+				return *field(l.TLS)
+			}
+			return ""
+		},
+	}
+}
+
+// Applies a sentinel directive, any of them enables sentinel mode.
+func setSentinelDirective(opts *ServerOptions, value string) error {
+	if opts.Sentinel == nil {
+		opts.Sentinel = &SentinelOptions{}
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 || fields[0] == "yes" {
+		return nil
+	}
+
+	directive := strings.ToLower(fields[0])
+	if directive == "monitor" {
+		if len(fields) != 5 {
+			return errors.New("sentinel monitor expects a name, host, port and quorum")
+		}
+		quorum, err := parseConfigInt(fields[4], 1)
+		if err != nil {
+			return err
+		}
+		opts.Sentinel.Masters = append(opts.Sentinel.Masters, SentinelMasterOptions{
+			Name:    fields[1],
+			Address: net.JoinHostPort(fields[2], fields[3]),
+			Quorum:  int(quorum),
+		})
+		return nil
+	}
+
+	switch directive {
+	// written by redis sentinels to persist their state, cider keeps none
+	case "myid", "config-epoch", "leader-epoch", "current-epoch", "known-replica",
+		"parallel-syncs", "deny-scripts-reconfig", "resolve-hostnames", "announce-hostnames":
+		return nil
+	}
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid sentinel %s", directive)
+	}
+	var master *SentinelMasterOptions
+	for i := range opts.Sentinel.Masters {
+		if opts.Sentinel.Masters[i].Name == fields[1] {
+			master = &opts.Sentinel.Masters[i]
+		}
+	}
+	if master == nil {
+		return fmt.Errorf("no such master %s, sentinel monitor has to come first", fields[1])
+	}
+
+	switch directive {
+	case "down-after-milliseconds", "failover-timeout":
+		ms, err := parseConfigInt(fields[2], 1)
+		if err != nil {
+			return err
+		}
+		if directive == "down-after-milliseconds" {
+			master.DownAfter = time.Duration(ms) * time.Millisecond
+		} else {
+			master.FailoverTimeout = time.Duration(ms) * time.Millisecond
+		}
+	case "auth-pass":
+		master.AuthPass = fields[2]
+	case "auth-user":
+		master.AuthUser = fields[2]
+	case "known-sentinel":
+		// known-sentinel <name> <ip> <port> [runid]
+		if len(fields) < 4 {
+			return errors.New("sentinel known-sentinel expects a name, host and port")
+		}
+		master.Sentinels = append(master.Sentinels, net.JoinHostPort(fields[2], fields[3]))
+	default:
+		return fmt.Errorf("unsupported sentinel directive %s", directive)
+	}
+	return nil
+}
+
+func findConfigParam(name string) *configParam {
+	name = strings.ToLower(name)
+	for i := range configParams {
+		if configParams[i].name == name {
+			return &configParams[i]
+		}
+	}
+	return nil
+}
+
+func findListener(opts *ServerOptions, network string, tls bool) *ListenerOptions {
+	for i := range opts.Listeners {
+		l := &opts.Listeners[i]
+		if l.Network == network && (l.TLS != nil) == tls {
+			return l
+		}
+	}
+	return nil
+}
+
+// Finds the listener configured by the parameters, adding it when missing.
+func configListener(opts *ServerOptions, network string, tls bool) *ListenerOptions {
+	if l := findListener(opts, network, tls); l != nil {
+		return l
+	}
+	listener := ListenerOptions{Network: network}
+	if tls {
+		listener.TLS = &TLSOptions{}
+	}
+	opts.Listeners = append(opts.Listeners, listener)
+	return &opts.Listeners[len(opts.Listeners)-1]
+}
+
+func parseConfigInt(value string, min int64) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("argument must be an integer")
+	}
+	if n < min {
+		return 0, fmt.Errorf("argument must be at least %d", min)
+	}
+	return n, nil
+}
+
+// Parses a memory size with an optional unit like redis, 1k is 1000 bytes and 1kb is 1024.
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+
+	value = strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
+
+func parseLogLevel(level string) (zerolog.Level, error) {
+	switch level {
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "verbose", "notice", "":
+		return zerolog.InfoLevel, nil
+	case "warning":
+		return zerolog.WarnLevel, nil
+	case "nothing":
+		return zerolog.Disabled, nil
+	}
+	return zerolog.NoLevel, fmt.Errorf("invalid loglevel %s", level)
+}
+
+// Splits a config line into arguments, double quoted arguments may contain spaces and escapes.
+func splitConfigLine(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		var sb strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 'r':
+						sb.WriteByte('\r')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(line[i])
+					}
+					i++
+					continue
+				}
+				sb.WriteByte(line[i])
+				i++
+			}
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unbalanced quotes")
+			}
+			sb.WriteString(line[i+1 : i+1+end])
+			i += end + 2
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				sb.WriteByte(line[i])
+				i++
+			}
+		}
+		args = append(args, sb.String())
+	}
+	return args, nil
+}
+
+// Quotes a value for the config file when needed.
+func quoteConfigValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\"'\\\r\n") {
+		return value
+	}
+	return quoteArg(value)
+}
+
+// Reads directives of a config file, the value of a directive is its arguments joined by spaces.
+func readConfigFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var directives [][2]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitConfigLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		directives = append(directives, [2]string{strings.ToLower(args[0]), strings.Join(args[1:], " ")})
+	}
+	return directives, scanner.Err()
+}
+
+// Builds server options from a redis.conf style config file, environment
+// variables and --name value flags, each overriding the previous. The config
+// file is the first argument unless it starts with --.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (ServerOptions, error) {
+	var opts ServerOptions
+
+	apply := func(name string, value string) error {
+		param := findConfigParam(name)
+		if param == nil {
+			return fmt.Errorf("unknown config parameter %s", name)
+		}
+		err := param.set(&opts, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", param.name, err)
+		}
+		return nil
+	}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return opts, err
+		}
+		directives, err := readConfigFile(path)
+		if err != nil {
+			return opts, err
+		}
+
+		saves := []string{}
+		for _, d := range directives {
+			// redis.conf files can be used as is, directives cider doesn't know are skipped
+			if findConfigParam(d[0]) == nil {
+				log.Warn().Msgf("ignoring unsupported config directive %s", d[0])
+				continue
+			}
+			// every save line adds a snapshot point
+			if d[0] == "save" && d[1] != "" {
+				saves = append(saves, d[1])
+				d[1] = strings.Join(saves, " ")
+			}
+			err := apply(d[0], d[1])
+			if err != nil {
+				return opts, err
+			}
+		}
+
+		opts.ConfigFile = path
+		args = args[1:]
+	}
+
+	for _, param := range configParams {
+		if value, ok := lookupEnv(param.env); ok {
+			err := apply(param.name, value)
+			if err != nil {
+				return opts, err
+			}
+		}
+	}
+
+	for i := 0; i < len(args); {
+		if !strings.HasPrefix(args[i], "--") {
+			return opts, fmt.Errorf("unexpected argument %s", args[i])
+		}
+		name := strings.TrimPrefix(args[i], "--")
+		i++
+
+		var values []string
+		for i < len(args) && !strings.HasPrefix(args[i], "--") {
+			values = append(values, args[i])
+			i++
+		}
+		err := apply(name, strings.Join(values, " "))
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	// tls parameters without a tls-address don't start a listener
+	opts.Listeners = slices.DeleteFunc(opts.Listeners, func(l ListenerOptions) bool {
+		return l.Address == ""
+	})
+
+	return opts, nil
+}
+
+// Changes a copy of the current options with f and applies it to the running server.
+// Updates run one at a time, so concurrent ones don't overwrite each other.
+func (srv *Server) updateOptions(f func(opts *ServerOptions) error) error {
+	srv.optsMu.Lock()
+	defer srv.optsMu.Unlock()
+
+	prev := srv.options()
+	opts := *prev
+	err := f(&opts)
+	if err != nil {
+		return err
+	}
+	return srv.reconfigure(prev, &opts)
+}
+
+// Applies options changed from prev to the running server, call it through updateOptions.
+func (srv *Server) reconfigure(prev *ServerOptions, opts *ServerOptions) error {
+	policy := opts.MaxMemoryPolicy
+	if policy == "" {
+		policy = "noeviction"
+	}
+	err := setMaxMemory(srv.store, opts.MaxMemory, policy, opts.MaxMemorySamples)
+	if err != nil {
+		return err
+	}
+
+	level, err := parseLogLevel(opts.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	if opts.RequirePass != prev.RequirePass {
+		srv.acl.SetRequirePass(opts.RequirePass)
+	}
+	if opts.LogLevel != "" {
+		zerolog.SetGlobalLevel(level)
+	}
+	if opts.ReplBacklogSize != prev.ReplBacklogSize {
+		srv.repl.resizeBacklog(opts.ReplBacklogSize)
+	}
+	srv.slowlog.configure(opts.SlowlogLogSlowerThan, opts.SlowlogMaxLen)
+	srv.latency.threshold.Store(int64(opts.LatencyMonitorThreshold))
+
+	srv.opts.Store(opts)
+	return nil
+}
+
+// Writes the current configuration to the config file. Directives already in
+// the file are updated in place, comments and unknown lines are kept, and
+// parameters changed from their default are appended.
+func (srv *Server) rewriteConfig() error {
+	opts := srv.options()
+	if opts.ConfigFile == "" {
+		return errors.New("The server is running without a config file")
+	}
+
+	var lines []string
+	content, err := os.ReadFile(opts.ConfigFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	}
+
+	format := func(param *configParam) string {
+		value := param.get(opts)
+		if !param.list {
+			value = quoteConfigValue(value)
+		}
+		return strings.TrimSpace(param.name + " " + value)
+	}
+
+	written := make(map[string]bool)
+	var rewritten []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		args, err := splitConfigLine(trimmed)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || err != nil || len(args) == 0 {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		param := findConfigParam(args[0])
+		if param == nil || param.get == nil {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		// repeated directives are merged into the first one
+		if written[param.name] {
+			continue
+		}
+		written[param.name] = true
+		rewritten = append(rewritten, format(param))
+	}
+
+	defaults := &ServerOptions{}
+	appended := false
+	for i := range configParams {
+		param := &configParams[i]
+		if written[param.name] || param.get == nil || param.get(opts) == param.get(defaults) {
+			continue
+		}
+		if !appended {
+			rewritten = append(rewritten, "# Generated by CONFIG REWRITE")
+			appended = true
+		}
+		rewritten = append(rewritten, format(param))
+	}
+
+	// replace the file atomically so a crash never leaves it half written
+	tmp, err := os.CreateTemp(filepath.Dir(opts.ConfigFile), ".cider-config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(strings.Join(rewritten, "\n") + "\n")
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(opts.ConfigFile); err == nil {
+		os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	return os.Rename(tmp.Name(), opts.ConfigFile)
+}
+
+func (s *Session) handleConfig(op opConfig) []byte {
+	srv := s.server
+
+	switch op.subcommand {
+	case "GET":
+		if len(op.args) == 0 {
+			return replyError(errors.New("wrong number of arguments for CONFIG GET"))
+		}
+		opts := srv.options()
+
+		var replies [][]byte
+		for i := range configParams {
+			param := &configParams[i]
+			if param.get == nil {
+				continue
+			}
+			for _, pattern := range op.args {
+				if matchPattern(strings.ToLower(pattern), param.name) {
+					replies = append(replies, replyString([]byte(param.name)), replyString([]byte(param.get(opts))))
+					break
+				}
+			}
+		}
+		return replyArray(replies)
+
+	case "SET":
+		if len(op.args) == 0 || len(op.args)%2 != 0 {
+			return replyError(errors.New("wrong number of arguments for CONFIG SET"))
+		}
+
+		// every parameter is validated before any is applied
+		var setErr error
+		err := srv.updateOptions(func(opts *ServerOptions) error {
+			for i := 0; i < len(op.args); i += 2 {
+				name, value := op.args[i], op.args[i+1]
+				param := findConfigParam(name)
+				if param == nil {
+					setErr = fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+					return setErr
+				}
+				if !param.live {
+					setErr = fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+					return setErr
+				}
+				err := param.set(opts, value)
+				if err != nil {
+					setErr = fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", name, err)
+					return setErr
+				}
+			}
+			return nil
+		})
+		if setErr != nil {
+			return replyError(setErr)
+		}
+		if err != nil {
+			return replyError(fmt.Errorf("CONFIG SET failed - %s", err))
+		}
+		return replyOK()
+
+	case "RESETSTAT":
+		srv.resetStats()
+		return replyOK()
+
+	case "REWRITE":
+		err := srv.rewriteConfig()
+		if err != nil {
+			return replyError(fmt.Errorf("Rewriting config file: %s", err))
+		}
+		return replyOK()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
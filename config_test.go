@@ -0,0 +1,255 @@
+package cider
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitConfigLine(t *testing.T) {
+	tcs := map[string][]string{
+		"maxmemory 100mb":           {"maxmemory", "100mb"},
+		"  save  900 1 ":            {"save", "900", "1"},
+		`requirepass "pass word"`:   {"requirepass", "pass word"},
+		`requirepass "a\"b\\c"`:     {"requirepass", `a"b\c`},
+		`requirepass 'it''s'`:       {"requirepass", "it", "s"},
+		`notify-keyspace-events ""`: {"notify-keyspace-events", ""},
+		"tls-ciphers\tA,B":          {"tls-ciphers", "A,B"},
+	}
+
+	for line, want := range tcs {
+		got, err := splitConfigLine(line)
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if slices.Compare(got, want) != 0 {
+			t.Errorf("%q: want %q, got %q", line, want, got)
+		}
+	}
+
+	if _, err := splitConfigLine(`requirepass "foo`); err == nil {
+		t.Error("want error for unbalanced quotes")
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	tcs := map[string]int64{
+		"0":     0,
+		"1024":  1024,
+		"1k":    1000,
+		"1kb":   1024,
+		"100MB": 100 << 20,
+		"2g":    2000000000,
+		"1gb":   1 << 30,
+	}
+
+	for value, want := range tcs {
+		got, err := parseMemory(value)
+		if err != nil {
+			t.Errorf("%s: %v", value, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: want %d, got %d", value, want, got)
+		}
+	}
+
+	for _, value := range []string{"", "mb", "-1", "1tb"} {
+		if _, err := parseMemory(value); err == nil {
+			t.Errorf("%s: want error", value)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cider.conf")
+	err := os.WriteFile(path, []byte(`# cider config
+address 127.0.0.1:6379
+requirepass "secret pass"
+maxmemory 100mb
+timeout 10
+save 900 1
+save 300 10
+tls-cert-file /tmp/cert.pem
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"TIMEOUT":       "20",
+		"MAXCLIENTS":    "50",
+		"TCP_KEEPALIVE": "0",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	opts, err := LoadConfig([]string{path, "--timeout", "30", "--client-output-buffer-limit", "normal", "1mb", "512kb", "60"}, lookupEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.ConfigFile != path {
+		t.Errorf("want: %s, got %s", path, opts.ConfigFile)
+	}
+	// the tls listener has no address, so it is not started
+	if len(opts.Listeners) != 1 || opts.Listeners[0].Address != "127.0.0.1:6379" || opts.Listeners[0].TLS != nil {
+		t.Errorf("unexpected listeners %+v", opts.Listeners)
+	}
+	if opts.RequirePass != "secret pass" {
+		t.Errorf("want: secret pass, got %s", opts.RequirePass)
+	}
+	if opts.MaxMemory != 100<<20 {
+		t.Errorf("want: %d, got %d", 100<<20, opts.MaxMemory)
+	}
+	if opts.Save != "900 1 300 10" {
+		t.Errorf("want: 900 1 300 10, got %s", opts.Save)
+	}
+	if opts.Timeout != 30*time.Second {
+		t.Errorf("want flag to override env and file, got %s", opts.Timeout)
+	}
+	if opts.MaxClients != 50 {
+		t.Errorf("want: 50, got %d", opts.MaxClients)
+	}
+	if opts.TCPKeepAlive != -1 {
+		t.Errorf("want keepalive disabled, got %s", opts.TCPKeepAlive)
+	}
+	want := OutputBufferLimit{Hard: 1 << 20, Soft: 512 << 10, SoftDuration: time.Minute}
+	if opts.OutputBufferLimit != want {
+		t.Errorf("want: %+v, got %+v", want, opts.OutputBufferLimit)
+	}
+
+	for _, args := range [][]string{
+		{"--unknown", "1"},
+		{"--maxmemory", "lots"},
+		{"--maxmemory-policy", "sometimes"},
+		{"stray"},
+		{filepath.Join(t.TempDir(), "missing.conf")},
+	} {
+		if _, err := LoadConfig(args, lookupEnv); err == nil {
+			t.Errorf("%v: want error", args)
+		}
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cider.conf")
+	err := os.WriteFile(path, []byte("# keep this comment\naddress 127.0.0.1:0\ntimeout 10\nunknown-directive yes\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := LoadConfig([]string{path}, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startTestServer(t, opts)
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	if reply := client.do(t, "CONFIG GET maxmemory*"); reply != "*6\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n$16\r\nmaxmemory-policy\r\n$10\r\nnoeviction\r\n$17\r\nmaxmemory-samples\r\n$1\r\n5\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if reply := client.do(t, "CONFIG SET maxmemory 1kb maxmemory-policy allkeys-lru timeout 20"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	if reply := client.do(t, "CONFIG GET maxmemory timeout"); reply != "*4\r\n$7\r\ntimeout\r\n$2\r\n20\r\n$9\r\nmaxmemory\r\n$4\r\n1024\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if stats := storeStats(server.store); stats.MaxMemory != 1024 || stats.Policy != "allkeys-lru" {
+		t.Errorf("want maxmemory applied to the store, got %+v", stats)
+	}
+
+	tcs := map[string]string{
+		"CONFIG SET address 127.0.0.1:1":      "-ERR CONFIG SET failed (possibly related to argument 'address') - can't set immutable config",
+		"CONFIG SET nope 1":                   "-ERR Unknown option or number of arguments for CONFIG SET - 'nope'",
+		"CONFIG SET timeout 5 maxclients x":   "-ERR CONFIG SET failed (possibly related to argument 'maxclients') - argument must be an integer",
+		"CONFIG SET notify-keyspace-events X": "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - invalid event class character 'X'",
+		"CONFIG SET timeout":                  "-ERR wrong number of arguments for CONFIG SET",
+	}
+	for command, want := range tcs {
+		if reply := client.do(t, command); reply != want+"\r\n" {
+			t.Errorf("%s: want %q, got %q", command, want, reply)
+		}
+	}
+	// a failed CONFIG SET changes nothing
+	if reply := client.do(t, "CONFIG GET timeout"); reply != "*2\r\n$7\r\ntimeout\r\n$2\r\n20\r\n" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	client.do(t, "GET missing")
+	if reply := client.do(t, "CONFIG RESETSTAT"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	if stats := storeStats(server.store); stats.Misses != 0 {
+		t.Errorf("want misses reset, got %d", stats.Misses)
+	}
+
+	if reply := client.do(t, "CONFIG REWRITE"); reply != "+OK\r\n" {
+		t.Fatalf("want: +OK, got %q", reply)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# keep this comment\naddress 127.0.0.1:0\ntimeout 20\nunknown-directive yes\n" +
+		"# Generated by CONFIG REWRITE\nmaxmemory 1024\nmaxmemory-policy allkeys-lru\n"
+	if string(content) != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, content)
+	}
+
+	// the rewritten file loads to the same configuration
+	reloaded, err := LoadConfig([]string{path}, func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Timeout != 20*time.Second || reloaded.MaxMemoryPolicy != "allkeys-lru" {
+		t.Errorf("unexpected reloaded options %+v", reloaded)
+	}
+}
+
+func TestConfigRewriteWithoutFile(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	if reply := client.do(t, "CONFIG REWRITE"); !strings.HasPrefix(reply, "-ERR Rewriting config file: The server is running without a config file") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestConcurrentOptionUpdates(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+
+	// every update starts from the one before, none is lost
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := server.updateOptions(func(opts *ServerOptions) error {
+					opts.SlowlogMaxLen++
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := server.options().SlowlogMaxLen; got != 800 {
+		t.Errorf("want 800, got %d", got)
+	}
+}
@@ -0,0 +1,431 @@
+package cider
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"math"
+	"strconv"
+	"time"
+)
+
+// DUMP payloads use the redis format so they can be restored by either server:
+// the RDB type and encoding of the value, the RDB version as 2 bytes and the
+// CRC64 of everything before it as 8 bytes, both little endian.
+const (
+	rdbVersion    = 11
+	rdbTypeString = 0
+	// sorted set with binary scores
+	rdbTypeZSet2 = 5
+	// sorted set as a listpack of members and scores, written by redis 7 for small sets
+	rdbTypeZSetListpack = 17
+
+	rdbEncodingInt8  = 0
+	rdbEncodingInt16 = 1
+	rdbEncodingInt32 = 2
+	rdbEncodingLZF   = 3
+
+	dumpFooterSize = 10
+)
+
+var (
+	errDumpChecksum = errors.New("DUMP payload version or checksum are wrong")
+	errDumpFormat   = errors.New("Bad data format")
+)
+
+// Jones polynomial in reversed form, as used by redis.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// Redis computes the CRC64 without the initial and final inversion of hash/crc64.
+func crc64Jones(data []byte) uint64 {
+	return ^crc64.Update(^uint64(0), crc64Table, data)
+}
+
+// Serializes a string value in the DUMP format.
+func dumpValue(value []byte) []byte {
+	buf := []byte{rdbTypeString}
+	buf = appendRDBString(buf, value)
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	return binary.LittleEndian.AppendUint64(buf, crc64Jones(buf))
+}
+
+// Serializes a sorted set in the DUMP format. Redis loads it whatever the encoding.
+func dumpZSet(z *zset) []byte {
+	buf := []byte{rdbTypeZSet2}
+	buf = appendRDBLength(buf, uint64(z.len()))
+	z.each(func(member string, score float64) bool {
+		buf = appendRDBString(buf, []byte(member))
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(score))
+		return true
+	})
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	return binary.LittleEndian.AppendUint64(buf, crc64Jones(buf))
+}
+
+func appendRDBString(buf []byte, value []byte) []byte {
+	if n, ok := parseInteger(value); ok && n >= math.MinInt32 && n <= math.MaxInt32 {
+		switch {
+		case n >= math.MinInt8 && n <= math.MaxInt8:
+			return append(buf, 0xc0|rdbEncodingInt8, byte(n))
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			return binary.LittleEndian.AppendUint16(append(buf, 0xc0|rdbEncodingInt16), uint16(n))
+		default:
+			return binary.LittleEndian.AppendUint32(append(buf, 0xc0|rdbEncodingInt32), uint32(n))
+		}
+	}
+	buf = appendRDBLength(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendRDBLength(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, 0x40|byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0x80), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0x81), n)
+}
+
+// Checks the footer of a DUMP payload and returns the string value or the sorted set it holds.
+// Sorted sets are created in the encoding limits allows for their size, like redis does on load.
+func parseDump(payload []byte, limits zsetLimits) ([]byte, *zset, error) {
+	if len(payload) < dumpFooterSize+1 {
+		return nil, nil, errDumpChecksum
+	}
+	footer := len(payload) - 8
+	version := binary.LittleEndian.Uint16(payload[footer-2 : footer])
+	if version > rdbVersion || binary.LittleEndian.Uint64(payload[footer:]) != crc64Jones(payload[:footer]) {
+		return nil, nil, errDumpChecksum
+	}
+
+	body := payload[:len(payload)-dumpFooterSize]
+	var members, scores [][]byte
+	switch body[0] {
+	case rdbTypeString:
+		value, rest, err := readRDBString(body[1:])
+		if err != nil || len(rest) > 0 {
+			return nil, nil, errDumpFormat
+		}
+		return value, nil, nil
+
+	case rdbTypeZSet2:
+		n, encoded, buf, err := readRDBLength(body[1:])
+		if err != nil || encoded || n > uint64(len(buf)) {
+			return nil, nil, errDumpFormat
+		}
+		for i := uint64(0); i < n; i++ {
+			var member []byte
+			member, buf, err = readRDBString(buf)
+			if err != nil || len(buf) < 8 {
+				return nil, nil, errDumpFormat
+			}
+			members = append(members, member)
+			scores = append(scores, strconv.AppendFloat(nil, math.Float64frombits(binary.LittleEndian.Uint64(buf)), 'g', -1, 64))
+			buf = buf[8:]
+		}
+		if len(buf) > 0 {
+			return nil, nil, errDumpFormat
+		}
+
+	case rdbTypeZSetListpack:
+		lp, rest, err := readRDBString(body[1:])
+		if err != nil || len(rest) > 0 {
+			return nil, nil, errDumpFormat
+		}
+		entries, err := readListpack(lp)
+		if err != nil || len(entries)%2 != 0 {
+			return nil, nil, errDumpFormat
+		}
+		for i := 0; i < len(entries); i += 2 {
+			members = append(members, entries[i])
+			scores = append(scores, entries[i+1])
+		}
+
+	default:
+		return nil, nil, errDumpFormat
+	}
+
+	// empty sets, duplicate members and NaN scores are rejected like redis
+	if len(members) == 0 {
+		return nil, nil, errDumpFormat
+	}
+	maxLen := 0
+	for _, member := range members {
+		maxLen = max(maxLen, len(member))
+	}
+	z := newZSet(len(members), maxLen, limits)
+	for i, member := range members {
+		score, err := strconv.ParseFloat(string(scores[i]), 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, nil, errDumpFormat
+		}
+		if _, ok := z.score(string(member)); ok {
+			return nil, nil, errDumpFormat
+		}
+		z.add(string(member), score, limits)
+	}
+	return nil, z, nil
+}
+
+// Reads the entries of a listpack, integers are returned in decimal.
+func readListpack(lp []byte) ([][]byte, error) {
+	if len(lp) < 7 || binary.LittleEndian.Uint32(lp) != uint32(len(lp)) || lp[len(lp)-1] != 0xff {
+		return nil, errDumpFormat
+	}
+	count := int(binary.LittleEndian.Uint16(lp[4:]))
+
+	var entries [][]byte
+	p := lp[6 : len(lp)-1]
+	for len(p) > 0 {
+		first := p[0]
+		var entry []byte
+		var size, length int
+		number := int64(0)
+		switch {
+		case first&0x80 == 0:
+			number, size = int64(first), 1
+		case first&0xc0 == 0x80:
+			length, size = int(first&0x3f), 1
+		case first&0xe0 == 0xc0 && len(p) >= 2:
+			// 13 bit signed integer
+			number, size = int64(first&0x1f)<<8|int64(p[1]), 2
+			if number >= 1<<12 {
+				number -= 1 << 13
+			}
+		case first&0xf0 == 0xe0 && len(p) >= 2:
+			length, size = int(first&0x0f)<<8|int(p[1]), 2
+		case first == 0xf0 && len(p) >= 5:
+			length, size = int(binary.LittleEndian.Uint32(p[1:])), 5
+		case first == 0xf1 && len(p) >= 3:
+			number, size = int64(int16(binary.LittleEndian.Uint16(p[1:]))), 3
+		case first == 0xf2 && len(p) >= 4:
+			number, size = int64(int32(uint32(p[1])<<8|uint32(p[2])<<16|uint32(p[3])<<24)>>8), 4
+		case first == 0xf3 && len(p) >= 5:
+			number, size = int64(int32(binary.LittleEndian.Uint32(p[1:]))), 5
+		case first == 0xf4 && len(p) >= 9:
+			number, size = int64(binary.LittleEndian.Uint64(p[1:])), 9
+		default:
+			return nil, errDumpFormat
+		}
+		if length > len(p)-size {
+			return nil, errDumpFormat
+		}
+		if first&0xc0 == 0x80 || first&0xf0 == 0xe0 || first == 0xf0 {
+			entry = p[size : size+length : size+length]
+		} else {
+			entry = strconv.AppendInt(nil, number, 10)
+		}
+		size += length
+
+		// each entry ends with the size of its encoding and data, in 7 bit groups
+		backlen := 1
+		for n := size >> 7; n > 0; n >>= 7 {
+			backlen++
+		}
+		if size+backlen > len(p) {
+			return nil, errDumpFormat
+		}
+		entries = append(entries, entry)
+		p = p[size+backlen:]
+	}
+	// the count saturates for large listpacks
+	if count != 0xffff && count != len(entries) {
+		return nil, errDumpFormat
+	}
+	return entries, nil
+}
+
+// Reads a length, or the encoding of a specially encoded string when encoded is set.
+func readRDBLength(buf []byte) (n uint64, encoded bool, rest []byte, err error) {
+	if len(buf) == 0 {
+		return 0, false, nil, errDumpFormat
+	}
+	first := buf[0]
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3f), false, buf[1:], nil
+	case 1:
+		if len(buf) < 2 {
+			return 0, false, nil, errDumpFormat
+		}
+		return uint64(first&0x3f)<<8 | uint64(buf[1]), false, buf[2:], nil
+	case 3:
+		return uint64(first & 0x3f), true, buf[1:], nil
+	}
+	switch {
+	case first == 0x80 && len(buf) >= 5:
+		return uint64(binary.BigEndian.Uint32(buf[1:])), false, buf[5:], nil
+	case first == 0x81 && len(buf) >= 9:
+		return binary.BigEndian.Uint64(buf[1:]), false, buf[9:], nil
+	}
+	return 0, false, nil, errDumpFormat
+}
+
+func readRDBString(buf []byte) (value []byte, rest []byte, err error) {
+	n, encoded, buf, err := readRDBLength(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !encoded {
+		if uint64(len(buf)) < n {
+			return nil, nil, errDumpFormat
+		}
+		return buf[:n:n], buf[n:], nil
+	}
+
+	switch n {
+	case rdbEncodingInt8:
+		if len(buf) < 1 {
+			return nil, nil, errDumpFormat
+		}
+		return strconv.AppendInt(nil, int64(int8(buf[0])), 10), buf[1:], nil
+	case rdbEncodingInt16:
+		if len(buf) < 2 {
+			return nil, nil, errDumpFormat
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(buf))), 10), buf[2:], nil
+	case rdbEncodingInt32:
+		if len(buf) < 4 {
+			return nil, nil, errDumpFormat
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(buf))), 10), buf[4:], nil
+	case rdbEncodingLZF:
+		compressed, encoded, buf, err := readRDBLength(buf)
+		if err != nil || encoded {
+			return nil, nil, errDumpFormat
+		}
+		length, encoded, buf, err := readRDBLength(buf)
+		if err != nil || encoded || uint64(len(buf)) < compressed || length > maxBulkSize {
+			return nil, nil, errDumpFormat
+		}
+		value, err := lzfDecompress(buf[:compressed], int(length))
+		if err != nil {
+			return nil, nil, err
+		}
+		return value, buf[compressed:], nil
+	}
+	return nil, nil, errDumpFormat
+}
+
+// Expands LZF compressed data, used by redis for strings longer than 20 bytes.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		// literal run of ctrl+1 bytes
+		if ctrl < 1<<5 {
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > length {
+				return nil, errDumpFormat
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// back reference of n+2 bytes, the top 3 bits are the length unless all are set
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errDumpFormat
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errDumpFormat
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+n+2 > length {
+			return nil, errDumpFormat
+		}
+		// the reference may overlap the bytes being written
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, errDumpFormat
+	}
+	return out, nil
+}
+
+func (s *Session) handleDump(store Storer, op opDump) []byte {
+	ds, err := dumpStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	payload, _, err := ds.Dump(s.ctx, op.key)
+	if err != nil && err.Error() == "key not found" {
+		return replyNil()
+	}
+	if err != nil {
+		return replyError(err)
+	}
+	return replyString(payload)
+}
+
+func (s *Session) handleRestore(store Storer, op opRestore) []byte {
+	if !op.replace {
+		found, err := store.Exists(s.ctx, []string{op.key})
+		if err != nil {
+			return replyError(err)
+		}
+		if found > 0 {
+			return replyError(errBusyKey)
+		}
+	}
+
+	value, z, err := parseDump(op.payload, s.server.zsetLimits())
+	if err != nil {
+		return replyError(err)
+	}
+
+	ttl := int64(-1)
+	if op.ttl > 0 {
+		at := op.ttl
+		now := time.Now().UnixMilli()
+		if !op.absttl {
+			at += now
+		}
+		// a key that already expired is not created, like redis
+		if at <= now {
+			if op.replace {
+				_, err := store.Del(s.ctx, []string{op.key})
+				if err != nil {
+					return replyError(err)
+				}
+			}
+			return replyOK()
+		}
+		// ttls are kept in seconds, rounded up so the key does not expire early
+		ttl = (at + 999) / 1000
+	}
+
+	if z != nil {
+		zs, err := zsetStoreOf(store)
+		if err != nil {
+			return replyError(err)
+		}
+		err = zs.RestoreZSet(s.ctx, op.key, z, ttl, op.replace, op.idle, op.freq)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+	}
+	ds, err := dumpStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	err = ds.Restore(s.ctx, op.key, value, ttl, op.replace, op.idle, op.freq)
+	if err != nil {
+		return replyError(err)
+	}
+	return replyOK()
+}
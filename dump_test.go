@@ -0,0 +1,313 @@
+package cider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64(t *testing.T) {
+	if crc := crc64Jones([]byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("want 0xe9c6d914c4b8d9ca, got %#x", crc)
+	}
+}
+
+func TestDumpFormat(t *testing.T) {
+	// DUMP of the value 10 by redis 5 and redis 7.0
+	for _, payload := range []string{
+		"\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n",
+		"\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb",
+	} {
+		value, _, err := parseDump([]byte(payload), zsetLimitsOf(&ServerOptions{}))
+		if err != nil {
+			t.Fatalf("%q: %v", payload, err)
+		}
+		if string(value) != "10" {
+			t.Errorf("want 10, got %q", value)
+		}
+	}
+
+	values := []string{
+		"", "hello", "-128", "127", "128", "-32768", "32767", "2147483647", "-2147483649",
+		"9223372036854775807", "007", strings.Repeat("x", 63), strings.Repeat("x", 64),
+		strings.Repeat("x", 16383), strings.Repeat("x", 16384),
+	}
+	for _, value := range values {
+		payload := dumpValue([]byte(value))
+		restored, _, err := parseDump(payload, zsetLimitsOf(&ServerOptions{}))
+		if err != nil {
+			t.Fatalf("%.20q: %v", value, err)
+		}
+		if string(restored) != value {
+			t.Errorf("want %.20q, got %.20q", value, restored)
+		}
+	}
+	if payload := dumpValue([]byte("127")); !bytes.Equal(payload[:3], []byte{rdbTypeString, 0xc0, 127}) {
+		t.Errorf("want int8 encoding, got %q", payload)
+	}
+
+	// a literal "a" followed by a back reference of 9 bytes
+	lzf := []byte{rdbTypeString, 0xc0 | rdbEncodingLZF, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00}
+	lzf = append(lzf, rdbVersion, 0)
+	crc := crc64Jones(lzf)
+	for i := 0; i < 8; i++ {
+		lzf = append(lzf, byte(crc>>(8*i)))
+	}
+	value, _, err := parseDump(lzf, zsetLimitsOf(&ServerOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "aaaaaaaaaa" {
+		t.Errorf("want 10 a, got %q", value)
+	}
+
+	payload := dumpValue([]byte("hello"))
+	corrupted := bytes.Clone(payload)
+	corrupted[2] ^= 1
+	newer := dumpValue([]byte("hello"))
+	newer[len(newer)-10] = rdbVersion + 1
+	for _, bad := range [][]byte{nil, payload[:5], corrupted, newer} {
+		if _, _, err := parseDump(bad, zsetLimitsOf(&ServerOptions{})); err != errDumpChecksum {
+			t.Errorf("%q: want %v, got %v", bad, errDumpChecksum, err)
+		}
+	}
+}
+
+func TestDumpZSet(t *testing.T) {
+	limits := zsetLimits{entries: 2, value: 64}
+	z := &zset{}
+	z.add("a", 1.5, limits)
+	z.add("b", -2, limits)
+	for _, limits := range []zsetLimits{limits, {entries: 1, value: 64}} {
+		_, restored, err := parseDump(dumpZSet(z), limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, _ := restored.score("a"); restored.len() != 2 || a != 1.5 {
+			t.Errorf("want a scored 1.5 of 2 members, got %v of %d", a, restored.len())
+		}
+		if want := limits.entries >= 2; (restored.encoding() == encodingListpack) != want {
+			t.Errorf("want encoding to follow the limits %v, got %s", limits, restored.encoding())
+		}
+	}
+
+	// a listpack of redis 7: a 6 bit string, a 7 bit integer, a 12 bit string, a 13 bit negative integer,
+	// a 6 bit string and a 64 bit integer, each followed by its length
+	long := strings.Repeat("m", 100)
+	lp := []byte{0x81, 'a', 2, 0x05, 1, 0xe0, 100}
+	lp = append(lp, long...)
+	lp = append(lp, 102, 0xdf, 0xff, 2, 0x81, 'c', 2, 0xf4)
+	lp = binary.LittleEndian.AppendUint64(lp, 3479099956230698)
+	lp = append(lp, 9, 0xff)
+	lp = append(binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint32(nil, uint32(len(lp)+6)), 6), lp...)
+	payload := appendRDBString([]byte{rdbTypeZSetListpack}, lp)
+	payload = binary.LittleEndian.AppendUint16(payload, rdbVersion)
+	payload = binary.LittleEndian.AppendUint64(payload, crc64Jones(payload))
+	_, restored, err := parseDump(payload, zsetLimits{entries: 128, value: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	restored.each(func(member string, score float64) bool {
+		got = append(got, fmt.Sprintf("%.10s=%v", member, score))
+		return true
+	})
+	if want := "mmmmmmmmmm=-1 a=5 c=3.479099956230698e+15"; strings.Join(got, " ") != want {
+		t.Errorf("want %s, got %s", want, strings.Join(got, " "))
+	}
+	if restored.encoding() != encodingSkiplist {
+		t.Errorf("want skiplist for a member of 100 bytes, got %s", restored.encoding())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	l, err := dialLink(context.Background(), server.Addrs()[0].String(), time.Second, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.do("SET", "greeting", "hello")
+	dump, err := l.do("DUMP", "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := dump.(string)
+	if reply, _ := l.do("DUMP", "missing"); reply != nil {
+		t.Errorf("want nil for a missing key, got %v", reply)
+	}
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		args []string
+		want any
+	}{
+		{args: []string{"RESTORE", "greeting", "0", payload}, want: "BUSYKEY Target key name already exists."},
+		{args: []string{"RESTORE", "greeting", "0", payload, "REPLACE"}, want: "OK"},
+		{args: []string{"RESTORE", "copy", "0", "garbage"}, want: "ERR DUMP payload version or checksum are wrong"},
+		{args: []string{"RESTORE", "copy", "-1", payload}, want: "ERR Invalid TTL value, must be >= 0"},
+		{args: []string{"RESTORE", "copy", "0", payload, "IDLETIME", "1", "FREQ", "1"}, want: "ERR syntax error"},
+		{args: []string{"RESTORE", "copy", "0", payload, "FREQ", "256"}, want: "ERR Invalid FREQ value, must be >= 0 and <= 255"},
+		{args: []string{"RESTORE", "copy", "0", payload, "IDLETIME", "100"}, want: "OK"},
+		{args: []string{"OBJECT", "IDLETIME", "copy"}, want: int64(100)},
+		{args: []string{"GET", "copy"}, want: "hello"},
+		{args: []string{"RESTORE", "ttl", strconv.FormatInt(expireAt*1000, 10), payload, "ABSTTL"}, want: "OK"},
+		{args: []string{"RESTORE", "past", "1", payload, "ABSTTL"}, want: "OK"},
+		{args: []string{"EXISTS", "past"}, want: int64(0)},
+		{args: []string{"RESTORE", "copy", "1", payload, "ABSTTL", "REPLACE"}, want: "OK"},
+		{args: []string{"EXISTS", "copy"}, want: int64(0)},
+	}
+	for _, test := range tests {
+		reply, err := l.do(test.args...)
+		if err != nil {
+			reply = err.Error()
+		}
+		if reply != test.want {
+			t.Errorf("%.40q: want %v, got %v", test.args, test.want, reply)
+		}
+	}
+	if _, ttl, _ := server.store.Get(context.Background(), "ttl"); ttl != expireAt {
+		t.Errorf("want ttl %d, got %d", expireAt, ttl)
+	}
+
+	// an expired key that was not removed yet does not block RESTORE
+	server.store.Set(context.Background(), "expired", []byte("value"), time.Now().Unix()-1)
+	if reply, err := l.do("RESTORE", "expired", "0", payload); err != nil || reply != "OK" {
+		t.Errorf("want OK over an expired key, got %v %v", reply, err)
+	}
+
+	l.do("GEOADD", "geo", "13.361389", "38.115556", "Palermo")
+	dump, _ = l.do("DUMP", "geo")
+	l.do("RESTORE", "geocopy", "0", dump.(string))
+	want, _ := l.do("GEOPOS", "geo", "Palermo")
+	if got, _ := l.do("GEOPOS", "geocopy", "Palermo"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want restored sorted set %v, got %v", want, got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	source := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	target := startTestServer(t, ServerOptions{
+		Listeners:   []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		RequirePass: "secret",
+	})
+	s := dialTestClient(t, "tcp", source.Addrs()[0].String())
+	d := dialTestClient(t, "tcp", target.Addrs()[0].String())
+	d.do(t, "AUTH secret")
+	_, port, _ := net.SplitHostPort(target.Addrs()[0].String())
+
+	s.do(t, "SET a 1")
+	s.do(t, "SET b 2")
+	s.do(t, "SET c 3")
+	s.do(t, "EXPIRE c 100")
+	_, ttl, _ := source.store.Get(context.Background(), "c")
+
+	tests := []struct {
+		client  *testClient
+		command string
+		want    string
+	}{
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 0 1000", want: "-ERR Target instance replied with error: NOAUTH Authentication required.\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 0 1000 AUTH wrong", want: "-ERR Target instance replied with error: WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 1 1000 AUTH secret", want: "-ERR DB index is out of range\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " missing 0 1000 AUTH secret", want: "+NOKEY\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 0 1000 COPY AUTH secret", want: "+OK\r\n"},
+		{client: s, command: "EXISTS a", want: ":1\r\n"},
+		{client: d, command: "GET a", want: "$1\r\n1\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " b 0 1000 AUTH secret KEYS a", want: "-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 0 1000 NOPE", want: "-ERR syntax error\r\n"},
+		// a key that exists on the target fails the migration and the source keeps it
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 0 1000 AUTH secret", want: "-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n"},
+		{client: s, command: "EXISTS a", want: ":1\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 " + port + " a 0 1000 REPLACE AUTH secret", want: "+OK\r\n"},
+		{client: s, command: "EXISTS a", want: ":0\r\n"},
+		{client: s, command: "MIGRATE 127.0.0.1 1 b 0 100", want: "-IOERR error or timeout connecting to the client\r\n"},
+	}
+	for _, test := range tests {
+		if reply := test.client.do(t, test.command); reply != test.want {
+			t.Errorf("%s: want %q, got %q", test.command, test.want, reply)
+		}
+	}
+
+	// KEYS takes the empty key argument, sent as RESP
+	s.conn.Write(encodeCommand([]string{"MIGRATE", "127.0.0.1", port, "", "0", "1000", "AUTH2", "default", "secret", "KEYS", "b", "c", "missing"}))
+	if reply, _ := readTestReply(s.reader); reply != "+OK\r\n" {
+		t.Errorf("want +OK, got %q", reply)
+	}
+	if reply := s.do(t, "EXISTS b c"); reply != ":0\r\n" {
+		t.Errorf("want keys deleted from the source, got %q", reply)
+	}
+	if _, got, _ := target.store.Get(context.Background(), "c"); got != ttl {
+		t.Errorf("want ttl %d kept, got %d", ttl, got)
+	}
+}
+
+// Writes to a key being migrated wait until it is deleted from the source.
+func TestMigrateConcurrentWrite(t *testing.T) {
+	source := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	s := dialTestClient(t, "tcp", source.Addrs()[0].String())
+	writer := dialTestClient(t, "tcp", source.Addrs()[0].String())
+
+	// a target that holds its reply until released
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readCommand(bufio.NewReader(conn))
+		close(received)
+		<-release
+		conn.Write([]byte("+OK\r\n"))
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	s.do(t, "SET key old")
+	s.conn.Write([]byte("MIGRATE 127.0.0.1 " + port + " key 0 5000\r\n"))
+	<-received
+
+	written := make(chan string, 1)
+	go func() {
+		writer.conn.Write([]byte("SET key new\r\n"))
+		reply, _ := readTestReply(writer.reader)
+		written <- reply
+	}()
+	select {
+	case reply := <-written:
+		t.Fatalf("want write to wait for the migration, got %q", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if reply, _ := readTestReply(s.reader); reply != "+OK\r\n" {
+		t.Errorf("want +OK, got %q", reply)
+	}
+	if reply := <-written; reply != "+OK\r\n" {
+		t.Errorf("want +OK, got %q", reply)
+	}
+	// the write lands after the deletion instead of being lost
+	if reply := s.do(t, "GET key"); reply != "$3\r\nnew\r\n" {
+		t.Errorf("want new value, got %q", reply)
+	}
+}
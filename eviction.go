@@ -0,0 +1,264 @@
+package cider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+const (
+	// Approximate per key overhead of the item and its map entry in bytes.
+	itemOverhead = int64(unsafe.Sizeof(item{})) + mapEntryOverhead
+	// A string header and a pointer in a map bucket, plus the free slots of a map averaged over its growth.
+	mapEntryOverhead = 48
+	// Number of keys sampled when looking for a key to evict.
+	defaultMaxMemorySamples = 5
+	// Initial LFU counter of new keys so they are not evicted right away.
+	lfuInitValue = 5
+	// Higher values make the LFU counter grow slower.
+	lfuLogFactor = 10
+	// Minutes without access after which the LFU counter is decremented by one.
+	lfuDecayTime = 1
+)
+
+var evictionPolicies = []string{
+	"noeviction",
+	"allkeys-lru",
+	"allkeys-lfu",
+	"allkeys-random",
+	"volatile-lru",
+	"volatile-lfu",
+	"volatile-random",
+	"volatile-ttl",
+}
+
+var errOOM = newCodedError("OOM", "command not allowed when used memory > 'maxmemory'.")
+
+func itemSize(key string, value []byte) int64 {
+	return int64(len(key)+len(value)) + itemOverhead
+}
+
+// Int encoded values take no space beyond the item.
+func (item *item) sizeOf(key string) int64 {
+	if item.zset != nil {
+		return int64(len(key)) + itemOverhead + item.zset.bytes
+	}
+	return itemSize(key, item.value)
+}
+
+func isLFUPolicy(policy string) bool {
+	return policy == "allkeys-lfu" || policy == "volatile-lfu"
+}
+
+// Records an access for the LRU clock and the LFU counter.
+func (item *item) touch(now time.Time) {
+	item.access.Store(now.UnixMilli())
+
+	counter := item.decayedFreq(now)
+	item.freqTime.Store(now.Unix() / 60)
+
+	// logarithmic increment, the higher the counter the less likely it grows
+	if counter < 255 {
+		base := float64(counter) - lfuInitValue
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	item.freq.Store(uint32(counter))
+}
+
+// LFU counter decremented by one for every decay period without access.
+func (item *item) decayedFreq(now time.Time) int64 {
+	counter := int64(item.freq.Load())
+	elapsed := now.Unix()/60 - item.freqTime.Load()
+	if periods := elapsed / lfuDecayTime; periods > 0 {
+		counter -= periods
+	}
+	if counter < 0 {
+		counter = 0
+	}
+	return counter
+}
+
+func (item *item) idle(now time.Time) time.Duration {
+	return now.Sub(time.UnixMilli(item.access.Load()))
+}
+
+func (s *store) SetMaxMemory(maxmemory int64, policy string, samples int) error {
+	if !slices.Contains(evictionPolicies, policy) {
+		return fmt.Errorf("invalid maxmemory-policy %s", policy)
+	}
+	if maxmemory < 0 {
+		return errors.New("maxmemory can't be negative")
+	}
+	if samples <= 0 {
+		samples = defaultMaxMemorySamples
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxmemory.Store(maxmemory)
+	s.policy = policy
+	s.samples = samples
+
+	return nil
+}
+
+func (s *store) UsedMemory() int64 {
+	return s.used.Load()
+}
+
+// Evicts keys until there is room for needed more bytes, the key being written is never evicted.
+// Caller must not hold a shard lock. Like redis the limit is approximate, concurrent writes
+// may exceed it by the size of their values.
+func (s *store) evict(exclude string, needed int64) error {
+	maxmemory := s.maxmemory.Load()
+	if maxmemory == 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	policy, samples := s.policy, s.samples
+	s.mu.RUnlock()
+
+	needed = max(needed, 0)
+	for s.used.Load()+needed > maxmemory {
+		if policy == "noeviction" {
+			return errOOM
+		}
+
+		candidate, ok := s.evictionCandidate(exclude, policy, samples)
+		if !ok {
+			return errOOM
+		}
+		sh := candidate.shard
+		sh.mu.Lock()
+		// the key may have been replaced or deleted since it was sampled
+		if sh.db[candidate.key] == candidate.item && s.remove(sh, candidate.key) {
+			s.evicted.Add(1)
+		}
+		sh.mu.Unlock()
+	}
+
+	return nil
+}
+
+type evictionSample struct {
+	shard *shard
+	key   string
+	item  *item
+	// read while the shard was locked
+	ttl int64
+}
+
+// Picks the best key to evict among a few sampled keys according to the policy.
+// Keys are sampled from shards in turn starting at a random one, each locked while it is sampled.
+func (s *store) evictionCandidate(exclude string, policy string, samples int) (evictionSample, bool) {
+	volatile := policy == "volatile-lru" || policy == "volatile-lfu" ||
+		policy == "volatile-random" || policy == "volatile-ttl"
+
+	sampled := make([]evictionSample, 0, samples)
+	start := rand.Intn(storeShards)
+	for i := 0; i < storeShards && len(sampled) < samples; i++ {
+		sh := s.shards[(start+i)%storeShards]
+		sh.mu.RLock()
+		// map iteration starts at a random position, which is good enough for sampling
+		if volatile {
+			for key := range sh.expires {
+				if len(sampled) == samples {
+					break
+				}
+				if key != exclude {
+					item := sh.db[key]
+					sampled = append(sampled, evictionSample{shard: sh, key: key, item: item, ttl: item.ttl})
+				}
+			}
+		} else {
+			for key, item := range sh.db {
+				if len(sampled) == samples {
+					break
+				}
+				if key != exclude {
+					sampled = append(sampled, evictionSample{shard: sh, key: key, item: item, ttl: item.ttl})
+				}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	if len(sampled) == 0 {
+		return evictionSample{}, false
+	}
+
+	now := time.Now()
+	best := -1
+	bestScore := math.Inf(-1)
+	for i, sample := range sampled {
+		item := sample.item
+
+		// higher scores are better candidates
+		var score float64
+		switch policy {
+		case "allkeys-lru", "volatile-lru":
+			score = float64(item.idle(now))
+		case "allkeys-lfu", "volatile-lfu":
+			score = -float64(item.decayedFreq(now))
+		case "volatile-ttl":
+			score = -float64(sample.ttl)
+		default:
+			score = rand.Float64()
+		}
+
+		if best == -1 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+
+	return sampled[best], true
+}
+
+// Looks up a key and the eviction policy.
+func (s *store) lookup(key string) (*item, string, bool) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	item, ok := sh.db[key]
+	sh.mu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return item, s.policy, ok
+}
+
+func (s *store) IdleTime(ctx context.Context, key string) (int64, error) {
+	item, policy, ok := s.lookup(key)
+	if !ok {
+		return 0, errors.New("key not found")
+	}
+	if isLFUPolicy(policy) {
+		return 0, errors.New("An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	}
+
+	return int64(item.idle(time.Now()).Seconds()), nil
+}
+
+func (s *store) Freq(ctx context.Context, key string) (int64, error) {
+	item, policy, ok := s.lookup(key)
+	if !ok {
+		return 0, errors.New("key not found")
+	}
+	if !isLFUPolicy(policy) {
+		return 0, errors.New("An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	}
+
+	return item.decayedFreq(time.Now()), nil
+}
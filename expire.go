@@ -0,0 +1,63 @@
+package cider
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// How often the active expire cycle runs, like the default redis hz of 10.
+	activeExpireInterval = 100 * time.Millisecond
+	// Number of keys with a ttl sampled per round.
+	activeExpireSamples = 20
+	// Longest a single cycle may run, shards are only locked while they are sampled.
+	activeExpireCycleTime = 25 * time.Millisecond
+)
+
+// Keys are otherwise only expired when accessed, the cycle reclaims memory of keys
+// that are never read again. Shards are visited in turn, each cycle starting where
+// the previous one stopped.
+func (s *store) ActiveExpire(ctx context.Context) int64 {
+	start := time.Now()
+	total := int64(0)
+	for i := 0; i < storeShards; i++ {
+		if time.Since(start) > activeExpireCycleTime || ctx.Err() != nil {
+			break
+		}
+		sh := s.shards[s.expireCursor.Add(1)%storeShards]
+		total += s.expireShard(ctx, sh, start)
+	}
+
+	s.expired.Add(total)
+	return total
+}
+
+// Like redis it keeps sampling while more than a quarter of the sampled keys were expired.
+func (s *store) expireShard(ctx context.Context, sh *shard, start time.Time) int64 {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	total := int64(0)
+	for {
+		now := time.Now().Unix()
+		sampled := 0
+		expired := 0
+		// map iteration starts at a random position, which is good enough for sampling
+		for key := range sh.expires {
+			if sampled == activeExpireSamples {
+				break
+			}
+			sampled++
+
+			if sh.db[key].expired(now) {
+				s.remove(sh, key)
+				expired++
+			}
+		}
+		total += int64(expired)
+
+		if expired*4 <= sampled || time.Since(start) > activeExpireCycleTime || ctx.Err() != nil {
+			return total
+		}
+	}
+}
@@ -0,0 +1,930 @@
+package cider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var functionHelp = []string{
+	"FUNCTION <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"LOAD [REPLACE] <FUNCTION CODE>",
+	"    Create a new library with the given library name and code.",
+	"DELETE <LIBRARY NAME>",
+	"    Delete the given library.",
+	"LIST [LIBRARYNAME PATTERN] [WITHCODE]",
+	"    Return general information on all the libraries:",
+	"    * Library name",
+	"    * The engine used to run the Library",
+	"    * Library functions list",
+	"    * Library code (if WITHCODE is given)",
+	"    It also possible to get only function that matches a pattern using LIBRARYNAME argument.",
+	"STATS",
+	"    Return information about the current function running.",
+	"KILL",
+	"    Kill the current running function.",
+	"FLUSH [ASYNC|SYNC]",
+	"    Delete all the libraries.",
+	"DUMP",
+	"    Return a serialized payload representing the current libraries, can be restored using FUNCTION RESTORE command",
+	"RESTORE <PAYLOAD> [FLUSH|APPEND|REPLACE]",
+	"    Restore the libraries represented by the given payload, it is possible to give a restore policy to",
+	"    control how to handle existing libraries (default APPEND):",
+	"    * FLUSH: delete all existing libraries.",
+	"    * APPEND: appends the restored libraries to the existing libraries. On collision, abort.",
+	"    * REPLACE: appends the restored libraries to the existing libraries, On collision, replace the old",
+	"      libraries with the new libraries (notice that even on this option there is a chance of failure",
+	"      in case of functions name collision with another library).",
+	"HELP",
+	"    Print this help.",
+}
+
+const (
+	// FUNCTION DUMP payloads hold one such opcode followed by the code of every library
+	rdbOpcodeFunction2 = 245
+
+	// longest time the top level code of a library may run, like redis
+	functionLoadTimeout = 500 * time.Millisecond
+)
+
+// Flags register_function accepts. Only no-writes changes how cider runs a function.
+var functionFlags = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+// Commands redis flags noscript, and the ones that would wait for other clients.
+var scriptDenied = map[string]bool{
+	"AUTH": true, "ACL": true, "CLIENT": true, "CONFIG": true, "MONITOR": true, "LATENCY": true,
+	"REPLICAOF": true, "REPLCONF": true, "PSYNC": true, "SENTINEL": true, "CLUSTER": true, "ASKING": true,
+	"WAIT": true, "WAITAOF": true, "FUNCTION": true, "FCALL": true, "FCALL_RO": true,
+}
+
+// A library loaded by FUNCTION LOAD. Its functions share the locals of its top level code,
+// so calls of one library run one at a time.
+type luaLibrary struct {
+	name      string
+	code      string
+	functions map[string]*libraryFunction
+	globals   *luaTable
+	strings   *luaTable
+	mu        *sync.Mutex
+}
+
+type libraryFunction struct {
+	name        string
+	library     *luaLibrary
+	callback    any
+	description string
+	flags       []string
+}
+
+func (f *libraryFunction) noWrites() bool {
+	return slices.Contains(f.flags, "no-writes")
+}
+
+// A function call in progress, shown by FUNCTION STATS and stopped by FUNCTION KILL.
+type functionRun struct {
+	session  *Session
+	store    Storer
+	function *libraryFunction
+	args     []string
+	readOnly bool
+	started  time.Time
+	cancel   context.CancelFunc
+	killed   atomic.Bool
+	wrote    atomic.Bool
+}
+
+// The libraries of a server and the function calls running.
+type functions struct {
+	mu        *sync.RWMutex
+	libraries map[string]*luaLibrary
+	functions map[string]*libraryFunction
+	running   []*functionRun
+}
+
+func newFunctions() *functions {
+	return &functions{
+		mu:        &sync.RWMutex{},
+		libraries: map[string]*luaLibrary{},
+		functions: map[string]*libraryFunction{},
+	}
+}
+
+func (f *functions) lookup(name string) *libraryFunction {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.functions[name]
+}
+
+// Tells whether FCALL runs a function without writes, like FCALL_RO.
+func (f *functions) readOnly(name string) bool {
+	fn := f.lookup(name)
+	return fn != nil && fn.noWrites()
+}
+
+// Adds libraries, with the FLUSH, APPEND or REPLACE policy of FUNCTION RESTORE.
+// Nothing changes unless every library can be added.
+func (f *functions) install(libraries []*luaLibrary, policy string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	installed := map[string]*luaLibrary{}
+	if policy != "FLUSH" {
+		for name, library := range f.libraries {
+			installed[name] = library
+		}
+	}
+	for _, library := range libraries {
+		if _, ok := installed[library.name]; ok && policy != "REPLACE" {
+			return fmt.Errorf("Library '%s' already exists", library.name)
+		}
+		installed[library.name] = library
+	}
+
+	byName := map[string]*libraryFunction{}
+	for _, library := range installed {
+		for name, fn := range library.functions {
+			if _, ok := byName[name]; ok {
+				return fmt.Errorf("Function %s already exists", name)
+			}
+			byName[name] = fn
+		}
+	}
+	f.libraries, f.functions = installed, byName
+	return nil
+}
+
+func (f *functions) remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	library, ok := f.libraries[name]
+	if !ok {
+		return errors.New("Library not found")
+	}
+	delete(f.libraries, name)
+	for fn := range library.functions {
+		delete(f.functions, fn)
+	}
+	return nil
+}
+
+func (f *functions) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.libraries = map[string]*luaLibrary{}
+	f.functions = map[string]*libraryFunction{}
+}
+
+// Returns the libraries sorted by name.
+func (f *functions) list() []*luaLibrary {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	libraries := make([]*luaLibrary, 0, len(f.libraries))
+	for _, library := range f.libraries {
+		libraries = append(libraries, library)
+	}
+	sort.Slice(libraries, func(i, j int) bool {
+		return libraries[i].name < libraries[j].name
+	})
+	return libraries
+}
+
+func (f *functions) start(run *functionRun) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.running = append(f.running, run)
+}
+
+func (f *functions) stop(run *functionRun) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.running = slices.DeleteFunc(f.running, func(r *functionRun) bool {
+		return r == run
+	})
+}
+
+// Serializes every library in the FUNCTION DUMP format.
+func (f *functions) dump() []byte {
+	var buf []byte
+	for _, library := range f.list() {
+		buf = append(buf, rdbOpcodeFunction2)
+		buf = appendRDBString(buf, []byte(library.code))
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	return binary.LittleEndian.AppendUint64(buf, crc64Jones(buf))
+}
+
+// Reads the library codes of a FUNCTION DUMP payload.
+func parseFunctionDump(payload []byte) ([]string, error) {
+	if len(payload) < dumpFooterSize {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+	footer := len(payload) - 8
+	version := binary.LittleEndian.Uint16(payload[footer-2 : footer])
+	if version > rdbVersion || binary.LittleEndian.Uint64(payload[footer:]) != crc64Jones(payload[:footer]) {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+
+	var codes []string
+	body := payload[:len(payload)-dumpFooterSize]
+	for len(body) > 0 {
+		if body[0] != rdbOpcodeFunction2 {
+			return nil, errors.New("given type is not a function")
+		}
+		code, rest, err := readRDBString(body[1:])
+		if err != nil {
+			return nil, errors.New("failed loading the given functions payload")
+		}
+		codes = append(codes, string(code))
+		body = rest
+	}
+	return codes, nil
+}
+
+// Names of libraries and functions, like redis allows them.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c != '_' && !isLetter(c) && !isDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the #!lua name=<library> line that starts the code of a library.
+func parseLibraryHeader(code string) (string, error) {
+	header, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(header, "#!") {
+		return "", errors.New("Missing library metadata")
+	}
+	fields := strings.Fields(header[2:])
+	if len(fields) == 0 {
+		return "", errors.New("Missing library metadata")
+	}
+	if !strings.EqualFold(fields[0], "lua") {
+		return "", fmt.Errorf("Engine '%s' not found", fields[0])
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		value, ok := strings.CutPrefix(field, "name=")
+		if !ok {
+			return "", fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", errors.New("Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// Compiles a library and runs its top level code, which registers its functions.
+func loadLibrary(ctx context.Context, code string) (*luaLibrary, error) {
+	name, err := parseLibraryHeader(code)
+	if err != nil {
+		return nil, err
+	}
+	// the header is not Lua, an empty line keeps the line numbers of errors right
+	source := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		source = code[i:]
+	} else {
+		source = ""
+	}
+	chunk, err := parseLua(source)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling function: %s", err)
+	}
+
+	library := &luaLibrary{
+		name:      name,
+		code:      code,
+		functions: map[string]*libraryFunction{},
+		mu:        &sync.Mutex{},
+	}
+	library.globals, library.strings = newLuaGlobals()
+	library.globals.set("redis", newRedisAPI())
+	for _, table := range []*luaTable{library.globals, library.strings} {
+		table.readonly = true
+	}
+	for key, value, _ := library.globals.next(nil); key != nil; key, value, _ = library.globals.next(key) {
+		if t, ok := value.(*luaTable); ok {
+			t.readonly = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, functionLoadTimeout)
+	defer cancel()
+	l := &luaState{ctx: ctx, globals: library.globals, strings: library.strings, library: library}
+	_, err = l.call(&luaClosure{fn: chunk, scope: newLuaScope(nil)}, nil)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, errors.New("FUNCTION LOAD timeout")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error registering functions: %s", err)
+	}
+	if len(library.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+	return library, nil
+}
+
+// The redis table of a library. call and pcall only work while a function runs,
+// register_function only while the library loads.
+func newRedisAPI() *luaTable {
+	api := newLuaTable()
+	register := func(name string, fn func(l *luaState, args []any) ([]any, error)) {
+		api.set(name, &luaGoFunction{name: name, fn: fn})
+	}
+	register("call", func(l *luaState, args []any) ([]any, error) {
+		return luaRedisCall(l, args, true)
+	})
+	register("pcall", func(l *luaState, args []any) ([]any, error) {
+		return luaRedisCall(l, args, false)
+	})
+	register("register_function", luaRegisterFunction)
+	register("error_reply", func(l *luaState, args []any) ([]any, error) {
+		msg, err := luaCheckString(l, args, 0, "error_reply")
+		if err != nil {
+			return nil, err
+		}
+		return []any{luaStatusTable("err", strings.TrimPrefix(msg, "-"))}, nil
+	})
+	register("status_reply", func(l *luaState, args []any) ([]any, error) {
+		msg, err := luaCheckString(l, args, 0, "status_reply")
+		if err != nil {
+			return nil, err
+		}
+		return []any{luaStatusTable("ok", msg)}, nil
+	})
+	register("log", func(l *luaState, args []any) ([]any, error) {
+		level, err := luaCheckNumber(l, args, 0, "log")
+		if err != nil {
+			return nil, err
+		}
+		var parts []string
+		for i := 1; i < len(args); i++ {
+			s, err := luaCheckString(l, args, i, "log")
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		}
+		event := log.Debug()
+		switch int(level) {
+		case 1:
+			event = log.Debug()
+		case 2:
+			event = log.Info()
+		case 3:
+			event = log.Warn()
+		}
+		event.Msg(strings.Join(parts, " "))
+		return nil, nil
+	})
+	for level, name := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		api.set(name, float64(level))
+	}
+	api.set("REDIS_VERSION", redisVersion)
+	return api
+}
+
+func luaStatusTable(field string, msg string) *luaTable {
+	t := newLuaTable()
+	t.set(field, msg)
+	return t
+}
+
+func luaRegisterFunction(l *luaState, args []any) ([]any, error) {
+	library := l.library
+	if library == nil {
+		return nil, l.fail("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+
+	fn := &libraryFunction{library: library}
+	if t, ok := luaArg(args, 0).(*luaTable); ok && len(args) == 1 {
+		for key, value, _ := t.next(nil); key != nil; key, value, _ = t.next(key) {
+			switch key {
+			case "function_name":
+				fn.name, _ = value.(string)
+			case "callback":
+				fn.callback = value
+			case "description":
+				description, ok := value.(string)
+				if !ok {
+					return nil, l.fail("description argument given to redis.register_function must be a string")
+				}
+				fn.description = description
+			case "flags":
+				flags, ok := value.(*luaTable)
+				if !ok {
+					return nil, l.fail("flags argument to redis.register_function must be a table representing function flags")
+				}
+				for i := 1; i <= flags.length(); i++ {
+					flag, ok := flags.get(float64(i)).(string)
+					if !ok || !slices.Contains(functionFlags, flag) {
+						return nil, l.fail("unknown flag given")
+					}
+					fn.flags = append(fn.flags, flag)
+				}
+			default:
+				return nil, l.fail("unknown argument given to redis.register_function")
+			}
+		}
+	} else {
+		if len(args) != 2 {
+			return nil, l.fail("wrong number of arguments to redis.register_function")
+		}
+		fn.name, _ = args[0].(string)
+		fn.callback = args[1]
+	}
+
+	if !validFunctionName(fn.name) {
+		return nil, l.fail("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, ok := fn.callback.(*luaClosure); !ok {
+		return nil, l.fail("callback argument given to redis.register_function must be a function")
+	}
+	if _, ok := library.functions[fn.name]; ok {
+		return nil, l.fail("Function already exists in the library")
+	}
+	library.functions[fn.name] = fn
+	return nil, nil
+}
+
+// Runs a command for redis.call, raising errors, or redis.pcall, returning them as a table.
+func luaRedisCall(l *luaState, args []any, raise bool) ([]any, error) {
+	run := l.run
+	if run == nil {
+		return nil, l.fail("redis.call can only be called from a function")
+	}
+	value, err := run.command(l, args)
+	if err != nil {
+		value = luaStatusTable("err", err.Error())
+	}
+	if t, ok := value.(*luaTable); ok && raise && t.get("err") != nil {
+		return nil, &luaError{value: t}
+	}
+	return []any{value}, nil
+}
+
+// Runs a command for the function, as the user that called it.
+func (run *functionRun) command(l *luaState, luaArgs []any) (any, error) {
+	s := run.session
+	if len(luaArgs) == 0 {
+		return nil, errors.New("ERR Please specify at least one argument for this redis lib call")
+	}
+	args := make([]string, len(luaArgs))
+	for i, value := range luaArgs {
+		switch v := value.(type) {
+		case string:
+			args[i] = v
+		case float64:
+			args[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			if v != math.Trunc(v) {
+				args[i] = strconv.FormatFloat(v, 'g', 17, 64)
+			}
+		default:
+			return nil, errors.New("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	op, err := parseArgs(args)
+	if err != nil && err.Error() == "unsupported operation" {
+		return nil, errors.New("ERR Unknown Redis command called from script")
+	}
+	if err != nil {
+		return nil, errors.New("ERR " + err.Error())
+	}
+	name, subcommand := commandName(op)
+	if scriptDenied[name] {
+		return nil, errors.New("ERR This Redis command is not allowed from script")
+	}
+	write := slices.Contains(categoriesFor(name, subcommand), "write")
+	if write && run.readOnly {
+		return nil, errors.New("ERR Write commands are not allowed from read-only scripts.")
+	}
+	if s.user != nil {
+		err := s.acl.check(s.user, op, s.clientInfo())
+		if err != nil {
+			return nil, errors.New(strings.TrimSpace(string(replyError(err)[1:])))
+		}
+	}
+	if s.server.cluster != nil {
+		err := s.server.cluster.route(s.ctx, run.store, commandKeys(op), false)
+		if err != nil {
+			return nil, errors.New("ERR Script attempted to access a non local key in a cluster node")
+		}
+	}
+
+	start := time.Now()
+	reply := s.dispatch(run.store, op)
+	s.server.recordCommand(op, time.Since(start))
+	// the effects of a function are replicated, not the function call
+	if write && (len(reply) == 0 || reply[0] != '-') {
+		run.wrote.Store(true)
+		if offset := s.server.propagate(op, args); offset > 0 {
+			s.writeOffset = offset
+		}
+	}
+
+	value, err := luaFromReply(bufio.NewReader(bytes.NewReader(reply)))
+	if err != nil {
+		return nil, errors.New("ERR " + err.Error())
+	}
+	return value, nil
+}
+
+// Converts a reply to Lua like redis does with RESP2: status and error replies become
+// tables with an ok or err field, nil replies false.
+func luaFromReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r, maxInlineSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return luaStatusTable("ok", line[1:]), nil
+	case '-':
+		return luaStatusTable("err", line[1:]), nil
+	case '_':
+		return false, nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return float64(n), nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %s", line[1:])
+		}
+		if n < 0 {
+			return false, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %s", line[1:])
+		}
+		if n < 0 {
+			return false, nil
+		}
+		t := newLuaTable()
+		for i := 0; i < n; i++ {
+			value, err := luaFromReply(r)
+			if err != nil {
+				return nil, err
+			}
+			t.set(float64(i+1), value)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// Converts the value a function returned to a reply, like redis does with RESP2.
+func luaToReply(value any) []byte {
+	switch v := value.(type) {
+	case string:
+		return replyString([]byte(v))
+	case float64:
+		return replyInteger(int64(v))
+	case bool:
+		if v {
+			return replyInteger(1)
+		}
+		return replyNil()
+	case *luaTable:
+		if msg, ok := v.get("err").(string); ok {
+			return replyScriptError(msg)
+		}
+		if msg, ok := v.get("ok").(string); ok {
+			return []byte("+" + errorNewlines.Replace(msg) + "\r\n")
+		}
+		// arrays end at the first nil, like redis
+		var values [][]byte
+		for i := 1; ; i++ {
+			item := v.get(float64(i))
+			if item == nil {
+				break
+			}
+			values = append(values, luaToReply(item))
+		}
+		return replyArray(values)
+	}
+	return replyNil()
+}
+
+// Replies with an error raised by a script, which carries its own error code.
+func replyScriptError(msg string) []byte {
+	return []byte("-" + errorNewlines.Replace(msg) + "\r\n")
+}
+
+func (s *Session) handleFcall(store Storer, op opFcall) []byte {
+	functions := s.server.functions
+	fn := functions.lookup(op.function)
+	if fn == nil {
+		return replyError(errors.New("Function not found"))
+	}
+	if op.ro && !fn.noWrites() {
+		return replyError(errors.New("Can not execute a script with write flag using *_ro command."))
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	run := &functionRun{
+		session:  s,
+		store:    store,
+		function: fn,
+		args:     append([]string{op.function}, append(op.keys, op.args...)...),
+		// the session decided whether the call runs as a write before it got here
+		readOnly: op.ro || op.noWrites || fn.noWrites(),
+		started:  time.Now(),
+		cancel:   cancel,
+	}
+	functions.start(run)
+	defer functions.stop(run)
+
+	library := fn.library
+	library.mu.Lock()
+	defer library.mu.Unlock()
+
+	keys, args := newLuaTable(), newLuaTable()
+	for i, key := range op.keys {
+		keys.set(float64(i+1), key)
+	}
+	for i, arg := range op.args {
+		args.set(float64(i+1), arg)
+	}
+	l := &luaState{ctx: ctx, globals: library.globals, strings: library.strings, run: run}
+	values, err := l.call(fn.callback, []any{keys, args})
+	if run.killed.Load() {
+		return replyError(errors.New("Script killed by user with FUNCTION KILL..."))
+	}
+	var lerr *luaError
+	if errors.As(err, &lerr) {
+		if t, ok := lerr.value.(*luaTable); ok {
+			if msg, ok := t.get("err").(string); ok {
+				return replyScriptError(msg)
+			}
+		}
+		return replyError(fmt.Errorf("%s script: %s, on @user_function:%d.", lerr.Error(), fn.name, l.line))
+	}
+	if err != nil {
+		return replyError(err)
+	}
+	if len(values) == 0 {
+		return replyNil()
+	}
+	return luaToReply(values[0])
+}
+
+func (s *Session) handleFunction(op opFunction) []byte {
+	functions := s.server.functions
+
+	switch op.subcommand {
+	case "HELP":
+		return replyHelp(functionHelp)
+
+	case "LOAD":
+		args := op.args
+		replace := false
+		if len(args) == 2 && strings.EqualFold(args[0], "REPLACE") {
+			replace = true
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return replyError(errors.New("wrong number of arguments for FUNCTION LOAD"))
+		}
+		library, err := loadLibrary(s.ctx, args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		policy := "APPEND"
+		if replace {
+			policy = "REPLACE"
+		}
+		err = functions.install([]*luaLibrary{library}, policy)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyString([]byte(library.name))
+
+	case "DELETE":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for FUNCTION DELETE"))
+		}
+		err := functions.remove(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+
+	case "FLUSH":
+		if len(op.args) > 1 || (len(op.args) == 1 && !strings.EqualFold(op.args[0], "ASYNC") && !strings.EqualFold(op.args[0], "SYNC")) {
+			return replyError(errors.New("FUNCTION FLUSH only supports SYNC|ASYNC option"))
+		}
+		functions.flush()
+		return replyOK()
+
+	case "LIST":
+		return s.functionList(op.args)
+
+	case "DUMP":
+		if len(op.args) != 0 {
+			return replyError(errors.New("wrong number of arguments for FUNCTION DUMP"))
+		}
+		return replyString(functions.dump())
+
+	case "RESTORE":
+		if len(op.args) < 1 || len(op.args) > 2 {
+			return replyError(errors.New("wrong number of arguments for FUNCTION RESTORE"))
+		}
+		policy := "APPEND"
+		if len(op.args) == 2 {
+			policy = strings.ToUpper(op.args[1])
+			if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+				return replyError(errors.New("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."))
+			}
+		}
+		codes, err := parseFunctionDump([]byte(op.args[0]))
+		if err != nil {
+			return replyError(err)
+		}
+		var libraries []*luaLibrary
+		for _, code := range codes {
+			library, err := loadLibrary(s.ctx, code)
+			if err != nil {
+				return replyError(err)
+			}
+			libraries = append(libraries, library)
+		}
+		err = functions.install(libraries, policy)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+
+	case "KILL":
+		return s.functionKill()
+
+	case "STATS":
+		return s.functionStats()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'. Try FUNCTION HELP.", strings.ToLower(op.subcommand)))
+}
+
+func (s *Session) functionList(args []string) []byte {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHCODE":
+			if withCode {
+				return replyError(errors.New("Unknown argument withcode"))
+			}
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 == len(args) || pattern != "" {
+				return replyError(errors.New("library name argument was not given"))
+			}
+			pattern = args[i+1]
+			i++
+		default:
+			return replyError(fmt.Errorf("Unknown argument %s", args[i]))
+		}
+	}
+
+	var libraries [][]byte
+	for _, library := range s.server.functions.list() {
+		if pattern != "" && !matchPattern(pattern, library.name) {
+			continue
+		}
+		names := make([]string, 0, len(library.functions))
+		for name := range library.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var fns [][]byte
+		for _, name := range names {
+			fn := library.functions[name]
+			description := replyNil()
+			if fn.description != "" {
+				description = replyString([]byte(fn.description))
+			}
+			flags := make([][]byte, len(fn.flags))
+			for i, flag := range fn.flags {
+				flags[i] = replyString([]byte(flag))
+			}
+			fns = append(fns, replyArray([][]byte{
+				replyString([]byte("name")), replyString([]byte(fn.name)),
+				replyString([]byte("description")), description,
+				replyString([]byte("flags")), replyArray(flags),
+			}))
+		}
+
+		fields := [][]byte{
+			replyString([]byte("library_name")), replyString([]byte(library.name)),
+			replyString([]byte("engine")), replyString([]byte("LUA")),
+			replyString([]byte("functions")), replyArray(fns),
+		}
+		if withCode {
+			fields = append(fields, replyString([]byte("library_code")), replyString([]byte(library.code)))
+		}
+		libraries = append(libraries, replyArray(fields))
+	}
+	return replyArray(libraries)
+}
+
+// Stops the running functions that did not write yet, like redis a function that wrote runs to its end.
+func (s *Session) functionKill() []byte {
+	functions := s.server.functions
+	functions.mu.RLock()
+	defer functions.mu.RUnlock()
+
+	if len(functions.running) == 0 {
+		return replyError(newCodedError("NOTBUSY", "No scripts in execution right now."))
+	}
+	killed := 0
+	for _, run := range functions.running {
+		if run.wrote.Load() {
+			continue
+		}
+		run.killed.Store(true)
+		run.cancel()
+		killed++
+	}
+	if killed == 0 {
+		return replyError(newCodedError("UNKILLABLE", "Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."))
+	}
+	return replyOK()
+}
+
+// Describes the longest running function and the libraries loaded.
+func (s *Session) functionStats() []byte {
+	functions := s.server.functions
+	functions.mu.RLock()
+	running := replyNil()
+	if len(functions.running) > 0 {
+		run := functions.running[0]
+		command := make([][]byte, len(run.args))
+		for i, arg := range run.args {
+			command[i] = replyString([]byte(arg))
+		}
+		running = replyArray([][]byte{
+			replyString([]byte("name")), replyString([]byte(run.function.name)),
+			replyString([]byte("command")), replyArray(command),
+			replyString([]byte("duration_ms")), replyInteger(time.Since(run.started).Milliseconds()),
+		})
+	}
+	libraries, fns := len(functions.libraries), len(functions.functions)
+	functions.mu.RUnlock()
+
+	return replyArray([][]byte{
+		replyString([]byte("running_script")), running,
+		replyString([]byte("engines")), replyArray([][]byte{
+			replyString([]byte("LUA")), replyArray([][]byte{
+				replyString([]byte("libraries_count")), replyInteger(int64(libraries)),
+				replyString([]byte("functions_count")), replyInteger(int64(fns)),
+			}),
+		}),
+	})
+}
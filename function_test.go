@@ -0,0 +1,264 @@
+package cider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLibrary = `#!lua name=mylib
+
+local calls = 0
+
+local function incr(keys)
+  calls = calls + 1
+  return redis.call('INCR', keys[1])
+end
+
+redis.register_function('incr', incr)
+redis.register_function{
+  function_name = 'get',
+  callback = function(keys) return redis.call('GET', keys[1]) end,
+  flags = {'no-writes'},
+  description = 'reads a key',
+}
+redis.register_function('calls', function() return calls end)
+redis.register_function('echo', function(keys, args)
+  return {args[1], tonumber(args[2]), true, false, {ok = 'fine'}, args[3]}
+end)
+redis.register_function('fail', function(keys, args)
+  if args[1] == 'reply' then return redis.error_reply('MYERR custom') end
+  if args[1] == 'status' then return redis.status_reply('DONE') end
+  if args[1] == 'pcall' then
+    local reply = redis.pcall('NOSUCH')
+    return reply.err
+  end
+  return redis.call(args[1])
+end)
+`
+
+func dialTestLink(t *testing.T, server *Server) *link {
+	t.Helper()
+
+	l, err := dialLink(context.Background(), server.Addrs()[0].String(), 2*time.Second, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestFunction(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	l := dialTestLink(t, server)
+
+	tests := []struct {
+		args []string
+		want any
+	}{
+		{args: []string{"FUNCTION", "LOAD", testLibrary}, want: "mylib"},
+		{args: []string{"FUNCTION", "LOAD", testLibrary}, want: "ERR Library 'mylib' already exists"},
+		{args: []string{"FUNCTION", "LOAD", "REPLACE", testLibrary}, want: "mylib"},
+		{args: []string{"SET", "counter", "0"}, want: "OK"},
+		{args: []string{"FCALL", "incr", "1", "counter"}, want: "OK"},
+		{args: []string{"FCALL", "incr", "1", "counter", "ignored"}, want: "OK"},
+		{args: []string{"FCALL_RO", "get", "1", "counter"}, want: "2"},
+		{args: []string{"FCALL", "get", "1", "counter"}, want: "2"},
+		{args: []string{"FCALL_RO", "incr", "1", "counter"}, want: "ERR Can not execute a script with write flag using *_ro command."},
+		{args: []string{"FCALL", "calls", "0"}, want: int64(2)},
+		{args: []string{"FCALL", "echo", "0", "a", "2.7", "c"}, want: "[a 2 1 <nil> fine c]"},
+		{args: []string{"FCALL", "fail", "0", "reply"}, want: "MYERR custom"},
+		{args: []string{"FCALL", "fail", "0", "status"}, want: "DONE"},
+		{args: []string{"FCALL", "fail", "0", "pcall"}, want: "ERR Unknown Redis command called from script"},
+		{args: []string{"FCALL", "fail", "0", "NOSUCH"}, want: "ERR Unknown Redis command called from script"},
+		{args: []string{"FCALL", "fail", "0", "MONITOR"}, want: "ERR This Redis command is not allowed from script"},
+		{args: []string{"FCALL", "nosuch", "0"}, want: "ERR Function not found"},
+		{args: []string{"FCALL", "incr", "2", "counter"}, want: "ERR Number of keys can't be greater than number of args"},
+		{args: []string{"FCALL", "incr", "-1"}, want: "ERR Number of keys can't be negative"},
+		{args: []string{"FUNCTION", "LOAD", "return 1"}, want: "ERR Missing library metadata"},
+		{args: []string{"FUNCTION", "LOAD", "#!js name=x\n"}, want: "ERR Engine 'js' not found"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua\n"}, want: "ERR Library name was not given"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=x foo=bar\n"}, want: "ERR Invalid metadata value given: foo=bar"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=empty\nlocal x = 1"}, want: "ERR No functions registered"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=bad\n\nlocal x ="}, want: "ERR Error compiling function: user_function:3: unexpected symbol near '<eof>'"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=global\nx = 1"}, want: "ERR Error registering functions: user_function:2: Attempt to modify a readonly table, use local variables instead of the global 'x'"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=clash\nredis.register_function('get', function() end)"}, want: "ERR Function get already exists"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=slow\nwhile true do end"}, want: "ERR FUNCTION LOAD timeout"},
+		{args: []string{"FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('other', function() return redis.call('SET', 'k', 'v') end)"}, want: "other"},
+		{args: []string{"FCALL", "other", "0"}, want: "OK"},
+		{args: []string{"FUNCTION", "LIST", "LIBRARYNAME", "oth*"}, want: "[[library_name other engine LUA functions [[name other description <nil> flags []]]]]"},
+		{args: []string{"FUNCTION", "DELETE", "other"}, want: "OK"},
+		{args: []string{"FUNCTION", "DELETE", "other"}, want: "ERR Library not found"},
+		{args: []string{"FCALL", "other", "0"}, want: "ERR Function not found"},
+		{args: []string{"FUNCTION", "STATS"}, want: "[running_script <nil> engines [LUA [libraries_count 1 functions_count 5]]]"},
+		{args: []string{"FUNCTION", "KILL"}, want: "NOTBUSY No scripts in execution right now."},
+		{args: []string{"FUNCTION", "NOSUCH"}, want: "ERR unknown subcommand 'nosuch'. Try FUNCTION HELP."},
+	}
+	for _, test := range tests {
+		reply, err := l.do(test.args...)
+		if err != nil {
+			reply = err.Error()
+		}
+		if got := fmt.Sprint(reply); got != fmt.Sprint(test.want) {
+			t.Errorf("%.60q: want %v, got %v", test.args, test.want, got)
+		}
+	}
+
+	list, _ := l.do("FUNCTION", "LIST", "WITHCODE")
+	if got := fmt.Sprint(list); !strings.Contains(got, "name get description reads a key flags [no-writes]") || !strings.Contains(got, "library_code "+testLibrary) {
+		t.Errorf("want library with its code, got %v", got)
+	}
+
+	// a dump restores the libraries as they were
+	dump, err := l.do("FUNCTION", "DUMP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := dump.(string)
+	restores := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"FUNCTION", "RESTORE", payload}, want: "ERR Library 'mylib' already exists"},
+		{args: []string{"FUNCTION", "RESTORE", payload, "REPLACE"}, want: "OK"},
+		{args: []string{"FUNCTION", "FLUSH"}, want: "OK"},
+		{args: []string{"FCALL", "get", "1", "counter"}, want: "ERR Function not found"},
+		{args: []string{"FUNCTION", "RESTORE", payload}, want: "OK"},
+		{args: []string{"FCALL", "get", "1", "counter"}, want: "2"},
+		{args: []string{"FUNCTION", "RESTORE", payload, "FLUSH"}, want: "OK"},
+		{args: []string{"FUNCTION", "RESTORE", payload[:len(payload)-1] + "x"}, want: "ERR payload version or checksum are wrong"},
+		{args: []string{"FUNCTION", "RESTORE", payload, "MERGE"}, want: "ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."},
+	}
+	for _, test := range restores {
+		reply, err := l.do(test.args...)
+		if err != nil {
+			reply = err.Error()
+		}
+		if got := fmt.Sprint(reply); got != test.want {
+			t.Errorf("%.40q: want %v, got %v", test.args, test.want, got)
+		}
+	}
+}
+
+// Commands run by a function are checked against the ACL of the caller.
+func TestFunctionACL(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	l := dialTestLink(t, server)
+	l.do("FUNCTION", "LOAD", testLibrary)
+	l.do("ACL", "SETUSER", "limited", "on", "nopass", "+fcall", "+fcall_ro", "+get", "~*")
+
+	limited, err := dialLink(context.Background(), server.Addrs()[0].String(), 2*time.Second, "limited", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+
+	if _, err := limited.do("FCALL", "incr", "1", "counter"); err == nil || !strings.HasPrefix(err.Error(), "NOPERM") {
+		t.Errorf("want NOPERM from INCR, got %v", err)
+	}
+	if reply, err := limited.do("FCALL_RO", "get", "1", "counter"); err != nil || reply != nil {
+		t.Errorf("want nil from GET, got %v %v", reply, err)
+	}
+	if _, err := limited.do("FUNCTION", "FLUSH"); err == nil || !strings.HasPrefix(err.Error(), "NOPERM") {
+		t.Errorf("want NOPERM for FUNCTION FLUSH, got %v", err)
+	}
+}
+
+func TestFunctionKill(t *testing.T) {
+	for _, eventLoop := range []bool{false, true} {
+		server := startTestServer(t, ServerOptions{
+			Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+			EventLoop: eventLoop,
+		})
+		l := dialTestLink(t, server)
+		l.do("FUNCTION", "LOAD", "#!lua name=loops\n"+
+			"redis.register_function('spin', function() while true do end end)\n"+
+			"redis.register_function('write', function() redis.call('SET', 'k', 'v') while true do end end)")
+
+		done := make(chan error, 1)
+		go func() {
+			spinner := dialTestLink(t, server)
+			_, err := spinner.do("FCALL", "spin", "0")
+			done <- err
+		}()
+
+		other := dialTestLink(t, server)
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			stats, _ := other.do("FUNCTION", "STATS")
+			if strings.Contains(fmt.Sprint(stats), "name spin command [spin]") {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("want spin in FUNCTION STATS, got %v", stats)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if reply, err := other.do("FUNCTION", "KILL"); err != nil || reply != "OK" {
+			t.Fatalf("want OK, got %v %v", reply, err)
+		}
+		if err := <-done; err == nil || !strings.Contains(err.Error(), "Script killed by user") {
+			t.Errorf("want killed script, got %v", err)
+		}
+	}
+}
+
+// Replicas get the libraries with a full resync and the writes of a function one by one.
+func TestFunctionReplication(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{Listeners: listeners})
+	replica := startTestServer(t, ServerOptions{Listeners: listeners})
+
+	p := dialTestLink(t, primary)
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+	p.do("FUNCTION", "LOAD", testLibrary)
+
+	host, port, _ := strings.Cut(primary.Addrs()[0].String(), ":")
+	r.do(t, "REPLICAOF "+host+" "+port)
+	waitForReply(t, r, "INFO replication", "master_link_status:up")
+
+	if reply := r.do(t, "FCALL_RO get 1 counter"); reply != "_\r\n" {
+		t.Errorf("want library on the replica, got %q", reply)
+	}
+	if reply := r.do(t, "FCALL incr 1 counter"); !strings.HasPrefix(reply, "-READONLY") {
+		t.Errorf("want READONLY for a function that writes, got %q", reply)
+	}
+
+	p.do("SET", "counter", "0")
+	p.do("FCALL", "incr", "1", "counter")
+	p.do("FCALL", "incr", "1", "counter")
+	waitForReply(t, r, "GET counter", "$1\r\n2\r\n")
+
+	p.do("FUNCTION", "LOAD", "#!lua name=later\n"+
+		"redis.register_function{function_name = 'later', callback = function() return 1 end, flags = {'no-writes'}}")
+	waitForReply(t, r, "FCALL later 0", ":1\r\n")
+}
+
+func TestFunctionDump(t *testing.T) {
+	functions := newFunctions()
+	library, err := loadLibrary(context.Background(), testLibrary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := functions.install([]*luaLibrary{library}, "APPEND"); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := parseFunctionDump(functions.dump())
+	if err != nil || len(codes) != 1 || codes[0] != testLibrary {
+		t.Errorf("want the code of the library, got %q %v", codes, err)
+	}
+
+	empty := newFunctions().dump()
+	if codes, err := parseFunctionDump(empty); err != nil || len(codes) != 0 {
+		t.Errorf("want no libraries, got %q %v", codes, err)
+	}
+	if _, err := parseFunctionDump(empty[:5]); err == nil {
+		t.Errorf("want error for a short payload")
+	}
+}
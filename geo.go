@@ -0,0 +1,528 @@
+package cider
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Geospatial indexes are sorted sets scored by 52 bit geohashes, interleaving
+// 26 bits of latitude on the even bits with 26 bits of longitude, like redis.
+const (
+	geoStepMax = 26
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+	// earth radius used by the haversine distances of redis
+	earthRadius = 6372797.560856
+	// half the circumference of the earth in the web mercator projection
+	mercatorMax = 20037726.37
+)
+
+var (
+	errGeoMember = errors.New("could not decode requested zset member")
+	errGeoUnit   = errors.New("unsupported unit provided. please use M, KM, FT, MI")
+)
+
+type geoRange struct {
+	min float64
+	max float64
+}
+
+var (
+	geoLongRange = geoRange{geoLongMin, geoLongMax}
+	geoLatRange  = geoRange{geoLatMin, geoLatMax}
+)
+
+// Meters per unit of distance arguments and replies.
+func geoUnit(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, errGeoUnit
+}
+
+// Spreads the bits of v to the even bits of the result.
+func geoSpread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// Gathers the even bits of x, the reverse of geoSpread.
+func geoSquash(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+	return uint32(x)
+}
+
+func geohashEncode(lon float64, lat float64, lonRange geoRange, latRange geoRange, step uint) uint64 {
+	scale := float64(uint64(1) << step)
+	latOffset := (lat - latRange.min) / (latRange.max - latRange.min) * scale
+	lonOffset := (lon - lonRange.min) / (lonRange.max - lonRange.min) * scale
+	return geoSpread(uint32(latOffset)) | geoSpread(uint32(lonOffset))<<1
+}
+
+// Returns the longitude and latitude ranges covered by a geohash.
+func geohashDecode(bits uint64, step uint, lonRange geoRange, latRange geoRange) (geoRange, geoRange) {
+	scale := float64(uint64(1) << step)
+	lat := float64(geoSquash(bits))
+	lon := float64(geoSquash(bits >> 1))
+	return geoRange{
+		lonRange.min + lon/scale*(lonRange.max-lonRange.min),
+		lonRange.min + (lon+1)/scale*(lonRange.max-lonRange.min),
+	}, geoRange{
+		latRange.min + lat/scale*(latRange.max-latRange.min),
+		latRange.min + (lat+1)/scale*(latRange.max-latRange.min),
+	}
+}
+
+func geoScore(lon float64, lat float64) float64 {
+	return float64(geohashEncode(lon, lat, geoLongRange, geoLatRange, geoStepMax))
+}
+
+// Returns the center of the area of a score, which is where members are reported to be.
+func geoPosition(score float64) (lon float64, lat float64) {
+	lonArea, latArea := geohashDecode(uint64(score), geoStepMax, geoLongRange, geoLatRange)
+	lon = math.Max(geoLongMin, math.Min(geoLongMax, (lonArea.min+lonArea.max)/2))
+	lat = math.Max(geoLatMin, math.Min(geoLatMax, (latArea.min+latArea.max)/2))
+	return lon, lat
+}
+
+// Moves a geohash by one area east or west and north or south.
+func geohashMove(bits uint64, step uint, dlon int, dlat int) uint64 {
+	lon := bits & 0xaaaaaaaaaaaaaaaa
+	lat := bits & 0x5555555555555555
+	if dlon != 0 {
+		zz := uint64(0x5555555555555555) >> (64 - step*2)
+		if dlon > 0 {
+			lon += zz + 1
+		} else {
+			lon = (lon | zz) - (zz + 1)
+		}
+		lon &= 0xaaaaaaaaaaaaaaaa >> (64 - step*2)
+	}
+	if dlat != 0 {
+		zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - step*2)
+		if dlat > 0 {
+			lat += zz + 1
+		} else {
+			lat = (lat | zz) - (zz + 1)
+		}
+		lat &= 0x5555555555555555 >> (64 - step*2)
+	}
+	return lon | lat
+}
+
+func degToRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radToDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+func geoLatDistance(lat1 float64, lat2 float64) float64 {
+	return earthRadius * math.Abs(degToRad(lat2)-degToRad(lat1))
+}
+
+// Haversine distance in meters.
+func geoDistance(lon1 float64, lat1 float64, lon2 float64, lat2 float64) float64 {
+	v := math.Sin((degToRad(lon2) - degToRad(lon1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	u := math.Sin((degToRad(lat2) - degToRad(lat1)) / 2)
+	a := u*u + math.Cos(degToRad(lat1))*math.Cos(degToRad(lat2))*v*v
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Area searched by GEOSEARCH, distances in meters.
+type geoShape struct {
+	lon    float64
+	lat    float64
+	box    bool
+	radius float64
+	width  float64
+	height float64
+}
+
+// Returns the distance to a point and whether it lies within the shape.
+func (s geoShape) contains(lon float64, lat float64) (float64, bool) {
+	if !s.box {
+		distance := geoDistance(s.lon, s.lat, lon, lat)
+		return distance, distance <= s.radius
+	}
+	// the latitude distance is cheaper, so it is checked first
+	if geoLatDistance(lat, s.lat) > s.height/2 {
+		return 0, false
+	}
+	if geoDistance(lon, lat, s.lon, lat) > s.width/2 {
+		return 0, false
+	}
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// Returns the longitude and latitude ranges bounding the shape.
+func (s geoShape) bounds() (geoRange, geoRange) {
+	height, width := s.radius, s.radius
+	if s.box {
+		height, width = s.height/2, s.width/2
+	}
+	latDelta := radToDeg(height / earthRadius)
+	lonDeltaTop := radToDeg(width / earthRadius / math.Cos(degToRad(s.lat+latDelta)))
+	lonDeltaBottom := radToDeg(width / earthRadius / math.Cos(degToRad(s.lat-latDelta)))
+	// the box is widest on the side closer to the equator
+	lonDelta := lonDeltaTop
+	if s.lat < 0 {
+		lonDelta = lonDeltaBottom
+	}
+	return geoRange{s.lon - lonDelta, s.lon + lonDelta}, geoRange{s.lat - latDelta, s.lat + latDelta}
+}
+
+// Picks the geohash precision whose areas are about as large as the radius.
+func geoEstimateStep(radius float64, lat float64) uint {
+	if radius == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for ; radius < mercatorMax; step++ {
+		radius *= 2
+	}
+	step -= 2
+	// areas are narrower towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(max(1, min(step, geoStepMax)))
+}
+
+// Returns the score ranges of the geohash area holding the center of the shape
+// and of its neighbors that overlap the shape, like redis searches them.
+func (s geoShape) ranges() [][2]float64 {
+	radius := s.radius
+	if s.box {
+		radius = math.Sqrt((s.width/2)*(s.width/2) + (s.height/2)*(s.height/2))
+	}
+	lonBounds, latBounds := s.bounds()
+
+	step := geoEstimateStep(radius, s.lat)
+	hash := geohashEncode(s.lon, s.lat, geoLongRange, geoLatRange, step)
+	// the estimated step may be too precise when the shape is near an edge of its area
+	_, north := geohashDecode(geohashMove(hash, step, 0, 1), step, geoLongRange, geoLatRange)
+	_, south := geohashDecode(geohashMove(hash, step, 0, -1), step, geoLongRange, geoLatRange)
+	east, _ := geohashDecode(geohashMove(hash, step, 1, 0), step, geoLongRange, geoLatRange)
+	west, _ := geohashDecode(geohashMove(hash, step, -1, 0), step, geoLongRange, geoLatRange)
+	if step > 1 && (north.max < latBounds.max || south.min > latBounds.min || east.max < lonBounds.max || west.min > lonBounds.min) {
+		step--
+		hash = geohashEncode(s.lon, s.lat, geoLongRange, geoLatRange, step)
+	}
+	lonArea, latArea := geohashDecode(hash, step, geoLongRange, geoLatRange)
+
+	// the center area and its neighbors as longitude and latitude moves
+	moves := [][2]int{{0, 0}, {0, 1}, {0, -1}, {1, 0}, {-1, 0}, {1, 1}, {-1, 1}, {1, -1}, {-1, -1}}
+	var ranges [][2]float64
+	for _, move := range moves {
+		// neighbors beyond a side of the shape the center area already covers are useless
+		if step >= 2 && ((move[1] < 0 && latArea.min < latBounds.min) || (move[1] > 0 && latArea.max > latBounds.max) ||
+			(move[0] < 0 && lonArea.min < lonBounds.min) || (move[0] > 0 && lonArea.max > lonBounds.max)) {
+			continue
+		}
+		bits := geohashMove(hash, step, move[0], move[1])
+		shift := 2 * (geoStepMax - step)
+		r := [2]float64{float64(bits << shift), float64((bits + 1) << shift)}
+		// large shapes can have the same neighbor on several sides
+		if !slices.Contains(ranges, r) {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+type geoResult struct {
+	member   string
+	score    float64
+	distance float64
+	lon      float64
+	lat      float64
+}
+
+// Finds the members within the shape, at most limit of them unless it is zero.
+func geoSearch(z *zset, s geoShape, limit int) []geoResult {
+	var results []geoResult
+	for _, r := range s.ranges() {
+		z.rangeByScore(r[0], r[1], func(member string, score float64) bool {
+			lon, lat := geoPosition(score)
+			distance, ok := s.contains(lon, lat)
+			if ok {
+				results = append(results, geoResult{member, score, distance, lon, lat})
+			}
+			return limit == 0 || len(results) < limit
+		})
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+	}
+	return results
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Returns the standard 11 character geohash of a score. Scores use latitudes
+// limited to ±85.05112878, so the position is encoded again with ±90.
+func geohashString(score float64) string {
+	lon, lat := geoPosition(score)
+	bits := geohashEncode(lon, lat, geoRange{-180, 180}, geoRange{-90, 90}, geoStepMax)
+	buf := make([]byte, 11)
+	for i := range buf {
+		// 52 bits make 10 characters and a half, the last one is padded with zeros
+		index := 0
+		if i < 10 {
+			index = int(bits>>(52-(i+1)*5)) & 0x1f
+		}
+		buf[i] = geohashAlphabet[index]
+	}
+	return string(buf)
+}
+
+// Formats coordinates with 17 decimals without trailing zeros, like redis.
+func formatCoordinate(v float64) []byte {
+	s := strconv.FormatFloat(v, 'f', 17, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return []byte(s)
+}
+
+func formatDistance(meters float64, unit float64) []byte {
+	return strconv.AppendFloat(nil, meters/unit, 'f', 4, 64)
+}
+
+func replyCoordinates(lon float64, lat float64) []byte {
+	return replyArray([][]byte{replyString(formatCoordinate(lon)), replyString(formatCoordinate(lat))})
+}
+
+func (s *Session) handleGeoadd(store Storer, op opGeoadd) []byte {
+	zs, err := zsetStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	limits := s.server.zsetLimits()
+	n := int64(0)
+	err = zs.UpdateZSet(s.ctx, op.key, func(z *zset) error {
+		for _, p := range op.points {
+			score := geoScore(p.lon, p.lat)
+			old, found := z.score(p.member)
+			switch {
+			case (op.nx && found) || (op.xx && !found):
+				continue
+			case !found:
+				n++
+			case old == score:
+				continue
+			case op.ch:
+				n++
+			}
+			z.add(p.member, score, limits)
+		}
+		return nil
+	})
+	if err != nil {
+		return replyError(err)
+	}
+	return replyInteger(n)
+}
+
+func (s *Session) handleGeopos(store Storer, op opGeopos) []byte {
+	zs, err := zsetStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	replies := make([][]byte, len(op.members))
+	for i := range replies {
+		replies[i] = replyNil()
+	}
+	err = zs.ReadZSet(s.ctx, op.key, func(z *zset) error {
+		for i, member := range op.members {
+			if score, ok := z.score(member); ok {
+				replies[i] = replyCoordinates(geoPosition(score))
+			}
+		}
+		return nil
+	})
+	if err != nil && err.Error() != "key not found" {
+		return replyError(err)
+	}
+	return replyArray(replies)
+}
+
+func (s *Session) handleGeodist(store Storer, op opGeodist) []byte {
+	zs, err := zsetStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	var reply []byte
+	err = zs.ReadZSet(s.ctx, op.key, func(z *zset) error {
+		score1, ok1 := z.score(op.member1)
+		score2, ok2 := z.score(op.member2)
+		if ok1 && ok2 {
+			lon1, lat1 := geoPosition(score1)
+			lon2, lat2 := geoPosition(score2)
+			reply = replyString(formatDistance(geoDistance(lon1, lat1, lon2, lat2), op.unit))
+		}
+		return nil
+	})
+	if err != nil && err.Error() != "key not found" {
+		return replyError(err)
+	}
+	if reply == nil {
+		return replyNil()
+	}
+	return reply
+}
+
+func (s *Session) handleGeohash(store Storer, op opGeohash) []byte {
+	zs, err := zsetStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	replies := make([][]byte, len(op.members))
+	for i := range replies {
+		replies[i] = replyNil()
+	}
+	err = zs.ReadZSet(s.ctx, op.key, func(z *zset) error {
+		for i, member := range op.members {
+			if score, ok := z.score(member); ok {
+				replies[i] = replyString([]byte(geohashString(score)))
+			}
+		}
+		return nil
+	})
+	if err != nil && err.Error() != "key not found" {
+		return replyError(err)
+	}
+	return replyArray(replies)
+}
+
+// Serves GEOSEARCH, and GEOSEARCHSTORE when op.store is set.
+func (s *Session) handleGeosearch(store Storer, op opGeosearch) []byte {
+	zs, err := zsetStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	shape := geoShape{
+		lon:    op.lon,
+		lat:    op.lat,
+		box:    op.box,
+		radius: op.radius * op.unit,
+		width:  op.width * op.unit,
+		height: op.height * op.unit,
+	}
+	limit := 0
+	if op.any {
+		limit = int(op.count)
+	}
+
+	var results []geoResult
+	err = zs.ReadZSet(s.ctx, op.key, func(z *zset) error {
+		if op.fromMember {
+			score, ok := z.score(op.member)
+			if !ok {
+				return errGeoMember
+			}
+			shape.lon, shape.lat = geoPosition(score)
+		}
+		results = geoSearch(z, shape, limit)
+		return nil
+	})
+	if err != nil && err.Error() != "key not found" {
+		return replyError(err)
+	}
+
+	switch {
+	case op.sort > 0:
+		slices.SortStableFunc(results, func(a, b geoResult) int { return cmp.Compare(a.distance, b.distance) })
+	case op.sort < 0:
+		slices.SortStableFunc(results, func(a, b geoResult) int { return cmp.Compare(b.distance, a.distance) })
+	}
+	if op.count > 0 && int64(len(results)) > op.count {
+		results = results[:op.count]
+	}
+
+	if op.store {
+		return s.storeGeoResults(zs, op, results)
+	}
+	replies := make([][]byte, 0, len(results))
+	for _, r := range results {
+		if !op.withDist && !op.withHash && !op.withCoord {
+			replies = append(replies, replyString([]byte(r.member)))
+			continue
+		}
+		fields := [][]byte{replyString([]byte(r.member))}
+		if op.withDist {
+			fields = append(fields, replyString(formatDistance(r.distance, op.unit)))
+		}
+		if op.withHash {
+			fields = append(fields, replyInteger(int64(r.score)))
+		}
+		if op.withCoord {
+			fields = append(fields, replyCoordinates(r.lon, r.lat))
+		}
+		replies = append(replies, replyArray(fields))
+	}
+	return replyArray(replies)
+}
+
+// Replaces the destination of GEOSEARCHSTORE with the results, scored by
+// geohash or by distance with STOREDIST. No results delete it like redis.
+func (s *Session) storeGeoResults(store zsetStorer, op opGeosearch, results []geoResult) []byte {
+	if len(results) == 0 {
+		_, err := store.Del(s.ctx, []string{op.dest})
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(0)
+	}
+
+	limits := s.server.zsetLimits()
+	maxLen := 0
+	for _, r := range results {
+		maxLen = max(maxLen, len(r.member))
+	}
+	z := newZSet(len(results), maxLen, limits)
+	for _, r := range results {
+		score := r.score
+		if op.storeDist {
+			score = r.distance / op.unit
+		}
+		z.add(r.member, score, limits)
+	}
+	err := store.SetZSet(s.ctx, op.dest, z)
+	if err != nil {
+		return replyError(err)
+	}
+	return replyInteger(int64(len(results)))
+}
@@ -0,0 +1,194 @@
+package cider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestGeo(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	palermo := "*2\r\n$20\r\n13.36138933897018433\r\n$20\r\n38.11555639549629859\r\n"
+	catania := "*2\r\n$20\r\n15.08726745843887329\r\n$20\r\n37.50266842333162032\r\n"
+
+	// examples of the redis documentation
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "GEOADD Sicily 13.361389 38.115556 Palermo 15.087269 37.502669 Catania", want: ":2\r\n"},
+		{command: "GEOADD Sicily 13.361389 38.115556 Palermo", want: ":0\r\n"},
+		{command: "GEOADD Sicily NX 13 38 Palermo", want: ":0\r\n"},
+		{command: "GEOADD Sicily XX 13 38 Nowhere", want: ":0\r\n"},
+		{command: "GEOADD Sicily NX XX 13 38 Palermo", want: "-ERR syntax error\r\n"},
+		{command: "GEOADD Sicily 13 38", want: "-ERR wrong number of arguments for GEOADD\r\n"},
+		{command: "GEOADD Sicily 13 38 a 14", want: "-ERR syntax error\r\n"},
+		{command: "GEOADD Sicily 181 10 a", want: "-ERR invalid longitude,latitude pair 181.000000,10.000000\r\n"},
+		{command: "GEOADD Sicily x 10 a", want: "-ERR value is not a valid float\r\n"},
+		{command: "GEODIST Sicily Palermo Catania", want: "$11\r\n166274.1516\r\n"},
+		{command: "GEODIST Sicily Palermo Catania km", want: "$8\r\n166.2742\r\n"},
+		{command: "GEODIST Sicily Palermo Catania MI", want: "$8\r\n103.3182\r\n"},
+		{command: "GEODIST Sicily Palermo Catania yd", want: "-ERR unsupported unit provided. please use M, KM, FT, MI\r\n"},
+		{command: "GEODIST Sicily Palermo Nowhere", want: "_\r\n"},
+		{command: "GEODIST Nowhere Palermo Catania", want: "_\r\n"},
+		{command: "GEOPOS Sicily Palermo Catania Nowhere", want: "*3\r\n" + palermo + catania + "_\r\n"},
+		{command: "GEOPOS Nowhere Palermo", want: "*1\r\n_\r\n"},
+		{command: "GEOHASH Sicily Palermo Catania", want: "*2\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n"},
+		{command: "GEOADD Sicily 12.758489 38.788135 edge1 17.241510 38.788135 edge2", want: ":2\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km ASC", want: "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km DESC", want: "*2\r\n$7\r\nPalermo\r\n$7\r\nCatania\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km WITHHASH", want: "*2\r\n*2\r\n$7\r\nPalermo\r\n:3479099956230698\r\n*2\r\n$7\r\nCatania\r\n:3479447370796909\r\n"},
+		{
+			command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHCOORD WITHDIST",
+			want: "*4\r\n" +
+				"*3\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n" + catania +
+				"*3\r\n$7\r\nPalermo\r\n$8\r\n190.4424\r\n" + palermo +
+				"*3\r\n$5\r\nedge2\r\n$8\r\n279.7403\r\n*2\r\n$20\r\n17.24151045083999634\r\n$20\r\n38.78813451624225195\r\n" +
+				"*3\r\n$5\r\nedge1\r\n$8\r\n279.7405\r\n*2\r\n$19\r\n12.7584877610206604\r\n$20\r\n38.78813451624225195\r\n",
+		},
+		{command: "GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 200 km COUNT 1", want: "*1\r\n$7\r\nPalermo\r\n"},
+		{command: "GEOSEARCH Sicily FROMMEMBER Palermo BYRADIUS 200 km COUNT 2 DESC WITHDIST", want: "*2\r\n*2\r\n$7\r\nCatania\r\n$8\r\n166.2742\r\n*2\r\n$5\r\nedge1\r\n$7\r\n91.4007\r\n"},
+		{command: "GEOSEARCH Sicily FROMMEMBER Nowhere BYRADIUS 200 km", want: "-ERR could not decode requested zset member\r\n"},
+		{command: "GEOSEARCH Nowhere FROMMEMBER Nowhere BYRADIUS 200 km", want: "*0\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 FROMMEMBER Palermo BYRADIUS 200 km", want: "-ERR syntax error\r\n"},
+		{command: "GEOSEARCH Sicily BYRADIUS 200 km ASC WITHDIST", want: "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 ASC WITHDIST", want: "-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS -1 km", want: "-ERR radius cannot be negative\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 km COUNT 0", want: "-ERR COUNT must be > 0\r\n"},
+		{command: "GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 1 km ANY", want: "-ERR syntax error\r\n"},
+		{command: "GEOSEARCHSTORE dest Sicily FROMLONLAT 15 37 BYRADIUS 1 km WITHDIST", want: "-ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options\r\n"},
+		{command: "GEOSEARCHSTORE key1 Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC COUNT 3", want: ":3\r\n"},
+		{command: "GEOSEARCH key1 FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHHASH", want: "*3\r\n*2\r\n$7\r\nCatania\r\n:3479447370796909\r\n*2\r\n$7\r\nPalermo\r\n:3479099956230698\r\n*2\r\n$5\r\nedge2\r\n:3481342659049484\r\n"},
+		{command: "GEOSEARCHSTORE key2 Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC COUNT 3 STOREDIST", want: ":3\r\n"},
+		{command: "GEOSEARCHSTORE key2 Sicily FROMLONLAT 0 0 BYRADIUS 1 km", want: ":0\r\n"},
+		{command: "EXISTS key2", want: ":0\r\n"},
+		{command: "SET plain value", want: "+OK\r\n"},
+		{command: "GEOADD plain 13 38 a", want: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{command: "GEOPOS plain a", want: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{command: "GET Sicily", want: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{command: "INCR Sicily", want: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{command: "PFADD Sicily a", want: "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{command: "OBJECT ENCODING Sicily", want: "$8\r\nlistpack\r\n"},
+	}
+	for _, test := range tests {
+		if reply := client.do(t, test.command); reply != test.want {
+			t.Errorf("%s: want %q, got %q", test.command, test.want, reply)
+		}
+	}
+
+	// STOREDIST scores members by their distance in the unit of the search
+	var scores []string
+	client.do(t, "GEOSEARCHSTORE key2 Sicily FROMLONLAT 15 37 BYBOX 400 400 km ASC COUNT 3 STOREDIST")
+	server.store.(zsetStorer).ReadZSet(context.Background(), "key2", func(z *zset) error {
+		z.each(func(member string, score float64) bool {
+			scores = append(scores, fmt.Sprintf("%s %.4f", member, score))
+			return true
+		})
+		return nil
+	})
+	if got := strings.Join(scores, ", "); got != "Catania 56.4413, Palermo 190.4424, edge2 279.7403" {
+		t.Errorf("want distances as scores, got %s", got)
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	// searches return exactly the members within the shape, whatever the geohash areas visited
+	limits := zsetLimits{entries: 128, value: 64}
+	z := &zset{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		lon := r.Float64()*360 - 180
+		lat := r.Float64()*170 - 85
+		z.add(fmt.Sprint(i), geoScore(lon, lat), limits)
+	}
+
+	for i := 0; i < 200; i++ {
+		s := geoShape{lon: r.Float64()*360 - 180, lat: r.Float64()*170 - 85}
+		if i%2 == 0 {
+			s.radius = math.Pow(10, r.Float64()*7)
+		} else {
+			s.box = true
+			s.width = math.Pow(10, r.Float64()*7)
+			s.height = math.Pow(10, r.Float64()*7)
+		}
+
+		want := make(map[string]bool)
+		z.each(func(member string, score float64) bool {
+			if _, ok := s.contains(geoPosition(score)); ok {
+				want[member] = true
+			}
+			return true
+		})
+		results := geoSearch(z, s, 0)
+		got := make(map[string]bool)
+		for _, result := range results {
+			got[result.member] = true
+		}
+		if len(got) != len(results) || len(got) != len(want) {
+			t.Fatalf("%+v: want %d members, got %d (%d unique)", s, len(want), len(results), len(got))
+		}
+	}
+}
+
+func TestZSetEncoding(t *testing.T) {
+	limits := zsetLimits{entries: 4, value: 8}
+	z := &zset{}
+	for i, member := range []string{"d", "b", "a", "c"} {
+		z.add(member, float64(i%2), limits)
+	}
+	z.add("a", 5, limits)
+	if z.encoding() != encodingListpack {
+		t.Errorf("want listpack, got %s", z.encoding())
+	}
+	var order []string
+	z.each(func(member string, score float64) bool {
+		order = append(order, member)
+		return true
+	})
+	if got := strings.Join(order, ""); got != "dbca" {
+		t.Errorf("want members by score then name, got %s", got)
+	}
+
+	bytes := z.bytes
+	z.add("e", 0, limits)
+	if z.encoding() != encodingSkiplist || z.len() != 5 || z.bytes <= bytes {
+		t.Errorf("want skiplist of 5 after the limit, got %s of %d", z.encoding(), z.len())
+	}
+	order = order[:0]
+	z.rangeByScore(0, 1, func(member string, score float64) bool {
+		order = append(order, member)
+		return true
+	})
+	if got := strings.Join(order, ""); got != "de" {
+		t.Errorf("want de scored in [0, 1), got %s", got)
+	}
+
+	long := &zset{}
+	long.add("longer than eight", 1, limits)
+	if long.encoding() != encodingSkiplist {
+		t.Errorf("want skiplist for long members, got %s", long.encoding())
+	}
+}
+
+// Stores given in the options only need Storer, sorted set commands fail on them.
+func TestGeoStorer(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		Store:     struct{ Storer }{NewStore()},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	if reply := client.do(t, "GEOADD Sicily 13.361389 38.115556 Palermo"); reply != "-ERR sorted sets are not supported by the store\r\n" {
+		t.Errorf("want unsupported error, got %q", reply)
+	}
+	if reply := client.do(t, "SET foo bar"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+}
@@ -5,7 +5,6 @@ go 1.21.2
 require github.com/rs/zerolog v1.31.0
 
 require (
-	github.com/google/uuid v1.4.0
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,499 @@
+package cider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogs are kept in string values using the redis representation, so they
+// can be moved between cider and redis with DUMP and RESTORE. A 16 byte header
+// holds the "HYLL" magic, the encoding and the cached cardinality, followed by
+// 16384 registers of 6 bits, either dense or run length encoded (sparse).
+const (
+	hllP            = 14
+	hllQ            = 64 - hllP
+	hllRegisters    = 1 << hllP
+	hllBits         = 6
+	hllRegisterMax  = 1<<hllBits - 1
+	hllHeaderSize   = 16
+	hllDenseSize    = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense        = 0
+	hllSparse       = 1
+	hllAlphaInf     = 0.721347520444481703680
+	hllHashSeed     = 0xadc83b19
+	hllMagic        = "HYLL"
+	hllCacheInvalid = 1 << 7
+
+	// largest value and run length of a sparse VAL opcode
+	hllSparseValMax    = 32
+	hllSparseValMaxLen = 4
+	// longest run of a ZERO and an XZERO opcode
+	hllSparseZeroMaxLen  = 64
+	hllSparseXZeroMaxLen = 16384
+
+	// Sparse HyperLogLogs larger than this are converted to the dense encoding.
+	defaultHLLSparseMaxBytes = 3000
+)
+
+var (
+	errHLLType    = newCodedError("WRONGTYPE", "Key is not a valid HyperLogLog string value.")
+	errHLLCorrupt = newCodedError("INVALIDOBJ", "Corrupted HLL object detected")
+)
+
+type hllRegisterSet [hllRegisters]uint8
+
+// MurmurHash64A as used by redis, reading blocks as little endian.
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(data))*m
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// Returns the register an element maps to and the length of the run of zeros
+// after the register bits, plus one.
+func hllPosition(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, hllHashSeed)
+	index := int(hash & (hllRegisters - 1))
+	// the stop bit makes sure the count is at most hllQ+1
+	hash = hash>>hllP | 1<<hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+func denseRegister(registers []byte, i int) uint8 {
+	bit := i * hllBits
+	b, shift := bit/8, uint(bit%8)
+	v := uint(registers[b]) >> shift
+	if b+1 < len(registers) {
+		v |= uint(registers[b+1]) << (8 - shift)
+	}
+	return uint8(v & hllRegisterMax)
+}
+
+func setDenseRegister(registers []byte, i int, value uint8) {
+	bit := i * hllBits
+	b, shift := bit/8, uint(bit%8)
+	registers[b] &^= byte(hllRegisterMax << shift)
+	registers[b] |= byte(uint(value) << shift)
+	if b+1 < len(registers) {
+		registers[b+1] &^= byte(hllRegisterMax >> (8 - shift))
+		registers[b+1] |= byte(uint(value) >> (8 - shift))
+	}
+}
+
+// Checks the header of a HyperLogLog value.
+func hllEncoding(value []byte) (byte, error) {
+	if len(value) < hllHeaderSize || string(value[:4]) != hllMagic {
+		return 0, errHLLType
+	}
+	switch value[4] {
+	case hllDense:
+		if len(value) != hllDenseSize {
+			return 0, errHLLType
+		}
+	case hllSparse:
+	default:
+		return 0, errHLLType
+	}
+	return value[4], nil
+}
+
+// Merges the registers of a HyperLogLog value into r, keeping the largest values.
+func (r *hllRegisterSet) merge(value []byte) error {
+	encoding, err := hllEncoding(value)
+	if err != nil {
+		return err
+	}
+
+	if encoding == hllDense {
+		registers := value[hllHeaderSize:]
+		for i := range r {
+			r[i] = max(r[i], denseRegister(registers, i))
+		}
+		return nil
+	}
+
+	i := 0
+	for p := hllHeaderSize; p < len(value); p++ {
+		op := value[p]
+		switch {
+		// ZERO: 00xxxxxx, a run of up to 64 empty registers
+		case op&0xc0 == 0:
+			i += int(op&0x3f) + 1
+		// XZERO: 01xxxxxx yyyyyyyy, a run of up to 16384 empty registers
+		case op&0xc0 == 0x40:
+			p++
+			if p == len(value) {
+				return errHLLCorrupt
+			}
+			i += (int(op&0x3f)<<8 | int(value[p])) + 1
+		// VAL: 1vvvvvxx, a run of up to 4 registers set to vvvvv+1
+		default:
+			n := int(op&0x3) + 1
+			if i+n > hllRegisters {
+				return errHLLCorrupt
+			}
+			v := (op>>2)&0x1f + 1
+			for end := i + n; i < end; i++ {
+				r[i] = max(r[i], v)
+			}
+		}
+		if i > hllRegisters {
+			return errHLLCorrupt
+		}
+	}
+	if i != hllRegisters {
+		return errHLLCorrupt
+	}
+	return nil
+}
+
+// Encodes registers as a sparse value, false when a register does not fit or it would exceed maxBytes.
+func (r *hllRegisterSet) sparse(maxBytes int) ([]byte, bool) {
+	buf := make([]byte, hllHeaderSize, hllHeaderSize+64)
+	copy(buf, hllMagic)
+	buf[4] = hllSparse
+
+	for i := 0; i < hllRegisters; {
+		v := r[i]
+		run := 1
+		for i+run < hllRegisters && r[i+run] == v {
+			run++
+		}
+		i += run
+
+		if v > hllSparseValMax {
+			return nil, false
+		}
+		for run > 0 {
+			switch {
+			case v > 0:
+				n := min(run, hllSparseValMaxLen)
+				buf = append(buf, 0x80|(v-1)<<2|byte(n-1))
+				run -= n
+			case run > hllSparseZeroMaxLen:
+				n := min(run, hllSparseXZeroMaxLen)
+				buf = append(buf, 0x40|byte((n-1)>>8), byte(n-1))
+				run -= n
+			default:
+				buf = append(buf, byte(run-1))
+				run = 0
+			}
+		}
+		if len(buf) > maxBytes {
+			return nil, false
+		}
+	}
+	return buf, true
+}
+
+func (r *hllRegisterSet) dense() []byte {
+	buf := make([]byte, hllDenseSize)
+	copy(buf, hllMagic)
+	buf[4] = hllDense
+	for i, v := range r {
+		if v > 0 {
+			setDenseRegister(buf[hllHeaderSize:], i, v)
+		}
+	}
+	return buf
+}
+
+// Encodes registers sparse when possible, the cached cardinality is invalid.
+func (r *hllRegisterSet) encode(sparseMaxBytes int) []byte {
+	buf, ok := r.sparse(sparseMaxBytes)
+	if !ok {
+		buf = r.dense()
+	}
+	buf[15] |= hllCacheInvalid
+	return buf
+}
+
+// Estimates the cardinality with the improved estimator by Otmar Ertl used by redis.
+func (r *hllRegisterSet) count() uint64 {
+	var histogram [hllQ + 2]int
+	for _, v := range r {
+		histogram[v]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// Returns the cached cardinality of a HyperLogLog value, if it is valid.
+func hllCached(value []byte) (uint64, bool) {
+	if value[15]&hllCacheInvalid != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(value[8:16]), true
+}
+
+// Creates a HyperLogLog holding elements. Like redis an empty one has a valid cached cardinality of zero.
+func newHLL(elements []string, sparseMaxBytes int) []byte {
+	var r hllRegisterSet
+	if len(elements) == 0 {
+		// a single XZERO opcode, sparse whatever the limit
+		value, _ := r.sparse(hllDenseSize)
+		return value
+	}
+	for _, element := range elements {
+		i, count := hllPosition([]byte(element))
+		r[i] = max(r[i], count)
+	}
+	return r.encode(sparseMaxBytes)
+}
+
+// Adds elements to a HyperLogLog value. Returns the new value and whether a register changed.
+func hllAdd(value []byte, elements []string, sparseMaxBytes int) ([]byte, bool, error) {
+	encoding, err := hllEncoding(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// dense values are updated in a copy, the store may still be sending the original
+	if encoding == hllDense {
+		var updated []byte
+		for _, element := range elements {
+			i, count := hllPosition([]byte(element))
+			registers := value[hllHeaderSize:]
+			if updated != nil {
+				registers = updated[hllHeaderSize:]
+			}
+			if denseRegister(registers, i) >= count {
+				continue
+			}
+			if updated == nil {
+				updated = append([]byte(nil), value...)
+			}
+			setDenseRegister(updated[hllHeaderSize:], i, count)
+		}
+		if updated == nil {
+			return value, false, nil
+		}
+		updated[15] |= hllCacheInvalid
+		return updated, true, nil
+	}
+
+	var r hllRegisterSet
+	err = r.merge(value)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for _, element := range elements {
+		i, count := hllPosition([]byte(element))
+		if r[i] < count {
+			r[i] = count
+			changed = true
+		}
+	}
+	if !changed {
+		return value, false, nil
+	}
+	return r.encode(sparseMaxBytes), true, nil
+}
+
+func (srv *Server) hllSparseMaxBytes() int {
+	if n := srv.options().HLLSparseMaxBytes; n > 0 {
+		return int(n)
+	}
+	return defaultHLLSparseMaxBytes
+}
+
+func (s *Session) handlePfadd(store Storer, op opPfadd) []byte {
+	us, err := updateStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+	sparseMaxBytes := s.server.hllSparseMaxBytes()
+	changed := false
+	err = us.Update(s.ctx, op.key, func(value []byte, found bool) ([]byte, bool, error) {
+		if !found {
+			changed = true
+			return newHLL(op.elements, sparseMaxBytes), true, nil
+		}
+		updated, ok, err := hllAdd(value, op.elements, sparseMaxBytes)
+		changed = ok
+		return updated, ok, err
+	})
+	if err != nil {
+		return replyError(err)
+	}
+	if changed {
+		return replyInteger(1)
+	}
+	return replyInteger(0)
+}
+
+func (s *Session) handlePfcount(store Storer, op opPfcount) []byte {
+	// several keys are merged on the fly, their cached cardinalities do not help
+	if len(op.keys) > 1 {
+		var r hllRegisterSet
+		for _, key := range op.keys {
+			value, _, err := store.Get(s.ctx, key)
+			if err != nil && err.Error() == "key not found" {
+				continue
+			}
+			if err != nil {
+				return replyError(err)
+			}
+			err = r.merge(value)
+			if err != nil {
+				return replyError(err)
+			}
+		}
+		return replyInteger(int64(r.count()))
+	}
+
+	value, _, err := store.Get(s.ctx, op.keys[0])
+	if err != nil && err.Error() == "key not found" {
+		return replyInteger(0)
+	}
+	if err != nil {
+		return replyError(err)
+	}
+	_, err = hllEncoding(value)
+	if err != nil {
+		return replyError(err)
+	}
+	if card, ok := hllCached(value); ok {
+		return replyInteger(int64(card))
+	}
+
+	var r hllRegisterSet
+	err = r.merge(value)
+	if err != nil {
+		return replyError(err)
+	}
+	card := r.count()
+
+	// the cache is only stored if the value did not change meanwhile, failing to store it is harmless
+	cached := append([]byte(nil), value...)
+	binary.LittleEndian.PutUint64(cached[8:16], card)
+	if us, ok := store.(updateStorer); ok {
+		us.Update(s.ctx, op.keys[0], func(current []byte, found bool) ([]byte, bool, error) {
+			if !found || !bytes.Equal(current, value) {
+				return nil, false, nil
+			}
+			return cached, true, nil
+		})
+	}
+	return replyInteger(int64(card))
+}
+
+func (s *Session) handlePfmerge(store Storer, op opPfmerge) []byte {
+	us, err := updateStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+
+	var r hllRegisterSet
+	dense := false
+	for _, key := range op.sources {
+		value, _, err := store.Get(s.ctx, key)
+		if err != nil && err.Error() == "key not found" {
+			continue
+		}
+		if err != nil {
+			return replyError(err)
+		}
+		encoding, err := hllEncoding(value)
+		if err != nil {
+			return replyError(err)
+		}
+		dense = dense || encoding == hllDense
+		err = r.merge(value)
+		if err != nil {
+			return replyError(err)
+		}
+	}
+
+	// like redis the result stays sparse only when every input was sparse
+	sparseMaxBytes := s.server.hllSparseMaxBytes()
+	err = us.Update(s.ctx, op.dest, func(value []byte, found bool) ([]byte, bool, error) {
+		merged := r
+		dense := dense
+		if found {
+			encoding, err := hllEncoding(value)
+			if err != nil {
+				return nil, false, err
+			}
+			dense = dense || encoding == hllDense
+			err = merged.merge(value)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		if dense {
+			updated := merged.dense()
+			updated[15] |= hllCacheInvalid
+			return updated, true, nil
+		}
+		return merged.encode(sparseMaxBytes), true, nil
+	})
+	if err != nil {
+		return replyError(err)
+	}
+	return replyOK()
+}
@@ -0,0 +1,221 @@
+package cider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLogFormat(t *testing.T) {
+	// PFADD of an empty key in redis creates this value
+	want := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff"
+	if got := string(newHLL(nil, defaultHLLSparseMaxBytes)); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// sparse values survive a decode and encode round trip
+	elements := make([]string, 500)
+	for i := range elements {
+		elements[i] = strconv.Itoa(i)
+	}
+	value := newHLL(elements, defaultHLLSparseMaxBytes)
+	if encoding, _ := hllEncoding(value); encoding != hllSparse {
+		t.Fatalf("want sparse encoding, got %d", encoding)
+	}
+	var r hllRegisterSet
+	if err := r.merge(value); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.encode(defaultHLLSparseMaxBytes); string(got) != string(value) {
+		t.Errorf("want round trip to keep the value")
+	}
+	var d hllRegisterSet
+	if err := d.merge(r.dense()); err != nil {
+		t.Fatal(err)
+	}
+	if d != r {
+		t.Errorf("want dense round trip to keep the registers")
+	}
+
+	// adding to a full sparse value promotes it to dense
+	value, changed, err := hllAdd(value, []string{"more", "elements"}, 10)
+	if err != nil || !changed {
+		t.Fatalf("want changed value, got %v %v", changed, err)
+	}
+	if encoding, _ := hllEncoding(value); encoding != hllDense || len(value) != hllDenseSize {
+		t.Errorf("want dense encoding, got %d of %d bytes", encoding, len(value))
+	}
+	if _, changed, _ = hllAdd(value, []string{"more"}, 10); changed {
+		t.Errorf("want no change adding an element again")
+	}
+}
+
+func TestHyperLogLogError(t *testing.T) {
+	var r hllRegisterSet
+	n := 0
+	for _, cardinality := range []int{10, 100, 1000, 10000, 100000} {
+		for ; n < cardinality; n++ {
+			i, count := hllPosition([]byte("element:" + strconv.Itoa(n)))
+			r[i] = max(r[i], count)
+		}
+		estimate := float64(r.count())
+		if e := math.Abs(estimate-float64(cardinality)) / float64(cardinality); e > 0.03 {
+			t.Errorf("%d elements: estimate %v is off by %.2f%%", cardinality, estimate, e*100)
+		}
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "PFADD empty", want: ":1\r\n"},
+		{command: "PFADD empty", want: ":0\r\n"},
+		{command: "PFCOUNT empty", want: ":0\r\n"},
+		{command: "PFADD a x y z", want: ":1\r\n"},
+		{command: "PFADD a x", want: ":0\r\n"},
+		{command: "PFCOUNT a", want: ":3\r\n"},
+		{command: "PFADD b z w", want: ":1\r\n"},
+		{command: "PFCOUNT a b missing", want: ":4\r\n"},
+		{command: "PFMERGE c a b", want: "+OK\r\n"},
+		{command: "PFCOUNT c", want: ":4\r\n"},
+		{command: "PFMERGE c", want: "+OK\r\n"},
+		{command: "PFCOUNT c", want: ":4\r\n"},
+		{command: "PFMERGE new", want: "+OK\r\n"},
+		{command: "PFCOUNT new", want: ":0\r\n"},
+		{command: "SET plain value", want: "+OK\r\n"},
+		{command: "PFADD plain x", want: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{command: "PFCOUNT plain", want: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{command: "PFMERGE c plain", want: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{command: "PFMERGE plain a", want: "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"},
+		{command: "PFCOUNT", want: "-ERR wrong number of arguments for PFCOUNT\r\n"},
+	}
+	for _, test := range tests {
+		if reply := client.do(t, test.command); reply != test.want {
+			t.Errorf("%s: want %q, got %q", test.command, test.want, reply)
+		}
+	}
+
+	// PFCOUNT stores the cardinality in the header, PFADD invalidates it
+	value, _, _ := server.store.Get(context.Background(), "a")
+	if card, ok := hllCached(value); !ok || card != 3 {
+		t.Errorf("want cached cardinality 3, got %d %v", card, ok)
+	}
+	client.do(t, "PFADD a v")
+	value, _, _ = server.store.Get(context.Background(), "a")
+	if _, ok := hllCached(value); ok {
+		t.Errorf("want cache invalidated, got %q", value[8:16])
+	}
+	if reply := client.do(t, "PFCOUNT a"); reply != ":4\r\n" {
+		t.Errorf("want 4, got %q", reply)
+	}
+
+	// a sparse value whose opcodes run past the registers
+	corrupt := "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80" + strings.Repeat("\x7f\xff", 3)
+	server.store.Set(context.Background(), "corrupt", []byte(corrupt), -1)
+	if reply := client.do(t, "PFCOUNT corrupt"); !strings.HasPrefix(reply, "-INVALIDOBJ") {
+		t.Errorf("want INVALIDOBJ, got %q", reply)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners:         []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		HLLSparseMaxBytes: 100,
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	// sources overlap by half, one of them large enough to be dense
+	var a, b strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&a, " %d", i)
+		fmt.Fprintf(&b, " %d", i+1000)
+	}
+	client.do(t, "PFADD a"+a.String())
+	client.do(t, "PFADD b"+b.String())
+	client.do(t, "PFADD union"+a.String()+b.String())
+	client.do(t, "PFMERGE merged a b")
+
+	merged, _, _ := server.store.Get(context.Background(), "merged")
+	union, _, _ := server.store.Get(context.Background(), "union")
+	var m, u hllRegisterSet
+	m.merge(merged)
+	u.merge(union)
+	if m != u {
+		t.Errorf("want merged registers to equal the union")
+	}
+	if encoding, _ := hllEncoding(merged); encoding != hllDense {
+		t.Errorf("want dense result for dense sources, got %d", encoding)
+	}
+
+	// concurrent PFADDs to one key are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				server.store.(updateStorer).Update(context.Background(), "shared", func(value []byte, found bool) ([]byte, bool, error) {
+					element := []string{strconv.Itoa(i*50 + j)}
+					if !found {
+						return newHLL(element, 100), true, nil
+					}
+					return hllAdd(value, element, 100)
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if reply := client.do(t, "PFCOUNT shared"); reply != ":200\r\n" && reply != ":199\r\n" && reply != ":201\r\n" {
+		t.Errorf("want about 200, got %q", reply)
+	}
+}
+
+// Values read with GET and written back with SET are the same HyperLogLogs.
+func TestHyperLogLogSet(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	l, err := dialLink(context.Background(), server.Addrs()[0].String(), time.Second, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	padded := 0
+	for i := 0; i < 100; i++ {
+		key := "hll:" + strconv.Itoa(i)
+		for n := 0; n <= i; n++ {
+			l.do("PFADD", key, "element:"+strconv.Itoa(i*1000+n))
+		}
+		value, err := l.do("GET", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := value.(string); strings.TrimSpace(s) != s {
+			padded++
+		}
+		if _, err := l.do("SET", "copy", value.(string)); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := l.do("PFCOUNT", key)
+		count, err := l.do("PFCOUNT", "copy")
+		if err != nil || count != want {
+			t.Errorf("%s: want count %v, got %v (%v)", key, want, count, err)
+		}
+	}
+	if padded == 0 {
+		t.Error("want some values starting or ending with whitespace bytes")
+	}
+}
@@ -0,0 +1,287 @@
+package cider
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Redis version reported to clients, cider implements a subset of its commands.
+const redisVersion = "7.2.0"
+
+// Number of instantaneous ops/sec samples averaged, taken every opsSampleInterval.
+const (
+	opsSamples        = 16
+	opsSampleInterval = 100 * time.Millisecond
+)
+
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cluster", "keyspace"}
+
+// Sections shown by INFO in sentinel mode.
+var sentinelInfoSections = []string{"server", "clients", "stats", "sentinel"}
+
+type serverStats struct {
+	started     time.Time
+	connections atomic.Int64
+	rejected    atomic.Int64
+	commands    atomic.Int64
+	netInput    atomic.Int64
+	netOutput   atomic.Int64
+	// highest used memory seen by the sampling task
+	peakMemory atomic.Int64
+
+	mu           *sync.Mutex
+	samples      [opsSamples]float64
+	sampleIndex  int
+	lastCommands int64
+	lastSample   time.Time
+}
+
+func newServerStats() *serverStats {
+	now := time.Now()
+	return &serverStats{
+		started:    now,
+		mu:         &sync.Mutex{},
+		lastSample: now,
+	}
+}
+
+// Records the commands processed since the previous sample.
+func (st *serverStats) sample() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	commands := st.commands.Load()
+	elapsed := now.Sub(st.lastSample).Seconds()
+	if elapsed > 0 {
+		st.samples[st.sampleIndex] = float64(commands-st.lastCommands) / elapsed
+		st.sampleIndex = (st.sampleIndex + 1) % opsSamples
+	}
+	st.lastCommands = commands
+	st.lastSample = now
+}
+
+// Records used memory and returns the peak, including used.
+func (st *serverStats) notePeak(used int64) int64 {
+	for {
+		peak := st.peakMemory.Load()
+		if used <= peak {
+			return peak
+		}
+		if st.peakMemory.CompareAndSwap(peak, used) {
+			return used
+		}
+	}
+}
+
+func (st *serverStats) reset() {
+	st.connections.Store(0)
+	st.peakMemory.Store(0)
+	st.rejected.Store(0)
+	st.commands.Store(0)
+	st.netInput.Store(0)
+	st.netOutput.Store(0)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.samples = [opsSamples]float64{}
+	st.lastCommands = 0
+	st.lastSample = time.Now()
+}
+
+// Resets the statistics reported by INFO and the metrics endpoint, used by CONFIG RESETSTAT.
+func (srv *Server) resetStats() {
+	srv.stats.reset()
+	srv.commandStats.reset()
+	if ks, ok := srv.store.(keyspaceStorer); ok {
+		ks.ResetStats()
+	}
+	srv.repl.syncFull.Store(0)
+	srv.repl.syncPartialOK.Store(0)
+	srv.repl.syncPartialErr.Store(0)
+}
+
+func (st *serverStats) opsPerSecond() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sum := 0.0
+	for _, v := range st.samples {
+		sum += v
+	}
+	return int64(sum / opsSamples)
+}
+
+// Counts bytes read from a connection for total_net_input_bytes.
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// Counts bytes written to a connection for total_net_output_bytes.
+type countingWriter struct {
+	io.Writer
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+func humanBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// Renders INFO sections in the redis text format.
+func (srv *Server) info(sections []string) string {
+	stats := storeStats(srv.store)
+	now := time.Now()
+	uptime := int64(now.Sub(srv.stats.started).Seconds())
+
+	var sb strings.Builder
+	for _, section := range sections {
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		field := func(name string, value any) {
+			fmt.Fprintf(&sb, "%s:%v\r\n", name, value)
+		}
+
+		switch section {
+		case "server":
+			sb.WriteString("# Server\r\n")
+			field("redis_version", redisVersion)
+			mode := "standalone"
+			if srv.sentinel != nil {
+				mode = "sentinel"
+			}
+			if srv.cluster != nil {
+				mode = "cluster"
+			}
+			field("redis_mode", mode)
+			field("os", runtime.GOOS)
+			field("arch_bits", strconv.IntSize)
+			field("go_version", runtime.Version())
+			field("process_id", os.Getpid())
+			field("run_id", srv.runID)
+			field("uptime_in_seconds", uptime)
+			field("uptime_in_days", uptime/86400)
+		case "clients":
+			maxClients := srv.options().MaxClients
+			if maxClients == 0 {
+				maxClients = defaultMaxClients
+			}
+			sb.WriteString("# Clients\r\n")
+			field("connected_clients", srv.clients.count())
+			field("maxclients", maxClients)
+			field("blocked_clients", 0)
+		case "memory":
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			sb.WriteString("# Memory\r\n")
+			field("used_memory", stats.UsedMemory)
+			field("used_memory_human", humanBytes(stats.UsedMemory))
+			peak := srv.stats.notePeak(stats.UsedMemory)
+			field("used_memory_peak", peak)
+			field("used_memory_peak_human", humanBytes(peak))
+			field("used_memory_rss", mem.Sys)
+			field("used_memory_rss_human", humanBytes(int64(mem.Sys)))
+			field("maxmemory", stats.MaxMemory)
+			field("maxmemory_human", humanBytes(stats.MaxMemory))
+			field("maxmemory_policy", stats.Policy)
+		case "persistence":
+			// there is no persistence, report an idle instance so dashboards keep working
+			sb.WriteString("# Persistence\r\n")
+			field("loading", 0)
+			field("rdb_changes_since_last_save", 0)
+			field("rdb_bgsave_in_progress", 0)
+			field("rdb_last_save_time", srv.stats.started.Unix())
+			field("rdb_last_bgsave_status", "ok")
+			field("aof_enabled", 0)
+			field("aof_rewrite_in_progress", 0)
+			field("aof_last_write_status", "ok")
+		case "stats":
+			sb.WriteString("# Stats\r\n")
+			field("total_connections_received", srv.stats.connections.Load())
+			field("total_commands_processed", srv.stats.commands.Load())
+			field("instantaneous_ops_per_sec", srv.stats.opsPerSecond())
+			field("total_net_input_bytes", srv.stats.netInput.Load())
+			field("total_net_output_bytes", srv.stats.netOutput.Load())
+			field("rejected_connections", srv.stats.rejected.Load())
+			field("sync_full", srv.repl.syncFull.Load())
+			field("sync_partial_ok", srv.repl.syncPartialOK.Load())
+			field("sync_partial_err", srv.repl.syncPartialErr.Load())
+			field("expired_keys", stats.Expired)
+			field("evicted_keys", stats.Evicted)
+			field("keyspace_hits", stats.Hits)
+			field("keyspace_misses", stats.Misses)
+		case "replication":
+			sb.WriteString("# Replication\r\n")
+			srv.replicationInfo(field)
+		case "cluster":
+			sb.WriteString("# Cluster\r\n")
+			srv.clusterInfo(field)
+		case "sentinel":
+			sb.WriteString("# Sentinel\r\n")
+			srv.sentinel.info(field)
+		case "keyspace":
+			sb.WriteString("# Keyspace\r\n")
+			if stats.Keys > 0 {
+				fmt.Fprintf(&sb, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", stats.Keys, stats.Expires)
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+// Unknown sections are ignored like redis does, an empty string is returned when nothing matches.
+func (s *Session) handleInfo(op opInfo) []byte {
+	known := infoSections
+	if s.server.sentinel != nil {
+		known = sentinelInfoSections
+	}
+
+	var sections []string
+	if len(op.sections) == 0 {
+		sections = known
+	}
+	for _, section := range op.sections {
+		section = strings.ToLower(section)
+		switch section {
+		case "all", "everything", "default":
+			sections = known
+		default:
+			if slices.Contains(known, section) && !slices.Contains(sections, section) {
+				sections = append(sections, section)
+			}
+		}
+	}
+
+	return replyString([]byte(s.server.info(sections)))
+}
@@ -0,0 +1,58 @@
+package cider
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	client.do(t, "SET foo bar")
+	client.do(t, "SET baz qux EX 100")
+	client.do(t, "GET foo")
+	client.do(t, "GET missing")
+
+	reply := client.do(t, "INFO")
+	for _, want := range []string{
+		"# Server\r\n", "# Clients\r\n", "# Memory\r\n", "# Persistence\r\n", "# Stats\r\n", "# Keyspace\r\n",
+		"connected_clients:1\r\n",
+		"total_connections_received:1\r\n",
+		"total_commands_processed:5\r\n",
+		"keyspace_hits:1\r\n",
+		"keyspace_misses:1\r\n",
+		"maxmemory_policy:noeviction\r\n",
+		"db0:keys=2,expires=1,avg_ttl=0\r\n",
+	} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("want INFO to contain %q, got %q", want, reply)
+		}
+	}
+
+	tcs := []struct {
+		command string
+		want    []string
+		skip    []string
+	}{
+		{"INFO stats", []string{"# Stats\r\n"}, []string{"# Server\r\n", "# Keyspace\r\n"}},
+		{"INFO CLIENTS memory", []string{"# Clients\r\n", "# Memory\r\n"}, []string{"# Stats\r\n"}},
+		{"INFO everything", []string{"# Server\r\n", "# Keyspace\r\n"}, nil},
+		{"INFO unknown", nil, []string{"#"}},
+	}
+	for _, tc := range tcs {
+		reply := client.do(t, tc.command)
+		for _, want := range tc.want {
+			if !strings.Contains(reply, want) {
+				t.Errorf("%s: want %q, got %q", tc.command, want, reply)
+			}
+		}
+		for _, skip := range tc.skip {
+			if strings.Contains(reply, skip) {
+				t.Errorf("%s: want no %q, got %q", tc.command, skip, reply)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package cider
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of samples kept per latency event, like redis.
+const latencyHistoryLen = 160
+
+type latencySample struct {
+	time    int64
+	latency int64
+}
+
+type latencyEvent struct {
+	history []latencySample
+	max     int64
+}
+
+// Tracks latency spikes above a threshold per event, e.g. command or expire-cycle.
+type latencyMonitor struct {
+	mu *sync.Mutex
+	// read on every command, so kept outside the lock
+	threshold atomic.Int64
+	events    map[string]*latencyEvent
+}
+
+func newLatencyMonitor(threshold time.Duration) *latencyMonitor {
+	m := &latencyMonitor{
+		mu:     &sync.Mutex{},
+		events: make(map[string]*latencyEvent),
+	}
+	m.threshold.Store(int64(threshold))
+	return m
+}
+
+// Records a latency spike in milliseconds, samples within the same second are merged.
+func (m *latencyMonitor) add(event string, d time.Duration) {
+	threshold := time.Duration(m.threshold.Load())
+	if threshold <= 0 || d < threshold {
+		return
+	}
+
+	now := time.Now().Unix()
+	latency := d.Milliseconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		m.events[event] = e
+	}
+	e.max = max(e.max, latency)
+
+	if n := len(e.history); n > 0 && e.history[n-1].time == now {
+		e.history[n-1].latency = max(e.history[n-1].latency, latency)
+		return
+	}
+	e.history = append(e.history, latencySample{time: now, latency: latency})
+	if len(e.history) > latencyHistoryLen {
+		e.history = e.history[1:]
+	}
+}
+
+func (m *latencyMonitor) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.events))
+	for name := range m.events {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Returns a copy of the samples and the all time maximum of an event.
+func (m *latencyMonitor) history(event string) ([]latencySample, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.events[event]
+	if !ok {
+		return nil, 0
+	}
+	return slices.Clone(e.history), e.max
+}
+
+// Resets the given events, or every event when none are given. Returns the number of events reset.
+func (m *latencyMonitor) reset(events []string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(events) == 0 {
+		n := int64(len(m.events))
+		clear(m.events)
+		return n
+	}
+
+	n := int64(0)
+	for _, event := range events {
+		if _, ok := m.events[event]; ok {
+			delete(m.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// Human readable analysis of the recorded latency spikes.
+func (m *latencyMonitor) doctor() string {
+	threshold := time.Duration(m.threshold.Load())
+	if threshold <= 0 {
+		return "Latency monitoring is disabled in this instance. Set the latency monitor threshold to a value in milliseconds to enable it.\n"
+	}
+
+	names := m.names()
+	if len(names) == 0 {
+		return fmt.Sprintf("No latency spikes above the %dms threshold were observed.\n", threshold.Milliseconds())
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Latency spikes were observed for the following events:\n\n")
+	for i, name := range names {
+		history, worst := m.history(name)
+		if len(history) == 0 {
+			continue
+		}
+		sum := int64(0)
+		for _, sample := range history {
+			sum += sample.latency
+		}
+		avg := sum / int64(len(history))
+
+		fmt.Fprintf(&sb, "%d. %s: %d latency spikes (average %dms). Worst all time event %dms.\n",
+			i+1, name, len(history), avg, worst)
+	}
+
+	sb.WriteString("\nAdvices:\n")
+	for _, name := range names {
+		switch name {
+		case "command":
+			sb.WriteString("- Check SLOWLOG GET for slow commands and avoid commands that touch many keys at once.\n")
+		case "fast-command":
+			sb.WriteString("- O(1) commands were slow, the host may be overloaded or the process paused by the Go garbage collector.\n")
+		case "expire-cycle":
+			sb.WriteString("- Many keys expired at the same time, spread out the expire times of keys set together.\n")
+		}
+	}
+
+	return sb.String()
+}
+
+func (s *Session) handleLatency(op opLatency) []byte {
+	monitor := s.server.latency
+
+	switch op.subcommand {
+	case "LATEST":
+		var replies [][]byte
+		for _, name := range monitor.names() {
+			history, worst := monitor.history(name)
+			if len(history) == 0 {
+				continue
+			}
+			latest := history[len(history)-1]
+			replies = append(replies, replyArray([][]byte{
+				replyString([]byte(name)),
+				replyInteger(latest.time),
+				replyInteger(latest.latency),
+				replyInteger(worst),
+			}))
+		}
+		return replyArray(replies)
+
+	case "HISTORY":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for LATENCY HISTORY"))
+		}
+		history, _ := monitor.history(op.args[0])
+		replies := make([][]byte, 0, len(history))
+		for _, sample := range history {
+			replies = append(replies, replyArray([][]byte{
+				replyInteger(sample.time),
+				replyInteger(sample.latency),
+			}))
+		}
+		return replyArray(replies)
+
+	case "RESET":
+		return replyInteger(monitor.reset(op.args))
+
+	case "DOCTOR":
+		return replyString([]byte(monitor.doctor()))
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
@@ -0,0 +1,42 @@
+package cider
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners:               []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		LatencyMonitorThreshold: 10 * time.Millisecond,
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	server.latency.add("command", 25*time.Millisecond)
+	server.latency.add("command", 40*time.Millisecond)
+	server.latency.add("expire-cycle", 5*time.Millisecond)
+
+	reply := client.do(t, "LATENCY LATEST")
+	if !strings.HasPrefix(reply, "*1\r\n*4\r\n$7\r\ncommand\r\n:") || !strings.HasSuffix(reply, ":40\r\n:40\r\n") {
+		t.Errorf("unexpected latest %q", reply)
+	}
+
+	// samples within the same second are merged
+	reply = client.do(t, "LATENCY HISTORY command")
+	if !strings.HasPrefix(reply, "*1\r\n*2\r\n:") || !strings.HasSuffix(reply, ":40\r\n") {
+		t.Errorf("unexpected history %q", reply)
+	}
+
+	reply = client.do(t, "LATENCY DOCTOR")
+	if !strings.Contains(reply, "command: 1 latency spikes") {
+		t.Errorf("unexpected doctor %q", reply)
+	}
+
+	if reply := client.do(t, "LATENCY RESET command unknown"); reply != ":1\r\n" {
+		t.Errorf("want: :1, got %q", reply)
+	}
+	if reply := client.do(t, "LATENCY LATEST"); reply != "*0\r\n" {
+		t.Errorf("want empty array, got %q", reply)
+	}
+}
@@ -0,0 +1,163 @@
+package cider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error reply sent by another instance.
+type replyErr string
+
+func (e replyErr) Error() string {
+	return string(e)
+}
+
+// Outgoing connection to another instance. Commands are sent one at a time.
+type link struct {
+	mu      *sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// Connects to address, authenticating when password is set.
+func dialLink(ctx context.Context, address string, timeout time.Duration, user string, password string) (*link, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &link{
+		mu:      &sync.Mutex{},
+		conn:    conn,
+		reader:  bufio.NewReaderSize(conn, sessionBufferSize),
+		timeout: timeout,
+	}
+	if password != "" {
+		args := []string{"AUTH", password}
+		if user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		_, err := l.do(args...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Sends a command and waits for its reply. Error replies are returned as replyErr.
+func (l *link) do(args ...string) (any, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+	_, err := l.conn.Write(encodeCommand(args))
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readReply(l.reader)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(replyErr); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// Sends commands in one write and reads their replies in order. Error replies
+// are returned as replyErr values so every reply is read.
+func (l *link) pipeline(commands [][]string) ([]any, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf []byte
+	for _, args := range commands {
+		buf = append(buf, encodeCommand(args)...)
+	}
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+	_, err := l.conn.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, 0, len(commands))
+	for range commands {
+		reply, err := readReply(l.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+func (l *link) Close() error {
+	return l.conn.Close()
+}
+
+// Reads a RESP reply. Simple and bulk strings are returned as string, integers
+// as int64, arrays as []any, errors as replyErr and nil replies as nil.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r, maxInlineSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return replyErr(line[1:]), nil
+	case '_':
+		return nil, nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %s", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %s", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			value, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
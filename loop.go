@@ -0,0 +1,107 @@
+package cider
+
+import (
+	"sync"
+	"time"
+)
+
+// A command waiting for the event loop.
+type loopRequest struct {
+	session *Session
+	store   Storer
+	op      any
+	args    []string
+	write   bool
+	queued  time.Time
+}
+
+// Runs every command of every session on a single goroutine, like redis does.
+// Commands run one at a time, so no other command observes a command half done.
+// The loop does not own the keyspace: active expiry, WAIT, WAITAOF, metrics and a replica
+// loading a snapshot still reach the store from other goroutines, so commands on the loop
+// keep taking the shard locks. Uncontended, a lock costs 15 to 30ns against roughly 13us for
+// a command round trip, so the loop trades parallelism for atomicity and not for speed.
+type eventLoop struct {
+	// unbuffered, a request is accepted only once the loop is ready to run it
+	requests chan loopRequest
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     *sync.Once
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{
+		requests: make(chan loopRequest),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		once:     &sync.Once{},
+	}
+}
+
+// Stops the loop once the command it is running finished.
+func (l *eventLoop) close() {
+	l.once.Do(func() {
+		close(l.stop)
+	})
+}
+
+func (l *eventLoop) run() {
+	defer close(l.stopped)
+
+	for {
+		select {
+		case req := <-l.requests:
+			s := req.session
+			// time spent waiting for the loop is not execution time
+			s.blocked += time.Since(req.queued)
+			s.loopReply <- s.run(req.store, req.op, req.args, req.write)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Runs a command on the loop and waits for its reply. Once the loop stopped, commands run in place.
+func (l *eventLoop) submit(s *Session, store Storer, op any, args []string, write bool) []byte {
+	req := loopRequest{
+		session: s,
+		store:   store,
+		op:      op,
+		args:    args,
+		write:   write,
+		queued:  time.Now(),
+	}
+	select {
+	case l.requests <- req:
+		return <-s.loopReply
+	case <-l.stopped:
+		return s.run(store, op, args, write)
+	}
+}
+
+// Commands that wait for other clients run on their session, the loop must not block.
+// FUNCTION KILL and STATS have to get through while a function holds the loop.
+func loopCommand(op any) bool {
+	switch t := op.(type) {
+	case opWait, opWaitAof:
+		return false
+	case opFunction:
+		return t.subcommand != "KILL" && t.subcommand != "STATS"
+	}
+	return true
+}
+
+// Runs a command, on the event loop when the server uses one.
+func (s *Session) execute(store Storer, op any, args []string, write bool) []byte {
+	if l := s.server.loop; l != nil && loopCommand(op) {
+		return l.submit(s, store, op, args, write)
+	}
+	return s.run(store, op, args, write)
+}
+
+func (s *Session) run(store Storer, op any, args []string, write bool) []byte {
+	if write {
+		return s.dispatchWrite(store, op, args)
+	}
+	return s.dispatch(store, op)
+}
@@ -0,0 +1,144 @@
+package cider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventLoop(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		EventLoop: true,
+	})
+	addr := server.Addrs()[0].String()
+
+	client := dialTestClient(t, "tcp", addr)
+	if reply := client.do(t, "CONFIG GET event-loop"); reply != "*2\r\n$10\r\nevent-loop\r\n$3\r\nyes\r\n" {
+		t.Errorf("want event-loop yes, got %q", reply)
+	}
+	client.do(t, "SET counter 0")
+
+	// every increment from concurrent clients is applied
+	const clients, incrs = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := dialTestClient(t, "tcp", addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrs; j++ {
+				c.conn.Write([]byte("INCR counter\r\n"))
+				reply, err := readTestReply(c.reader)
+				if err != nil || strings.HasPrefix(reply, "-") {
+					t.Errorf("incr failed: %q %v", reply, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reply := client.do(t, "GET counter"); reply != "$4\r\n1600\r\n" {
+		t.Errorf("want 1600, got %q", reply)
+	}
+
+	// WAIT blocks its client only
+	if reply := client.do(t, "WAIT 1 50"); reply != ":0\r\n" {
+		t.Errorf("want :0, got %q", reply)
+	}
+
+	server.Close()
+	if _, err := readTestReply(client.reader); err == nil {
+		t.Error("want connection to be closed")
+	}
+}
+
+func benchmarkExecution(b *testing.B, eventLoop bool) {
+	server, err := NewServer(ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		EventLoop: eventLoop,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = server.Listen()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+	addr := server.Addrs()[0].String()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		// random keys out of 100000, like redis-benchmark -r 100000
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; pb.Next(); i++ {
+			key := fmt.Sprintf("key:%012d", random.Intn(100000))
+			command := encodeCommand([]string{"GET", key})
+			if i%4 == 0 {
+				command = encodeCommand([]string{"SET", key, "xxx"})
+			}
+			_, err := conn.Write(command)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			_, err = readTestReply(reader)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
+
+func BenchmarkExecutionGoroutines(b *testing.B) {
+	benchmarkExecution(b, false)
+}
+
+func BenchmarkExecutionEventLoop(b *testing.B) {
+	benchmarkExecution(b, true)
+}
+
+// A replica on the event loop loads a snapshot while its own replica syncs with it.
+func TestEventLoopChainedReplica(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{Listeners: listeners})
+	replica := startTestServer(t, ServerOptions{Listeners: listeners, EventLoop: true})
+	chained := startTestServer(t, ServerOptions{Listeners: listeners})
+
+	for i := 0; i < 100000; i++ {
+		primary.store.Set(context.Background(), "key:"+strconv.Itoa(i), []byte("value"), -1)
+	}
+
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+	c := dialTestClient(t, "tcp", chained.Addrs()[0].String())
+	host, port, _ := strings.Cut(primary.Addrs()[0].String(), ":")
+	r.do(t, "REPLICAOF "+host+" "+port)
+	waitForReply(t, r, "INFO replication", "master_sync_in_progress:1")
+	host, port, _ = strings.Cut(replica.Addrs()[0].String(), ":")
+	c.do(t, "REPLICAOF "+host+" "+port)
+
+	// the chained replica gets every key once the replica loaded them
+	waitForReply(t, c, "EXISTS key:0 key:99999", ":2\r\n")
+}
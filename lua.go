@@ -0,0 +1,1204 @@
+package cider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The function libraries run on a small interpreter for the subset of Lua 5.1
+// scripts use: locals, closures, tables, varargs and the usual statements,
+// without metatables, coroutines or goto. This file turns source into a tree.
+
+type luaTokenKind int
+
+const (
+	luaEOF luaTokenKind = iota
+	luaTokName
+	luaTokNumber
+	luaTokString
+	// keywords and operators, the text tells them apart
+	luaTokSymbol
+)
+
+type luaToken struct {
+	kind luaTokenKind
+	text string
+	num  float64
+	line int
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// Error in the source of a library, reported with its line like Lua does.
+type luaSyntaxError struct {
+	line    int
+	message string
+}
+
+func (e *luaSyntaxError) Error() string {
+	return fmt.Sprintf("user_function:%d: %s", e.line, e.message)
+}
+
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *luaLexer) fail(format string, args ...any) error {
+	return &luaSyntaxError{line: l.line, message: fmt.Sprintf(format, args...)}
+}
+
+func (l *luaLexer) peekByte(offset int) byte {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+// Skips whitespace and comments.
+func (l *luaLexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case c == '-' && l.peekByte(1) == '-':
+			l.pos += 2
+			if l.peekByte(0) == '[' {
+				if level := l.longBracket(); level >= 0 {
+					_, err := l.readLong(level)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns the level of a long bracket like [==[ at the current position, -1 if there is none.
+func (l *luaLexer) longBracket() int {
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1
+	}
+	return -1
+}
+
+// Reads a long string or comment starting at its opening bracket.
+func (l *luaLexer) readLong(level int) (string, error) {
+	l.pos += level + 2
+	// a newline right after the opening bracket is skipped
+	if l.peekByte(0) == '\r' {
+		l.pos++
+	}
+	if l.peekByte(0) == '\n' {
+		l.line++
+		l.pos++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end < 0 {
+		return "", l.fail("unfinished long string")
+	}
+	text := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(text, "\n")
+	l.pos += end + len(closing)
+	return text, nil
+}
+
+func (l *luaLexer) next() (luaToken, error) {
+	err := l.skip()
+	if err != nil {
+		return luaToken{}, err
+	}
+	if l.pos >= len(l.src) {
+		return luaToken{kind: luaEOF, line: l.line}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '_' || isLetter(c):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		text := l.src[start:l.pos]
+		if luaKeywords[text] {
+			return luaToken{kind: luaTokSymbol, text: text, line: l.line}, nil
+		}
+		return luaToken{kind: luaTokName, text: text, line: l.line}, nil
+
+	case isDigit(c) || (c == '.' && isDigit(l.peekByte(1))):
+		return l.readNumber()
+
+	case c == '"' || c == '\'':
+		return l.readString(c)
+
+	case c == '[':
+		if level := l.longBracket(); level >= 0 {
+			line := l.line
+			text, err := l.readLong(level)
+			if err != nil {
+				return luaToken{}, err
+			}
+			return luaToken{kind: luaTokString, text: text, line: line}, nil
+		}
+	}
+
+	for _, symbol := range []string{"...", "..", "==", "~=", "<=", ">="} {
+		if strings.HasPrefix(l.src[l.pos:], symbol) {
+			l.pos += len(symbol)
+			return luaToken{kind: luaTokSymbol, text: symbol, line: l.line}, nil
+		}
+	}
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", c) >= 0 {
+		l.pos++
+		return luaToken{kind: luaTokSymbol, text: string(c), line: l.line}, nil
+	}
+	return luaToken{}, l.fail("unexpected symbol near '%c'", c)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (l *luaLexer) readNumber() (luaToken, error) {
+	start := l.pos
+	if l.src[l.pos] == '0' && (l.peekByte(1) == 'x' || l.peekByte(1) == 'X') {
+		l.pos += 2
+	}
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if (c == '+' || c == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') && !strings.HasPrefix(l.src[start:], "0x") {
+			l.pos++
+			continue
+		}
+		if c != '.' && c != '_' && !isLetter(c) && !isDigit(c) {
+			break
+		}
+		l.pos++
+	}
+	text := l.src[start:l.pos]
+	n, ok := luaParseNumber(text)
+	if !ok {
+		return luaToken{}, l.fail("malformed number near '%s'", text)
+	}
+	return luaToken{kind: luaTokNumber, num: n, text: text, line: l.line}, nil
+}
+
+func (l *luaLexer) readString(quote byte) (luaToken, error) {
+	line := l.line
+	l.pos++
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return luaToken{}, l.fail("unfinished string")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == quote {
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if l.pos >= len(l.src) {
+			return luaToken{}, l.fail("unfinished string")
+		}
+		e := l.src[l.pos]
+		l.pos++
+		switch e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(e)
+		case '\n':
+			l.line++
+			b.WriteByte('\n')
+		default:
+			if !isDigit(e) {
+				return luaToken{}, l.fail("invalid escape sequence '\\%c'", e)
+			}
+			// up to three decimal digits
+			n := int(e - '0')
+			for i := 0; i < 2 && isDigit(l.peekByte(0)); i++ {
+				n = n*10 + int(l.src[l.pos]-'0')
+				l.pos++
+			}
+			if n > 255 {
+				return luaToken{}, l.fail("escape sequence too large")
+			}
+			b.WriteByte(byte(n))
+		}
+	}
+	return luaToken{kind: luaTokString, text: b.String(), line: line}, nil
+}
+
+// Converts a numeral like Lua does for both source and tonumber: decimal or hexadecimal.
+func luaParseNumber(text string) (float64, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, false
+	}
+	body := strings.TrimLeft(text, "+-")
+	if len(text)-len(body) > 1 {
+		return 0, false
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if text[0] == '-' {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	// Go accepts spellings Lua does not, like Inf or underscores
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if !isDigit(c) && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Expressions
+
+type luaExpr interface{}
+
+type luaConstExpr struct {
+	value any
+}
+
+type luaVarargExpr struct{}
+
+type luaNameExpr struct {
+	name string
+}
+
+type luaIndexExpr struct {
+	object luaExpr
+	key    luaExpr
+	line   int
+}
+
+type luaCallExpr struct {
+	fn   luaExpr
+	args []luaExpr
+	// set for obj:method(args), fn is then the object
+	method string
+	line   int
+}
+
+type luaFunctionExpr struct {
+	params []string
+	vararg bool
+	body   *luaBlock
+}
+
+type luaBinaryExpr struct {
+	op    string
+	left  luaExpr
+	right luaExpr
+	line  int
+}
+
+type luaUnaryExpr struct {
+	op   string
+	expr luaExpr
+	line int
+}
+
+type luaTableItem struct {
+	// nil for positional items
+	key   luaExpr
+	value luaExpr
+}
+
+type luaTableExpr struct {
+	items []luaTableItem
+}
+
+// An expression in parentheses, which keeps only the first value of a call.
+type luaParenExpr struct {
+	expr luaExpr
+}
+
+// Statements
+
+type luaStat interface{}
+
+type luaBlock struct {
+	stats []luaStat
+}
+
+type luaLocalStat struct {
+	names []string
+	exprs []luaExpr
+	line  int
+}
+
+type luaLocalFunctionStat struct {
+	name string
+	fn   *luaFunctionExpr
+}
+
+type luaAssignStat struct {
+	targets []luaExpr
+	exprs   []luaExpr
+	line    int
+}
+
+type luaCallStat struct {
+	call *luaCallExpr
+}
+
+type luaDoStat struct {
+	body *luaBlock
+}
+
+type luaWhileStat struct {
+	cond luaExpr
+	body *luaBlock
+	line int
+}
+
+type luaRepeatStat struct {
+	body *luaBlock
+	cond luaExpr
+	line int
+}
+
+type luaIfStat struct {
+	conds  []luaExpr
+	blocks []*luaBlock
+	// nil without an else branch
+	otherwise *luaBlock
+	line      int
+}
+
+type luaNumericForStat struct {
+	name  string
+	start luaExpr
+	stop  luaExpr
+	// nil for a step of 1
+	step luaExpr
+	body *luaBlock
+	line int
+}
+
+type luaGenericForStat struct {
+	names []string
+	exprs []luaExpr
+	body  *luaBlock
+	line  int
+}
+
+type luaReturnStat struct {
+	exprs []luaExpr
+	line  int
+}
+
+type luaBreakStat struct{}
+
+type luaParser struct {
+	lexer *luaLexer
+	tok   luaToken
+	ahead *luaToken
+	// loops enclosing the statement parsed in the current function, break needs one
+	loops int
+}
+
+// Parses a chunk, the body of an anonymous vararg function.
+func parseLua(src string) (*luaFunctionExpr, error) {
+	p := &luaParser{lexer: &luaLexer{src: src, line: 1}}
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != luaEOF {
+		return nil, p.unexpected()
+	}
+	return &luaFunctionExpr{vararg: true, body: body}, nil
+}
+
+func (p *luaParser) advance() error {
+	if p.ahead != nil {
+		p.tok = *p.ahead
+		p.ahead = nil
+		return nil
+	}
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *luaParser) peek() (luaToken, error) {
+	if p.ahead == nil {
+		tok, err := p.lexer.next()
+		if err != nil {
+			return luaToken{}, err
+		}
+		p.ahead = &tok
+	}
+	return *p.ahead, nil
+}
+
+func (p *luaParser) is(symbol string) bool {
+	return p.tok.kind == luaTokSymbol && p.tok.text == symbol
+}
+
+func (p *luaParser) unexpected() error {
+	near := p.tok.text
+	if p.tok.kind == luaEOF {
+		near = "<eof>"
+	}
+	return &luaSyntaxError{line: p.tok.line, message: fmt.Sprintf("unexpected symbol near '%s'", near)}
+}
+
+func (p *luaParser) expect(symbol string) error {
+	if !p.is(symbol) {
+		near := p.tok.text
+		if p.tok.kind == luaEOF {
+			near = "<eof>"
+		}
+		return &luaSyntaxError{line: p.tok.line, message: fmt.Sprintf("'%s' expected near '%s'", symbol, near)}
+	}
+	return p.advance()
+}
+
+func (p *luaParser) name() (string, error) {
+	if p.tok.kind != luaTokName {
+		return "", &luaSyntaxError{line: p.tok.line, message: fmt.Sprintf("<name> expected near '%s'", p.tok.text)}
+	}
+	name := p.tok.text
+	return name, p.advance()
+}
+
+// Tells whether the current token ends a block.
+func (p *luaParser) blockEnd() bool {
+	if p.tok.kind == luaEOF {
+		return true
+	}
+	return p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *luaParser) block() (*luaBlock, error) {
+	block := &luaBlock{}
+	for !p.blockEnd() {
+		if p.is("return") {
+			line := p.tok.line
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			var exprs []luaExpr
+			if !p.blockEnd() && !p.is(";") {
+				exprs, err = p.exprList()
+				if err != nil {
+					return nil, err
+				}
+			}
+			if p.is(";") {
+				err = p.advance()
+				if err != nil {
+					return nil, err
+				}
+			}
+			block.stats = append(block.stats, &luaReturnStat{exprs: exprs, line: line})
+			// return ends a block
+			if !p.blockEnd() {
+				return nil, p.unexpected()
+			}
+			break
+		}
+		stat, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if stat != nil {
+			block.stats = append(block.stats, stat)
+		}
+	}
+	return block, nil
+}
+
+// Parses the body of a loop.
+func (p *luaParser) loopBlock() (*luaBlock, error) {
+	p.loops++
+	defer func() { p.loops-- }()
+
+	return p.block()
+}
+
+func (p *luaParser) statement() (luaStat, error) {
+	line := p.tok.line
+	switch {
+	case p.is(";"):
+		return nil, p.advance()
+
+	case p.is("break"):
+		if p.loops == 0 {
+			return nil, &luaSyntaxError{line: line, message: "no loop to break"}
+		}
+		return &luaBreakStat{}, p.advance()
+
+	case p.is("do"):
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &luaDoStat{body: body}, p.expect("end")
+
+	case p.is("while"):
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect("do")
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.loopBlock()
+		if err != nil {
+			return nil, err
+		}
+		return &luaWhileStat{cond: cond, body: body, line: line}, p.expect("end")
+
+	case p.is("repeat"):
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.loopBlock()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect("until")
+		if err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &luaRepeatStat{body: body, cond: cond, line: line}, nil
+
+	case p.is("if"):
+		return p.ifStatement()
+
+	case p.is("for"):
+		return p.forStatement()
+
+	case p.is("function"):
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		// function a.b.c:m() assigns to a field, function a() to a variable
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		var target luaExpr = &luaNameExpr{name: name}
+		method := false
+		for p.is(".") || p.is(":") {
+			method = p.is(":")
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			target = &luaIndexExpr{object: target, key: &luaConstExpr{value: key}, line: line}
+			if method {
+				break
+			}
+		}
+		fn, err := p.functionBody(method)
+		if err != nil {
+			return nil, err
+		}
+		return &luaAssignStat{targets: []luaExpr{target}, exprs: []luaExpr{fn}, line: line}, nil
+
+	case p.is("local"):
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		if p.is("function") {
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			fn, err := p.functionBody(false)
+			if err != nil {
+				return nil, err
+			}
+			return &luaLocalFunctionStat{name: name, fn: fn}, nil
+		}
+		stat := &luaLocalStat{line: line}
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			stat.names = append(stat.names, name)
+			if !p.is(",") {
+				break
+			}
+			err = p.advance()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if p.is("=") {
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			stat.exprs, err = p.exprList()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return stat, nil
+	}
+
+	expr, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := expr.(*luaCallExpr); ok && !p.is("=") && !p.is(",") {
+		return &luaCallStat{call: call}, nil
+	}
+
+	targets := []luaExpr{expr}
+	for p.is(",") {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		target, err := p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	for _, target := range targets {
+		switch target.(type) {
+		case *luaNameExpr, *luaIndexExpr:
+		default:
+			return nil, &luaSyntaxError{line: line, message: "syntax error near '='"}
+		}
+	}
+	err = p.expect("=")
+	if err != nil {
+		return nil, err
+	}
+	exprs, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return &luaAssignStat{targets: targets, exprs: exprs, line: line}, nil
+}
+
+func (p *luaParser) ifStatement() (luaStat, error) {
+	stat := &luaIfStat{line: p.tok.line}
+	for p.is("if") || p.is("elseif") {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect("then")
+		if err != nil {
+			return nil, err
+		}
+		block, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stat.conds = append(stat.conds, cond)
+		stat.blocks = append(stat.blocks, block)
+	}
+	if p.is("else") {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		stat.otherwise, err = p.block()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stat, p.expect("end")
+}
+
+func (p *luaParser) forStatement() (luaStat, error) {
+	line := p.tok.line
+	err := p.advance()
+	if err != nil {
+		return nil, err
+	}
+	first, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.is("=") {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		stat := &luaNumericForStat{name: first, line: line}
+		stat.start, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect(",")
+		if err != nil {
+			return nil, err
+		}
+		stat.stop, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.is(",") {
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			stat.step, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = p.expect("do")
+		if err != nil {
+			return nil, err
+		}
+		stat.body, err = p.loopBlock()
+		if err != nil {
+			return nil, err
+		}
+		return stat, p.expect("end")
+	}
+
+	stat := &luaGenericForStat{names: []string{first}, line: line}
+	for p.is(",") {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		stat.names = append(stat.names, name)
+	}
+	err = p.expect("in")
+	if err != nil {
+		return nil, err
+	}
+	stat.exprs, err = p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	err = p.expect("do")
+	if err != nil {
+		return nil, err
+	}
+	stat.body, err = p.loopBlock()
+	if err != nil {
+		return nil, err
+	}
+	return stat, p.expect("end")
+}
+
+// Parses parameters and body after the function keyword and name. Methods get an implicit self.
+func (p *luaParser) functionBody(method bool) (*luaFunctionExpr, error) {
+	fn := &luaFunctionExpr{}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	for !p.is(")") {
+		if p.is("...") {
+			fn.vararg = true
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+		if !p.is(",") {
+			break
+		}
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = p.expect(")")
+	if err != nil {
+		return nil, err
+	}
+	// a function body starts outside of any loop
+	loops := p.loops
+	p.loops = 0
+	fn.body, err = p.block()
+	p.loops = loops
+	if err != nil {
+		return nil, err
+	}
+	return fn, p.expect("end")
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.is(",") {
+			return exprs, nil
+		}
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Left and right binding power of binary operators, from Lua 5.1.
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	// right associative
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const luaUnaryPriority = 8
+
+func (p *luaParser) expr() (luaExpr, error) {
+	return p.subExpr(0)
+}
+
+// Parses an expression whose binary operators bind tighter than limit.
+func (p *luaParser) subExpr(limit int) (luaExpr, error) {
+	var left luaExpr
+	if p.is("not") || p.is("-") || p.is("#") {
+		op, line := p.tok.text, p.tok.line
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		operand, err := p.subExpr(luaUnaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &luaUnaryExpr{op: op, expr: operand, line: line}
+	} else {
+		var err error
+		left, err = p.simpleExpr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for p.tok.kind == luaTokSymbol {
+		priority, ok := luaBinaryPriority[p.tok.text]
+		if !ok || priority[0] <= limit {
+			break
+		}
+		op, line := p.tok.text, p.tok.line
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.subExpr(priority[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &luaBinaryExpr{op: op, left: left, right: right, line: line}
+	}
+	return left, nil
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == luaTokNumber:
+		return &luaConstExpr{value: tok.num}, p.advance()
+	case tok.kind == luaTokString:
+		return &luaConstExpr{value: tok.text}, p.advance()
+	case p.is("nil"):
+		return &luaConstExpr{}, p.advance()
+	case p.is("true"):
+		return &luaConstExpr{value: true}, p.advance()
+	case p.is("false"):
+		return &luaConstExpr{value: false}, p.advance()
+	case p.is("..."):
+		return &luaVarargExpr{}, p.advance()
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.is("function"):
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		return p.functionBody(false)
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() (luaExpr, error) {
+	if p.tok.kind == luaTokName {
+		name := p.tok.text
+		return &luaNameExpr{name: name}, p.advance()
+	}
+	if p.is("(") {
+		err := p.advance()
+		if err != nil {
+			return nil, err
+		}
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &luaParenExpr{expr: expr}, p.expect(")")
+	}
+	return nil, p.unexpected()
+}
+
+// Parses a primary expression followed by fields, indexes and calls.
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	expr, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line := p.tok.line
+		switch {
+		case p.is("."):
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaIndexExpr{object: expr, key: &luaConstExpr{value: name}, line: line}
+
+		case p.is("["):
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			err = p.expect("]")
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaIndexExpr{object: expr, key: key, line: line}
+
+		case p.is(":"):
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			method, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCallExpr{fn: expr, args: args, method: method, line: line}
+
+		case p.is("(") || p.is("{") || p.tok.kind == luaTokString:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCallExpr{fn: expr, args: args, line: line}
+
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// Parses f(args), f{table} or f"string".
+func (p *luaParser) callArgs() ([]luaExpr, error) {
+	switch {
+	case p.tok.kind == luaTokString:
+		value := p.tok.text
+		return []luaExpr{&luaConstExpr{value: value}}, p.advance()
+	case p.is("{"):
+		table, err := p.tableConstructor()
+		if err != nil {
+			return nil, err
+		}
+		return []luaExpr{table}, nil
+	}
+
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	var args []luaExpr
+	if !p.is(")") {
+		args, err = p.exprList()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return args, p.expect(")")
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	err := p.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	table := &luaTableExpr{}
+	for !p.is("}") {
+		var item luaTableItem
+		switch {
+		case p.is("["):
+			err := p.advance()
+			if err != nil {
+				return nil, err
+			}
+			item.key, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+			err = p.expect("]")
+			if err != nil {
+				return nil, err
+			}
+			err = p.expect("=")
+			if err != nil {
+				return nil, err
+			}
+		case p.tok.kind == luaTokName:
+			next, err := p.peek()
+			if err != nil {
+				return nil, err
+			}
+			if next.kind == luaTokSymbol && next.text == "=" {
+				item.key = &luaConstExpr{value: p.tok.text}
+				err := p.advance()
+				if err != nil {
+					return nil, err
+				}
+				err = p.advance()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		item.value, err = p.expr()
+		if err != nil {
+			return nil, err
+		}
+		table.items = append(table.items, item)
+		if !p.is(",") && !p.is(";") {
+			break
+		}
+		err = p.advance()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return table, p.expect("}")
+}
@@ -0,0 +1,166 @@
+package cider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Runs a chunk and returns its first value, or the error it raised.
+func runLua(src string) (any, error) {
+	chunk, err := parseLua(src)
+	if err != nil {
+		return nil, err
+	}
+	globals, strs := newLuaGlobals()
+	l := &luaState{ctx: context.Background(), globals: globals, strings: strs}
+	values, err := l.call(&luaClosure{fn: chunk, scope: newLuaScope(nil)}, nil)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+func TestLua(t *testing.T) {
+	tests := []struct {
+		src  string
+		want any
+	}{
+		{src: "return 1 + 2 * 3 ^ 2", want: float64(19)},
+		{src: "return 2 ^ 3 ^ 2", want: float64(512)},
+		{src: "return -2 ^ 2", want: float64(-4)},
+		{src: "return 7 % -3", want: float64(-2)},
+		{src: "return 10 / 4", want: 2.5},
+		{src: "return 0x10 + 1e2", want: float64(116)},
+		{src: "return '10' + 1", want: float64(11)},
+		{src: "return 1 .. 2", want: "12"},
+		{src: "return 'a' < 'b' and 1 < 2 and not (2 <= 1)", want: true},
+		{src: "return nil or false", want: false},
+		{src: "return false and error('not evaluated')", want: false},
+		{src: "return #'hello' + #{1, 2, 3}", want: float64(8)},
+		{src: "return [[long\nstring]]", want: "long\nstring"},
+		{src: "return 'tab\\tnew\\nline\\65'", want: "tab\tnew\nlineA"},
+		{src: "-- comment\n--[[ long\ncomment ]] return 1", want: float64(1)},
+		{src: "local t = {} t.x = 1 t['y'] = 2 return t.x + t.y", want: float64(3)},
+		{src: "local t = {10, 20, x = 1, [3] = 30} return #t", want: float64(3)},
+		{src: "local a, b, c = (function() return 1, 2 end)() return c == nil", want: true},
+		{src: "local a, b = 1 return b == nil", want: true},
+		{src: "local a, b = 1, 2 a, b = b, a return a .. b", want: "21"},
+		{src: "local function f(n) if n < 2 then return n end return f(n-1) + f(n-2) end return f(15)", want: float64(610)},
+		{src: "local function f(...) return select('#', ...) end return f(1, nil, 3)", want: float64(3)},
+		{src: "local function f(...) local a, b = ... return b end return f(1, 2)", want: float64(2)},
+		{src: "local n = 0 for i = 1, 10, 3 do n = n + i end return n", want: float64(22)},
+		{src: "local n = 0 for i = 10, 1, -1 do if i == 5 then break end n = n + 1 end return n", want: float64(5)},
+		{src: "local n = 0 while true do n = n + 1 if n > 4 then break end end return n", want: float64(5)},
+		{src: "local n = 0 repeat local m = n n = n + 1 until m >= 3 return n", want: float64(4)},
+		{src: "local s = '' for i, v in ipairs({'a', 'b', nil, 'd'}) do s = s .. i .. v end return s", want: "1a2b"},
+		{src: "local n = 0 for k, v in pairs({a = 1, b = 2, 3}) do n = n + v end return n", want: float64(6)},
+		{src: "local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1]() + fs[3]()", want: float64(4)},
+		{src: "local function counter() local n = 0 return function() n = n + 1 return n end end local c = counter() c() return c()", want: float64(2)},
+		{src: "local t = {n = 2} function t.add(x) return x + 1 end function t:get() return self.n end return t.add(1) + t:get()", want: float64(4)},
+		{src: "local t = {n = 2} t.get = function(self) return self.n end return t:get()", want: float64(2)},
+		{src: "local s = 'Hello' return s:upper() .. s:len()", want: "HELLO5"},
+		{src: "return string.format('%d %s %5.2f %x %q', 42, 'x', 3.14159, 255, 'a\"b')", want: "42 x  3.14 ff \"a\\\"b\""},
+		{src: "return string.sub('hello', 2, -2) .. string.sub('hello', -3)", want: "ellllo"},
+		{src: "return string.rep('ab', 3)", want: "ababab"},
+		{src: "return string.find('a.b', '.', 1, true)", want: float64(2)},
+		{src: "return string.byte('A') + #string.char(72, 105)", want: float64(67)},
+		{src: "local t = {3, 1, 2} table.sort(t) return table.concat(t, ',')", want: "1,2,3"},
+		{src: "local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return table.concat(t, ',')", want: "3,2,1"},
+		{src: "local t = {} table.insert(t, 'b') table.insert(t, 1, 'a') return table.concat(t) .. table.remove(t)", want: "abb"},
+		{src: "return tostring(10 / 2) .. tostring(1 / 3) .. tostring(nil)", want: "50.33333333333333nil"},
+		{src: "return tonumber('0x1f') + tonumber('z', 36) + (tonumber('x') or 0)", want: float64(66)},
+		{src: "return math.max(1, 5, 3) + math.floor(-1.5) + math.fmod(7, 3)", want: float64(4)},
+		{src: "local ok, err = pcall(function() error('boom') end) return tostring(ok) .. err", want: "falseuser_function:1: boom"},
+		{src: "local ok, err = pcall(function() local x = nil return x.y end) return err", want: "user_function:1: attempt to index a nil value"},
+		{src: "return select(2, pcall(error, {code = 1})).code", want: float64(1)},
+		{src: "return type(tostring) .. type(nil) .. type({})", want: "functionniltable"},
+		{src: "return unpack({1, 2, 3})", want: float64(1)},
+		{src: "return rawequal({}, {})", want: false},
+	}
+	for _, test := range tests {
+		got, err := runLua(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: want %#v, got %#v", test.src, test.want, got)
+		}
+	}
+
+	errs := []struct {
+		src  string
+		want string
+	}{
+		{src: "return 1 +", want: "user_function:1: unexpected symbol near '<eof>'"},
+		{src: "x = = 1", want: "user_function:1: unexpected symbol near '='"},
+		{src: "local s = 'open", want: "user_function:1: unfinished string"},
+		{src: "\n\nreturn nosuch()", want: "user_function:3: Script attempted to access nonexistent global variable 'nosuch'"},
+		{src: "return {} .. 'x'", want: "user_function:1: attempt to concatenate a table value"},
+		{src: "return 1 < 'x'", want: "user_function:1: attempt to compare number with string"},
+		{src: "return ('x'):gsub('x', 'y')", want: "user_function:1: attempt to call a nil value"},
+		{src: "local function f() return f() + 1 end return f()", want: "stack overflow"},
+		{src: "error('plain')", want: "plain"},
+		{src: "break", want: "user_function:1: no loop to break"},
+	}
+	for _, test := range errs {
+		_, err := runLua(test.src)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: want error %q, got %v", test.src, test.want, err)
+		}
+	}
+}
+
+func TestLuaTable(t *testing.T) {
+	table := newLuaTable()
+	for i := 1; i <= 5; i++ {
+		table.set(float64(i), i)
+	}
+	table.set("key", "value")
+	if table.length() != 5 {
+		t.Errorf("want length 5, got %d", table.length())
+	}
+
+	// removing the last item shrinks the array, keys set out of order are moved into it
+	table.set(float64(5), nil)
+	table.set(float64(7), 7)
+	table.set(float64(6), 6)
+	if table.length() != 4 {
+		t.Errorf("want length 4, got %d", table.length())
+	}
+	table.set(float64(5), 5)
+	if table.length() != 7 {
+		t.Errorf("want length 7, got %d", table.length())
+	}
+
+	var keys []string
+	for key, _, _ := table.next(nil); key != nil; key, _, _ = table.next(key) {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	if got := strings.Join(keys, " "); got != "1 2 3 4 5 6 7 key" {
+		t.Errorf("want array keys before the others, got %s", got)
+	}
+
+	table.readonly = true
+	if err := table.set("key", 1); err == nil {
+		t.Errorf("want error setting a readonly table")
+	}
+}
+
+// Scripts stop once their context is done.
+func TestLuaCancel(t *testing.T) {
+	chunk, err := parseLua("while true do end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	globals, strs := newLuaGlobals()
+	l := &luaState{ctx: ctx, globals: globals, strings: strs}
+	_, err = l.call(&luaClosure{fn: chunk, scope: newLuaScope(nil)}, nil)
+	if err != context.Canceled {
+		t.Errorf("want context canceled, got %v", err)
+	}
+}
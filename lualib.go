@@ -0,0 +1,750 @@
+package cider
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The part of the Lua standard library scripts use. String patterns are not
+// supported, string.find only searches for plain text.
+
+// Creates the globals of a library: base functions and the string, table and math libraries.
+func newLuaGlobals() (globals *luaTable, stringLib *luaTable) {
+	globals = newLuaTable()
+	register := func(table *luaTable, name string, fn func(l *luaState, args []any) ([]any, error)) {
+		table.set(name, &luaGoFunction{name: name, fn: fn})
+	}
+
+	register(globals, "type", luaBaseType)
+	register(globals, "tostring", luaBaseToString)
+	register(globals, "tonumber", luaBaseToNumber)
+	register(globals, "error", luaBaseError)
+	register(globals, "assert", luaBaseAssert)
+	register(globals, "pcall", luaBasePcall)
+	register(globals, "select", luaBaseSelect)
+	register(globals, "next", luaBaseNext)
+	register(globals, "pairs", luaBasePairs)
+	register(globals, "ipairs", luaBaseIpairs)
+	register(globals, "unpack", luaBaseUnpack)
+	register(globals, "rawget", luaBaseRawGet)
+	register(globals, "rawset", luaBaseRawSet)
+	register(globals, "rawequal", func(l *luaState, args []any) ([]any, error) {
+		return []any{luaEqual(luaArg(args, 0), luaArg(args, 1))}, nil
+	})
+
+	stringLib = newLuaTable()
+	register(stringLib, "len", luaStringLen)
+	register(stringLib, "sub", luaStringSub)
+	register(stringLib, "upper", luaStringUpper)
+	register(stringLib, "lower", luaStringLower)
+	register(stringLib, "rep", luaStringRep)
+	register(stringLib, "reverse", luaStringReverse)
+	register(stringLib, "byte", luaStringByte)
+	register(stringLib, "char", luaStringChar)
+	register(stringLib, "find", luaStringFind)
+	register(stringLib, "format", luaStringFormat)
+	globals.set("string", stringLib)
+
+	tableLib := newLuaTable()
+	register(tableLib, "insert", luaTableInsert)
+	register(tableLib, "remove", luaTableRemove)
+	register(tableLib, "concat", luaTableConcat)
+	register(tableLib, "sort", luaTableSort)
+	register(tableLib, "getn", func(l *luaState, args []any) ([]any, error) {
+		t, err := luaCheckTable(l, args, 0, "getn")
+		if err != nil {
+			return nil, err
+		}
+		return []any{float64(t.length())}, nil
+	})
+	globals.set("table", tableLib)
+
+	mathLib := newLuaTable()
+	for name, fn := range map[string]func(float64) float64{
+		"abs": math.Abs, "ceil": math.Ceil, "floor": math.Floor, "sqrt": math.Sqrt,
+		"exp": math.Exp, "log": math.Log, "log10": math.Log10,
+		"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	} {
+		fn := fn
+		register(mathLib, name, func(l *luaState, args []any) ([]any, error) {
+			n, err := luaCheckNumber(l, args, 0, name)
+			if err != nil {
+				return nil, err
+			}
+			return []any{fn(n)}, nil
+		})
+	}
+	register(mathLib, "fmod", func(l *luaState, args []any) ([]any, error) {
+		a, err := luaCheckNumber(l, args, 0, "fmod")
+		if err != nil {
+			return nil, err
+		}
+		b, err := luaCheckNumber(l, args, 1, "fmod")
+		if err != nil {
+			return nil, err
+		}
+		return []any{math.Mod(a, b)}, nil
+	})
+	register(mathLib, "pow", func(l *luaState, args []any) ([]any, error) {
+		a, err := luaCheckNumber(l, args, 0, "pow")
+		if err != nil {
+			return nil, err
+		}
+		b, err := luaCheckNumber(l, args, 1, "pow")
+		if err != nil {
+			return nil, err
+		}
+		return []any{math.Pow(a, b)}, nil
+	})
+	register(mathLib, "max", func(l *luaState, args []any) ([]any, error) {
+		return luaMathExtreme(l, args, "max", func(a, b float64) bool { return a > b })
+	})
+	register(mathLib, "min", func(l *luaState, args []any) ([]any, error) {
+		return luaMathExtreme(l, args, "min", func(a, b float64) bool { return a < b })
+	})
+	mathLib.set("huge", math.Inf(1))
+	mathLib.set("pi", math.Pi)
+	globals.set("math", mathLib)
+
+	return globals, stringLib
+}
+
+func luaArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func luaArgError(l *luaState, i int, name string, message string) error {
+	return l.fail("bad argument #%d to '%s' (%s)", i+1, name, message)
+}
+
+func luaCheckNumber(l *luaState, args []any, i int, name string) (float64, error) {
+	n, ok := luaToNumber(luaArg(args, i))
+	if !ok {
+		return 0, luaArgError(l, i, name, fmt.Sprintf("number expected, got %s", luaType(luaArg(args, i))))
+	}
+	return n, nil
+}
+
+// Gets an optional integer argument, def when it is nil.
+func luaOptInt(l *luaState, args []any, i int, name string, def int) (int, error) {
+	if luaArg(args, i) == nil {
+		return def, nil
+	}
+	n, err := luaCheckNumber(l, args, i, name)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func luaCheckString(l *luaState, args []any, i int, name string) (string, error) {
+	s, ok := luaToString(luaArg(args, i))
+	if !ok {
+		return "", luaArgError(l, i, name, fmt.Sprintf("string expected, got %s", luaType(luaArg(args, i))))
+	}
+	return s, nil
+}
+
+func luaCheckTable(l *luaState, args []any, i int, name string) (*luaTable, error) {
+	t, ok := luaArg(args, i).(*luaTable)
+	if !ok {
+		return nil, luaArgError(l, i, name, fmt.Sprintf("table expected, got %s", luaType(luaArg(args, i))))
+	}
+	return t, nil
+}
+
+func luaBaseType(l *luaState, args []any) ([]any, error) {
+	if len(args) == 0 {
+		return nil, luaArgError(l, 0, "type", "value expected")
+	}
+	return []any{luaType(args[0])}, nil
+}
+
+func luaBaseToString(l *luaState, args []any) ([]any, error) {
+	value := luaArg(args, 0)
+	if s, ok := luaToString(value); ok {
+		return []any{s}, nil
+	}
+	switch v := value.(type) {
+	case nil:
+		return []any{"nil"}, nil
+	case bool:
+		return []any{strconv.FormatBool(v)}, nil
+	}
+	return []any{fmt.Sprintf("%s: %p", luaType(value), value)}, nil
+}
+
+func luaBaseToNumber(l *luaState, args []any) ([]any, error) {
+	value := luaArg(args, 0)
+	if luaArg(args, 1) == nil {
+		n, ok := luaToNumber(value)
+		if !ok {
+			return []any{nil}, nil
+		}
+		return []any{n}, nil
+	}
+	base, err := luaCheckNumber(l, args, 1, "tonumber")
+	if err != nil {
+		return nil, err
+	}
+	if base < 2 || base > 36 {
+		return nil, luaArgError(l, 1, "tonumber", "base out of range")
+	}
+	s, _ := luaToString(value)
+	n, err := strconv.ParseInt(strings.ToLower(strings.TrimSpace(s)), int(base), 64)
+	if err != nil {
+		return []any{nil}, nil
+	}
+	return []any{float64(n)}, nil
+}
+
+// Raises an error, strings get the position of the caller like error(msg, 1) does.
+func luaBaseError(l *luaState, args []any) ([]any, error) {
+	value := luaArg(args, 0)
+	level := 1
+	if luaArg(args, 1) != nil {
+		n, err := luaCheckNumber(l, args, 1, "error")
+		if err != nil {
+			return nil, err
+		}
+		level = int(n)
+	}
+	if s, ok := value.(string); ok && level > 0 {
+		value = fmt.Sprintf("user_function:%d: %s", l.line, s)
+	}
+	return nil, &luaError{value: value}
+}
+
+func luaBaseAssert(l *luaState, args []any) ([]any, error) {
+	if luaTruthy(luaArg(args, 0)) {
+		return args, nil
+	}
+	if len(args) > 1 {
+		return nil, &luaError{value: args[1]}
+	}
+	return nil, l.fail("assertion failed!")
+}
+
+// Calls a function, returning false and the error instead of raising it.
+// A killed script is not caught, it has to stop.
+func luaBasePcall(l *luaState, args []any) ([]any, error) {
+	if len(args) == 0 {
+		return nil, luaArgError(l, 0, "pcall", "value expected")
+	}
+	depth := l.depth
+	values, err := l.call(args[0], args[1:])
+	if err != nil {
+		var lerr *luaError
+		if !errors.As(err, &lerr) {
+			return nil, err
+		}
+		l.depth = depth
+		return []any{false, lerr.value}, nil
+	}
+	return append([]any{true}, values...), nil
+}
+
+func luaBaseSelect(l *luaState, args []any) ([]any, error) {
+	if s, ok := luaArg(args, 0).(string); ok && s == "#" {
+		return []any{float64(len(args) - 1)}, nil
+	}
+	n, err := luaCheckNumber(l, args, 0, "select")
+	if err != nil {
+		return nil, err
+	}
+	i := int(n)
+	if i < 0 {
+		i = len(args) + i
+	}
+	if i < 1 {
+		return nil, luaArgError(l, 0, "select", "index out of range")
+	}
+	if i >= len(args) {
+		return nil, nil
+	}
+	return args[i:], nil
+}
+
+func luaBaseNext(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "next")
+	if err != nil {
+		return nil, err
+	}
+	key, value, err := t.next(luaArg(args, 1))
+	if err != nil {
+		return nil, l.fail("%s", err)
+	}
+	if key == nil {
+		return []any{nil}, nil
+	}
+	return []any{key, value}, nil
+}
+
+func luaBasePairs(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "pairs")
+	if err != nil {
+		return nil, err
+	}
+	return []any{&luaGoFunction{name: "next", fn: luaBaseNext}, t, nil}, nil
+}
+
+func luaBaseIpairs(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "ipairs")
+	if err != nil {
+		return nil, err
+	}
+	iterator := &luaGoFunction{name: "ipairs", fn: func(l *luaState, args []any) ([]any, error) {
+		i, _ := luaToNumber(luaArg(args, 1))
+		value := t.get(i + 1)
+		if value == nil {
+			return []any{nil}, nil
+		}
+		return []any{i + 1, value}, nil
+	}}
+	return []any{iterator, t, float64(0)}, nil
+}
+
+func luaBaseUnpack(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "unpack")
+	if err != nil {
+		return nil, err
+	}
+	first, err := luaOptInt(l, args, 1, "unpack", 1)
+	if err != nil {
+		return nil, err
+	}
+	last, err := luaOptInt(l, args, 2, "unpack", t.length())
+	if err != nil {
+		return nil, err
+	}
+	if last-first >= 1<<20 {
+		return nil, l.fail("too many results to unpack")
+	}
+	var values []any
+	for i := first; i <= last; i++ {
+		values = append(values, t.get(float64(i)))
+	}
+	return values, nil
+}
+
+func luaBaseRawGet(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "rawget")
+	if err != nil {
+		return nil, err
+	}
+	return []any{t.get(luaArg(args, 1))}, nil
+}
+
+func luaBaseRawSet(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	err = t.set(luaArg(args, 1), luaArg(args, 2))
+	if err != nil {
+		return nil, l.fail("%s", err)
+	}
+	return []any{t}, nil
+}
+
+func luaStringLen(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "len")
+	if err != nil {
+		return nil, err
+	}
+	return []any{float64(len(s))}, nil
+}
+
+// Converts Lua string positions, 1 based and negative from the end, to a Go slice range.
+func luaStringRange(length int, i int, j int) (int, int) {
+	if i < 0 {
+		i = max(length+i+1, 1)
+	} else if i == 0 {
+		i = 1
+	}
+	if j < 0 {
+		j = length + j + 1
+	} else if j > length {
+		j = length
+	}
+	if i > j {
+		return 0, 0
+	}
+	return i - 1, j
+}
+
+func luaStringSub(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "sub")
+	if err != nil {
+		return nil, err
+	}
+	i, err := luaOptInt(l, args, 1, "sub", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := luaOptInt(l, args, 2, "sub", -1)
+	if err != nil {
+		return nil, err
+	}
+	start, end := luaStringRange(len(s), i, j)
+	return []any{s[start:end]}, nil
+}
+
+func luaStringUpper(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "upper")
+	if err != nil {
+		return nil, err
+	}
+	return []any{strings.ToUpper(s)}, nil
+}
+
+func luaStringLower(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "lower")
+	if err != nil {
+		return nil, err
+	}
+	return []any{strings.ToLower(s)}, nil
+}
+
+func luaStringRep(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "rep")
+	if err != nil {
+		return nil, err
+	}
+	n, err := luaCheckNumber(l, args, 1, "rep")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return []any{""}, nil
+	}
+	if float64(len(s))*n > 512<<20 {
+		return nil, l.fail("resulting string too large")
+	}
+	return []any{strings.Repeat(s, int(n))}, nil
+}
+
+func luaStringReverse(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "reverse")
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return []any{string(b)}, nil
+}
+
+func luaStringByte(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "byte")
+	if err != nil {
+		return nil, err
+	}
+	i, err := luaOptInt(l, args, 1, "byte", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := luaOptInt(l, args, 2, "byte", i)
+	if err != nil {
+		return nil, err
+	}
+	start, end := luaStringRange(len(s), i, j)
+	var values []any
+	for _, c := range []byte(s[start:end]) {
+		values = append(values, float64(c))
+	}
+	return values, nil
+}
+
+func luaStringChar(l *luaState, args []any) ([]any, error) {
+	b := make([]byte, len(args))
+	for i := range args {
+		n, err := luaCheckNumber(l, args, i, "char")
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, luaArgError(l, i, "char", "invalid value")
+		}
+		b[i] = byte(n)
+	}
+	return []any{string(b)}, nil
+}
+
+// Finds plain text, patterns with special characters fail unless plain is set.
+func luaStringFind(l *luaState, args []any) ([]any, error) {
+	s, err := luaCheckString(l, args, 0, "find")
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := luaCheckString(l, args, 1, "find")
+	if err != nil {
+		return nil, err
+	}
+	init, err := luaOptInt(l, args, 2, "find", 1)
+	if err != nil {
+		return nil, err
+	}
+	if !luaTruthy(luaArg(args, 3)) && strings.ContainsAny(pattern, "^$*+?.([%-") {
+		return nil, l.fail("string patterns are not supported, pass true as the 4th argument of string.find for a plain search")
+	}
+	if init < 0 {
+		init = max(len(s)+init+1, 1)
+	} else if init == 0 {
+		init = 1
+	}
+	if init > len(s)+1 {
+		return []any{nil}, nil
+	}
+	start := init - 1
+	i := strings.Index(s[start:], pattern)
+	if i < 0 {
+		return []any{nil}, nil
+	}
+	return []any{float64(start + i + 1), float64(start + i + len(pattern))}, nil
+}
+
+// Formats like string.format, with the directives of C printf Lua supports.
+func luaStringFormat(l *luaState, args []any) ([]any, error) {
+	format, err := luaCheckString(l, args, 0, "format")
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		// flags, width and precision are passed on to fmt, which reads them like printf
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			return nil, l.fail("invalid option '%%' to 'format'")
+		}
+		spec := "%" + format[start:i]
+		verb := format[i]
+		switch verb {
+		case 'd', 'i':
+			n, err := luaCheckNumber(l, args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+"d", int64(n))
+		case 'c':
+			n, err := luaCheckNumber(l, args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			b.WriteByte(byte(n))
+		case 'x', 'X', 'o':
+			n, err := luaCheckNumber(l, args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+string(verb), int64(n))
+		case 'e', 'E', 'f', 'g', 'G':
+			n, err := luaCheckNumber(l, args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+string(verb), n)
+		case 's':
+			s, ok := luaToString(luaArg(args, arg))
+			if !ok {
+				values, err := luaBaseToString(l, []any{luaArg(args, arg)})
+				if err != nil {
+					return nil, err
+				}
+				s = values[0].(string)
+			}
+			fmt.Fprintf(&b, spec+"s", s)
+		case 'q':
+			s, err := luaCheckString(l, args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(luaQuote(s))
+		default:
+			return nil, l.fail("invalid option '%%%c' to 'format'", verb)
+		}
+		arg++
+	}
+	return []any{b.String()}, nil
+}
+
+// Quotes a string so Lua reads it back, like %q does.
+func luaQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\000")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func luaTableInsert(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "insert")
+	if err != nil {
+		return nil, err
+	}
+	switch len(args) {
+	case 2:
+		return nil, luaTableSet(l, t, float64(t.length()+1), args[1])
+	case 3:
+		n := t.length()
+		pos, err := luaCheckNumber(l, args, 1, "insert")
+		if err != nil {
+			return nil, err
+		}
+		for i := n; i >= int(pos); i-- {
+			err := luaTableSet(l, t, float64(i+1), t.get(float64(i)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, luaTableSet(l, t, pos, args[2])
+	}
+	return nil, l.fail("wrong number of arguments to 'insert'")
+}
+
+func luaTableRemove(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "remove")
+	if err != nil {
+		return nil, err
+	}
+	n := t.length()
+	if n == 0 {
+		return []any{nil}, nil
+	}
+	pos, err := luaOptInt(l, args, 1, "remove", n)
+	if err != nil {
+		return nil, err
+	}
+	removed := t.get(float64(pos))
+	for i := pos; i < n; i++ {
+		err := luaTableSet(l, t, float64(i), t.get(float64(i+1)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []any{removed}, luaTableSet(l, t, float64(n), nil)
+}
+
+func luaTableSet(l *luaState, t *luaTable, key any, value any) error {
+	err := t.set(key, value)
+	if err != nil {
+		return l.fail("%s", err)
+	}
+	return nil
+}
+
+func luaTableConcat(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "concat")
+	if err != nil {
+		return nil, err
+	}
+	sep := ""
+	if luaArg(args, 1) != nil {
+		sep, err = luaCheckString(l, args, 1, "concat")
+		if err != nil {
+			return nil, err
+		}
+	}
+	first, err := luaOptInt(l, args, 2, "concat", 1)
+	if err != nil {
+		return nil, err
+	}
+	last, err := luaOptInt(l, args, 3, "concat", t.length())
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for i := first; i <= last; i++ {
+		s, ok := luaToString(t.get(float64(i)))
+		if !ok {
+			return nil, l.fail("invalid value (at index %d) in table for 'concat'", i)
+		}
+		if i > first {
+			b.WriteString(sep)
+		}
+		b.WriteString(s)
+	}
+	return []any{b.String()}, nil
+}
+
+func luaTableSort(l *luaState, args []any) ([]any, error) {
+	t, err := luaCheckTable(l, args, 0, "sort")
+	if err != nil {
+		return nil, err
+	}
+	less := luaArg(args, 1)
+	var sortErr error
+	sort.SliceStable(t.array, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		if less != nil {
+			values, err := l.call(less, []any{t.array[i], t.array[j]})
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			return len(values) > 0 && luaTruthy(values[0])
+		}
+		result, err := l.compare("<", t.array[i], t.array[j])
+		if err != nil {
+			sortErr = err
+			return false
+		}
+		return result.(bool)
+	})
+	return nil, sortErr
+}
+
+func luaMathExtreme(l *luaState, args []any, name string, better func(a, b float64) bool) ([]any, error) {
+	best, err := luaCheckNumber(l, args, 0, name)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := luaCheckNumber(l, args, i, name)
+		if err != nil {
+			return nil, err
+		}
+		if better(n, best) {
+			best = n
+		}
+	}
+	return []any{best}, nil
+}
@@ -0,0 +1,940 @@
+package cider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Runs the tree built by parseLua. Values are nil, bool, float64, string,
+// *luaTable, *luaClosure and *luaGoFunction.
+
+// Deepest nesting of calls before a script fails, like the C stack limit of Lua.
+const luaMaxCallDepth = 200
+
+// The context is checked once every so many statements, so a killed script stops soon.
+const luaCheckInterval = 1000
+
+type luaTable struct {
+	// values of the keys 1 to len(array)
+	array []any
+	// other keys in insertion order, removed keys stay as nil values until the next insert
+	keys   []any
+	values []any
+	index  map[any]int
+	// set on the globals of a library, scripts can't create globals
+	readonly bool
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{index: map[any]int{}}
+}
+
+// Normalizes a key, -0 and 0 are the same number.
+func luaKey(key any) any {
+	if n, ok := key.(float64); ok && n == 0 {
+		return float64(0)
+	}
+	return key
+}
+
+// Returns the array position of a key, or -1.
+func (t *luaTable) arrayIndex(key any) int {
+	n, ok := key.(float64)
+	if !ok || n < 1 || n != math.Trunc(n) || n > float64(len(t.array)+1) {
+		return -1
+	}
+	return int(n) - 1
+}
+
+func (t *luaTable) get(key any) any {
+	if i := t.arrayIndex(key); i >= 0 && i < len(t.array) {
+		return t.array[i]
+	}
+	if i, ok := t.index[luaKey(key)]; ok {
+		return t.values[i]
+	}
+	return nil
+}
+
+func (t *luaTable) set(key any, value any) error {
+	switch k := key.(type) {
+	case nil:
+		return errors.New("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			return errors.New("table index is NaN")
+		}
+	}
+	if t.readonly {
+		return errors.New("Attempt to modify a readonly table")
+	}
+
+	if i := t.arrayIndex(key); i >= 0 {
+		if i < len(t.array) {
+			t.array[i] = value
+			// keep the last array value non nil so the length is a border
+			for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+				t.array = t.array[:len(t.array)-1]
+			}
+			return nil
+		}
+		if value != nil {
+			t.hashSet(key, nil)
+			t.array = append(t.array, value)
+			// the following keys may have been stored in the hash part
+			for {
+				next := float64(len(t.array) + 1)
+				i, ok := t.index[next]
+				if !ok || t.values[i] == nil {
+					break
+				}
+				t.array = append(t.array, t.values[i])
+				t.values[i] = nil
+			}
+			return nil
+		}
+	}
+	t.hashSet(luaKey(key), value)
+	return nil
+}
+
+func (t *luaTable) hashSet(key any, value any) {
+	if i, ok := t.index[key]; ok {
+		t.values[i] = value
+		return
+	}
+	if value == nil {
+		return
+	}
+	// adding keys during a traversal is not allowed in Lua either, so compacting here is safe
+	if len(t.keys) >= 8 && len(t.index) > 2*t.liveKeys() {
+		t.compact()
+	}
+	t.index[key] = len(t.keys)
+	t.keys = append(t.keys, key)
+	t.values = append(t.values, value)
+}
+
+func (t *luaTable) liveKeys() int {
+	n := 0
+	for _, value := range t.values {
+		if value != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *luaTable) compact() {
+	keys, values := t.keys[:0], t.values[:0]
+	t.index = map[any]int{}
+	for i, key := range t.keys {
+		if t.values[i] != nil {
+			t.index[key] = len(keys)
+			keys = append(keys, key)
+			values = append(values, t.values[i])
+		}
+	}
+	t.keys, t.values = keys, values
+}
+
+func (t *luaTable) length() int {
+	return len(t.array)
+}
+
+// Returns the key and value following key in a traversal, nil when there are no more.
+func (t *luaTable) next(key any) (any, any, error) {
+	start := 0
+	if key != nil {
+		if i := t.arrayIndex(key); i >= 0 && i < len(t.array) {
+			start = i + 1
+		} else {
+			i, ok := t.index[luaKey(key)]
+			if !ok {
+				return nil, nil, errors.New("invalid key to 'next'")
+			}
+			start = len(t.array) + i + 1
+		}
+	}
+	for i := start; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i], nil
+		}
+	}
+	for i := max(start-len(t.array), 0); i < len(t.keys); i++ {
+		if t.values[i] != nil {
+			return t.keys[i], t.values[i], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// A function written in Lua with the variables it captured.
+type luaClosure struct {
+	fn    *luaFunctionExpr
+	scope *luaScope
+}
+
+// A function of the standard library or of the redis API.
+type luaGoFunction struct {
+	name string
+	fn   func(l *luaState, args []any) ([]any, error)
+}
+
+// An error raised by a script, with the value given to error(), caught by pcall.
+type luaError struct {
+	value any
+}
+
+func (e *luaError) Error() string {
+	if t, ok := e.value.(*luaTable); ok {
+		if msg, ok := t.get("err").(string); ok {
+			return msg
+		}
+	}
+	if s, ok := luaToString(e.value); ok {
+		return s
+	}
+	return fmt.Sprintf("(error object is a %s value)", luaType(e.value))
+}
+
+type luaCell struct {
+	value any
+}
+
+// Local variables of a block, blocks without locals share the scope of their parent.
+type luaScope struct {
+	vars   map[string]*luaCell
+	parent *luaScope
+}
+
+func (s *luaScope) lookup(name string) *luaCell {
+	for ; s != nil; s = s.parent {
+		if cell, ok := s.vars[name]; ok {
+			return cell
+		}
+	}
+	return nil
+}
+
+func (s *luaScope) declare(name string, value any) *luaScope {
+	s.vars[name] = &luaCell{value: value}
+	return s
+}
+
+func newLuaScope(parent *luaScope) *luaScope {
+	return &luaScope{vars: map[string]*luaCell{}, parent: parent}
+}
+
+// How a statement ended.
+type luaFlow int
+
+const (
+	luaFlowNormal luaFlow = iota
+	luaFlowBreak
+	luaFlowReturn
+)
+
+// One running script. States are not safe for concurrent use.
+type luaState struct {
+	ctx     context.Context
+	globals *luaTable
+	// the string library, indexed by string values for s:upper() and the like
+	strings *luaTable
+	depth   int
+	steps   int
+	line    int
+	// varargs of the function running
+	varargs []any
+	// the library loading, for redis.register_function
+	library *luaLibrary
+	// the function call running, for redis.call
+	run *functionRun
+}
+
+// Error raised by the interpreter itself, with the line of the statement running.
+func (l *luaState) fail(format string, args ...any) error {
+	return &luaError{value: fmt.Sprintf("user_function:%d: %s", l.line, fmt.Sprintf(format, args...))}
+}
+
+// Calls a function value with arguments.
+func (l *luaState) call(fn any, args []any) ([]any, error) {
+	switch f := fn.(type) {
+	case *luaGoFunction:
+		return f.fn(l, args)
+	case *luaClosure:
+		if l.depth >= luaMaxCallDepth {
+			return nil, l.fail("stack overflow")
+		}
+		l.depth++
+		defer func() { l.depth-- }()
+
+		scope := newLuaScope(f.scope)
+		for i, name := range f.fn.params {
+			var value any
+			if i < len(args) {
+				value = args[i]
+			}
+			scope.declare(name, value)
+		}
+		varargs := l.varargs
+		l.varargs = nil
+		if f.fn.vararg && len(args) > len(f.fn.params) {
+			l.varargs = args[len(f.fn.params):]
+		}
+		line := l.line
+		flow, values, err := l.execBlock(f.fn.body, scope)
+		l.varargs = varargs
+		// on errors the line stays the one that failed
+		if err != nil {
+			return nil, err
+		}
+		l.line = line
+		if flow == luaFlowReturn {
+			return values, nil
+		}
+		return nil, nil
+	}
+	return nil, l.fail("attempt to call a %s value", luaType(fn))
+}
+
+// Counts a step of the script, returning the error of its context once every so often.
+func (l *luaState) tick() error {
+	l.steps++
+	if l.steps%luaCheckInterval == 0 {
+		return l.ctx.Err()
+	}
+	return nil
+}
+
+// Runs a block, loops run their body through here so empty bodies are counted as well.
+func (l *luaState) execBlock(block *luaBlock, scope *luaScope) (luaFlow, []any, error) {
+	if err := l.tick(); err != nil {
+		return luaFlowNormal, nil, err
+	}
+	for _, stat := range block.stats {
+		flow, values, err := l.exec(stat, &scope)
+		if err != nil || flow != luaFlowNormal {
+			return flow, values, err
+		}
+	}
+	return luaFlowNormal, nil, nil
+}
+
+// Runs a statement. Locals it declares start a new scope, so closures created
+// before the declaration don't see them.
+func (l *luaState) exec(stat luaStat, scope **luaScope) (luaFlow, []any, error) {
+	if err := l.tick(); err != nil {
+		return luaFlowNormal, nil, err
+	}
+
+	switch s := stat.(type) {
+	case *luaLocalStat:
+		l.line = s.line
+		values, err := l.evalList(s.exprs, *scope)
+		if err != nil {
+			return luaFlowNormal, nil, err
+		}
+		next := newLuaScope(*scope)
+		for i, name := range s.names {
+			var value any
+			if i < len(values) {
+				value = values[i]
+			}
+			next.declare(name, value)
+		}
+		*scope = next
+		return luaFlowNormal, nil, nil
+
+	case *luaLocalFunctionStat:
+		// the function can call itself
+		next := newLuaScope(*scope).declare(s.name, nil)
+		next.vars[s.name].value = &luaClosure{fn: s.fn, scope: next}
+		*scope = next
+		return luaFlowNormal, nil, nil
+
+	case *luaAssignStat:
+		l.line = s.line
+		return luaFlowNormal, nil, l.assign(s, *scope)
+
+	case *luaCallStat:
+		_, err := l.evalCall(s.call, *scope)
+		return luaFlowNormal, nil, err
+
+	case *luaDoStat:
+		return l.execBlock(s.body, *scope)
+
+	case *luaWhileStat:
+		for {
+			l.line = s.line
+			cond, err := l.eval(s.cond, *scope)
+			if err != nil {
+				return luaFlowNormal, nil, err
+			}
+			if !luaTruthy(cond) {
+				return luaFlowNormal, nil, nil
+			}
+			flow, values, err := l.execBlock(s.body, *scope)
+			if err != nil || flow == luaFlowReturn {
+				return flow, values, err
+			}
+			if flow == luaFlowBreak {
+				return luaFlowNormal, nil, nil
+			}
+		}
+
+	case *luaRepeatStat:
+		for {
+			// the condition sees the locals of the body
+			if err := l.tick(); err != nil {
+				return luaFlowNormal, nil, err
+			}
+			inner := newLuaScope(*scope)
+			for _, stat := range s.body.stats {
+				flow, values, err := l.exec(stat, &inner)
+				if err != nil || flow == luaFlowReturn {
+					return flow, values, err
+				}
+				if flow == luaFlowBreak {
+					return luaFlowNormal, nil, nil
+				}
+			}
+			l.line = s.line
+			cond, err := l.eval(s.cond, inner)
+			if err != nil {
+				return luaFlowNormal, nil, err
+			}
+			if luaTruthy(cond) {
+				return luaFlowNormal, nil, nil
+			}
+		}
+
+	case *luaIfStat:
+		l.line = s.line
+		for i, expr := range s.conds {
+			cond, err := l.eval(expr, *scope)
+			if err != nil {
+				return luaFlowNormal, nil, err
+			}
+			if luaTruthy(cond) {
+				return l.execBlock(s.blocks[i], *scope)
+			}
+		}
+		if s.otherwise != nil {
+			return l.execBlock(s.otherwise, *scope)
+		}
+		return luaFlowNormal, nil, nil
+
+	case *luaNumericForStat:
+		return l.execNumericFor(s, *scope)
+
+	case *luaGenericForStat:
+		return l.execGenericFor(s, *scope)
+
+	case *luaReturnStat:
+		l.line = s.line
+		values, err := l.evalList(s.exprs, *scope)
+		return luaFlowReturn, values, err
+
+	case *luaBreakStat:
+		return luaFlowBreak, nil, nil
+	}
+	return luaFlowNormal, nil, fmt.Errorf("unknown statement %T", stat)
+}
+
+func (l *luaState) execNumericFor(s *luaNumericForStat, scope *luaScope) (luaFlow, []any, error) {
+	l.line = s.line
+	bounds := []luaExpr{s.start, s.stop, &luaConstExpr{value: float64(1)}}
+	if s.step != nil {
+		bounds[2] = s.step
+	}
+	var numbers [3]float64
+	for i, name := range []string{"initial", "limit", "step"} {
+		value, err := l.eval(bounds[i], scope)
+		if err != nil {
+			return luaFlowNormal, nil, err
+		}
+		n, ok := luaToNumber(value)
+		if !ok {
+			return luaFlowNormal, nil, l.fail("'for' %s value must be a number", name)
+		}
+		numbers[i] = n
+	}
+	start, stop, step := numbers[0], numbers[1], numbers[2]
+	if step == 0 {
+		return luaFlowNormal, nil, l.fail("'for' step is zero")
+	}
+
+	for i := start; (step > 0 && i <= stop) || (step < 0 && i >= stop); i += step {
+		// every iteration gets its own variable for closures to capture
+		flow, values, err := l.execBlock(s.body, newLuaScope(scope).declare(s.name, i))
+		if err != nil || flow == luaFlowReturn {
+			return flow, values, err
+		}
+		if flow == luaFlowBreak {
+			break
+		}
+	}
+	return luaFlowNormal, nil, nil
+}
+
+func (l *luaState) execGenericFor(s *luaGenericForStat, scope *luaScope) (luaFlow, []any, error) {
+	l.line = s.line
+	values, err := l.evalList(s.exprs, scope)
+	if err != nil {
+		return luaFlowNormal, nil, err
+	}
+	values = append(values, nil, nil, nil)
+	iterator, state, control := values[0], values[1], values[2]
+
+	for {
+		results, err := l.call(iterator, []any{state, control})
+		if err != nil {
+			return luaFlowNormal, nil, err
+		}
+		if len(results) == 0 || results[0] == nil {
+			return luaFlowNormal, nil, nil
+		}
+		control = results[0]
+
+		inner := newLuaScope(scope)
+		for i, name := range s.names {
+			var value any
+			if i < len(results) {
+				value = results[i]
+			}
+			inner.declare(name, value)
+		}
+		flow, values, err := l.execBlock(s.body, inner)
+		if err != nil || flow == luaFlowReturn {
+			return flow, values, err
+		}
+		if flow == luaFlowBreak {
+			return luaFlowNormal, nil, nil
+		}
+	}
+}
+
+func (l *luaState) assign(s *luaAssignStat, scope *luaScope) error {
+	// targets are evaluated before any is assigned, a, b = b, a swaps
+	type target struct {
+		cell  *luaCell
+		table *luaTable
+		name  string
+		key   any
+	}
+	targets := make([]target, len(s.targets))
+	for i, expr := range s.targets {
+		switch t := expr.(type) {
+		case *luaNameExpr:
+			if cell := scope.lookup(t.name); cell != nil {
+				targets[i].cell = cell
+				continue
+			}
+			targets[i].table = l.globals
+			targets[i].name = t.name
+			targets[i].key = t.name
+		case *luaIndexExpr:
+			object, err := l.eval(t.object, scope)
+			if err != nil {
+				return err
+			}
+			key, err := l.eval(t.key, scope)
+			if err != nil {
+				return err
+			}
+			table, ok := object.(*luaTable)
+			if !ok {
+				return l.fail("attempt to index a %s value", luaType(object))
+			}
+			targets[i].table = table
+			targets[i].key = key
+		}
+	}
+
+	values, err := l.evalList(s.exprs, scope)
+	if err != nil {
+		return err
+	}
+	for i, t := range targets {
+		var value any
+		if i < len(values) {
+			value = values[i]
+		}
+		if t.cell != nil {
+			t.cell.value = value
+			continue
+		}
+		err := t.table.set(t.key, value)
+		if err != nil {
+			if t.table == l.globals {
+				return l.fail("Attempt to modify a readonly table, use local variables instead of the global '%s'", t.name)
+			}
+			return l.fail("%s", err)
+		}
+	}
+	return nil
+}
+
+// Evaluates expressions, the last one can give several values.
+func (l *luaState) evalList(exprs []luaExpr, scope *luaScope) ([]any, error) {
+	values := make([]any, 0, len(exprs))
+	for i, expr := range exprs {
+		if i == len(exprs)-1 {
+			last, err := l.evalMulti(expr, scope)
+			if err != nil {
+				return nil, err
+			}
+			return append(values, last...), nil
+		}
+		value, err := l.eval(expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Evaluates an expression to all its values, several for calls and varargs.
+func (l *luaState) evalMulti(expr luaExpr, scope *luaScope) ([]any, error) {
+	switch e := expr.(type) {
+	case *luaCallExpr:
+		return l.evalCall(e, scope)
+	case *luaVarargExpr:
+		return l.varargs, nil
+	}
+	value, err := l.eval(expr, scope)
+	if err != nil {
+		return nil, err
+	}
+	return []any{value}, nil
+}
+
+// Evaluates an expression to a single value.
+func (l *luaState) eval(expr luaExpr, scope *luaScope) (any, error) {
+	switch e := expr.(type) {
+	case *luaConstExpr:
+		return e.value, nil
+
+	case *luaVarargExpr:
+		if len(l.varargs) == 0 {
+			return nil, nil
+		}
+		return l.varargs[0], nil
+
+	case *luaNameExpr:
+		if cell := scope.lookup(e.name); cell != nil {
+			return cell.value, nil
+		}
+		value := l.globals.get(e.name)
+		if value == nil {
+			return nil, l.fail("Script attempted to access nonexistent global variable '%s'", e.name)
+		}
+		return value, nil
+
+	case *luaIndexExpr:
+		object, err := l.eval(e.object, scope)
+		if err != nil {
+			return nil, err
+		}
+		key, err := l.eval(e.key, scope)
+		if err != nil {
+			return nil, err
+		}
+		l.line = e.line
+		return l.index(object, key)
+
+	case *luaCallExpr:
+		values, err := l.evalCall(e, scope)
+		if err != nil || len(values) == 0 {
+			return nil, err
+		}
+		return values[0], nil
+
+	case *luaParenExpr:
+		return l.eval(e.expr, scope)
+
+	case *luaFunctionExpr:
+		return &luaClosure{fn: e, scope: scope}, nil
+
+	case *luaTableExpr:
+		return l.evalTable(e, scope)
+
+	case *luaUnaryExpr:
+		value, err := l.eval(e.expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		l.line = e.line
+		switch e.op {
+		case "not":
+			return !luaTruthy(value), nil
+		case "-":
+			n, ok := luaToNumber(value)
+			if !ok {
+				return nil, l.fail("attempt to perform arithmetic on a %s value", luaType(value))
+			}
+			return -n, nil
+		case "#":
+			switch v := value.(type) {
+			case string:
+				return float64(len(v)), nil
+			case *luaTable:
+				return float64(v.length()), nil
+			}
+			return nil, l.fail("attempt to get length of a %s value", luaType(value))
+		}
+
+	case *luaBinaryExpr:
+		return l.evalBinary(e, scope)
+	}
+	return nil, fmt.Errorf("unknown expression %T", expr)
+}
+
+func (l *luaState) index(object any, key any) (any, error) {
+	switch o := object.(type) {
+	case *luaTable:
+		return o.get(key), nil
+	case string:
+		return l.strings.get(key), nil
+	}
+	return nil, l.fail("attempt to index a %s value", luaType(object))
+}
+
+func (l *luaState) evalCall(e *luaCallExpr, scope *luaScope) ([]any, error) {
+	l.line = e.line
+	fn, err := l.eval(e.fn, scope)
+	if err != nil {
+		return nil, err
+	}
+	var self []any
+	if e.method != "" {
+		self = []any{fn}
+		l.line = e.line
+		fn, err = l.index(fn, e.method)
+		if err != nil {
+			return nil, err
+		}
+	}
+	args, err := l.evalList(e.args, scope)
+	if err != nil {
+		return nil, err
+	}
+	if self != nil {
+		args = append(self, args...)
+	}
+	l.line = e.line
+	return l.call(fn, args)
+}
+
+func (l *luaState) evalTable(e *luaTableExpr, scope *luaScope) (any, error) {
+	table := newLuaTable()
+	position := 1
+	for i, item := range e.items {
+		if item.key != nil {
+			key, err := l.eval(item.key, scope)
+			if err != nil {
+				return nil, err
+			}
+			value, err := l.eval(item.value, scope)
+			if err != nil {
+				return nil, err
+			}
+			err = table.set(key, value)
+			if err != nil {
+				return nil, l.fail("%s", err)
+			}
+			continue
+		}
+
+		// the last positional item expands to all its values
+		var values []any
+		if i == len(e.items)-1 {
+			var err error
+			values, err = l.evalMulti(item.value, scope)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value, err := l.eval(item.value, scope)
+			if err != nil {
+				return nil, err
+			}
+			values = []any{value}
+		}
+		for _, value := range values {
+			table.set(float64(position), value)
+			position++
+		}
+	}
+	return table, nil
+}
+
+func (l *luaState) evalBinary(e *luaBinaryExpr, scope *luaScope) (any, error) {
+	left, err := l.eval(e.left, scope)
+	if err != nil {
+		return nil, err
+	}
+	// and, or only evaluate their right side when needed
+	switch e.op {
+	case "and":
+		if !luaTruthy(left) {
+			return left, nil
+		}
+		return l.eval(e.right, scope)
+	case "or":
+		if luaTruthy(left) {
+			return left, nil
+		}
+		return l.eval(e.right, scope)
+	}
+	right, err := l.eval(e.right, scope)
+	if err != nil {
+		return nil, err
+	}
+	l.line = e.line
+
+	switch e.op {
+	case "==":
+		return luaEqual(left, right), nil
+	case "~=":
+		return !luaEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		return l.compare(e.op, left, right)
+	case "..":
+		a, ok := luaToString(left)
+		if !ok {
+			return nil, l.fail("attempt to concatenate a %s value", luaType(left))
+		}
+		b, ok := luaToString(right)
+		if !ok {
+			return nil, l.fail("attempt to concatenate a %s value", luaType(right))
+		}
+		return a + b, nil
+	}
+
+	a, ok := luaToNumber(left)
+	if !ok {
+		return nil, l.fail("attempt to perform arithmetic on a %s value", luaType(left))
+	}
+	b, ok := luaToNumber(right)
+	if !ok {
+		return nil, l.fail("attempt to perform arithmetic on a %s value", luaType(right))
+	}
+	switch e.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", e.op)
+}
+
+// Compares numbers or strings, a > b is evaluated as b < a like Lua does.
+func (l *luaState) compare(op string, left any, right any) (any, error) {
+	if op == ">" || op == ">=" {
+		op = "<" + op[1:]
+		left, right = right, left
+	}
+	switch a := left.(type) {
+	case float64:
+		if b, ok := right.(float64); ok {
+			return a < b || (op == "<=" && a == b), nil
+		}
+	case string:
+		if b, ok := right.(string); ok {
+			return a < b || (op == "<=" && a == b), nil
+		}
+	}
+	if luaType(left) == luaType(right) {
+		return nil, l.fail("attempt to compare two %s values", luaType(left))
+	}
+	return nil, l.fail("attempt to compare %s with %s", luaType(left), luaType(right))
+}
+
+func luaTruthy(value any) bool {
+	return value != nil && value != false
+}
+
+func luaEqual(a any, b any) bool {
+	return a == b
+}
+
+func luaType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Converts numbers and numeric strings, like Lua does for arithmetic.
+func luaToNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		return luaParseNumber(v)
+	}
+	return 0, false
+}
+
+// Converts strings and numbers, like Lua does for concatenation.
+func luaToString(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return luaFormatNumber(v), true
+	}
+	return "", false
+}
+
+// Formats a number like Lua 5.1 does with %.14g.
+func luaFormatNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15:
+		return strconv.FormatFloat(n, 'f', 0, 64)
+	}
+	s := strconv.FormatFloat(n, 'g', 14, 64)
+	// %g drops trailing zeros, Go keeps them
+	if mantissa, exponent, ok := strings.Cut(s, "e"); ok {
+		if strings.Contains(mantissa, ".") {
+			mantissa = strings.TrimRight(strings.TrimRight(mantissa, "0"), ".")
+		}
+		return mantissa + "e" + exponent
+	}
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
@@ -0,0 +1,204 @@
+package cider
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Below this much memory MEMORY DOCTOR has nothing meaningful to say.
+const memoryDoctorMinUsage = 5 * 1024 * 1024
+
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"DOCTOR",
+	"    Return memory problems reports.",
+	"PURGE",
+	"    Return freed memory to the operating system.",
+	"STATS",
+	"    Return information about the memory usage of the server.",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. Nested values are",
+	"    sampled up to <count> times (default: 5, 0 means sample all).",
+	"HELP",
+	"    Print this help.",
+}
+
+// Memory used by the server besides keys and values, and the Go heap.
+type memoryStats struct {
+	peak      int64
+	used      int64
+	keys      int64
+	backlog   int64
+	replicas  int64
+	clients   int64
+	heapAlloc uint64
+	heapInuse uint64
+	resident  uint64
+	gcCount   uint32
+}
+
+func (m memoryStats) overhead() int64 {
+	return m.backlog + m.replicas + m.clients
+}
+
+// Ratio of heap spans in use to live objects, how much the heap is fragmented.
+func (m memoryStats) fragmentation() float64 {
+	if m.heapAlloc == 0 {
+		return 0
+	}
+	return float64(m.heapInuse) / float64(m.heapAlloc)
+}
+
+func (srv *Server) memoryStats() memoryStats {
+	stats := storeStats(srv.store)
+	m := memoryStats{
+		used: stats.UsedMemory,
+		keys: stats.Keys,
+	}
+	m.peak = srv.stats.notePeak(m.used)
+
+	srv.repl.mu.Lock()
+	if srv.repl.backlog != nil {
+		m.backlog = int64(len(srv.repl.backlog.buf))
+	}
+	srv.repl.mu.Unlock()
+
+	for _, session := range srv.clients.list() {
+		_, size := session.out.stats()
+		session.mu.Lock()
+		replica := session.replica
+		session.mu.Unlock()
+		if replica {
+			m.replicas += size
+		} else {
+			m.clients += size
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m.heapAlloc = mem.HeapAlloc
+	m.heapInuse = mem.HeapInuse
+	m.resident = mem.Sys - mem.HeapReleased
+	m.gcCount = mem.NumGC
+
+	return m
+}
+
+func formatFloat(f float64) []byte {
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func (s *Session) handleMemory(store Storer, op opMemory) []byte {
+	switch op.subcommand {
+	case "HELP":
+		return replyHelp(memoryHelp)
+
+	case "USAGE":
+		if len(op.args) == 0 {
+			return replyError(errors.New("wrong number of arguments for MEMORY USAGE"))
+		}
+		// sorted sets keep their size up to date as they change, so the usage is always
+		// exact and SAMPLES, which bounds the elements redis looks at, changes nothing
+		args := op.args[1:]
+		for len(args) > 0 {
+			if !strings.EqualFold(args[0], "SAMPLES") || len(args) < 2 {
+				return replyError(errors.New("syntax error"))
+			}
+			samples, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || samples < 0 {
+				return replyError(errNotInteger)
+			}
+			args = args[2:]
+		}
+
+		ms, err := memoryStoreOf(store)
+		if err != nil {
+			return replyError(err)
+		}
+		usage, err := ms.MemoryUsage(s.ctx, op.args[0])
+		if err != nil && err.Error() == "key not found" {
+			return replyNil()
+		}
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(usage)
+
+	case "STATS":
+		m := s.server.memoryStats()
+		bytesPerKey := int64(0)
+		if m.keys > 0 {
+			bytesPerKey = m.used / m.keys
+		}
+		peakPercentage := 100.0
+		if m.peak > 0 {
+			peakPercentage = float64(m.used) * 100 / float64(m.peak)
+		}
+		return replyArray([][]byte{
+			replyString([]byte("peak.allocated")), replyInteger(m.peak),
+			replyString([]byte("total.allocated")), replyInteger(m.used + m.overhead()),
+			replyString([]byte("replication.backlog")), replyInteger(m.backlog),
+			replyString([]byte("clients.slaves")), replyInteger(m.replicas),
+			replyString([]byte("clients.normal")), replyInteger(m.clients),
+			replyString([]byte("overhead.total")), replyInteger(m.overhead()),
+			replyString([]byte("keys.count")), replyInteger(m.keys),
+			replyString([]byte("keys.bytes-per-key")), replyInteger(bytesPerKey),
+			replyString([]byte("dataset.bytes")), replyInteger(m.used),
+			replyString([]byte("peak.percentage")), replyString(formatFloat(peakPercentage)),
+			replyString([]byte("allocator.allocated")), replyInteger(int64(m.heapAlloc)),
+			replyString([]byte("allocator.active")), replyInteger(int64(m.heapInuse)),
+			replyString([]byte("allocator.resident")), replyInteger(int64(m.resident)),
+			replyString([]byte("allocator-fragmentation.ratio")), replyString(formatFloat(m.fragmentation())),
+			replyString([]byte("allocator-fragmentation.bytes")), replyInteger(int64(m.heapInuse) - int64(m.heapAlloc)),
+			replyString([]byte("allocator.gc-count")), replyInteger(int64(m.gcCount)),
+		})
+
+	case "DOCTOR":
+		return replyString([]byte(s.server.memoryDoctor(s.server.memoryStats())))
+
+	case "PURGE":
+		debug.FreeOSMemory()
+		return replyOK()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'. Try MEMORY HELP.", strings.ToLower(op.subcommand)))
+}
+
+// Describes memory problems and what to do about them.
+func (srv *Server) memoryDoctor(m memoryStats) string {
+	if m.used+m.overhead() < memoryDoctorMinUsage {
+		return "This instance is empty or is using very little memory, there is nothing to diagnose yet."
+	}
+
+	var hints []string
+	if m.peak > m.used*3/2 {
+		hints = append(hints, fmt.Sprintf("Peak memory: In the past this instance used %s, more than 150%% of the %s it uses now. The Go heap keeps some of the freed memory, MEMORY PURGE returns it to the operating system.",
+			humanBytes(m.peak), humanBytes(m.used)))
+	}
+	if m.fragmentation() > 1.4 && m.heapInuse-m.heapAlloc > 10*1024*1024 {
+		hints = append(hints, fmt.Sprintf("High heap fragmentation: Heap spans in use are %.2f times the size of live objects. This usually follows deleting many keys and improves as new keys fill the spans.",
+			m.fragmentation()))
+	}
+	if clients := int64(srv.clients.count()); clients > 0 && m.clients/clients > 200*1024 {
+		hints = append(hints, fmt.Sprintf("Big client buffers: Clients hold %s of queued replies, %s per client on average. Clients may be reading large replies slowly, set client-output-buffer-limit to disconnect them.",
+			humanBytes(m.clients), humanBytes(m.clients/clients)))
+	}
+	if m.replicas > 10*1024*1024 {
+		hints = append(hints, fmt.Sprintf("Big replica buffers: Replicas hold %s of queued replication stream. The link to the replicas may be too slow for the write load.",
+			humanBytes(m.replicas)))
+	}
+	if maxmemory := storeStats(srv.store).MaxMemory; maxmemory > 0 && m.used > maxmemory*9/10 {
+		hints = append(hints, fmt.Sprintf("Close to maxmemory: Keys use %s of the %s limit. With maxmemory-policy noeviction writes will be refused once the limit is reached.",
+			humanBytes(m.used), humanBytes(maxmemory)))
+	}
+
+	if len(hints) == 0 {
+		return "No memory issues found in this instance."
+	}
+	return "Found a few memory issues in this instance:\n\n * " + strings.Join(hints, "\n\n * ") + "\n"
+}
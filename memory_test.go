@@ -0,0 +1,112 @@
+package cider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	client.do(t, "SET counter 12345")
+	client.do(t, "SET greeting hello")
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "MEMORY USAGE counter", want: string(replyInteger(itemSize("counter", nil)))},
+		{command: "MEMORY USAGE greeting SAMPLES 0", want: string(replyInteger(itemSize("greeting", []byte("hello"))))},
+		{command: "MEMORY USAGE missing", want: "_\r\n"},
+		{command: "MEMORY USAGE greeting SAMPLES", want: "-ERR syntax error\r\n"},
+		{command: "MEMORY USAGE greeting SAMPLES x", want: "-ERR value is not an integer or out of range\r\n"},
+		{command: "MEMORY NOPE", want: "-ERR unknown subcommand 'nope'. Try MEMORY HELP.\r\n"},
+		{command: "OBJECT ENCODING counter", want: "$3\r\nint\r\n"},
+		{command: "OBJECT ENCODING greeting", want: "$6\r\nembstr\r\n"},
+		{command: "OBJECT REFCOUNT greeting", want: ":1\r\n"},
+		{command: "OBJECT REFCOUNT missing", want: "_\r\n"},
+		{command: "MEMORY PURGE", want: "+OK\r\n"},
+	}
+	for _, test := range tests {
+		if reply := client.do(t, test.command); reply != test.want {
+			t.Errorf("%s: want %q, got %q", test.command, test.want, reply)
+		}
+	}
+
+	for _, command := range []string{"OBJECT HELP", "MEMORY HELP"} {
+		if reply := client.do(t, command); !strings.HasPrefix(reply, "*") || !strings.Contains(reply, "\r\n+HELP\r\n") {
+			t.Errorf("%s: want help lines, got %q", command, reply)
+		}
+	}
+
+	stats := client.do(t, "MEMORY STATS")
+	for _, field := range []string{"peak.allocated", "dataset.bytes", "allocator.allocated"} {
+		if !strings.Contains(stats, field) {
+			t.Errorf("want %s in MEMORY STATS, got %q", field, stats)
+		}
+	}
+	if !strings.Contains(stats, "$10\r\nkeys.count\r\n:2\r\n") {
+		t.Errorf("want 2 keys in MEMORY STATS, got %q", stats)
+	}
+
+	if reply := client.do(t, "MEMORY DOCTOR"); !strings.Contains(reply, "very little memory") {
+		t.Errorf("want empty instance diagnosis, got %q", reply)
+	}
+}
+
+// Sorted set sizes are tracked exactly, whatever number of samples is asked for.
+func TestMemoryUsageSamples(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	// enough members for a skiplist, with sizes redis would have to sample
+	for i := 0; i < 300; i++ {
+		client.do(t, fmt.Sprintf("GEOADD z %f 38 %s", float64(i%180), strings.Repeat("m", i%50+1)+strconv.Itoa(i)))
+	}
+	if reply := client.do(t, "OBJECT ENCODING z"); reply != "$8\r\nskiplist\r\n" {
+		t.Fatalf("want skiplist, got %q", reply)
+	}
+
+	want := client.do(t, "MEMORY USAGE z")
+	if !strings.HasPrefix(want, ":") {
+		t.Fatalf("want an integer, got %q", want)
+	}
+	for _, samples := range []string{"0", "1", "5", "1000"} {
+		if reply := client.do(t, "MEMORY USAGE z SAMPLES "+samples); reply != want {
+			t.Errorf("SAMPLES %s: want %q, got %q", samples, want, reply)
+		}
+	}
+
+	client.do(t, "GEOADD z 13 38 extra")
+	if reply := client.do(t, "MEMORY USAGE z SAMPLES 1"); reply == want {
+		t.Errorf("want the usage to grow with a new member, got %q", reply)
+	}
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+
+	m := memoryStats{used: 20 << 20, peak: 40 << 20, heapAlloc: 20 << 20, heapInuse: 22 << 20}
+	if report := server.memoryDoctor(m); !strings.Contains(report, "Peak memory") || strings.Contains(report, "fragmentation") {
+		t.Errorf("want a peak memory hint only, got %q", report)
+	}
+
+	m = memoryStats{used: 20 << 20, peak: 20 << 20, heapAlloc: 20 << 20, heapInuse: 40 << 20}
+	if report := server.memoryDoctor(m); !strings.Contains(report, "fragmentation") {
+		t.Errorf("want a fragmentation hint, got %q", report)
+	}
+
+	m = memoryStats{used: 20 << 20, peak: 20 << 20, heapAlloc: 20 << 20, heapInuse: 20 << 20}
+	if report := server.memoryDoctor(m); report != "No memory issues found in this instance." {
+		t.Errorf("want no issues, got %q", report)
+	}
+}
@@ -0,0 +1,206 @@
+package cider
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the command latency histogram buckets.
+var latencyBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+// Call count and latency histogram of one command.
+type commandStat struct {
+	calls   atomic.Int64
+	nanos   atomic.Int64
+	buckets []atomic.Int64
+}
+
+type commandStats struct {
+	mu       *sync.RWMutex
+	commands map[string]*commandStat
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{
+		mu:       &sync.RWMutex{},
+		commands: make(map[string]*commandStat),
+	}
+}
+
+func (c *commandStats) record(cmd string, d time.Duration) {
+	c.mu.RLock()
+	stat, ok := c.commands[cmd]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.mu.Lock()
+		stat, ok = c.commands[cmd]
+		if !ok {
+			stat = &commandStat{buckets: make([]atomic.Int64, len(latencyBuckets))}
+			c.commands[cmd] = stat
+		}
+		c.mu.Unlock()
+	}
+
+	stat.calls.Add(1)
+	stat.nanos.Add(int64(d))
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			stat.buckets[i].Add(1)
+			break
+		}
+	}
+}
+
+func (c *commandStats) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.commands)
+}
+
+// Commands that have been called at least once, sorted by name.
+func (c *commandStats) names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (c *commandStats) get(cmd string) *commandStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.commands[cmd]
+}
+
+// Records a processed command for the metrics endpoint and the latency monitor.
+func (srv *Server) recordCommand(op any, d time.Duration) {
+	srv.commandStats.record(commandLabel(op), d)
+
+	name, subcommand := commandName(op)
+	if slices.Contains(categoriesFor(name, subcommand), "fast") {
+		srv.latency.add("fast-command", d)
+	} else {
+		srv.latency.add("command", d)
+	}
+}
+
+// Serves metrics in the Prometheus text exposition format.
+func (srv *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		srv.WriteMetrics(w)
+	})
+}
+
+// Writes metrics in the Prometheus text exposition format.
+func (srv *Server) WriteMetrics(w io.Writer) error {
+	stats := storeStats(srv.store)
+	m := &metricsWriter{w: w}
+
+	m.metric("cider_uptime_seconds", "gauge", "Seconds since the server was created.",
+		"", int64(time.Since(srv.stats.started).Seconds()))
+	m.metric("cider_connected_clients", "gauge", "Number of connected clients.",
+		"", srv.clients.count())
+	m.metric("cider_connections_received_total", "counter", "Connections accepted by the server.",
+		"", srv.stats.connections.Load())
+	m.metric("cider_rejected_connections_total", "counter", "Connections rejected because of maxclients.",
+		"", srv.stats.rejected.Load())
+	m.metric("cider_net_input_bytes_total", "counter", "Bytes read from clients.",
+		"", srv.stats.netInput.Load())
+	m.metric("cider_net_output_bytes_total", "counter", "Bytes written to clients.",
+		"", srv.stats.netOutput.Load())
+
+	m.header("cider_keys", "gauge", "Number of keys by type.")
+	m.sample("cider_keys", `type="string"`, stats.Keys-stats.ZSets)
+	m.sample("cider_keys", `type="zset"`, stats.ZSets)
+	m.metric("cider_keys_with_expiry", "gauge", "Number of keys with a time to live.",
+		"", stats.Expires)
+	m.metric("cider_expired_keys_total", "counter", "Keys removed because their time to live elapsed.",
+		"", stats.Expired)
+	m.metric("cider_evicted_keys_total", "counter", "Keys evicted because of maxmemory.",
+		"", stats.Evicted)
+	m.metric("cider_keyspace_hits_total", "counter", "Successful key lookups.",
+		"", stats.Hits)
+	m.metric("cider_keyspace_misses_total", "counter", "Failed key lookups.",
+		"", stats.Misses)
+	m.metric("cider_used_memory_bytes", "gauge", "Approximate memory used by keys and values.",
+		"", stats.UsedMemory)
+	m.metric("cider_maxmemory_bytes", "gauge", "Configured memory limit, zero when unlimited.",
+		"", stats.MaxMemory)
+	m.metric("cider_full_syncs_total", "counter", "Full resyncs served to replicas.",
+		"", srv.repl.syncFull.Load())
+	m.metric("cider_full_sync_duration_seconds", "gauge", "Seconds the snapshot of the last full resync blocked writes.",
+		"", time.Duration(srv.repl.syncFullNanos.Load()).Seconds())
+
+	names := srv.commandStats.names()
+
+	m.header("cider_commands_total", "counter", "Commands processed by command name.")
+	for _, name := range names {
+		m.sample("cider_commands_total", fmt.Sprintf("cmd=%q", name), srv.commandStats.get(name).calls.Load())
+	}
+
+	m.header("cider_command_duration_seconds", "histogram", "Command latency by command name.")
+	for _, name := range names {
+		stat := srv.commandStats.get(name)
+		label := fmt.Sprintf("cmd=%q", name)
+
+		// read the total first so the cumulative buckets never exceed it
+		calls := stat.calls.Load()
+		nanos := stat.nanos.Load()
+		cumulative := int64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += stat.buckets[i].Load()
+			m.sample("cider_command_duration_seconds_bucket",
+				label+`,le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, min(cumulative, calls))
+		}
+		m.sample("cider_command_duration_seconds_bucket", label+`,le="+Inf"`, calls)
+		m.sample("cider_command_duration_seconds_sum", label, time.Duration(nanos).Seconds())
+		m.sample("cider_command_duration_seconds_count", label, calls)
+	}
+
+	return m.err
+}
+
+// Writes the text exposition format, keeping the first write error.
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricsWriter) header(name string, kind string, help string) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) sample(name string, labels string, value any) {
+	if m.err != nil {
+		return
+	}
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	_, m.err = fmt.Fprintf(m.w, "%s %v\n", name, value)
+}
+
+func (m *metricsWriter) metric(name string, kind string, help string, labels string, value any) {
+	m.header(name, kind, help)
+	m.sample(name, labels, value)
+}
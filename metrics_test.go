@@ -0,0 +1,62 @@
+package cider
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	client.do(t, "SET foo bar")
+	client.do(t, "GET foo")
+	client.do(t, "GET foo")
+	client.do(t, "CLIENT ID")
+	client.do(t, "GEOADD geo 13.361389 38.115556 Palermo")
+
+	metrics := httptest.NewServer(server.MetricsHandler())
+	defer metrics.Close()
+
+	resp, err := http.Get(metrics.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE cider_commands_total counter\n",
+		"cider_commands_total{cmd=\"get\"} 2\n",
+		"cider_commands_total{cmd=\"set\"} 1\n",
+		"cider_commands_total{cmd=\"client|id\"} 1\n",
+		"# TYPE cider_command_duration_seconds histogram\n",
+		"cider_command_duration_seconds_bucket{cmd=\"get\",le=\"+Inf\"} 2\n",
+		"cider_command_duration_seconds_count{cmd=\"get\"} 2\n",
+		"cider_connected_clients 1\n",
+		"cider_keys{type=\"string\"} 1\n",
+		"cider_keys{type=\"zset\"} 1\n",
+		"cider_keyspace_hits_total 2\n",
+		"cider_full_syncs_total 0\n",
+		"cider_full_sync_duration_seconds 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("want metrics to contain %q, got\n%s", want, body)
+		}
+	}
+
+	if strings.Contains(string(body), "cider_net_input_bytes_total 0\n") {
+		t.Error("want input bytes to be counted")
+	}
+}
@@ -0,0 +1,84 @@
+package cider
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Used when MIGRATE is given a timeout of zero or less, like redis.
+const defaultMigrateTimeout = time.Second
+
+var errMigrateIO = newCodedError("IOERR", "error or timeout reading to target instance")
+
+// Moves keys to another instance with pipelined RESTORE commands. Source keys
+// are deleted only once the target accepted every one of them, and can not be
+// changed by other commands in between.
+func (s *Session) handleMigrate(store Storer, op opMigrate) []byte {
+	if op.db != 0 {
+		return replyError(errors.New("DB index is out of range"))
+	}
+
+	ds, err := dumpStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+
+	var reply []byte
+	err = ds.Migrate(s.ctx, op.keys, func(keys []string, payloads [][]byte, ttls []int64) (bool, error) {
+		if len(keys) == 0 {
+			reply = []byte("+NOKEY\r\n")
+			return false, nil
+		}
+		reply = s.migrateKeys(op, keys, payloads, ttls)
+		return reply[0] == '+' && !op.copy, nil
+	})
+	if err != nil {
+		return replyError(err)
+	}
+	return reply
+}
+
+// Sends dumped keys to the target of MIGRATE.
+func (s *Session) migrateKeys(op opMigrate, keys []string, payloads [][]byte, ttls []int64) []byte {
+	commands := make([][]string, 0, len(keys))
+	for i, key := range keys {
+		// ttls are sent as the absolute time they are kept as, so they are not rounded again
+		args := []string{"RESTORE", key, "0", string(payloads[i])}
+		if ttls[i] != -1 {
+			args[2] = strconv.FormatInt(ttls[i]*1000, 10)
+			args = append(args, "ABSTTL")
+		}
+		if op.replace {
+			args = append(args, "REPLACE")
+		}
+		commands = append(commands, args)
+	}
+
+	timeout := time.Duration(op.timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultMigrateTimeout
+	}
+	l, err := dialLink(s.ctx, net.JoinHostPort(op.host, op.port), timeout, op.username, op.password)
+	var target replyErr
+	if errors.As(err, &target) {
+		return replyError(fmt.Errorf("Target instance replied with error: %s", target))
+	}
+	if err != nil {
+		return replyError(newCodedError("IOERR", "error or timeout connecting to the client"))
+	}
+	defer l.Close()
+
+	replies, err := l.pipeline(commands)
+	if err != nil {
+		return replyError(errMigrateIO)
+	}
+	for _, reply := range replies {
+		if e, ok := reply.(replyErr); ok {
+			return replyError(fmt.Errorf("Target instance replied with error: %s", e))
+		}
+	}
+	return replyOK()
+}
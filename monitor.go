@@ -0,0 +1,125 @@
+package cider
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pending reply bytes above which lines for a monitor are dropped instead of queued.
+const monitorMaxPending = 1024 * 1024
+
+// Sessions that issued MONITOR and receive every command run by other sessions.
+type monitors struct {
+	mu       *sync.RWMutex
+	sessions map[*Session]struct{}
+	// lets the dispatch path skip the lock when nobody is monitoring
+	count atomic.Int64
+}
+
+func newMonitors() *monitors {
+	return &monitors{
+		mu:       &sync.RWMutex{},
+		sessions: make(map[*Session]struct{}),
+	}
+}
+
+func (m *monitors) add(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[s] = struct{}{}
+	m.count.Store(int64(len(m.sessions)))
+}
+
+func (m *monitors) remove(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, s)
+	m.count.Store(int64(len(m.sessions)))
+}
+
+// Sends a command to every monitor except the session that ran it.
+// Like redis, admin commands are not shown and AUTH arguments are redacted.
+func (m *monitors) feed(from *Session, op any, args []string, at time.Time) {
+	if m.count.Load() == 0 {
+		return
+	}
+
+	name, subcommand := commandName(op)
+	if slices.Contains(categoriesFor(name, subcommand), "admin") {
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "+%d.%06d [0 %s]", at.Unix(), at.Nanosecond()/1000, from.conn.RemoteAddr())
+	for i, arg := range args {
+		if _, ok := op.(opAuth); ok && i > 0 {
+			arg = "(redacted)"
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(quoteArg(arg))
+	}
+	sb.WriteString("\r\n")
+	line := []byte(sb.String())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for s := range m.sessions {
+		if s == from {
+			continue
+		}
+		// a monitor that falls behind misses lines rather than slowing everyone down
+		if _, size := s.out.stats(); size > monitorMaxPending {
+			continue
+		}
+		s.out.push(line)
+		s.flush()
+	}
+}
+
+// Quotes an argument like redis sdscatrepr.
+func quoteArg(arg string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		default:
+			if c < ' ' || c > '~' {
+				fmt.Fprintf(&sb, `\x%02x`, c)
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func (s *Session) handleMonitor() []byte {
+	s.mu.Lock()
+	s.monitor = true
+	s.mu.Unlock()
+
+	s.server.monitors.add(s)
+	return replyOK()
+}
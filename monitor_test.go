@@ -0,0 +1,60 @@
+package cider
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	address := server.Addrs()[0].String()
+
+	monitor := dialTestClient(t, "tcp", address)
+	client := dialTestClient(t, "tcp", address)
+
+	if reply := monitor.do(t, "MONITOR"); reply != "+OK\r\n" {
+		t.Fatalf("want: +OK, got %q", reply)
+	}
+
+	client.do(t, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$4\r\na\"\nb")
+	client.do(t, "AUTH secret")
+	// admin commands are not shown
+	client.do(t, "SLOWLOG LEN")
+	client.do(t, "GET foo")
+
+	want := []*regexp.Regexp{
+		regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "SET" "foo" "a\\"\\nb"\r\n$`),
+		regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "AUTH" "\(redacted\)"\r\n$`),
+		regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "GET" "foo"\r\n$`),
+	}
+	monitor.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for _, w := range want {
+		line, err := readTestReply(monitor.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !w.MatchString(line) {
+			t.Errorf("want line matching %s, got %q", w, line)
+		}
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	tcs := map[string]string{
+		"foo":      `"foo"`,
+		"a b":      `"a b"`,
+		"\"\\":     `"\"\\"`,
+		"\r\n\t":   `"\r\n\t"`,
+		"\x00\xff": `"\x00\xff"`,
+		"":         `""`,
+	}
+
+	for arg, want := range tcs {
+		if got := quoteArg(arg); got != want {
+			t.Errorf("want: %s, got %s", want, got)
+		}
+	}
+}
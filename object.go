@@ -0,0 +1,91 @@
+package cider
+
+import (
+	"fmt"
+	"strings"
+)
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+func (s *Session) handleObject(store Storer, op opObject) []byte {
+	if op.subcommand == "HELP" {
+		return replyHelp(objectHelp)
+	}
+	if len(op.args) != 1 {
+		return replyError(fmt.Errorf("wrong number of arguments for OBJECT %s", op.subcommand))
+	}
+	key := op.args[0]
+
+	switch op.subcommand {
+	case "ENCODING":
+		ms, err := memoryStoreOf(store)
+		if err != nil {
+			return replyError(err)
+		}
+		encoding, err := ms.Encoding(s.ctx, key)
+		if err != nil && err.Error() == "key not found" {
+			return replyNil()
+		}
+		if err != nil {
+			return replyError(err)
+		}
+		return replyString([]byte(encoding))
+
+	case "REFCOUNT":
+		// values are never shared between keys
+		found, err := store.Exists(s.ctx, []string{key})
+		if err != nil {
+			return replyError(err)
+		}
+		if found == 0 {
+			return replyNil()
+		}
+		return replyInteger(1)
+
+	case "IDLETIME":
+		ms, err := memoryStoreOf(store)
+		if err != nil {
+			return replyError(err)
+		}
+		idle, err := ms.IdleTime(s.ctx, key)
+		if err != nil && err.Error() == "key not found" {
+			return replyNil()
+		}
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(idle)
+
+	case "FREQ":
+		ms, err := memoryStoreOf(store)
+		if err != nil {
+			return replyError(err)
+		}
+		freq, err := ms.Freq(s.ctx, key)
+		if err != nil && err.Error() == "key not found" {
+			return replyNil()
+		}
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(freq)
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'. Try OBJECT HELP.", strings.ToLower(op.subcommand)))
+}
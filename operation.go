@@ -1,5 +1,7 @@
 package cider
 
+import "strings"
+
 type opSet struct {
 	key   string
 	value []byte
@@ -34,6 +36,16 @@ type opExpire struct {
 	lt  bool
 }
 
+type opExpireAt struct {
+	key string
+	// unix time in seconds
+	at int64
+	nx bool
+	xx bool
+	gt bool
+	lt bool
+}
+
 type opIncr struct {
 	key string
 }
@@ -41,3 +53,369 @@ type opIncr struct {
 type opDecr struct {
 	key string
 }
+
+type opAuth struct {
+	username string
+	password string
+}
+
+type opACL struct {
+	subcommand string
+	args       []string
+}
+
+type opClient struct {
+	subcommand string
+	args       []string
+}
+
+type opObject struct {
+	subcommand string
+	args       []string
+}
+
+type opMemory struct {
+	subcommand string
+	args       []string
+}
+
+type opInfo struct {
+	sections []string
+}
+
+type opSlowlog struct {
+	subcommand string
+	args       []string
+}
+
+type opLatency struct {
+	subcommand string
+	args       []string
+}
+
+type opMonitor struct{}
+
+type opConfig struct {
+	subcommand string
+	args       []string
+}
+
+type opPing struct {
+	message string
+}
+
+type opReplicaOf struct {
+	host string
+	port string
+}
+
+type opRole struct{}
+
+type opReplconf struct {
+	args []string
+}
+
+type opPsync struct {
+	replid string
+	offset int64
+}
+
+type opSentinel struct {
+	subcommand string
+	args       []string
+}
+
+type opWait struct {
+	numreplicas string
+	timeout     string
+}
+
+type opWaitAof struct {
+	numlocal    string
+	numreplicas string
+	timeout     string
+}
+
+type opCluster struct {
+	subcommand string
+	args       []string
+}
+
+type opAsking struct{}
+
+type opFunction struct {
+	subcommand string
+	args       []string
+}
+
+type opFcall struct {
+	function string
+	keys     []string
+	args     []string
+	ro       bool
+	// set by the session for FCALL of a function flagged no-writes
+	noWrites bool
+}
+
+type opDump struct {
+	key string
+}
+
+type opRestore struct {
+	key string
+	// milliseconds, a unix time with absttl, zero for none
+	ttl     int64
+	payload []byte
+	replace bool
+	absttl  bool
+	// seconds since last access and LFU counter, -1 when not given
+	idle int64
+	freq int64
+}
+
+type opPfadd struct {
+	key      string
+	elements []string
+}
+
+type opPfcount struct {
+	keys []string
+}
+
+type opPfmerge struct {
+	dest    string
+	sources []string
+}
+
+type geoPoint struct {
+	lon    float64
+	lat    float64
+	member string
+}
+
+type opGeoadd struct {
+	key    string
+	nx     bool
+	xx     bool
+	ch     bool
+	points []geoPoint
+}
+
+type opGeopos struct {
+	key     string
+	members []string
+}
+
+type opGeodist struct {
+	key     string
+	member1 string
+	member2 string
+	// meters per unit
+	unit float64
+}
+
+type opGeohash struct {
+	key     string
+	members []string
+}
+
+// GEOSEARCH, or GEOSEARCHSTORE into dest when store is set.
+type opGeosearch struct {
+	store      bool
+	dest       string
+	key        string
+	fromMember bool
+	member     string
+	lon        float64
+	lat        float64
+	box        bool
+	radius     float64
+	width      float64
+	height     float64
+	// meters per unit
+	unit float64
+	// 1 for ascending and -1 for descending distances, 0 unsorted
+	sort      int
+	count     int64
+	any       bool
+	withCoord bool
+	withDist  bool
+	withHash  bool
+	storeDist bool
+}
+
+type opMigrate struct {
+	host string
+	port string
+	keys []string
+	db   int64
+	// milliseconds
+	timeout  int64
+	copy     bool
+	replace  bool
+	username string
+	password string
+}
+
+// Returns the command name and subcommand (if any) of a parsed operation.
+func commandName(op any) (name string, subcommand string) {
+	switch t := op.(type) {
+	case opSet:
+		return "SET", ""
+	case opGet:
+		return "GET", ""
+	case opDel:
+		return "DEL", ""
+	case opExists:
+		return "EXISTS", ""
+	case opExpire:
+		return "EXPIRE", ""
+	case opExpireAt:
+		return "EXPIREAT", ""
+	case opIncr:
+		return "INCR", ""
+	case opDecr:
+		return "DECR", ""
+	case opAuth:
+		return "AUTH", ""
+	case opACL:
+		return "ACL", t.subcommand
+	case opClient:
+		return "CLIENT", t.subcommand
+	case opObject:
+		return "OBJECT", t.subcommand
+	case opMemory:
+		return "MEMORY", t.subcommand
+	case opInfo:
+		return "INFO", ""
+	case opSlowlog:
+		return "SLOWLOG", t.subcommand
+	case opLatency:
+		return "LATENCY", t.subcommand
+	case opMonitor:
+		return "MONITOR", ""
+	case opConfig:
+		return "CONFIG", t.subcommand
+	case opPing:
+		return "PING", ""
+	case opReplicaOf:
+		return "REPLICAOF", ""
+	case opRole:
+		return "ROLE", ""
+	case opReplconf:
+		return "REPLCONF", ""
+	case opPsync:
+		return "PSYNC", ""
+	case opSentinel:
+		return "SENTINEL", t.subcommand
+	case opWait:
+		return "WAIT", ""
+	case opWaitAof:
+		return "WAITAOF", ""
+	case opCluster:
+		return "CLUSTER", t.subcommand
+	case opAsking:
+		return "ASKING", ""
+	case opDump:
+		return "DUMP", ""
+	case opRestore:
+		return "RESTORE", ""
+	case opMigrate:
+		return "MIGRATE", ""
+	case opPfadd:
+		return "PFADD", ""
+	case opPfcount:
+		return "PFCOUNT", ""
+	case opPfmerge:
+		return "PFMERGE", ""
+	case opGeoadd:
+		return "GEOADD", ""
+	case opGeopos:
+		return "GEOPOS", ""
+	case opGeodist:
+		return "GEODIST", ""
+	case opGeohash:
+		return "GEOHASH", ""
+	case opGeosearch:
+		if t.store {
+			return "GEOSEARCHSTORE", ""
+		}
+		return "GEOSEARCH", ""
+	case opFunction:
+		return "FUNCTION", t.subcommand
+	case opFcall:
+		if t.ro {
+			return "FCALL_RO", ""
+		}
+		return "FCALL", ""
+	}
+	return "", ""
+}
+
+// Returns the lowercase command name as shown by CLIENT LIST, e.g. client|list.
+func commandLabel(op any) string {
+	name, subcommand := commandName(op)
+	label := strings.ToLower(name)
+	if subcommand != "" {
+		label += "|" + strings.ToLower(subcommand)
+	}
+	return label
+}
+
+// Returns the keys a parsed operation touches.
+func commandKeys(op any) []string {
+	switch t := op.(type) {
+	case opSet:
+		return []string{t.key}
+	case opGet:
+		return []string{t.key}
+	case opDel:
+		return t.keys
+	case opExists:
+		return t.keys
+	case opExpire:
+		return []string{t.key}
+	case opExpireAt:
+		return []string{t.key}
+	case opIncr:
+		return []string{t.key}
+	case opDecr:
+		return []string{t.key}
+	case opObject:
+		if len(t.args) > 0 {
+			return t.args[:1]
+		}
+	case opMemory:
+		if t.subcommand == "USAGE" && len(t.args) > 0 {
+			return t.args[:1]
+		}
+	case opDump:
+		return []string{t.key}
+	case opRestore:
+		return []string{t.key}
+	case opMigrate:
+		return t.keys
+	case opPfadd:
+		return []string{t.key}
+	case opPfcount:
+		return t.keys
+	case opPfmerge:
+		return append([]string{t.dest}, t.sources...)
+	case opGeoadd:
+		return []string{t.key}
+	case opGeopos:
+		return []string{t.key}
+	case opGeodist:
+		return []string{t.key}
+	case opGeohash:
+		return []string{t.key}
+	case opGeosearch:
+		if t.store {
+			return []string{t.dest, t.key}
+		}
+		return []string{t.key}
+	case opFcall:
+		return t.keys
+	}
+	return nil
+}
@@ -1,13 +1,109 @@
 package cider
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"strconv"
 	"strings"
 )
 
+const (
+	// Maximum length of an inline command line.
+	maxInlineSize = 64 * 1024
+	// Maximum number of arguments in a RESP array command.
+	maxMultibulkLength = 1024 * 1024
+	// Maximum length of a single RESP bulk argument.
+	maxBulkSize = 512 * 1024 * 1024
+)
+
+// Malformed client input, the connection is closed after replying.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// Reads the next command from r, either an inline command terminated by a
+// newline or a RESP array of bulk strings as sent by redis clients.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := readLine(r, maxInlineSize)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	line, err := readLine(r, maxInlineSize)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxMultibulkLength {
+		return nil, protocolError("invalid multibulk length")
+	}
+
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxInlineSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, protocolError("invalid bulk length")
+		}
+
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, protocolError("invalid bulk terminator")
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+// Reads a line without its trailing \r\n.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", protocolError("too big inline request")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
 func ParseCommand(command []byte) (any, error) {
-	fields := strings.Fields(string(command))
+	return parseArgs(strings.Fields(string(command)))
+}
+
+// Parses a command already split into its arguments.
+func parseArgs(fields []string) (any, error) {
 	if len(fields) <= 0 {
 		return nil, errors.New("no command supplied")
 	}
@@ -24,7 +120,7 @@ func ParseCommand(command []byte) (any, error) {
 		// cutoff point to read the value only excluding ex/exat number
 		cutoff := 256
 		var op opSet
-		var sb strings.Builder
+		var words []string
 
 		for i, v := range fields {
 			if i == 1 {
@@ -89,11 +185,13 @@ func ParseCommand(command []byte) (any, error) {
 			}
 
 			if i > 1 && i < cutoff {
-				sb.WriteString(v + " ")
+				words = append(words, v)
 			}
 		}
 
-		op.value = []byte(strings.TrimSpace(sb.String()))
+		// a single argument is the value byte for byte, inline commands
+		// may spread it over several words
+		op.value = []byte(strings.Join(words, " "))
 
 		return op, nil
 
@@ -185,6 +283,48 @@ func ParseCommand(command []byte) (any, error) {
 
 		return op, nil
 
+	// https://redis.io/commands/expireat/
+	case "EXPIREAT":
+		if len(fields) < 3 {
+			return nil, errors.New("not enough arguments for EXPIREAT")
+		}
+
+		at, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("unable to parse EXPIREAT timestamp")
+		}
+		op := opExpireAt{
+			key: fields[1],
+			at:  at,
+		}
+
+		for _, v := range fields[3:] {
+			switch v {
+			case "NX":
+				if op.xx || op.gt || op.lt {
+					return nil, errors.New("XX/GT/LT already set in this command")
+				}
+				op.nx = true
+			case "XX":
+				if op.nx {
+					return nil, errors.New("NX already set in this command")
+				}
+				op.xx = true
+			case "GT":
+				if op.nx {
+					return nil, errors.New("NX already set in this command")
+				}
+				op.gt = true
+			case "LT":
+				if op.nx {
+					return nil, errors.New("NX already set in this command")
+				}
+				op.lt = true
+			}
+		}
+
+		return op, nil
+
 	// https://redis.io/commands/incr/
 	case "INCR":
 		if len(fields) < 2 {
@@ -207,8 +347,638 @@ func ParseCommand(command []byte) (any, error) {
 			key: fields[1],
 		}
 
+		return op, nil
+
+	// https://redis.io/commands/auth/
+	case "AUTH":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for AUTH")
+		}
+		if len(fields) > 3 {
+			return nil, errors.New("too many arguments for AUTH")
+		}
+
+		op := opAuth{
+			password: fields[1],
+		}
+		if len(fields) == 3 {
+			op.username = fields[1]
+			op.password = fields[2]
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/acl/
+	case "ACL":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for ACL")
+		}
+
+		op := opACL{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/client/
+	case "CLIENT":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for CLIENT")
+		}
+
+		op := opClient{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/object/
+	case "OBJECT":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for OBJECT")
+		}
+
+		op := opObject{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/memory/
+	case "MEMORY":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for MEMORY")
+		}
+
+		op := opMemory{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/info/
+	case "INFO":
+		op := opInfo{
+			sections: fields[1:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/slowlog/
+	case "SLOWLOG":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for SLOWLOG")
+		}
+
+		op := opSlowlog{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/latency/
+	case "LATENCY":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for LATENCY")
+		}
+
+		op := opLatency{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/monitor/
+	case "MONITOR":
+		return opMonitor{}, nil
+
+	// https://redis.io/commands/config/
+	case "CONFIG":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for CONFIG")
+		}
+
+		op := opConfig{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/ping/
+	case "PING":
+		if len(fields) > 2 {
+			return nil, errors.New("too many arguments for PING")
+		}
+
+		var op opPing
+		if len(fields) == 2 {
+			op.message = fields[1]
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/replicaof/
+	case "REPLICAOF", "SLAVEOF":
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("wrong number of arguments for %s", operation)
+		}
+
+		op := opReplicaOf{
+			host: fields[1],
+			port: fields[2],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/role/
+	case "ROLE":
+		return opRole{}, nil
+
+	// https://redis.io/commands/replconf/
+	case "REPLCONF":
+		op := opReplconf{
+			args: fields[1:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/psync/
+	case "PSYNC":
+		if len(fields) != 3 {
+			return nil, errors.New("wrong number of arguments for PSYNC")
+		}
+
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("unable to parse PSYNC offset")
+		}
+		op := opPsync{
+			replid: fields[1],
+			offset: offset,
+		}
+
+		return op, nil
+
+	// https://redis.io/docs/management/sentinel/#sentinel-commands
+	case "SENTINEL":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for SENTINEL")
+		}
+
+		op := opSentinel{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/cluster/
+	case "CLUSTER":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for CLUSTER")
+		}
+
+		op := opCluster{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/asking/
+	case "ASKING":
+		return opAsking{}, nil
+
+	// https://redis.io/commands/dump/
+	case "DUMP":
+		if len(fields) != 2 {
+			return nil, errors.New("wrong number of arguments for DUMP")
+		}
+
+		return opDump{key: fields[1]}, nil
+
+	// https://redis.io/commands/restore/
+	case "RESTORE":
+		if len(fields) < 4 {
+			return nil, errors.New("wrong number of arguments for RESTORE")
+		}
+
+		op := opRestore{
+			key:     fields[1],
+			payload: []byte(fields[3]),
+			idle:    -1,
+			freq:    -1,
+		}
+		ttl, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		if ttl < 0 {
+			return nil, errors.New("Invalid TTL value, must be >= 0")
+		}
+		op.ttl = ttl
+
+		for i := 4; i < len(fields); i++ {
+			switch strings.ToUpper(fields[i]) {
+			case "REPLACE":
+				op.replace = true
+			case "ABSTTL":
+				op.absttl = true
+			case "IDLETIME", "FREQ":
+				if i+1 == len(fields) || op.idle != -1 || op.freq != -1 {
+					return nil, errors.New("syntax error")
+				}
+				n, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, errNotInteger
+				}
+				if strings.EqualFold(fields[i], "IDLETIME") {
+					if n < 0 {
+						return nil, errors.New("Invalid IDLETIME value, must be >= 0")
+					}
+					op.idle = n
+				} else {
+					if n < 0 || n > 255 {
+						return nil, errors.New("Invalid FREQ value, must be >= 0 and <= 255")
+					}
+					op.freq = n
+				}
+				i++
+			default:
+				return nil, errors.New("syntax error")
+			}
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/migrate/
+	case "MIGRATE":
+		if len(fields) < 6 {
+			return nil, errors.New("wrong number of arguments for MIGRATE")
+		}
+
+		op := opMigrate{
+			host: fields[1],
+			port: fields[2],
+		}
+		db, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		op.db = db
+		timeout, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		op.timeout = timeout
+
+		keys := false
+		for i := 6; i < len(fields) && !keys; i++ {
+			switch strings.ToUpper(fields[i]) {
+			case "COPY":
+				op.copy = true
+			case "REPLACE":
+				op.replace = true
+			case "AUTH":
+				if i+1 == len(fields) {
+					return nil, errors.New("syntax error")
+				}
+				op.password = fields[i+1]
+				i++
+			case "AUTH2":
+				if i+2 >= len(fields) {
+					return nil, errors.New("syntax error")
+				}
+				op.username = fields[i+1]
+				op.password = fields[i+2]
+				i += 2
+			case "KEYS":
+				if fields[3] != "" {
+					return nil, errors.New("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				}
+				op.keys = fields[i+1:]
+				keys = true
+			default:
+				return nil, errors.New("syntax error")
+			}
+		}
+		if !keys {
+			op.keys = fields[3:4]
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/pfadd/
+	case "PFADD":
+		if len(fields) < 2 {
+			return nil, errors.New("wrong number of arguments for PFADD")
+		}
+
+		return opPfadd{key: fields[1], elements: fields[2:]}, nil
+
+	// https://redis.io/commands/pfcount/
+	case "PFCOUNT":
+		if len(fields) < 2 {
+			return nil, errors.New("wrong number of arguments for PFCOUNT")
+		}
+
+		return opPfcount{keys: fields[1:]}, nil
+
+	// https://redis.io/commands/pfmerge/
+	case "PFMERGE":
+		if len(fields) < 2 {
+			return nil, errors.New("wrong number of arguments for PFMERGE")
+		}
+
+		return opPfmerge{dest: fields[1], sources: fields[2:]}, nil
+
+	// https://redis.io/commands/geoadd/
+	case "GEOADD":
+		if len(fields) < 5 {
+			return nil, errors.New("wrong number of arguments for GEOADD")
+		}
+
+		op := opGeoadd{key: fields[1]}
+		i := 2
+	options:
+		for ; i < len(fields); i++ {
+			switch strings.ToUpper(fields[i]) {
+			case "NX":
+				op.nx = true
+			case "XX":
+				op.xx = true
+			case "CH":
+				op.ch = true
+			default:
+				break options
+			}
+		}
+		if i == len(fields) || (len(fields)-i)%3 != 0 || (op.nx && op.xx) {
+			return nil, errors.New("syntax error")
+		}
+		for ; i < len(fields); i += 3 {
+			lon, lat, err := parseLonLat(fields[i], fields[i+1])
+			if err != nil {
+				return nil, err
+			}
+			op.points = append(op.points, geoPoint{lon: lon, lat: lat, member: fields[i+2]})
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/geopos/
+	case "GEOPOS":
+		if len(fields) < 2 {
+			return nil, errors.New("wrong number of arguments for GEOPOS")
+		}
+
+		return opGeopos{key: fields[1], members: fields[2:]}, nil
+
+	// https://redis.io/commands/geodist/
+	case "GEODIST":
+		if len(fields) != 4 && len(fields) != 5 {
+			return nil, errors.New("wrong number of arguments for GEODIST")
+		}
+
+		op := opGeodist{key: fields[1], member1: fields[2], member2: fields[3], unit: 1}
+		if len(fields) == 5 {
+			unit, err := geoUnit(fields[4])
+			if err != nil {
+				return nil, err
+			}
+			op.unit = unit
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/geohash/
+	case "GEOHASH":
+		if len(fields) < 2 {
+			return nil, errors.New("wrong number of arguments for GEOHASH")
+		}
+
+		return opGeohash{key: fields[1], members: fields[2:]}, nil
+
+	// https://redis.io/commands/geosearch/
+	case "GEOSEARCH":
+		if len(fields) < 7 {
+			return nil, errors.New("wrong number of arguments for GEOSEARCH")
+		}
+
+		return parseGeosearch(opGeosearch{key: fields[1]}, fields[2:])
+
+	// https://redis.io/commands/geosearchstore/
+	case "GEOSEARCHSTORE":
+		if len(fields) < 8 {
+			return nil, errors.New("wrong number of arguments for GEOSEARCHSTORE")
+		}
+
+		return parseGeosearch(opGeosearch{store: true, dest: fields[1], key: fields[2]}, fields[3:])
+
+	// https://redis.io/commands/wait/
+	case "WAIT":
+		if len(fields) != 3 {
+			return nil, errors.New("wrong number of arguments for WAIT")
+		}
+
+		op := opWait{
+			numreplicas: fields[1],
+			timeout:     fields[2],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/waitaof/
+	case "WAITAOF":
+		if len(fields) != 4 {
+			return nil, errors.New("wrong number of arguments for WAITAOF")
+		}
+
+		op := opWaitAof{
+			numlocal:    fields[1],
+			numreplicas: fields[2],
+			timeout:     fields[3],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/function/
+	case "FUNCTION":
+		if len(fields) < 2 {
+			return nil, errors.New("not enough arguments for FUNCTION")
+		}
+
+		op := opFunction{
+			subcommand: strings.ToUpper(fields[1]),
+			args:       fields[2:],
+		}
+
+		return op, nil
+
+	// https://redis.io/commands/fcall/
+	// https://redis.io/commands/fcall_ro/
+	case "FCALL", "FCALL_RO":
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("wrong number of arguments for %s", operation)
+		}
+
+		numkeys, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, errors.New("value is not an integer or out of range")
+		}
+		if numkeys < 0 {
+			return nil, errors.New("Number of keys can't be negative")
+		}
+		if numkeys > len(fields)-3 {
+			return nil, errors.New("Number of keys can't be greater than number of args")
+		}
+
+		op := opFcall{
+			function: fields[1],
+			keys:     fields[3 : 3+numkeys],
+			args:     fields[3+numkeys:],
+			ro:       operation == "FCALL_RO",
+		}
+
 		return op, nil
 	}
 
 	return nil, errors.New("unsupported operation")
 }
+
+func parseLonLat(lonArg string, latArg string) (float64, float64, error) {
+	lon, err := strconv.ParseFloat(lonArg, 64)
+	if err != nil || math.IsNaN(lon) {
+		return 0, 0, errors.New("value is not a valid float")
+	}
+	lat, err := strconv.ParseFloat(latArg, 64)
+	if err != nil || math.IsNaN(lat) {
+		return 0, 0, errors.New("value is not a valid float")
+	}
+	if lon < geoLongMin || lon > geoLongMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, fmt.Errorf("invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return lon, lat, nil
+}
+
+// Parses the options of GEOSEARCH and GEOSEARCHSTORE following the keys.
+func parseGeosearch(op opGeosearch, args []string) (opGeosearch, error) {
+	name := "GEOSEARCH"
+	if op.store {
+		name = "GEOSEARCHSTORE"
+	}
+	fromLonLat, byRadius := false, false
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch option := strings.ToUpper(args[i]); {
+		case option == "WITHCOORD":
+			op.withCoord = true
+		case option == "WITHDIST":
+			op.withDist = true
+		case option == "WITHHASH":
+			op.withHash = true
+		case option == "STOREDIST" && op.store:
+			op.storeDist = true
+		case option == "ASC":
+			op.sort = 1
+		case option == "DESC":
+			op.sort = -1
+		case option == "COUNT" && remaining >= 1:
+			count, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || count <= 0 {
+				return op, errors.New("COUNT must be > 0")
+			}
+			op.count = count
+			i++
+			if remaining >= 2 && strings.ToUpper(args[i+1]) == "ANY" {
+				op.any = true
+				i++
+			}
+		case option == "FROMMEMBER" && remaining >= 1:
+			if op.fromMember || fromLonLat {
+				return op, errors.New("syntax error")
+			}
+			op.fromMember = true
+			op.member = args[i+1]
+			i++
+		case option == "FROMLONLAT" && remaining >= 2:
+			if op.fromMember || fromLonLat {
+				return op, errors.New("syntax error")
+			}
+			lon, lat, err := parseLonLat(args[i+1], args[i+2])
+			if err != nil {
+				return op, err
+			}
+			fromLonLat = true
+			op.lon, op.lat = lon, lat
+			i += 2
+		case option == "BYRADIUS" && remaining >= 2:
+			if byRadius || op.box {
+				return op, errors.New("syntax error")
+			}
+			radius, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || math.IsNaN(radius) {
+				return op, errors.New("need numeric radius")
+			}
+			if radius < 0 {
+				return op, errors.New("radius cannot be negative")
+			}
+			unit, err := geoUnit(args[i+2])
+			if err != nil {
+				return op, err
+			}
+			byRadius = true
+			op.radius, op.unit = radius, unit
+			i += 2
+		case option == "BYBOX" && remaining >= 3:
+			if byRadius || op.box {
+				return op, errors.New("syntax error")
+			}
+			width, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || math.IsNaN(width) {
+				return op, errors.New("need numeric width")
+			}
+			height, err := strconv.ParseFloat(args[i+2], 64)
+			if err != nil || math.IsNaN(height) {
+				return op, errors.New("need numeric height")
+			}
+			if width < 0 || height < 0 {
+				return op, errors.New("height or width cannot be negative")
+			}
+			unit, err := geoUnit(args[i+3])
+			if err != nil {
+				return op, err
+			}
+			op.box = true
+			op.width, op.height, op.unit = width, height, unit
+			i += 3
+		default:
+			return op, errors.New("syntax error")
+		}
+	}
+
+	if !op.fromMember && !fromLonLat {
+		return op, fmt.Errorf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", name)
+	}
+	if !byRadius && !op.box {
+		return op, fmt.Errorf("exactly one of BYRADIUS and BYBOX can be specified for %s", name)
+	}
+	if op.any && op.count == 0 {
+		return op, errors.New("the ANY argument requires COUNT argument")
+	}
+	if op.store && (op.withDist || op.withHash || op.withCoord) {
+		return op, fmt.Errorf("%s is not compatible with WITHDIST, WITHHASH and WITHCOORD options", name)
+	}
+	// like redis a COUNT without ANY returns the closest members
+	if op.count > 0 && op.sort == 0 && !op.any {
+		op.sort = 1
+	}
+	return op, nil
+}
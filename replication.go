@@ -0,0 +1,887 @@
+package cider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultReplBacklogSize = 1024 * 1024
+	// Primaries ping their replicas so both sides notice a dead link.
+	replPingPeriod = 10 * time.Second
+	// Link without traffic for this long is considered dead.
+	replTimeout = 60 * time.Second
+	// How often replicas acknowledge the processed offset.
+	replAckPeriod = time.Second
+	// Wait between attempts to connect to the primary.
+	replRetryInterval = time.Second
+	replDialTimeout   = 5 * time.Second
+)
+
+var errReadOnly = newCodedError("READONLY", "You can't write against a read only replica.")
+
+// Ring buffer of the most recent replication stream, used for partial resyncs.
+type backlog struct {
+	buf []byte
+	// next write position in buf
+	idx     int
+	histlen int
+}
+
+func newBacklog(size int64) *backlog {
+	if size <= 0 {
+		size = defaultReplBacklogSize
+	}
+	return &backlog{buf: make([]byte, size)}
+}
+
+func (b *backlog) write(p []byte) {
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		p = p[n:]
+	}
+}
+
+// Returns the last n bytes written.
+func (b *backlog) tail(n int) []byte {
+	n = min(n, b.histlen)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	out := make([]byte, 0, n)
+	if start+n <= len(b.buf) {
+		return append(out, b.buf[start:start+n]...)
+	}
+	out = append(out, b.buf[start:]...)
+	return append(out, b.buf[:n-len(out)]...)
+}
+
+// State of a replica connected to this server.
+type replicaLink struct {
+	ip        string
+	port      int
+	ackOffset int64
+	// offset the replica fsynced to its append only file, never set by cider replicas
+	aofOffset int64
+	ackTime   time.Time
+}
+
+// Replication state, both as a primary feeding replicas and as a replica of a primary.
+type replication struct {
+	// held for reading while a write runs and is propagated, and for writing
+	// while a snapshot is taken, so snapshots and the stream never overlap
+	writes *sync.RWMutex
+	// set once a backlog exists, lets writes skip feeding when replication was never used
+	active atomic.Bool
+	// resyncs served to replicas, shown by INFO stats
+	syncFull       atomic.Int64
+	syncPartialOK  atomic.Int64
+	syncPartialErr atomic.Int64
+	// time taken by the snapshot of the last full resync, exported as a metric
+	syncFullNanos atomic.Int64
+
+	mu *sync.Mutex
+	// the second id and offset let replicas of a promoted replica continue with a partial resync
+	replid       string
+	replid2      string
+	offset       int64
+	secondOffset int64
+	backlog      *backlog
+	backlogSize  int64
+	replicas     map[*Session]*replicaLink
+	lastPing     time.Time
+	// closed and replaced whenever a replica acknowledges an offset, wakes up WAIT
+	acked chan struct{}
+
+	// replica side, masterHost is empty on a primary
+	masterHost   string
+	masterPort   int
+	linkState    string
+	linkLastIO   time.Time
+	cancelLink   context.CancelFunc
+	masterClient *Session
+}
+
+func newReplication(backlogSize int64) *replication {
+	return &replication{
+		writes:       &sync.RWMutex{},
+		mu:           &sync.Mutex{},
+		replid:       newReplID(),
+		replid2:      strings.Repeat("0", 40),
+		secondOffset: -1,
+		backlogSize:  backlogSize,
+		replicas:     make(map[*Session]*replicaLink),
+		acked:        make(chan struct{}),
+	}
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (r *replication) isReplica() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.masterHost != ""
+}
+
+// Creates the backlog, caller must hold mu.
+func (r *replication) ensureBacklog() {
+	if r.backlog == nil {
+		r.backlog = newBacklog(r.backlogSize)
+		r.active.Store(true)
+	}
+}
+
+// Appends encoded commands to the backlog and sends them to every replica.
+// Returns the offset of the stream after them.
+func (r *replication) feed(stream []byte) int64 {
+	if !r.active.Load() {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.backlog.write(stream)
+	r.offset += int64(len(stream))
+	for s := range r.replicas {
+		s.out.push(stream)
+		s.flush()
+	}
+	return r.offset
+}
+
+func (r *replication) resizeBacklog(size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.backlogSize = size
+	if r.backlog == nil {
+		return
+	}
+	history := r.backlog.tail(r.backlog.histlen)
+	r.backlog = newBacklog(size)
+	r.backlog.write(history)
+}
+
+// Disconnects every replica, they reconnect and resync from the new history.
+// Caller must hold mu.
+func (r *replication) dropReplicas() {
+	for s := range r.replicas {
+		s.kill()
+	}
+	clear(r.replicas)
+}
+
+func (r *replication) removeReplica(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.replicas, s)
+}
+
+// Encodes a command as a RESP array of bulk strings, the form used on the replication stream.
+func encodeCommand(args []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buf.Bytes()
+}
+
+// Rewrites relative expire times as absolute ones, the stream may be replayed later by a partial resync.
+// Returns nil for commands that change nothing on replicas.
+func replicationArgs(op any, args []string) []string {
+	switch t := op.(type) {
+	case opSet:
+		if t.ex == 0 {
+			return args
+		}
+		rewritten := slices.Clone(args)
+		for i := 3; i < len(rewritten)-1; i++ {
+			if rewritten[i] == "EX" {
+				rewritten[i] = "EXAT"
+				rewritten[i+1] = strconv.FormatInt(time.Now().Unix()+t.ex, 10)
+				break
+			}
+		}
+		return rewritten
+	case opExpire:
+		rewritten := []string{"EXPIREAT", t.key, strconv.FormatInt(time.Now().Unix()+t.ttl, 10)}
+		return append(rewritten, args[min(3, len(args)):]...)
+	case opRestore:
+		if t.ttl == 0 || t.absttl {
+			return args
+		}
+		rewritten := slices.Clone(args)
+		rewritten[2] = strconv.FormatInt(time.Now().UnixMilli()+t.ttl, 10)
+		return append(rewritten, "ABSTTL")
+	case opMigrate:
+		// replicas delete the keys that moved instead of migrating them again
+		if t.copy {
+			return nil
+		}
+		return append([]string{"DEL"}, t.keys...)
+	case opFcall:
+		// the writes of a function are propagated one by one as it runs them
+		return nil
+	}
+	return args
+}
+
+// Propagates a write command that succeeded to the replicas and returns the
+// offset replicas have to reach to have it. Caller holds writes for reading.
+func (srv *Server) propagate(op any, args []string) int64 {
+	args = replicationArgs(op, args)
+	if args == nil {
+		return 0
+	}
+	return srv.repl.feed(encodeCommand(args))
+}
+
+// Pings replicas so they can tell an idle primary from a dead one.
+func (srv *Server) replicationCron() {
+	r := srv.repl
+	r.mu.Lock()
+	ping := len(r.replicas) > 0 && time.Since(r.lastPing) >= replPingPeriod
+	if ping {
+		r.lastPing = time.Now()
+	}
+	r.mu.Unlock()
+
+	if ping {
+		r.writes.RLock()
+		r.feed(encodeCommand([]string{"PING"}))
+		r.writes.RUnlock()
+	}
+}
+
+// Encodes every key as a RESTORE command, sent to replicas on a full resync. Values
+// travel as DUMP payloads so they arrive byte for byte whatever they hold. The
+// libraries come first, as a FUNCTION RESTORE replacing those of the replica.
+func snapshot(ctx context.Context, store keyspaceStorer, functions *functions) []byte {
+	var buf bytes.Buffer
+	buf.Write(encodeCommand([]string{"FUNCTION", "RESTORE", string(functions.dump()), "FLUSH"}))
+	restore := func(key string, payload []byte, ttl int64) bool {
+		args := []string{"RESTORE", key, "0", string(payload), "REPLACE"}
+		if ttl != -1 {
+			args[2] = strconv.FormatInt(ttl*1000, 10)
+			args = append(args, "ABSTTL")
+		}
+		buf.Write(encodeCommand(args))
+		return true
+	}
+	store.Range(ctx, func(key string, value []byte, ttl int64) bool {
+		return restore(key, dumpValue(value), ttl)
+	})
+	if zs, ok := store.(zsetStorer); ok {
+		zs.RangeZSets(ctx, func(key string, z *zset, ttl int64) bool {
+			return restore(key, dumpZSet(z), ttl)
+		})
+	}
+	return buf.Bytes()
+}
+
+// Turns the session into a replica link, replying with the missing part of the
+// stream when possible or a full snapshot otherwise.
+func (s *Session) handlePsync(store Storer, op opPsync) []byte {
+	r := s.server.repl
+	ks, err := keyspaceStoreOf(store)
+	if err != nil {
+		return replyError(err)
+	}
+
+	// no write may run between the snapshot and the replica joining the stream
+	r.writes.Lock()
+	defer r.writes.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ensureBacklog()
+
+	s.mu.Lock()
+	s.replica = true
+	port := s.replicaPort
+	s.mu.Unlock()
+
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	link := &replicaLink{ip: host, port: port, ackTime: time.Now()}
+
+	first := r.offset - int64(r.backlog.histlen) + 1
+	known := op.replid == r.replid || (op.replid == r.replid2 && op.offset <= r.secondOffset)
+	if known && op.offset >= first && op.offset <= r.offset+1 {
+		s.out.push([]byte(fmt.Sprintf("+CONTINUE %s\r\n", r.replid)))
+		if missing := int(r.offset - op.offset + 1); missing > 0 {
+			s.out.push(r.backlog.tail(missing))
+		}
+		link.ackOffset = op.offset - 1
+		r.replicas[s] = link
+		r.syncPartialOK.Add(1)
+		log.Info().Msgf("partial resync of replica %s:%d from offset %d", host, port, op.offset)
+		return nil
+	}
+
+	// a replica asking for a specific offset wanted a partial resync
+	if op.replid != "?" {
+		r.syncPartialErr.Add(1)
+	}
+	r.syncFull.Add(1)
+	// writes wait for the snapshot, so it counts as latency like the fork of redis does
+	start := time.Now()
+	data := snapshot(s.ctx, ks, s.server.functions)
+	took := time.Since(start)
+	r.syncFullNanos.Store(int64(took))
+	s.server.latency.add("snapshot", took)
+	s.out.push([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", r.replid, r.offset)))
+	s.out.push([]byte(fmt.Sprintf("$%d\r\n", len(data))))
+	s.out.push(data)
+	r.replicas[s] = link
+	log.Info().Msgf("full resync of replica %s:%d, %d bytes at offset %d", host, port, len(data), r.offset)
+	return nil
+}
+
+func (s *Session) handleReplconf(op opReplconf) []byte {
+	if len(op.args) == 0 || len(op.args)%2 != 0 {
+		return replyError(errors.New("syntax error"))
+	}
+	r := s.server.repl
+
+	// REPLCONF ACK <offset> [FACK <aofoffset>], acknowledgements are never replied to
+	if strings.EqualFold(op.args[0], "ack") {
+		offset, err := strconv.ParseInt(op.args[1], 10, 64)
+		if err != nil {
+			return nil
+		}
+		aofOffset := int64(0)
+		if len(op.args) == 4 && strings.EqualFold(op.args[2], "fack") {
+			aofOffset, _ = strconv.ParseInt(op.args[3], 10, 64)
+		}
+		r.ack(s, offset, aofOffset)
+		return nil
+	}
+
+	for i := 0; i < len(op.args); i += 2 {
+		value := op.args[i+1]
+		switch strings.ToLower(op.args[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return replyError(errors.New("value is not an integer or out of range"))
+			}
+			s.mu.Lock()
+			s.replicaPort = port
+			s.mu.Unlock()
+		case "capa", "ip-address":
+		default:
+			return replyError(fmt.Errorf("Unrecognized REPLCONF option: %s", op.args[i]))
+		}
+	}
+	return replyOK()
+}
+
+func (s *Session) handleReplicaOf(op opReplicaOf) []byte {
+	srv := s.server
+	r := srv.repl
+
+	// kept in the options so CONFIG GET and CONFIG REWRITE see the current primary
+	setReplicaOf := func(value string) {
+		srv.updateOptions(func(opts *ServerOptions) error {
+			opts.ReplicaOf = value
+			return nil
+		})
+	}
+
+	if srv.cluster != nil {
+		return replyError(errors.New("REPLICAOF not allowed in cluster mode."))
+	}
+	if strings.EqualFold(op.host, "no") && strings.EqualFold(op.port, "one") {
+		srv.promote()
+		setReplicaOf("")
+		return replyOK()
+	}
+
+	port, err := strconv.Atoi(op.port)
+	if err != nil || port <= 0 || port > 65535 {
+		return replyError(errors.New("Invalid master port"))
+	}
+
+	r.mu.Lock()
+	if r.masterHost == op.host && r.masterPort == port {
+		r.mu.Unlock()
+		return []byte("+OK Already connected to specified master\r\n")
+	}
+	r.mu.Unlock()
+
+	srv.replicaOf(op.host, port)
+	setReplicaOf(net.JoinHostPort(op.host, op.port))
+	return replyOK()
+}
+
+// Stops replicating and becomes a primary. Replicas of this server can continue with a partial resync.
+func (srv *Server) promote() {
+	r := srv.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost == "" {
+		return
+	}
+	log.Info().Msgf("stopped replicating %s:%d, now a primary", r.masterHost, r.masterPort)
+	if r.cancelLink != nil {
+		r.cancelLink()
+	}
+	r.masterHost = ""
+	r.masterPort = 0
+	r.cancelLink = nil
+
+	r.replid2 = r.replid
+	r.secondOffset = r.offset + 1
+	r.replid = newReplID()
+}
+
+// Starts replicating a primary, replacing any current one.
+func (srv *Server) replicaOf(host string, port int) {
+	r := srv.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancelLink != nil {
+		r.cancelLink()
+	}
+	// the history is kept, if the new primary shares it a partial resync is possible
+	ctx, cancel := context.WithCancel(srv.ctx)
+	r.masterHost = host
+	r.masterPort = port
+	r.linkState = "connect"
+	r.cancelLink = cancel
+	r.ensureBacklog()
+
+	log.Info().Msgf("replicating %s:%d", host, port)
+	go srv.replicate(ctx, host, port)
+}
+
+// Keeps a link with the primary until ctx is done, reconnecting when it drops.
+func (srv *Server) replicate(ctx context.Context, host string, port int) {
+	for ctx.Err() == nil {
+		err := srv.syncWithMaster(ctx, host, port)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Msgf("replication link with %s:%d lost", host, port)
+
+		srv.repl.setLinkState("connect")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replRetryInterval):
+		}
+	}
+}
+
+func (r *replication) setLinkState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.linkState = state
+	r.linkLastIO = time.Now()
+}
+
+// Port announced to the primary, the port of the first plain tcp listener.
+func (srv *Server) announcedPort() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.tcpPort()
+}
+
+// Caller must hold mu.
+func (srv *Server) tcpPort() int {
+	for _, l := range srv.listeners {
+		if tcp, ok := l.Addr().(*net.TCPAddr); ok {
+			return tcp.Port
+		}
+	}
+	return 0
+}
+
+// Connects to the primary, resyncs and applies the replication stream until the link fails.
+func (srv *Server) syncWithMaster(ctx context.Context, host string, port int) error {
+	r := srv.repl
+	r.setLinkState("connecting")
+
+	dialer := net.Dialer{Timeout: replDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReaderSize(conn, sessionBufferSize)
+	writeMu := &sync.Mutex{}
+	command := func(args ...string) (string, error) {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		_, err := conn.Write(encodeCommand(args))
+		if err != nil {
+			return "", err
+		}
+		reply, err := readLine(reader, maxInlineSize)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return "", fmt.Errorf("%s replied %s", args[0], reply[1:])
+		}
+		return reply, nil
+	}
+
+	opts := srv.options()
+	if opts.MasterAuth != "" {
+		args := []string{"AUTH", opts.MasterAuth}
+		if opts.MasterUser != "" {
+			args = []string{"AUTH", opts.MasterUser, opts.MasterAuth}
+		}
+		_, err := command(args...)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = command("PING")
+	if err != nil {
+		return err
+	}
+	_, err = command("REPLCONF", "listening-port", strconv.Itoa(srv.announcedPort()), "capa", "psync2")
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	replid, offset := r.replid, r.offset
+	r.mu.Unlock()
+
+	reply, err := command("PSYNC", replid, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return err
+	}
+
+	// the master link runs commands through a session whose replies are discarded
+	master := NewSession(ctx, conn, srv)
+	master.reader = reader
+	master.master = true
+	srv.clients.add(master)
+	defer srv.clients.remove(master)
+
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC offset %s", fields[2])
+		}
+		r.setLinkState("sync")
+		err = srv.loadSnapshot(master, reader, fields[1], offset)
+		if err != nil {
+			return err
+		}
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		r.mu.Lock()
+		// the primary was promoted and has a new id, the history is still shared
+		if len(fields) == 2 && fields[1] != r.replid {
+			r.replid2 = r.replid
+			r.secondOffset = r.offset + 1
+			r.replid = fields[1]
+			r.dropReplicas()
+		}
+		r.mu.Unlock()
+		log.Info().Msgf("partial resync with %s:%d accepted", host, port)
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %s", reply)
+	}
+
+	r.mu.Lock()
+	r.masterClient = master
+	r.mu.Unlock()
+	r.setLinkState("connected")
+	defer func() {
+		r.mu.Lock()
+		r.masterClient = nil
+		r.mu.Unlock()
+	}()
+
+	ack := func() error {
+		r.mu.Lock()
+		offset := r.offset
+		r.mu.Unlock()
+
+		writeMu.Lock()
+		defer writeMu.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		_, err := conn.Write(encodeCommand([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}))
+		return err
+	}
+
+	acks := time.NewTicker(replAckPeriod)
+	defer acks.Stop()
+	linkCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		for {
+			select {
+			case <-linkCtx.Done():
+				return
+			case <-acks.C:
+				if ack() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	conn.SetDeadline(time.Time{})
+	for {
+		if reader.Buffered() == 0 {
+			conn.SetReadDeadline(time.Now().Add(replTimeout))
+		}
+		args, err := readCommand(reader)
+		if err != nil {
+			return err
+		}
+		stream := encodeCommand(args)
+
+		r.mu.Lock()
+		r.linkLastIO = time.Now()
+		r.mu.Unlock()
+
+		if len(args) == 3 && strings.EqualFold(args[0], "REPLCONF") && strings.EqualFold(args[1], "GETACK") {
+			err := ack()
+			if err != nil {
+				return err
+			}
+		} else {
+			srv.applyReplicated(master, args, master.execute)
+		}
+
+		// the stream is kept byte for byte so offsets match the primary
+		r.writes.RLock()
+		r.feed(stream)
+		r.writes.RUnlock()
+	}
+}
+
+// Replaces the dataset with the snapshot sent by the primary.
+func (srv *Server) loadSnapshot(master *Session, reader *bufio.Reader, replid string, offset int64) error {
+	line, err := readLine(reader, maxInlineSize)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("unexpected snapshot header %s", line)
+	}
+	size, err := strconv.Atoi(line[1:])
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid snapshot size %s", line[1:])
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return err
+	}
+
+	r := srv.repl
+	r.writes.Lock()
+	defer r.writes.Unlock()
+
+	ks, err := keyspaceStoreOf(srv.store)
+	if err != nil {
+		return err
+	}
+	err = ks.Flush(master.ctx)
+	if err != nil {
+		return err
+	}
+	snapshot := bufio.NewReader(bytes.NewReader(data))
+	keys := 0
+	for {
+		args, err := readCommand(snapshot)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		// run in place, a command on the event loop may be waiting for writes
+		srv.applyReplicated(master, args, master.run)
+		if !strings.EqualFold(args[0], "FUNCTION") {
+			keys++
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the history changed, replicas of this server have to resync
+	r.replid = replid
+	r.replid2 = strings.Repeat("0", 40)
+	r.secondOffset = -1
+	r.offset = offset
+	r.backlog = newBacklog(r.backlogSize)
+	r.active.Store(true)
+	r.dropReplicas()
+
+	log.Info().Msgf("loaded %d keys from the primary at offset %d", keys, offset)
+	return nil
+}
+
+// Runs a command received from the primary with execute or run, the reply is discarded.
+func (srv *Server) applyReplicated(master *Session, args []string, run func(store Storer, op any, args []string, write bool) []byte) {
+	op, err := parseArgs(args)
+	if err != nil {
+		log.Warn().Err(err).Msgf("unable to parse replicated command %s", args[0])
+		return
+	}
+	// already propagated by the primary, so not run as a write
+	reply := run(srv.store, op, args, false)
+	if len(reply) > 0 && reply[0] == '-' {
+		log.Warn().Msgf("replicated command %s failed: %s", args[0], strings.TrimSpace(string(reply[1:])))
+	}
+}
+
+// Describes replication for INFO.
+func (srv *Server) replicationInfo(field func(name string, value any)) {
+	r := srv.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost == "" {
+		field("role", "master")
+	} else {
+		field("role", "slave")
+		field("master_host", r.masterHost)
+		field("master_port", r.masterPort)
+		status := "down"
+		if r.linkState == "connected" {
+			status = "up"
+		}
+		field("master_link_status", status)
+		field("master_last_io_seconds_ago", int64(time.Since(r.linkLastIO).Seconds()))
+		syncing := 0
+		if r.linkState == "sync" {
+			syncing = 1
+		}
+		field("master_sync_in_progress", syncing)
+		field("slave_read_repl_offset", r.offset)
+		field("slave_repl_offset", r.offset)
+		field("slave_priority", 100)
+		field("slave_read_only", 1)
+		field("replica_announced", 1)
+	}
+
+	field("connected_slaves", len(r.replicas))
+	for i, link := range r.sortedReplicas() {
+		field(fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%s,port=%d,state=online,offset=%d,lag=%d",
+			link.ip, link.port, link.ackOffset, int64(time.Since(link.ackTime).Seconds())))
+	}
+	field("master_failover_state", "no-failover")
+	field("master_replid", r.replid)
+	field("master_replid2", r.replid2)
+	field("master_repl_offset", r.offset)
+	field("second_repl_offset", r.secondOffset)
+
+	active, size, first, histlen := 0, r.backlogSize, int64(0), 0
+	if size <= 0 {
+		size = defaultReplBacklogSize
+	}
+	if r.backlog != nil {
+		active = 1
+		histlen = r.backlog.histlen
+		first = r.offset - int64(histlen) + 1
+	}
+	field("repl_backlog_active", active)
+	field("repl_backlog_size", size)
+	field("repl_backlog_first_byte_offset", first)
+	field("repl_backlog_histlen", histlen)
+}
+
+// Replicas ordered by address, caller must hold mu.
+func (r *replication) sortedReplicas() []*replicaLink {
+	links := make([]*replicaLink, 0, len(r.replicas))
+	for _, link := range r.replicas {
+		links = append(links, link)
+	}
+	slices.SortFunc(links, func(a, b *replicaLink) int {
+		if c := strings.Compare(a.ip, b.ip); c != 0 {
+			return c
+		}
+		return a.port - b.port
+	})
+	return links
+}
+
+func (s *Session) handleRole() []byte {
+	if st := s.server.sentinel; st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		names := make([][]byte, 0, len(st.masters))
+		for _, name := range st.names() {
+			names = append(names, replyString([]byte(name)))
+		}
+		return replyArray([][]byte{replyString([]byte("sentinel")), replyArray(names)})
+	}
+
+	r := s.server.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.masterHost != "" {
+		return replyArray([][]byte{
+			replyString([]byte("slave")),
+			replyString([]byte(r.masterHost)),
+			replyInteger(int64(r.masterPort)),
+			replyString([]byte(r.linkState)),
+			replyInteger(r.offset),
+		})
+	}
+
+	var replicas [][]byte
+	for _, link := range r.sortedReplicas() {
+		replicas = append(replicas, replyArray([][]byte{
+			replyString([]byte(link.ip)),
+			replyString([]byte(strconv.Itoa(link.port))),
+			replyString([]byte(strconv.FormatInt(link.ackOffset, 10))),
+		}))
+	}
+	return replyArray([][]byte{
+		replyString([]byte("master")),
+		replyInteger(r.offset),
+		replyArray(replicas),
+	})
+}
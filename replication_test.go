@@ -0,0 +1,319 @@
+package cider
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Polls a command until its reply contains want.
+func waitForReply(t *testing.T, client *testClient, command string, want string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply := client.do(t, command)
+		if strings.Contains(reply, want) {
+			return reply
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: want reply containing %q, got %q", command, want, reply)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func infoField(info string, name string) string {
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, name+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestReplication(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{Listeners: listeners})
+	replica := startTestServer(t, ServerOptions{Listeners: listeners})
+
+	p := dialTestClient(t, "tcp", primary.Addrs()[0].String())
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+
+	// keys written before the replica connects are sent with the snapshot
+	p.do(t, "SET foo bar")
+	p.do(t, "SET ttl value EX 100")
+	r.do(t, "SET stale value")
+	p.do(t, "GEOADD geo 13.361389 38.115556 Palermo")
+
+	host, port, _ := strings.Cut(primary.Addrs()[0].String(), ":")
+	if reply := r.do(t, "REPLICAOF "+host+" "+port); reply != "+OK\r\n" {
+		t.Fatalf("want: +OK, got %q", reply)
+	}
+	waitForReply(t, r, "INFO replication", "master_link_status:up")
+
+	if reply := r.do(t, "GET foo"); reply != "$3\r\nbar\r\n" {
+		t.Errorf("want: bar, got %q", reply)
+	}
+	if ttl, _ := replica.store.TTL(context.Background(), "ttl"); ttl < 0 {
+		t.Errorf("want ttl to be replicated, got %d", ttl)
+	}
+	if reply := r.do(t, "GEOHASH geo Palermo"); reply != "*1\r\n$11\r\nsqc8b49rny0\r\n" {
+		t.Errorf("want sorted set to be replicated, got %q", reply)
+	}
+	if reply := r.do(t, "GET stale"); reply != "_\r\n" {
+		t.Errorf("want keys of the replica to be flushed, got %q", reply)
+	}
+
+	// writes are streamed, expire times are sent as absolute times
+	p.do(t, "SET counter 1")
+	p.do(t, "INCR counter")
+	p.do(t, "EXPIRE foo 100")
+	p.do(t, "DEL ttl")
+	p.do(t, "GEOADD geo 15.087269 37.502669 Catania")
+	waitForReply(t, r, "GET counter", "$1\r\n2\r\n")
+	waitForReply(t, r, "GEODIST geo Palermo Catania", "166274.1516")
+	if ttl, _ := replica.store.TTL(context.Background(), "foo"); ttl < 0 {
+		t.Errorf("want expire to be replicated, got %d", ttl)
+	}
+	if reply := r.do(t, "EXISTS ttl"); reply != ":0\r\n" {
+		t.Errorf("want deleted key to be replicated, got %q", reply)
+	}
+
+	if reply := r.do(t, "SET foo baz"); !strings.HasPrefix(reply, "-READONLY") {
+		t.Errorf("want READONLY error, got %q", reply)
+	}
+
+	role := p.do(t, "ROLE")
+	if !strings.HasPrefix(role, "*3\r\n$6\r\nmaster\r\n") || !strings.Contains(role, "$9\r\n127.0.0.1\r\n") {
+		t.Errorf("want master role listing the replica, got %q", role)
+	}
+	role = r.do(t, "ROLE")
+	if !regexp.MustCompile(`^\*5\r\n\$5\r\nslave\r\n\$9\r\n127\.0\.0\.1\r\n:\d+\r\n\$9\r\nconnected\r\n:\d+\r\n$`).MatchString(role) {
+		t.Errorf("want slave role, got %q", role)
+	}
+
+	info := p.do(t, "INFO")
+	if infoField(info, "connected_slaves") != "1" || infoField(info, "sync_full") != "1" {
+		t.Errorf("want one replica after a full sync, got %q", info)
+	}
+
+	// replica links and the link with the primary have their own client types
+	if list := p.do(t, "CLIENT LIST TYPE replica"); strings.Count(list, "flags=S") != 1 || strings.Contains(list, "flags=N") {
+		t.Errorf("want only the replica, got %q", list)
+	}
+	if list := p.do(t, "CLIENT LIST TYPE normal"); strings.Contains(list, "flags=S") || !strings.Contains(list, "flags=N") {
+		t.Errorf("want only normal clients, got %q", list)
+	}
+	if list := r.do(t, "CLIENT LIST TYPE master"); strings.Count(list, "flags=M") != 1 || strings.Contains(list, "flags=N") {
+		t.Errorf("want only the master link, got %q", list)
+	}
+	if reply := p.do(t, "CLIENT KILL TYPE master"); reply != ":0\r\n" {
+		t.Errorf("want no master link on the primary, got %q", reply)
+	}
+
+	// a dropped link is resumed from the backlog
+	if reply := r.do(t, "CLIENT KILL TYPE master"); reply != ":1\r\n" {
+		t.Errorf("want master link killed, got %q", reply)
+	}
+	p.do(t, "SET after reconnect")
+	waitForReply(t, r, "GET after", "reconnect")
+	waitForReply(t, p, "INFO stats", "sync_partial_ok:1")
+
+	info = p.do(t, "INFO replication")
+	offset := infoField(info, "master_repl_offset")
+	replicaInfo := waitForReply(t, r, "INFO replication", "slave_repl_offset:"+offset)
+	if infoField(replicaInfo, "master_replid") != infoField(info, "master_replid") {
+		t.Errorf("want replica to share the primary replid, got %q and %q", replicaInfo, info)
+	}
+}
+
+// Values with whitespace, line breaks and every byte survive a full resync.
+func TestReplicationBinaryValues(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{Listeners: listeners})
+	replica := startTestServer(t, ServerOptions{Listeners: listeners})
+
+	ctx := context.Background()
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	values := map[string][]byte{
+		"spaces":   []byte("  padded value \t "),
+		"newlines": []byte("\r\nline\r\n"),
+		"bytes":    all,
+		"empty":    {},
+	}
+	for key, value := range values {
+		if err := primary.store.Set(ctx, key, value, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := dialTestClient(t, "tcp", primary.Addrs()[0].String())
+	for i := 0; i < 200; i++ {
+		p.do(t, "PFADD hll element"+strconv.Itoa(i))
+	}
+	values["hll"], _, _ = primary.store.Get(ctx, "hll")
+
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+	host, port, _ := strings.Cut(primary.Addrs()[0].String(), ":")
+	r.do(t, "REPLICAOF "+host+" "+port)
+	waitForReply(t, r, "INFO replication", "master_link_status:up")
+
+	for key, want := range values {
+		value, _, err := replica.store.Get(ctx, key)
+		if err != nil || !bytes.Equal(value, want) {
+			t.Errorf("%s: want %q, got %q (%v)", key, want, value, err)
+		}
+	}
+	if reply := r.do(t, "PFCOUNT hll"); reply != p.do(t, "PFCOUNT hll") {
+		t.Errorf("want the same count on both servers, got %q", reply)
+	}
+}
+
+// Takes its time to walk the keyspace, like a large one.
+type slowRangeStore struct {
+	*store
+}
+
+func (s slowRangeStore) Range(ctx context.Context, f func(key string, value []byte, ttl int64) bool) {
+	time.Sleep(20 * time.Millisecond)
+	s.store.Range(ctx, f)
+}
+
+func TestFullSyncLatency(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{
+		Listeners:               listeners,
+		Store:                   slowRangeStore{NewStore()},
+		LatencyMonitorThreshold: 10 * time.Millisecond,
+	})
+	replica := startTestServer(t, ServerOptions{Listeners: listeners})
+
+	p := dialTestClient(t, "tcp", primary.Addrs()[0].String())
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+	host, port, _ := strings.Cut(primary.Addrs()[0].String(), ":")
+	r.do(t, "REPLICAOF "+host+" "+port)
+	waitForReply(t, r, "INFO replication", "master_link_status:up")
+
+	// writes are blocked while the snapshot is built
+	if reply := p.do(t, "LATENCY HISTORY snapshot"); !strings.HasPrefix(reply, "*1\r\n") {
+		t.Errorf("want a snapshot latency event, got %q", reply)
+	}
+
+	var metrics bytes.Buffer
+	err := primary.WriteMetrics(&metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(metrics.String(), "cider_full_syncs_total 1\n") {
+		t.Errorf("want one full sync, got\n%s", metrics.String())
+	}
+	match := regexp.MustCompile(`(?m)^cider_full_sync_duration_seconds (\S+)$`).FindStringSubmatch(metrics.String())
+	if match == nil {
+		t.Fatalf("want the snapshot duration, got\n%s", metrics.String())
+	}
+	if seconds, _ := strconv.ParseFloat(match[1], 64); seconds < 0.02 {
+		t.Errorf("want at least the 20ms the snapshot took, got %s", match[1])
+	}
+}
+
+func TestReplicaPromotion(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{Listeners: listeners})
+	replica := startTestServer(t, ServerOptions{
+		Listeners: listeners,
+		ReplicaOf: primary.Addrs()[0].String(),
+	})
+
+	p := dialTestClient(t, "tcp", primary.Addrs()[0].String())
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+
+	p.do(t, "SET foo bar")
+	waitForReply(t, r, "GET foo", "bar")
+
+	before := r.do(t, "INFO replication")
+	if reply := r.do(t, "REPLICAOF NO ONE"); reply != "+OK\r\n" {
+		t.Fatalf("want: +OK, got %q", reply)
+	}
+	after := r.do(t, "INFO replication")
+
+	if infoField(after, "role") != "master" {
+		t.Errorf("want master role, got %q", after)
+	}
+	if infoField(after, "master_replid2") != infoField(before, "master_replid") {
+		t.Errorf("want previous replid as replid2, got %q", after)
+	}
+	if reply := r.do(t, "SET foo baz"); reply != "+OK\r\n" {
+		t.Errorf("want promoted replica to accept writes, got %q", reply)
+	}
+	if reply := r.do(t, "CONFIG GET replicaof"); reply != "*2\r\n$9\r\nreplicaof\r\n$0\r\n\r\n" {
+		t.Errorf("want replicaof to be cleared, got %q", reply)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(8)
+	b.write([]byte("abc"))
+	if got := b.tail(3); !bytes.Equal(got, []byte("abc")) {
+		t.Errorf("want: abc, got %q", got)
+	}
+
+	b.write([]byte("defghij"))
+	if b.histlen != 8 {
+		t.Errorf("want: 8, got %d", b.histlen)
+	}
+	if got := b.tail(8); !bytes.Equal(got, []byte("cdefghij")) {
+		t.Errorf("want: cdefghij, got %q", got)
+	}
+	if got := b.tail(20); !bytes.Equal(got, []byte("cdefghij")) {
+		t.Errorf("want: cdefghij, got %q", got)
+	}
+
+	b.write([]byte("0123456789"))
+	if got := b.tail(4); !bytes.Equal(got, []byte("6789")) {
+		t.Errorf("want: 6789, got %q", got)
+	}
+}
+
+func TestReplicationArgs(t *testing.T) {
+	op, _ := parseArgs([]string{"SET", "foo", "bar", "EX", "10"})
+	args := replicationArgs(op, []string{"SET", "foo", "bar", "EX", "10"})
+	if args[3] != "EXAT" || args[4] == "10" {
+		t.Errorf("want EX rewritten as EXAT, got %v", args)
+	}
+
+	op, _ = parseArgs([]string{"EXPIRE", "foo", "10"})
+	args = replicationArgs(op, []string{"EXPIRE", "foo", "10"})
+	if args[0] != "EXPIREAT" || args[2] == "10" {
+		t.Errorf("want EXPIRE rewritten as EXPIREAT, got %v", args)
+	}
+
+	restore := []string{"RESTORE", "foo", "1000", "payload", "REPLACE"}
+	op, _ = parseArgs(restore)
+	args = replicationArgs(op, restore)
+	if len(args) != 6 || args[2] == "1000" || args[5] != "ABSTTL" {
+		t.Errorf("want RESTORE ttl rewritten as ABSTTL, got %v", args)
+	}
+
+	migrate := []string{"MIGRATE", "127.0.0.1", "6379", "", "0", "1000", "KEYS", "a", "b"}
+	op, _ = parseArgs(migrate)
+	if args = replicationArgs(op, migrate); !slices.Equal(args, []string{"DEL", "a", "b"}) {
+		t.Errorf("want MIGRATE propagated as DEL, got %v", args)
+	}
+	op, _ = parseArgs(append(migrate[:6:6], "COPY"))
+	if args = replicationArgs(op, migrate); args != nil {
+		t.Errorf("want MIGRATE COPY not propagated, got %v", args)
+	}
+
+	want := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	if got := string(encodeCommand([]string{"SET", "foo", "bar"})); got != want {
+		t.Errorf("want: %q, got %q", want, got)
+	}
+}
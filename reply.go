@@ -1,6 +1,11 @@
 package cider
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
 
 type Replyer interface {
 	replyOK() []byte
@@ -8,16 +13,41 @@ type Replyer interface {
 	replyNil() []byte
 	replyString(value []byte) []byte
 	replyInteger(value int64) []byte
+	replyArray(values [][]byte) []byte
+}
+
+// Error with a Redis error code prefix other than the generic ERR, e.g. NOAUTH or NOPERM.
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+func newCodedError(code string, message string) error {
+	return &codedError{
+		code:    code,
+		message: message,
+	}
 }
 
 func replyOK() []byte {
 	return []byte("+OK\r\n")
 }
 
+// Errors often quote client input, newlines are replaced by spaces so they can't end the reply early.
 func replyError(err error) []byte {
-	return []byte(fmt.Sprintf("-ERR %s\r\n", err.Error()))
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return []byte(fmt.Sprintf("-%s %s\r\n", coded.code, errorNewlines.Replace(coded.message)))
+	}
+	return []byte(fmt.Sprintf("-ERR %s\r\n", errorNewlines.Replace(err.Error())))
 }
 
+var errorNewlines = strings.NewReplacer("\r", " ", "\n", " ")
+
 func replyNil() []byte {
 	return []byte("_\r\n")
 }
@@ -29,3 +59,23 @@ func replyString(value []byte) []byte {
 func replyInteger(value int64) []byte {
 	return []byte(fmt.Sprintf(":%d\r\n", value))
 }
+
+// Help lines are sent as simple strings like redis does.
+func replyHelp(lines []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(lines))
+	for _, line := range lines {
+		fmt.Fprintf(&buf, "+%s\r\n", line)
+	}
+	return buf.Bytes()
+}
+
+// Values are expected to be already encoded replies so arrays can be nested.
+func replyArray(values [][]byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(values))
+	for _, v := range values {
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
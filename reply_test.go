@@ -26,6 +26,20 @@ func TestError(t *testing.T) {
 	}
 }
 
+func TestErrorNewlines(t *testing.T) {
+	want := []byte("-ERR unknown command 'a  +OK'\r\n")
+	res := replyError(errors.New("unknown command 'a\r\n+OK'"))
+	if slices.Compare(res, want) != 0 {
+		t.Errorf("want: %q, got %q", want, res)
+	}
+
+	want = []byte("-NOPERM no  permissions\r\n")
+	res = replyError(newCodedError("NOPERM", "no\r\npermissions"))
+	if slices.Compare(res, want) != 0 {
+		t.Errorf("want: %q, got %q", want, res)
+	}
+}
+
 func TestNil(t *testing.T) {
 	want := []byte("_\r\n")
 	res := replyNil()
@@ -48,3 +62,19 @@ func TestInteger(t *testing.T) {
 		t.Errorf("want: %v, got %v", want, res)
 	}
 }
+
+func TestCodedError(t *testing.T) {
+	want := []byte("-NOAUTH Authentication required.\r\n")
+	res := replyError(newCodedError("NOAUTH", "Authentication required."))
+	if slices.Compare(res, want) != 0 {
+		t.Errorf("want: %v, got %v", want, res)
+	}
+}
+
+func TestArray(t *testing.T) {
+	want := []byte("*2\r\n$3\r\nfoo\r\n:42\r\n")
+	res := replyArray([][]byte{replyString([]byte("foo")), replyInteger(42)})
+	if slices.Compare(res, want) != 0 {
+		t.Errorf("want: %v, got %v", want, res)
+	}
+}
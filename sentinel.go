@@ -0,0 +1,1174 @@
+package cider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Instances are pinged this often, or every down-after period when shorter.
+	sentinelPingPeriod = time.Second
+	// INFO is polled this often, every ping period while the primary is down or failing over.
+	sentinelInfoPeriod = 10 * time.Second
+	// Hello messages are sent to other sentinels this often.
+	sentinelHelloPeriod = 2 * time.Second
+	// How often the failover state of every primary is evaluated.
+	sentinelTickPeriod = 100 * time.Millisecond
+	// Other sentinels' opinion on a primary is ignored once older than this many ping periods.
+	sentinelReplyValidity = 5
+	// Failover attempts are delayed by up to this long.
+	sentinelMaxDesync = time.Second
+	// Longest a sentinel waits to be elected before abandoning a failover.
+	sentinelElectionTimeout = 10 * time.Second
+
+	defaultSentinelDownAfter       = 30 * time.Second
+	defaultSentinelFailoverTimeout = 3 * time.Minute
+)
+
+// Failover states, named like redis reports them.
+const (
+	failoverNone          = "none"
+	failoverWaitStart     = "wait_start"
+	failoverSelectReplica = "select_slave"
+	failoverWaitPromotion = "wait_promotion"
+)
+
+type SentinelOptions struct {
+	Masters []SentinelMasterOptions
+}
+
+type SentinelMasterOptions struct {
+	Name string
+	// host:port of the primary.
+	Address string
+	// Number of sentinels that have to agree the primary is down before failing over.
+	Quorum int
+	// The primary is considered down once it did not reply for this long, defaults to 30 seconds.
+	DownAfter time.Duration
+	// A failover is abandoned after this long and not retried for twice as long, defaults to 3 minutes.
+	FailoverTimeout time.Duration
+	// Credentials used with the primary and its replicas.
+	AuthUser string
+	AuthPass string
+	// Addresses of other sentinels monitoring the primary, more are learned from their hello messages.
+	Sentinels []string
+}
+
+// A primary, replica or sentinel watched by this sentinel.
+type sentinelInstance struct {
+	// master, slave or sentinel
+	kind    string
+	address string
+	runID   string
+	created time.Time
+	// last valid reply to PING
+	lastPong time.Time
+	sdown    bool
+	lastInfo time.Time
+	// reported by INFO
+	role          string
+	masterAddress string
+	masterLinkUp  bool
+	offset        int64
+	// replies of another sentinel to is-master-down-by-addr
+	masterDown  bool
+	lastReply   time.Time
+	leader      string
+	leaderEpoch int64
+	lastHello   time.Time
+
+	// guards link, which is used without holding the sentinel lock
+	linkMu *sync.Mutex
+	link   *link
+	cancel context.CancelFunc
+}
+
+func newSentinelInstance(kind string, address string) *sentinelInstance {
+	return &sentinelInstance{
+		kind:    kind,
+		address: address,
+		created: time.Now(),
+		linkMu:  &sync.Mutex{},
+	}
+}
+
+func (inst *sentinelInstance) flags() string {
+	flags := inst.kind
+	if inst.sdown {
+		flags += ",s_down"
+	}
+	return flags
+}
+
+func (inst *sentinelInstance) closeLink() {
+	inst.linkMu.Lock()
+	defer inst.linkMu.Unlock()
+
+	if inst.link != nil {
+		inst.link.Close()
+		inst.link = nil
+	}
+}
+
+// A monitored primary with its replicas and the other sentinels watching it.
+type sentinelMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	authUser        string
+	authPass        string
+
+	master    *sentinelInstance
+	replicas  map[string]*sentinelInstance
+	sentinels map[string]*sentinelInstance
+	// epoch of the failover that made the current primary
+	configEpoch int64
+	odown       bool
+	lastAsk     time.Time
+
+	// sentinel voted for as failover leader, and in which epoch
+	leader      string
+	leaderEpoch int64
+
+	failoverState string
+	failoverEpoch int64
+	failoverStart time.Time
+	// when the failover of a primary objectively down is attempted
+	tryAt time.Time
+	// started by SENTINEL FAILOVER, no agreement is needed
+	forced   bool
+	promoted *sentinelInstance
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (m *sentinelMaster) pingPeriod() time.Duration {
+	return min(sentinelPingPeriod, m.downAfter)
+}
+
+// Sentinel mode, monitors primaries and promotes a replica when one fails.
+type sentinel struct {
+	srv *Server
+	// guards everything below and the state of every instance
+	mu           *sync.Mutex
+	currentEpoch int64
+	masters      map[string]*sentinelMaster
+	ctx          context.Context
+}
+
+func newSentinel(srv *Server, opts SentinelOptions) (*sentinel, error) {
+	st := &sentinel{
+		srv:     srv,
+		mu:      &sync.Mutex{},
+		masters: make(map[string]*sentinelMaster),
+	}
+	for _, m := range opts.Masters {
+		_, err := st.addMaster(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// Registers a primary to monitor, watching starts once the sentinel runs. Caller must not hold mu.
+func (st *sentinel) addMaster(opts SentinelMasterOptions) (*sentinelMaster, error) {
+	if opts.Name == "" {
+		return nil, errors.New("sentinel primary name is required")
+	}
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		return nil, fmt.Errorf("invalid address of %s: %w", opts.Name, err)
+	}
+	if opts.Quorum <= 0 {
+		return nil, errors.New("quorum must be 1 or greater")
+	}
+	if opts.DownAfter == 0 {
+		opts.DownAfter = defaultSentinelDownAfter
+	}
+	if opts.FailoverTimeout == 0 {
+		opts.FailoverTimeout = defaultSentinelFailoverTimeout
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.masters[opts.Name]; ok {
+		return nil, errors.New("Duplicated master name")
+	}
+	m := &sentinelMaster{
+		name:            opts.Name,
+		quorum:          opts.Quorum,
+		downAfter:       opts.DownAfter,
+		failoverTimeout: opts.FailoverTimeout,
+		authUser:        opts.AuthUser,
+		authPass:        opts.AuthPass,
+		master:          newSentinelInstance("master", opts.Address),
+		replicas:        make(map[string]*sentinelInstance),
+		sentinels:       make(map[string]*sentinelInstance),
+		failoverState:   failoverNone,
+	}
+	for _, address := range opts.Sentinels {
+		m.sentinels[address] = newSentinelInstance("sentinel", address)
+	}
+	st.masters[m.name] = m
+
+	if st.ctx != nil {
+		st.startMaster(m)
+	}
+	return m, nil
+}
+
+// Starts watching every primary until ctx is done.
+func (st *sentinel) start(ctx context.Context) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.ctx = ctx
+	for _, m := range st.masters {
+		st.startMaster(m)
+	}
+}
+
+// Caller must hold mu.
+func (st *sentinel) startMaster(m *sentinelMaster) {
+	m.ctx, m.cancel = context.WithCancel(st.ctx)
+	log.Info().Msgf("+monitor master %s %s quorum %d", m.name, m.master.address, m.quorum)
+
+	st.startWatch(m, m.master)
+	for _, inst := range m.sentinels {
+		st.startWatch(m, inst)
+	}
+	go func() {
+		ticker := time.NewTicker(sentinelTickPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				st.tick(m)
+			}
+		}
+	}()
+}
+
+// Caller must hold mu.
+func (st *sentinel) removeMaster(m *sentinelMaster) {
+	delete(st.masters, m.name)
+	if m.cancel != nil {
+		m.cancel()
+	}
+	log.Info().Msgf("-monitor master %s %s", m.name, m.master.address)
+}
+
+// Caller must hold mu.
+func (st *sentinel) startWatch(m *sentinelMaster, inst *sentinelInstance) {
+	var ctx context.Context
+	ctx, inst.cancel = context.WithCancel(m.ctx)
+	go st.watch(ctx, m, inst)
+}
+
+// Pings an instance, polls its INFO and sends hello messages to sentinels until ctx is done.
+func (st *sentinel) watch(ctx context.Context, m *sentinelMaster, inst *sentinelInstance) {
+	defer inst.closeLink()
+
+	st.mu.Lock()
+	period := m.pingPeriod()
+	st.mu.Unlock()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		st.check(ctx, m, inst)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the connection to an instance, connecting when needed.
+func (st *sentinel) instanceLink(ctx context.Context, m *sentinelMaster, inst *sentinelInstance) (*link, error) {
+	inst.linkMu.Lock()
+	defer inst.linkMu.Unlock()
+
+	if inst.link != nil {
+		return inst.link, nil
+	}
+
+	st.mu.Lock()
+	timeout := m.pingPeriod()
+	user, pass := m.authUser, m.authPass
+	if inst.kind == "sentinel" {
+		user, pass = "", ""
+	}
+	st.mu.Unlock()
+
+	l, err := dialLink(ctx, inst.address, timeout, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	inst.link = l
+	return l, nil
+}
+
+// Runs a command on an instance, dropping the connection on network errors.
+func (st *sentinel) command(ctx context.Context, m *sentinelMaster, inst *sentinelInstance, args ...string) (any, error) {
+	l, err := st.instanceLink(ctx, m, inst)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := l.do(args...)
+	var rerr replyErr
+	if err != nil && !errors.As(err, &rerr) {
+		inst.closeLink()
+	}
+	return reply, err
+}
+
+func (st *sentinel) check(ctx context.Context, m *sentinelMaster, inst *sentinelInstance) {
+	_, err := st.command(ctx, m, inst, "PING")
+	var rerr replyErr
+	// like redis, an instance loading its data or without a primary link is still alive
+	alive := err == nil || (errors.As(err, &rerr) &&
+		(strings.HasPrefix(string(rerr), "LOADING") || strings.HasPrefix(string(rerr), "MASTERDOWN")))
+
+	st.mu.Lock()
+	if alive {
+		inst.lastPong = time.Now()
+	}
+	kind := inst.kind
+	infoPeriod := sentinelInfoPeriod
+	if m.master.sdown || m.failoverState != failoverNone {
+		infoPeriod = m.pingPeriod()
+	}
+	infoDue := time.Since(inst.lastInfo) >= infoPeriod
+	helloDue := time.Since(inst.lastHello) >= min(sentinelHelloPeriod, 2*m.pingPeriod())
+	st.mu.Unlock()
+
+	if err != nil && !alive {
+		return
+	}
+
+	switch {
+	case kind != "sentinel" && infoDue:
+		reply, err := st.command(ctx, m, inst, "INFO")
+		if info, ok := reply.(string); ok && err == nil {
+			st.refreshInfo(m, inst, parseInfo(info))
+		}
+	case kind == "sentinel" && helloDue:
+		st.sendHello(ctx, m, inst)
+	}
+}
+
+// Parses the redis INFO text format into fields.
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && !strings.HasPrefix(line, "#") {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// Updates an instance from its INFO and fixes replicas pointing at the wrong primary.
+func (st *sentinel) refreshInfo(m *sentinelMaster, inst *sentinelInstance, info map[string]string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	inst.lastInfo = time.Now()
+	inst.runID = info["run_id"]
+	inst.role = info["role"]
+	inst.masterAddress = ""
+	if inst.role == "slave" {
+		inst.masterAddress = net.JoinHostPort(info["master_host"], info["master_port"])
+		inst.masterLinkUp = info["master_link_status"] == "up"
+		inst.offset, _ = strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+	}
+
+	// replicas are discovered through the primary
+	if inst == m.master && inst.role == "master" {
+		for name, value := range info {
+			if !strings.HasPrefix(name, "slave") || !strings.Contains(value, "ip=") {
+				continue
+			}
+			var ip, port string
+			for _, field := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(field, "=")
+				switch k {
+				case "ip":
+					ip = v
+				case "port":
+					port = v
+				}
+			}
+			address := net.JoinHostPort(ip, port)
+			if _, ok := m.replicas[address]; ok || address == m.master.address {
+				continue
+			}
+			replica := newSentinelInstance("slave", address)
+			m.replicas[address] = replica
+			log.Info().Msgf("+slave slave %s @ %s %s", address, m.name, m.master.address)
+			st.startWatch(m, replica)
+		}
+	}
+
+	if m.failoverState == failoverWaitPromotion && inst == m.promoted && inst.role == "master" {
+		st.promotionDone(m)
+		return
+	}
+
+	// replicas replicating something else, or a restarted old primary, are pointed at the primary
+	if inst.kind != "slave" || m.failoverState != failoverNone || m.master.sdown {
+		return
+	}
+	if inst.role == "master" || inst.masterAddress != m.master.address {
+		event := "+fix-slave-config"
+		if inst.role == "master" {
+			event = "+convert-to-slave"
+		}
+		log.Info().Msgf("%s slave %s @ %s %s", event, inst.address, m.name, m.master.address)
+		go st.replicaOf(m, inst, m.master.address)
+	}
+}
+
+// Sends REPLICAOF to an instance, an empty address promotes it.
+func (st *sentinel) replicaOf(m *sentinelMaster, inst *sentinelInstance, address string) {
+	args := []string{"REPLICAOF", "NO", "ONE"}
+	if address != "" {
+		host, port, _ := net.SplitHostPort(address)
+		args = []string{"REPLICAOF", host, port}
+	}
+	_, err := st.command(m.ctx, m, inst, args...)
+	if err != nil {
+		log.Warn().Err(err).Msgf("unable to reconfigure %s", inst.address)
+	}
+}
+
+func (st *sentinel) sendHello(ctx context.Context, m *sentinelMaster, inst *sentinelInstance) {
+	l, err := st.instanceLink(ctx, m, inst)
+	if err != nil {
+		return
+	}
+	// other sentinels reach this one on the address it connects from
+	ip, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+
+	st.mu.Lock()
+	host, port, _ := net.SplitHostPort(m.master.address)
+	args := []string{
+		"SENTINEL", "HELLO", ip, strconv.Itoa(st.srv.announcedPort()), st.srv.runID,
+		strconv.FormatInt(st.currentEpoch, 10), m.name, host, port, strconv.FormatInt(m.configEpoch, 10),
+	}
+	st.mu.Unlock()
+
+	reply, err := st.command(ctx, m, inst, args...)
+	if err != nil {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	inst.lastHello = time.Now()
+	// the reply lists the sentinels the other one knows, so every sentinel ends up knowing every other
+	peers, _ := reply.([]any)
+	for _, peer := range peers {
+		address, _ := peer.(string)
+		if _, ok := m.sentinels[address]; ok || address == "" || m.ctx.Err() != nil {
+			continue
+		}
+		learned := newSentinelInstance("sentinel", address)
+		m.sentinels[address] = learned
+		st.startWatch(m, learned)
+	}
+}
+
+// Handles a hello message: learns about the sender and adopts a newer configuration of the primary.
+// Returns the addresses of the other sentinels known to monitor the primary.
+func (st *sentinel) hello(ip string, port string, runID string, epoch int64, name string, masterAddress string, configEpoch int64) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	m, ok := st.masters[name]
+	if !ok {
+		return nil
+	}
+	address := net.JoinHostPort(ip, port)
+	if runID == st.srv.runID {
+		// a configured address that turns out to be this sentinel
+		if self, ok := m.sentinels[address]; ok {
+			if self.cancel != nil {
+				self.cancel()
+			}
+			delete(m.sentinels, address)
+		}
+		return nil
+	}
+
+	for other, inst := range m.sentinels {
+		if inst.runID == runID && other != address {
+			// the sentinel restarted on another address
+			if inst.cancel != nil {
+				inst.cancel()
+			}
+			delete(m.sentinels, other)
+		}
+	}
+	inst, ok := m.sentinels[address]
+	if !ok {
+		inst = newSentinelInstance("sentinel", address)
+		m.sentinels[address] = inst
+		log.Info().Msgf("+sentinel sentinel %s %s @ %s %s", runID, address, m.name, m.master.address)
+		st.startWatch(m, inst)
+	}
+	inst.runID = runID
+	inst.lastHello = time.Now()
+
+	st.currentEpoch = max(st.currentEpoch, epoch)
+	if configEpoch > m.configEpoch && masterAddress != m.master.address {
+		log.Info().Msgf("+config-update-from sentinel %s %s @ %s %s", runID, address, m.name, m.master.address)
+		st.switchMaster(m, masterAddress)
+		m.configEpoch = configEpoch
+	}
+
+	var peers []string
+	for other := range m.sentinels {
+		if other != address {
+			peers = append(peers, other)
+		}
+	}
+	slices.Sort(peers)
+	return peers
+}
+
+// Evaluates the state of a primary: subjectively and objectively down, and the failover.
+func (st *sentinel) tick(m *sentinelMaster) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for _, inst := range st.instances(m) {
+		last := inst.lastPong
+		if last.IsZero() {
+			last = inst.created
+		}
+		sdown := now.Sub(last) > m.downAfter
+		if sdown != inst.sdown {
+			inst.sdown = sdown
+			event := "-sdown"
+			if sdown {
+				event = "+sdown"
+			}
+			log.Info().Msgf("%s %s %s @ %s %s", event, inst.kind, inst.address, m.name, m.master.address)
+		}
+	}
+
+	// objectively down once enough sentinels agree the primary is down
+	odown := false
+	if m.master.sdown {
+		votes := 1
+		for _, inst := range m.sentinels {
+			if inst.masterDown && now.Sub(inst.lastReply) < sentinelReplyValidity*m.pingPeriod() {
+				votes++
+			}
+		}
+		odown = votes >= m.quorum
+	}
+	if odown != m.odown {
+		m.odown = odown
+		event := "-odown"
+		if odown {
+			event = "+odown"
+		}
+		log.Info().Msgf("%s master %s %s #quorum %d", event, m.name, m.master.address, m.quorum)
+	}
+
+	switch m.failoverState {
+	case failoverNone:
+		if !m.odown || (!m.failoverStart.IsZero() && now.Sub(m.failoverStart) <= 2*m.failoverTimeout) {
+			m.tryAt = time.Time{}
+			break
+		}
+		// sentinels start at slightly different times so one of them is likely to get the votes first
+		if m.tryAt.IsZero() {
+			m.tryAt = now.Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+		}
+		if now.After(m.tryAt) {
+			m.tryAt = time.Time{}
+			st.startFailover(m, false)
+		}
+	case failoverWaitStart:
+		st.countVotes(m)
+	case failoverSelectReplica:
+		st.selectReplica(m)
+	case failoverWaitPromotion:
+		if now.Sub(m.failoverStart) > m.failoverTimeout {
+			st.abortFailover(m, "-failover-abort-slave-timeout")
+		}
+	}
+
+	if m.master.sdown && now.Sub(m.lastAsk) >= m.pingPeriod() {
+		m.lastAsk = now
+		runID, epoch := "*", st.currentEpoch
+		if m.failoverState == failoverWaitStart {
+			runID, epoch = st.srv.runID, m.failoverEpoch
+		}
+		for _, inst := range m.sentinels {
+			go st.askSentinel(m, inst, epoch, runID)
+		}
+	}
+}
+
+// Every instance watched for a primary. Caller must hold mu.
+func (st *sentinel) instances(m *sentinelMaster) []*sentinelInstance {
+	instances := []*sentinelInstance{m.master}
+	for _, inst := range m.replicas {
+		instances = append(instances, inst)
+	}
+	for _, inst := range m.sentinels {
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// Asks another sentinel whether the primary is down, and for its vote when runID is set.
+func (st *sentinel) askSentinel(m *sentinelMaster, inst *sentinelInstance, epoch int64, runID string) {
+	st.mu.Lock()
+	host, port, _ := net.SplitHostPort(m.master.address)
+	st.mu.Unlock()
+
+	reply, err := st.command(m.ctx, m, inst, "SENTINEL", "is-master-down-by-addr",
+		host, port, strconv.FormatInt(epoch, 10), runID)
+	values, ok := reply.([]any)
+	if err != nil || !ok || len(values) != 3 {
+		return
+	}
+	down, _ := values[0].(int64)
+	leader, _ := values[1].(string)
+	leaderEpoch, _ := values[2].(int64)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	inst.masterDown = down == 1
+	inst.lastReply = time.Now()
+	if leader != "*" {
+		inst.leader = leader
+		inst.leaderEpoch = leaderEpoch
+	}
+}
+
+// Votes for a failover leader, at most once per epoch. Caller must hold mu.
+func (st *sentinel) voteLeader(m *sentinelMaster, runID string, epoch int64) {
+	st.currentEpoch = max(st.currentEpoch, epoch)
+	if m.leaderEpoch < epoch && st.currentEpoch <= epoch {
+		m.leader = runID
+		m.leaderEpoch = epoch
+		log.Info().Msgf("+vote-for-leader %s %d", runID, epoch)
+		// like redis, a sentinel that voted for another one does not start a failover of its own for a while
+		if runID != st.srv.runID {
+			m.failoverStart = time.Now()
+		}
+	}
+}
+
+// Caller must hold mu.
+func (st *sentinel) startFailover(m *sentinelMaster, forced bool) {
+	st.currentEpoch++
+	m.failoverEpoch = st.currentEpoch
+	m.failoverStart = time.Now()
+	m.forced = forced
+	m.promoted = nil
+	log.Info().Msgf("+new-epoch %d", st.currentEpoch)
+	log.Info().Msgf("+try-failover master %s %s", m.name, m.master.address)
+
+	if forced {
+		m.failoverState = failoverSelectReplica
+		return
+	}
+	st.voteLeader(m, st.srv.runID, m.failoverEpoch)
+	m.failoverState = failoverWaitStart
+	// ask for votes right away
+	m.lastAsk = time.Time{}
+}
+
+// Moves on once a majority of sentinels, and at least the quorum, voted for this one. Caller must hold mu.
+func (st *sentinel) countVotes(m *sentinelMaster) {
+	if !m.odown {
+		st.abortFailover(m, "-failover-abort-master-is-back")
+		return
+	}
+
+	myID := st.srv.runID
+	votes := 0
+	if m.leader == myID && m.leaderEpoch == m.failoverEpoch {
+		votes++
+	}
+	for _, inst := range m.sentinels {
+		if inst.leader == myID && inst.leaderEpoch == m.failoverEpoch {
+			votes++
+		}
+	}
+	needed := max(m.quorum, (len(m.sentinels)+1)/2+1)
+	if votes >= needed {
+		log.Info().Msgf("+elected-leader master %s %s", m.name, m.master.address)
+		m.failoverState = failoverSelectReplica
+		return
+	}
+	if time.Since(m.failoverStart) > min(sentinelElectionTimeout, m.failoverTimeout) {
+		st.abortFailover(m, "-failover-abort-not-elected")
+	}
+}
+
+// Best replica to promote: reachable, then the most data, then the lowest run id. Caller must hold mu.
+func (st *sentinel) bestReplica(m *sentinelMaster) *sentinelInstance {
+	var best *sentinelInstance
+	for _, inst := range m.replicas {
+		if inst.sdown || inst.role != "slave" {
+			continue
+		}
+		if best == nil || inst.offset > best.offset || (inst.offset == best.offset && inst.runID < best.runID) {
+			best = inst
+		}
+	}
+	return best
+}
+
+// Caller must hold mu.
+func (st *sentinel) selectReplica(m *sentinelMaster) {
+	replica := st.bestReplica(m)
+	if replica == nil {
+		st.abortFailover(m, "-failover-abort-no-good-slave")
+		return
+	}
+	m.promoted = replica
+	m.failoverState = failoverWaitPromotion
+	log.Info().Msgf("+selected-slave slave %s @ %s %s", replica.address, m.name, m.master.address)
+	log.Info().Msgf("+failover-state-send-slaveof-noone slave %s @ %s %s", replica.address, m.name, m.master.address)
+	go st.replicaOf(m, replica, "")
+}
+
+// The selected replica became a primary: point the other replicas at it and switch. Caller must hold mu.
+func (st *sentinel) promotionDone(m *sentinelMaster) {
+	promoted := m.promoted
+	log.Info().Msgf("+promoted-slave slave %s @ %s %s", promoted.address, m.name, m.master.address)
+	m.configEpoch = m.failoverEpoch
+
+	for _, inst := range m.replicas {
+		if inst != promoted && !inst.sdown {
+			log.Info().Msgf("+slave-reconf-sent slave %s @ %s %s", inst.address, m.name, m.master.address)
+			go st.replicaOf(m, inst, promoted.address)
+		}
+	}
+	st.switchMaster(m, promoted.address)
+}
+
+// Caller must hold mu.
+func (st *sentinel) abortFailover(m *sentinelMaster, event string) {
+	log.Info().Msgf("%s master %s %s", event, m.name, m.master.address)
+	m.failoverState = failoverNone
+	m.promoted = nil
+	m.forced = false
+}
+
+// Makes address the primary, the old primary is watched as a replica. Caller must hold mu.
+func (st *sentinel) switchMaster(m *sentinelMaster, address string) {
+	old := m.master
+	log.Info().Msgf("+switch-master %s %s %s", m.name, old.address, address)
+
+	master, ok := m.replicas[address]
+	if !ok {
+		master = newSentinelInstance("master", address)
+		st.startWatch(m, master)
+	}
+	delete(m.replicas, address)
+	master.kind = "master"
+	old.kind = "slave"
+	m.replicas[old.address] = old
+	m.master = master
+
+	m.odown = false
+	m.failoverState = failoverNone
+	m.promoted = nil
+	m.forced = false
+}
+
+// Names of the monitored primaries, sorted. Caller must hold mu.
+func (st *sentinel) names() []string {
+	names := make([]string, 0, len(st.masters))
+	for name := range st.masters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (st *sentinel) master(name string) (*sentinelMaster, error) {
+	m, ok := st.masters[name]
+	if !ok {
+		return nil, errors.New("No such master with that name")
+	}
+	return m, nil
+}
+
+// Caller must hold mu.
+func (st *sentinel) masterFields(m *sentinelMaster) []byte {
+	host, port, _ := net.SplitHostPort(m.master.address)
+	flags := m.master.flags()
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != failoverNone {
+		flags += ",failover_in_progress"
+	}
+	return sentinelFields(
+		"name", m.name,
+		"ip", host,
+		"port", port,
+		"runid", m.master.runID,
+		"flags", flags,
+		"last-ok-ping-reply", sinceMillis(m.master.lastPong),
+		"info-refresh", sinceMillis(m.master.lastInfo),
+		"role-reported", m.master.role,
+		"down-after-milliseconds", strconv.FormatInt(m.downAfter.Milliseconds(), 10),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+		"failover-state", m.failoverState,
+	)
+}
+
+func sinceMillis(t time.Time) string {
+	if t.IsZero() {
+		return "-1"
+	}
+	return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+}
+
+// Encodes name value pairs as a flat array, like redis replies to SENTINEL MASTER.
+func sentinelFields(pairs ...string) []byte {
+	replies := make([][]byte, 0, len(pairs))
+	for _, s := range pairs {
+		replies = append(replies, replyString([]byte(s)))
+	}
+	return replyArray(replies)
+}
+
+// Instances ordered by address. Caller must hold mu.
+func sortedInstances(instances map[string]*sentinelInstance) []*sentinelInstance {
+	sorted := make([]*sentinelInstance, 0, len(instances))
+	for _, inst := range instances {
+		sorted = append(sorted, inst)
+	}
+	slices.SortFunc(sorted, func(a, b *sentinelInstance) int {
+		return strings.Compare(a.address, b.address)
+	})
+	return sorted
+}
+
+// Describes sentinel mode for INFO.
+func (st *sentinel) info(field func(name string, value any)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	names := st.names()
+	field("sentinel_masters", len(names))
+	field("sentinel_tilt", 0)
+	field("sentinel_running_scripts", 0)
+	field("sentinel_scripts_queue_length", 0)
+	for i, name := range names {
+		m := st.masters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.master.sdown {
+			status = "sdown"
+		}
+		field(fmt.Sprintf("master%d", i), fmt.Sprintf("name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			name, status, m.master.address, len(m.replicas), len(m.sentinels)+1))
+	}
+}
+
+// Commands served in sentinel mode, like redis there is no keyspace.
+func sentinelCommand(op any) bool {
+	switch op.(type) {
+	case opPing, opAuth, opACL, opClient, opInfo, opRole, opSentinel, opConfig, opSlowlog, opLatency, opMonitor:
+		return true
+	}
+	return false
+}
+
+func (s *Session) handleSentinel(op opSentinel) []byte {
+	st := s.server.sentinel
+	if st == nil {
+		return replyError(errors.New("This instance has sentinel support disabled."))
+	}
+
+	switch op.subcommand {
+	case "MONITOR":
+		if len(op.args) != 4 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL MONITOR"))
+		}
+		quorum, err := strconv.Atoi(op.args[3])
+		if err != nil || quorum <= 0 {
+			return replyError(errors.New("Quorum must be 1 or greater."))
+		}
+		_, err = st.addMaster(SentinelMasterOptions{
+			Name:    op.args[0],
+			Address: net.JoinHostPort(op.args[1], op.args[2]),
+			Quorum:  quorum,
+		})
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+
+	case "MYID":
+		return replyString([]byte(s.server.runID))
+
+	case "HELLO":
+		// cider specific, sent directly by other sentinels since there is no pub/sub
+		if len(op.args) != 8 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL HELLO"))
+		}
+		epoch, err1 := strconv.ParseInt(op.args[3], 10, 64)
+		configEpoch, err2 := strconv.ParseInt(op.args[7], 10, 64)
+		if err1 != nil || err2 != nil {
+			return replyError(errors.New("invalid epoch"))
+		}
+		peers := st.hello(op.args[0], op.args[1], op.args[2], epoch, op.args[4],
+			net.JoinHostPort(op.args[5], op.args[6]), configEpoch)
+		replies := make([][]byte, 0, len(peers))
+		for _, peer := range peers {
+			replies = append(replies, replyString([]byte(peer)))
+		}
+		return replyArray(replies)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch op.subcommand {
+	case "MASTERS":
+		var replies [][]byte
+		for _, name := range st.names() {
+			replies = append(replies, st.masterFields(st.masters[name]))
+		}
+		return replyArray(replies)
+
+	case "MASTER":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL MASTER"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		return st.masterFields(m)
+
+	case "REPLICAS", "SLAVES":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL REPLICAS"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		var replies [][]byte
+		for _, inst := range sortedInstances(m.replicas) {
+			host, port, _ := net.SplitHostPort(inst.address)
+			masterHost, masterPort, _ := net.SplitHostPort(inst.masterAddress)
+			linkStatus := "err"
+			if inst.masterLinkUp {
+				linkStatus = "ok"
+			}
+			replies = append(replies, sentinelFields(
+				"name", inst.address,
+				"ip", host,
+				"port", port,
+				"runid", inst.runID,
+				"flags", inst.flags(),
+				"last-ok-ping-reply", sinceMillis(inst.lastPong),
+				"info-refresh", sinceMillis(inst.lastInfo),
+				"role-reported", inst.role,
+				"master-link-status", linkStatus,
+				"master-host", masterHost,
+				"master-port", masterPort,
+				"slave-repl-offset", strconv.FormatInt(inst.offset, 10),
+			))
+		}
+		return replyArray(replies)
+
+	case "SENTINELS":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL SENTINELS"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		var replies [][]byte
+		for _, inst := range sortedInstances(m.sentinels) {
+			host, port, _ := net.SplitHostPort(inst.address)
+			leader := inst.leader
+			if leader == "" {
+				leader = "*"
+			}
+			replies = append(replies, sentinelFields(
+				"name", inst.runID,
+				"ip", host,
+				"port", port,
+				"runid", inst.runID,
+				"flags", inst.flags(),
+				"last-ok-ping-reply", sinceMillis(inst.lastPong),
+				"last-hello-message", sinceMillis(inst.lastHello),
+				"voted-leader", leader,
+				"voted-leader-epoch", strconv.FormatInt(inst.leaderEpoch, 10),
+			))
+		}
+		return replyArray(replies)
+
+	case "GET-MASTER-ADDR-BY-NAME":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL GET-MASTER-ADDR-BY-NAME"))
+		}
+		m, ok := st.masters[op.args[0]]
+		if !ok {
+			return replyNil()
+		}
+		host, port, _ := net.SplitHostPort(m.master.address)
+		return replyArray([][]byte{replyString([]byte(host)), replyString([]byte(port))})
+
+	case "IS-MASTER-DOWN-BY-ADDR":
+		if len(op.args) != 4 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL IS-MASTER-DOWN-BY-ADDR"))
+		}
+		epoch, err := strconv.ParseInt(op.args[2], 10, 64)
+		if err != nil {
+			return replyError(errors.New("invalid epoch"))
+		}
+		address := net.JoinHostPort(op.args[0], op.args[1])
+		for _, m := range st.masters {
+			if m.master.address != address {
+				continue
+			}
+			down := int64(0)
+			if m.master.sdown {
+				down = 1
+			}
+			// the requester asks for a vote when it wants to lead a failover
+			if op.args[3] != "*" {
+				st.voteLeader(m, op.args[3], epoch)
+			}
+			leader := m.leader
+			if leader == "" {
+				leader = "*"
+			}
+			return replyArray([][]byte{
+				replyInteger(down),
+				replyString([]byte(leader)),
+				replyInteger(m.leaderEpoch),
+			})
+		}
+		return replyArray([][]byte{replyInteger(0), replyString([]byte("*")), replyInteger(0)})
+
+	case "FAILOVER":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL FAILOVER"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		if m.failoverState != failoverNone {
+			return replyError(newCodedError("INPROG", "Failover already in progress"))
+		}
+		if st.bestReplica(m) == nil {
+			return replyError(newCodedError("NOGOODSLAVE", "No suitable replica to promote"))
+		}
+		st.startFailover(m, true)
+		return replyOK()
+
+	case "CKQUORUM":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL CKQUORUM"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		usable := 1
+		for _, inst := range m.sentinels {
+			if !inst.sdown {
+				usable++
+			}
+		}
+		voters := len(m.sentinels) + 1
+		if usable < m.quorum {
+			return replyError(newCodedError("NOQUORUM", fmt.Sprintf("%d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable)))
+		}
+		if usable < voters/2+1 {
+			return replyError(newCodedError("NOQUORUM", fmt.Sprintf("%d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable)))
+		}
+		return []byte(fmt.Sprintf("+OK %d usable Sentinels. Quorum and failover authorization can be reached\r\n", usable))
+
+	case "REMOVE":
+		if len(op.args) != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL REMOVE"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		st.removeMaster(m)
+		return replyOK()
+
+	case "SET":
+		if len(op.args) < 3 || len(op.args)%2 != 1 {
+			return replyError(errors.New("wrong number of arguments for SENTINEL SET"))
+		}
+		m, err := st.master(op.args[0])
+		if err != nil {
+			return replyError(err)
+		}
+		for i := 1; i < len(op.args); i += 2 {
+			option, value := strings.ToLower(op.args[i]), op.args[i+1]
+			n, err := strconv.ParseInt(value, 10, 64)
+			switch {
+			case option == "down-after-milliseconds" && err == nil && n > 0:
+				m.downAfter = time.Duration(n) * time.Millisecond
+			case option == "failover-timeout" && err == nil && n > 0:
+				m.failoverTimeout = time.Duration(n) * time.Millisecond
+			case option == "quorum" && err == nil && n > 0:
+				m.quorum = int(n)
+			case option == "auth-pass":
+				m.authPass = value
+			case option == "auth-user":
+				m.authUser = value
+			default:
+				return replyError(fmt.Errorf("Invalid argument '%s' for SENTINEL SET '%s'", value, option))
+			}
+		}
+		return replyOK()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
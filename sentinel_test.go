@@ -0,0 +1,130 @@
+package cider
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sentinelMasterAddr(t *testing.T, client *testClient) string {
+	t.Helper()
+
+	reply := client.do(t, "SENTINEL get-master-addr-by-name mymaster")
+	lines := strings.Split(reply, "\r\n")
+	if len(lines) < 5 {
+		t.Fatalf("want address, got %q", reply)
+	}
+	return net.JoinHostPort(lines[2], lines[4])
+}
+
+func TestSentinelFailover(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{Listeners: listeners})
+	primaryAddr := primary.Addrs()[0].String()
+	replica := startTestServer(t, ServerOptions{Listeners: listeners, ReplicaOf: primaryAddr})
+	replicaAddr := replica.Addrs()[0].String()
+
+	p := dialTestClient(t, "tcp", primaryAddr)
+	r := dialTestClient(t, "tcp", replicaAddr)
+	waitForReply(t, p, "INFO replication", "connected_slaves:1")
+
+	// the first sentinel is known to the others, they learn about each other from hello messages
+	var sentinels []*testClient
+	var first string
+	for i := 0; i < 3; i++ {
+		master := SentinelMasterOptions{
+			Name:            "mymaster",
+			Address:         primaryAddr,
+			Quorum:          2,
+			DownAfter:       300 * time.Millisecond,
+			FailoverTimeout: 2 * time.Second,
+		}
+		if first != "" {
+			master.Sentinels = []string{first}
+		}
+		server := startTestServer(t, ServerOptions{
+			Listeners: listeners,
+			Sentinel:  &SentinelOptions{Masters: []SentinelMasterOptions{master}},
+		})
+		if first == "" {
+			first = server.Addrs()[0].String()
+		}
+		sentinels = append(sentinels, dialTestClient(t, "tcp", server.Addrs()[0].String()))
+	}
+
+	for i, s := range sentinels {
+		if addr := sentinelMasterAddr(t, s); addr != primaryAddr {
+			t.Errorf("sentinel %d: want %s, got %s", i, primaryAddr, addr)
+		}
+		waitForReply(t, s, "INFO sentinel", "slaves=1,sentinels=3")
+	}
+
+	s := sentinels[0]
+	if reply := s.do(t, "SET foo bar"); !strings.HasPrefix(reply, "-ERR unknown command 'set'") {
+		t.Errorf("want unknown command, got %q", reply)
+	}
+	if reply := s.do(t, "ROLE"); reply != "*2\r\n$8\r\nsentinel\r\n*1\r\n$8\r\nmymaster\r\n" {
+		t.Errorf("want sentinel role, got %q", reply)
+	}
+	if reply := s.do(t, "SENTINEL ckquorum mymaster"); !strings.HasPrefix(reply, "+OK 3 usable Sentinels") {
+		t.Errorf("want quorum, got %q", reply)
+	}
+
+	primary.Close()
+
+	deadline := time.Now().Add(15 * time.Second)
+	for i, s := range sentinels {
+		for sentinelMasterAddr(t, s) != replicaAddr {
+			if time.Now().After(deadline) {
+				t.Fatalf("sentinel %d: want %s to be promoted, got %s", i, replicaAddr, sentinelMasterAddr(t, s))
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitForReply(t, r, "ROLE", "master")
+	if reply := r.do(t, "SET foo bar"); reply != "+OK\r\n" {
+		t.Errorf("want promoted replica to accept writes, got %q", reply)
+	}
+
+}
+
+func TestSentinelDirectives(t *testing.T) {
+	var opts ServerOptions
+	directives := []string{
+		"monitor mymaster 127.0.0.1 6379 2",
+		"down-after-milliseconds mymaster 5000",
+		"failover-timeout mymaster 60000",
+		"auth-pass mymaster secret",
+		"known-sentinel mymaster 127.0.0.1 26380 0123456789abcdef",
+		"config-epoch mymaster 3",
+	}
+	for _, d := range directives {
+		err := setSentinelDirective(&opts, d)
+		if err != nil {
+			t.Fatalf("%s: %s", d, err)
+		}
+	}
+
+	want := SentinelMasterOptions{
+		Name:            "mymaster",
+		Address:         "127.0.0.1:6379",
+		Quorum:          2,
+		DownAfter:       5 * time.Second,
+		FailoverTimeout: time.Minute,
+		AuthPass:        "secret",
+		Sentinels:       []string{"127.0.0.1:26380"},
+	}
+	if opts.Sentinel == nil || len(opts.Sentinel.Masters) != 1 {
+		t.Fatalf("want one primary, got %+v", opts.Sentinel)
+	}
+	got := opts.Sentinel.Masters[0]
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want: %+v, got %+v", want, got)
+	}
+
+	if err := setSentinelDirective(&opts, "down-after-milliseconds other 10"); err == nil {
+		t.Error("want error for an unknown primary")
+	}
+}
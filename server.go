@@ -0,0 +1,587 @@
+package cider
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type ListenerOptions struct {
+	// tcp or unix
+	Network string
+	// host:port for tcp or a socket path for unix
+	Address string
+	// File mode of unix sockets, defaults to 0700.
+	Permissions os.FileMode
+	// Serves TLS on this listener when set.
+	TLS *TLSOptions
+}
+
+type ServerOptions struct {
+	Listeners []ListenerOptions
+	// Store shared by every listener, a new store is created when nil.
+	Store Storer
+	// Password required for the default user.
+	RequirePass string
+	// ACL file loaded at startup.
+	ACLFile string
+	// Authenticate TLS clients as the user named by their certificate common name.
+	TLSClientCertUser bool
+	// How long ListenAndServe waits for sessions to finish once its context is done, defaults to 10 seconds.
+	ShutdownTimeout time.Duration
+	// Close sessions idle for this long, zero disables the timeout.
+	Timeout time.Duration
+	// TCP keepalive period, defaults to 300 seconds. A negative value disables keepalive.
+	TCPKeepAlive time.Duration
+	// Maximum number of connected clients, defaults to 10000.
+	MaxClients int
+	// Disconnect clients that do not read their replies fast enough.
+	OutputBufferLimit OutputBufferLimit
+	// Memory limit for keys and values in bytes, zero means no limit.
+	MaxMemory int64
+	// How keys are evicted once MaxMemory is reached, defaults to noeviction.
+	MaxMemoryPolicy string
+	// Number of keys sampled per eviction, defaults to 5.
+	MaxMemorySamples int
+	// Commands running longer than this are recorded in the slow log, defaults to 10ms. A negative value disables the slow log.
+	SlowlogLogSlowerThan time.Duration
+	// Number of entries kept in the slow log, defaults to 128.
+	SlowlogMaxLen int
+	// Events taking at least this long are recorded by the latency monitor, zero disables it.
+	LatencyMonitorThreshold time.Duration
+	// Address of the HTTP listener serving /metrics, started by the server binary.
+	MetricsAddress string
+	// One of debug, verbose, notice (default), warning or nothing.
+	LogLevel string
+	// Snapshot points as seconds and changes pairs. Accepted for compatibility, nothing is persisted.
+	Save string
+	// Keyspace event classes to notify. Accepted for compatibility, no notifications are sent.
+	NotifyKeyspaceEvents string
+	// Primary to replicate at startup as host:port.
+	ReplicaOf string
+	// Password and user used to authenticate with the primary.
+	MasterAuth string
+	MasterUser string
+	// Size of the replication backlog used for partial resyncs, defaults to 1mb.
+	ReplBacklogSize int64
+	// Runs the server as a sentinel monitoring primaries instead of serving keys.
+	Sentinel *SentinelOptions
+	// Shards keys over hash slots owned by the nodes of a cluster.
+	ClusterEnabled bool
+	// Nodes not replying for this long are flagged as failing, defaults to 15 seconds.
+	ClusterNodeTimeout time.Duration
+	// Sparse HyperLogLogs larger than this many bytes are converted to the dense encoding, defaults to 3000.
+	HLLSparseMaxBytes int64
+	// Sorted sets with more members, or a member longer than ZSetMaxListpackValue bytes, use the skiplist encoding.
+	// Zero means the defaults of 128 and 64, negative values disable the listpack encoding.
+	ZSetMaxListpackEntries int
+	ZSetMaxListpackValue   int
+	// Runs every command on a single goroutine like redis, instead of on the goroutine of its session.
+	EventLoop bool
+	// Config file rewritten by CONFIG REWRITE, set by LoadConfig.
+	ConfigFile string
+}
+
+type OutputBufferLimit struct {
+	// Queued reply bytes at which a client is disconnected right away, zero disables the limit.
+	Hard int64
+	// Queued reply bytes a client may stay above for at most SoftDuration, zero disables the limit.
+	Soft         int64
+	SoftDuration time.Duration
+}
+
+const (
+	defaultTCPKeepAlive = 300 * time.Second
+	defaultMaxClients   = 10000
+)
+
+// Returned by Serve and ListenAndServe after Shutdown or Close.
+var ErrServerClosed = errors.New("cider: server closed")
+
+type Server struct {
+	// replaced as a whole by CONFIG SET, use options() to read and updateOptions to change
+	opts atomic.Pointer[ServerOptions]
+	// serializes option updates so none is lost
+	optsMu *sync.Mutex
+	// random id of this run, shown by INFO
+	runID        string
+	store        Storer
+	acl          *acl
+	ctx          context.Context
+	cancel       context.CancelFunc
+	mu           *sync.Mutex
+	closed       bool
+	listeners    []net.Listener
+	tlsConfigs   []*tlsConfig
+	clients      *clients
+	active       *sync.WaitGroup
+	stats        *serverStats
+	commandStats *commandStats
+	slowlog      *slowlog
+	latency      *latencyMonitor
+	monitors     *monitors
+	repl         *replication
+	functions    *functions
+	// nil unless running in sentinel mode
+	sentinel *sentinel
+	// nil unless running in cluster mode
+	cluster *cluster
+	// nil unless commands run on an event loop
+	loop *eventLoop
+	// periodic tasks started by Listen
+	tasks []*task
+}
+
+func NewServer(opts ServerOptions) (*Server, error) {
+	if len(opts.Listeners) == 0 {
+		return nil, errors.New("at least one listener is required")
+	}
+
+	store := opts.Store
+	if store == nil {
+		store = NewStore()
+	}
+
+	policy := opts.MaxMemoryPolicy
+	if policy == "" {
+		policy = "noeviction"
+	}
+	err := setMaxMemory(store, opts.MaxMemory, policy, opts.MaxMemorySamples)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := NewACL()
+	if opts.ACLFile != "" {
+		err := acl.LoadFile(opts.ACLFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load acl file: %w", err)
+		}
+	}
+	if opts.RequirePass != "" {
+		acl.SetRequirePass(opts.RequirePass)
+	}
+	acl.SetCertificateUsers(opts.TLSClientCertUser)
+
+	level, err := parseLogLevel(opts.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if opts.LogLevel != "" {
+		zerolog.SetGlobalLevel(level)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	srv := &Server{
+		store:        store,
+		acl:          acl,
+		ctx:          ctx,
+		cancel:       cancel,
+		mu:           &sync.Mutex{},
+		optsMu:       &sync.Mutex{},
+		clients:      newClients(),
+		active:       &sync.WaitGroup{},
+		stats:        newServerStats(),
+		commandStats: newCommandStats(),
+		slowlog:      newSlowlog(opts.SlowlogLogSlowerThan, opts.SlowlogMaxLen),
+		latency:      newLatencyMonitor(opts.LatencyMonitorThreshold),
+		monitors:     newMonitors(),
+		repl:         newReplication(opts.ReplBacklogSize),
+		functions:    newFunctions(),
+		runID:        newReplID(),
+	}
+	srv.opts.Store(&opts)
+
+	if opts.Sentinel != nil {
+		if opts.ReplicaOf != "" {
+			return nil, errors.New("a sentinel can not be a replica")
+		}
+		srv.sentinel, err = newSentinel(srv, *opts.Sentinel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ClusterEnabled {
+		if opts.Sentinel != nil {
+			return nil, errors.New("a sentinel can not run in cluster mode")
+		}
+		if opts.ReplicaOf != "" {
+			return nil, errors.New("replicaof is not supported in cluster mode")
+		}
+		srv.cluster = newCluster(srv)
+	}
+	if opts.EventLoop {
+		srv.loop = newEventLoop()
+	}
+
+	return srv, nil
+}
+
+// Current options, including changes made by CONFIG SET.
+func (srv *Server) options() *ServerOptions {
+	return srv.opts.Load()
+}
+
+// Binds every configured listener. On failure listeners bound so far are closed.
+func (srv *Server) Listen() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return ErrServerClosed
+	}
+
+	var masterHost string
+	var masterPort int
+	if replicaOf := srv.options().ReplicaOf; replicaOf != "" {
+		host, port, err := net.SplitHostPort(replicaOf)
+		if err != nil {
+			return fmt.Errorf("invalid replicaof: %w", err)
+		}
+		masterPort, err = strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid replicaof port %s", port)
+		}
+		masterHost = host
+	}
+
+	for _, opts := range srv.options().Listeners {
+		listener, err := srv.listen(opts)
+		if err != nil {
+			for _, l := range srv.listeners {
+				l.Close()
+			}
+			srv.listeners = nil
+			srv.tlsConfigs = nil
+			return err
+		}
+		srv.listeners = append(srv.listeners, listener)
+	}
+
+	srv.tasks = []*task{
+		NewTask("instantaneous_ops_per_sec", opsSampleInterval, func(Storer) {
+			srv.stats.sample()
+			srv.stats.notePeak(usedMemory(srv.store))
+		}, srv.store),
+		NewTask("replication_cron", time.Second, func(Storer) {
+			srv.replicationCron()
+		}, srv.store),
+		NewTask("active_expire", activeExpireInterval, func(store Storer) {
+			ks, ok := store.(keyspaceStorer)
+			if !ok {
+				return
+			}
+			start := time.Now()
+			ks.ActiveExpire(srv.ctx)
+			srv.latency.add("expire-cycle", time.Since(start))
+		}, srv.store),
+	}
+	for _, t := range srv.tasks {
+		t.Run()
+	}
+
+	if masterHost != "" {
+		srv.replicaOf(masterHost, masterPort)
+	}
+	if srv.sentinel != nil {
+		srv.sentinel.start(srv.ctx)
+	}
+	if srv.cluster != nil {
+		srv.cluster.start(srv.ctx, srv.tcpPort())
+	}
+	if srv.loop != nil {
+		go srv.loop.run()
+	}
+
+	return nil
+}
+
+func (srv *Server) listen(opts ListenerOptions) (net.Listener, error) {
+	var listener net.Listener
+
+	switch opts.Network {
+	case "", "tcp":
+		l, err := net.Listen("tcp", opts.Address)
+		if err != nil {
+			return nil, err
+		}
+		listener = l
+	case "unix":
+		// remove a stale socket left behind by a previous run
+		if info, err := os.Stat(opts.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(opts.Address)
+		}
+		l, err := net.Listen("unix", opts.Address)
+		if err != nil {
+			return nil, err
+		}
+		perm := opts.Permissions
+		if perm == 0 {
+			perm = 0o700
+		}
+		err = os.Chmod(opts.Address, perm)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		listener = l
+	default:
+		return nil, fmt.Errorf("unsupported network %s", opts.Network)
+	}
+
+	if opts.TLS != nil {
+		config, err := NewTLSConfig(*opts.TLS)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		srv.tlsConfigs = append(srv.tlsConfigs, config)
+		listener = config.NewListener(listener)
+	}
+
+	log.Info().Msgf("listening on %s %s", listener.Addr().Network(), listener.Addr())
+
+	return listener, nil
+}
+
+// Addresses of the bound listeners, useful when listening on port 0.
+func (srv *Server) Addrs() []net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var addrs []net.Addr
+	for _, l := range srv.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Binds every listener and serves until ctx is done, then shuts down gracefully.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	err := srv.Listen()
+	if err != nil {
+		return err
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	timeout := srv.options().ShutdownTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	<-served
+	return err
+}
+
+// Accepts connections on every bound listener until the server is shut down.
+func (srv *Server) Serve() error {
+	srv.mu.Lock()
+	listeners := srv.listeners
+	closed := srv.closed
+	srv.mu.Unlock()
+
+	if closed {
+		return ErrServerClosed
+	}
+	if len(listeners) == 0 {
+		return errors.New("server is not listening")
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			srv.accept(l)
+		}(l)
+	}
+	wg.Wait()
+
+	return ErrServerClosed
+}
+
+func (srv *Server) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("unable to accept connection")
+			continue
+		}
+
+		srv.serveSession(conn)
+	}
+}
+
+func (srv *Server) serveSession(conn net.Conn) {
+	srv.setKeepAlive(conn)
+	srv.stats.connections.Add(1)
+
+	session := NewSession(srv.ctx, conn, srv)
+
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		conn.Close()
+		return
+	}
+	maxClients := srv.options().MaxClients
+	if maxClients == 0 {
+		maxClients = defaultMaxClients
+	}
+	if srv.clients.count() >= maxClients {
+		srv.mu.Unlock()
+		srv.stats.rejected.Add(1)
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(replyError(errors.New("max number of clients reached")))
+		conn.Close()
+		return
+	}
+	srv.clients.add(session)
+	srv.active.Add(1)
+	srv.mu.Unlock()
+
+	go session.HandleIn(srv.store)
+	go func() {
+		// HandleOut returns once HandleIn is done and the connection is closed
+		session.HandleOut()
+
+		srv.clients.remove(session)
+		srv.monitors.remove(session)
+		srv.repl.removeReplica(session)
+		srv.active.Done()
+	}()
+}
+
+func (srv *Server) setKeepAlive(conn net.Conn) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	period := srv.options().TCPKeepAlive
+	if period == 0 {
+		period = defaultTCPKeepAlive
+	}
+	if period < 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(period)
+}
+
+// Stops accepting connections and closes the listeners, caller must hold the lock.
+func (srv *Server) closeListeners() error {
+	if !srv.closed {
+		for _, t := range srv.tasks {
+			t.Stop()
+		}
+	}
+	srv.closed = true
+
+	var errs []error
+	for _, l := range srv.listeners {
+		err := l.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Gracefully shuts down the server. It stops accepting connections, lets every
+// session finish the commands it already received and flush its replies, and
+// then closes the connections. If ctx is done first the remaining connections
+// are closed forcefully and the context error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	err := srv.closeListeners()
+	srv.mu.Unlock()
+
+	srv.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		srv.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		srv.stopLoop()
+		return err
+	case <-ctx.Done():
+		srv.closeSessions()
+		srv.stopLoop()
+		return ctx.Err()
+	}
+}
+
+// Closes the listeners and every connection immediately.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	err := srv.closeListeners()
+	srv.mu.Unlock()
+
+	srv.cancel()
+	srv.closeSessions()
+	srv.stopLoop()
+
+	return err
+}
+
+// Stops the event loop, sessions still running afterwards execute their commands in place.
+func (srv *Server) stopLoop() {
+	if srv.loop != nil {
+		srv.loop.close()
+	}
+}
+
+func (srv *Server) closeSessions() {
+	for _, session := range srv.clients.list() {
+		session.kill()
+	}
+}
+
+// Reloads certificates of every TLS listener.
+func (srv *Server) ReloadTLS() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var errs []error
+	for _, config := range srv.tlsConfigs {
+		errs = append(errs, config.Reload())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,375 @@
+package cider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, network string, address string) *testClient {
+	t.Helper()
+
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Sends an inline command and returns the raw reply.
+func (c *testClient) do(t *testing.T, command string) string {
+	t.Helper()
+
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := c.conn.Write([]byte(command + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := readTestReply(c.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// Reads a single RESP reply including nested arrays.
+func readTestReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return "", err
+		}
+		return line + string(buf), nil
+	case '*':
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return "", err
+		}
+		var sb strings.Builder
+		sb.WriteString(line)
+		for i := 0; i < n; i++ {
+			item, err := readTestReply(r)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(item)
+		}
+		return sb.String(), nil
+	}
+
+	return line, nil
+}
+
+func startTestServer(t *testing.T, opts ServerOptions) *Server {
+	t.Helper()
+
+	server, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+func TestServerListeners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cider.sock")
+
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{
+			{Network: "tcp", Address: "127.0.0.1:0"},
+			{Network: "unix", Address: socket, Permissions: 0o770},
+		},
+	})
+
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("want 2 listeners, got %d", len(addrs))
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o770 {
+		t.Errorf("want: %o, got %o", 0o770, info.Mode().Perm())
+	}
+
+	tcp := dialTestClient(t, "tcp", addrs[0].String())
+	unix := dialTestClient(t, "unix", socket)
+
+	if reply := tcp.do(t, "SET shared value"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+
+	// both listeners share the same store
+	want := fmt.Sprintf("$%d\r\n%s\r\n", 5, "value")
+	if reply := unix.do(t, "GET shared"); reply != want {
+		t.Errorf("want: %q, got %q", want, reply)
+	}
+}
+
+func TestServerRequirePass(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners:   []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		RequirePass: "secret",
+	})
+
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	if reply := client.do(t, "GET foo"); !strings.HasPrefix(reply, "-NOAUTH") {
+		t.Errorf("want NOAUTH, got %q", reply)
+	}
+	if reply := client.do(t, "AUTH secret"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	if reply := client.do(t, "GET foo"); reply != "_\r\n" {
+		t.Errorf("want nil, got %q", reply)
+	}
+}
+
+func TestServerNoListeners(t *testing.T) {
+	_, err := NewServer(ServerOptions{})
+	if err == nil {
+		t.Error("want error without listeners")
+	}
+}
+
+// Stores given in the options only need Storer, commands needing more from the store fail on them.
+func TestServerMinimalStorer(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		Store:     struct{ Storer }{NewStore()},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	if reply := client.do(t, "SET foo bar"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	tcs := map[string]string{
+		"GET foo":                  "$3\r\nbar\r\n",
+		"OBJECT ENCODING foo":      "-ERR memory accounting is not supported by the store\r\n",
+		"MEMORY USAGE foo":         "-ERR memory accounting is not supported by the store\r\n",
+		"DUMP foo":                 "-ERR serialization is not supported by the store\r\n",
+		"PFADD hll a":              "-ERR atomic updates are not supported by the store\r\n",
+		"CONFIG SET maxmemory 1mb": "-ERR CONFIG SET failed - memory accounting is not supported by the store\r\n",
+		"PSYNC ? -1":               "-ERR keyspace operations are not supported by the store\r\n",
+		"CONFIG SET maxmemory 0":   "+OK\r\n",
+		"INFO keyspace":            "$12\r\n# Keyspace\r\n\r\n",
+	}
+	for command, want := range tcs {
+		if reply := client.do(t, command); reply != want {
+			t.Errorf("%s: want %q, got %q", command, want, reply)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server, err := NewServer(ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe(ctx)
+	}()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && len(addrs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = server.Addrs()
+	}
+	if len(addrs) == 0 {
+		t.Fatal("server did not start listening")
+	}
+
+	client := dialTestClient(t, "tcp", addrs[0].String())
+	if reply := client.do(t, "SET foo bar"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+
+	// pipelined commands already sent are answered before the connection closes
+	_, err = client.conn.Write([]byte("GET foo\r\nEXISTS foo\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("want clean shutdown, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+
+	client.conn.SetDeadline(time.Now().Add(time.Second))
+	rest, err := io.ReadAll(client.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "$3\r\nbar\r\n:1\r\n" {
+		t.Errorf("want pending replies flushed, got %q", rest)
+	}
+
+	_, err = net.DialTimeout("tcp", addrs[0].String(), 100*time.Millisecond)
+	if err == nil {
+		t.Error("want listener to be closed")
+	}
+
+	err = server.Serve()
+	if err != ErrServerClosed {
+		t.Errorf("want: %s, got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+	client.do(t, "SET foo bar")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil && err != context.Canceled {
+		t.Errorf("want nil or %s, got %s", context.Canceled, err)
+	}
+
+	client.conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = client.reader.ReadByte()
+	if err == nil {
+		t.Error("want connection to be closed")
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		Timeout:   100 * time.Millisecond,
+	})
+
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+	monitor := dialTestClient(t, "tcp", server.Addrs()[0].String())
+	if reply := monitor.do(t, "MONITOR"); reply != "+OK\r\n" {
+		t.Fatalf("want: +OK, got %q", reply)
+	}
+	if reply := client.do(t, "SET foo bar"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+
+	client.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := client.reader.ReadByte()
+	if err == nil {
+		t.Error("want idle connection to be closed")
+	}
+
+	// monitors are never idle
+	other := dialTestClient(t, "tcp", server.Addrs()[0].String())
+	other.do(t, "GET foo")
+	monitor.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{`"SET" "foo" "bar"`, `"GET" "foo"`} {
+		line, err := readTestReply(monitor.reader)
+		if err != nil || !strings.Contains(line, want) {
+			t.Errorf("want monitor line with %s, got %q (%v)", want, line, err)
+		}
+	}
+}
+
+func TestServerMaxClients(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners:  []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		MaxClients: 1,
+	})
+	address := server.Addrs()[0].String()
+
+	first := dialTestClient(t, "tcp", address)
+	first.do(t, "CLIENT ID")
+
+	second := dialTestClient(t, "tcp", address)
+	second.conn.SetDeadline(time.Now().Add(time.Second))
+	reply, err := readTestReply(second.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "-ERR max number of clients reached\r\n" {
+		t.Errorf("want max clients error, got %q", reply)
+	}
+}
+
+func TestServerOutputBufferLimit(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners:         []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		OutputBufferLimit: OutputBufferLimit{Hard: 256 * 1024},
+	})
+
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+	value := strings.Repeat("x", 32*1024)
+	client.do(t, "SET big "+value)
+
+	// request far more than the socket buffers can hold without reading any replies
+	const requests = 2000
+	go func() {
+		for i := 0; i < requests; i++ {
+			_, err := client.conn.Write([]byte("GET big\r\n"))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read, err := io.Copy(io.Discard, client.reader)
+	if err != nil && !strings.Contains(err.Error(), "reset") {
+		t.Fatal(err)
+	}
+	if read >= int64(requests*len(value)) {
+		t.Errorf("want slow client to be disconnected, read %d bytes", read)
+	}
+}
@@ -3,133 +3,574 @@ package cider
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
-	"io"
+	"fmt"
 	"net"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+	// Size of the read and write buffers of a session.
+	sessionBufferSize = 16 * 1024
+)
+
 type Session struct {
-	id     uuid.UUID
+	// client id, assigned when the session is registered with the server
+	id     int64
+	server *Server
 	conn   net.Conn
-	reader io.Reader
+	reader *bufio.Reader
 	ctx    context.Context
+	cancel context.CancelFunc
 	in     chan []byte
-	out    chan []byte
-	stop   chan bool
+	out    *replyQueue
+	acl    *acl
+	// guards the fields below which are read by other sessions through CLIENT LIST
+	mu *sync.Mutex
+	// nil until the session has authenticated
+	user            *aclUser
+	name            string
+	created         time.Time
+	lastInteraction time.Time
+	lastCommand     string
+	queryBuffer     int
+	noEvict         bool
+	// set once the session issued MONITOR
+	monitor bool
+	// set once the session issued PSYNC, the replication stream is sent to it
+	replica bool
+	// port the replica listens on, announced with REPLCONF listening-port
+	replicaPort int
+	// set on the session running commands received from the primary
+	master bool
+	// replication offset after the last write of the session, WAIT waits for replicas to reach it.
+	// Only used by the HandleIn goroutine, like blocked.
+	writeOffset int64
+	// set by ASKING, lets the next command use a slot this node is importing
+	asking bool
+	// time the last command spent blocked, left out of the slow log and latency monitor
+	blocked time.Duration
+	// replies of commands run by the event loop
+	loopReply chan []byte
+	// when the output buffer first exceeded the soft limit
+	softLimitSince time.Time
+}
+
+// Replies waiting to be written by HandleOut. A nil reply requests a flush.
+type replyQueue struct {
+	mu      *sync.Mutex
+	replies [][]byte
+	size    int64
+	closed  bool
+	wake    chan struct{}
+}
+
+func newReplyQueue() *replyQueue {
+	return &replyQueue{
+		mu:   &sync.Mutex{},
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Queues a reply without blocking and returns the number of queued bytes.
+// Replies pushed after the queue was closed are dropped.
+func (q *replyQueue) push(reply []byte) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return q.size
+	}
+	q.replies = append(q.replies, reply)
+	q.size += int64(len(reply))
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return q.size
+}
+
+// Waits for queued replies. Returns false once the queue is closed and drained.
+func (q *replyQueue) pop() ([][]byte, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.replies) > 0 {
+			replies := q.replies
+			q.replies = nil
+			q.size = 0
+			q.mu.Unlock()
+			return replies, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return nil, false
+		}
+		q.mu.Unlock()
+
+		<-q.wake
+	}
+}
+
+func (q *replyQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
 }
 
-func NewSession(conn net.Conn) *Session {
+// Number of queued replies and their size in bytes.
+func (q *replyQueue) stats() (int, int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.replies), q.size
+}
+
+// Creates a session for a connection. Cancelling ctx stops the session once
+// the commands already received have been processed.
+func NewSession(ctx context.Context, conn net.Conn, server *Server) *Session {
+	ctx, cancel := context.WithCancel(ctx)
+	now := time.Now()
+
 	return &Session{
-		id:     uuid.New(),
-		conn:   conn,
-		ctx:    context.Background(),
-		reader: bufio.NewReader(conn),
-		in:     make(chan []byte, 1),
-		out:    make(chan []byte, 1),
-		stop:   make(chan bool),
+		server:          server,
+		conn:            conn,
+		ctx:             ctx,
+		cancel:          cancel,
+		reader:          bufio.NewReaderSize(&countingReader{Reader: conn, n: &server.stats.netInput}, sessionBufferSize),
+		in:              make(chan []byte, 1),
+		out:             newReplyQueue(),
+		acl:             server.acl,
+		mu:              &sync.Mutex{},
+		user:            server.acl.defaultUser(),
+		created:         now,
+		lastInteraction: now,
+		loopReply:       make(chan []byte, 1),
 	}
 }
 
 func (s *Session) HandleIn(store Storer) {
-	scanner := bufio.NewScanner(s.reader)
+	defer s.out.close()
+	defer s.cancel()
+
+	if conn, ok := s.conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err := conn.Handshake()
+		if err != nil {
+			log.Error().Err(err).Msgf("tls handshake failed for session %d", s.id)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		if user := s.acl.certificateUser(clientCertificateName(conn.ConnectionState())); user != nil {
+			s.setUser(user)
+		}
+	}
+
+	go func() {
+		<-s.ctx.Done()
+		// interrupt a blocking read, commands already buffered are still processed
+		s.mu.Lock()
+		s.conn.SetReadDeadline(time.Now())
+		s.mu.Unlock()
+	}()
+
+	for {
+		// replies are flushed once every pipelined command in the read buffer has been handled
+		if s.reader.Buffered() == 0 {
+			s.flush()
+			s.armReadDeadline()
+		}
 
-	for scanner.Scan() {
-		bytes := scanner.Bytes()
+		args, err := readCommand(s.reader)
+		var perr protocolError
+		if errors.As(err, &perr) {
+			s.send(replyError(err))
+			return
+		}
+		if err != nil {
+			return
+		}
 
-		op, err := ParseCommand(bytes)
+		op, err := parseArgs(args)
 		if err != nil {
-			s.out <- replyError(err)
+			s.send(replyError(err))
 			continue
 		}
 
-		switch t := op.(type) {
-		case opSet:
-			// default ttl to none
-			ttl := int64(-1)
-			if t.ex != 0 {
-				ttl = time.Now().Unix() + t.ex
-			}
-			if t.exat != 0 {
-				ttl = t.exat
-			}
-			err := store.Set(s.ctx, t.key, t.value, ttl)
-			if err != nil {
-				s.out <- replyError(err)
-				continue
-			}
-			s.out <- replyOK()
-		case opGet:
-			value, _, err := store.Get(s.ctx, t.key)
-			if err != nil && err.Error() == "key not found" {
-				s.out <- replyNil()
-				continue
-			}
-			if err != nil {
-				s.out <- replyError(err)
-				continue
-			}
-			s.out <- replyString(value)
-		case opDel:
-			num, err := store.Del(s.ctx, t.keys)
-			if err != nil {
-				s.out <- replyError(err)
-				continue
-			}
-			s.out <- replyInteger(num)
-		case opExists:
-			num, err := store.Exists(s.ctx, t.keys)
-			if err != nil {
-				s.out <- replyError(err)
-				continue
-			}
-			s.out <- replyInteger(num)
-		case opExpire:
-			res, err := store.Expire(s.ctx, t.key, t.ttl)
-			if err != nil {
-				// todo: make error readable
-				s.out <- replyError(err)
+		if s.user != nil && s.isUserDeleted() {
+			// the user was removed, disconnect like redis does
+			return
+		}
+
+		if _, ok := op.(opAuth); !ok {
+			if s.user == nil {
+				s.send(replyError(newCodedError("NOAUTH", "Authentication required.")))
 				continue
 			}
-			s.out <- replyInteger(res)
-		case opIncr:
-			err := store.Incr(s.ctx, t.key)
+			err := s.acl.check(s.user, op, s.clientInfo())
 			if err != nil {
-				// todo: make error readable
-				s.out <- replyError(err)
+				s.send(replyError(err))
 				continue
 			}
-			s.out <- replyOK()
+		}
+
+		name, subcommand := commandName(op)
+		if s.server.sentinel != nil && !sentinelCommand(op) {
+			s.send(replyError(fmt.Errorf("unknown command '%s' in sentinel mode", strings.ToLower(name))))
 			continue
-		case opDecr:
-			err := store.Decr(s.ctx, t.key)
+		}
+		// ASKING only applies to the command that follows it
+		asking := s.asking
+		_, s.asking = op.(opAsking)
+		if s.server.cluster != nil && !s.master {
+			err := s.server.cluster.route(s.ctx, store, commandKeys(op), asking)
 			if err != nil {
-				s.out <- replyError(err)
+				s.send(replyError(err))
 				continue
 			}
-			s.out <- replyOK()
-			continue
-		default:
-			s.out <- replyError(errors.New("unknown command"))
+		}
+		write := slices.Contains(categoriesFor(name, subcommand), "write")
+		if t, ok := op.(opFcall); ok {
+			// a function runs as a write unless it is flagged no-writes
+			t.noWrites = s.server.functions.readOnly(t.function)
+			op, write = t, !t.ro && !t.noWrites
+		}
+		if write && s.server.repl.isReplica() {
+			s.send(replyError(errReadOnly))
 			continue
 		}
+
+		s.touch(op)
+		s.server.stats.commands.Add(1)
+
+		if _, ok := op.(opClient); !ok {
+			s.waitPause(write)
+		}
+
+		start := time.Now()
+		s.blocked = 0
+		s.send(s.execute(store, op, args, write))
+		elapsed := time.Since(start) - s.blocked
+		s.server.recordCommand(op, elapsed)
+		s.server.monitors.feed(s, op, args, start)
+		// passwords are kept out of the slow log
+		if _, ok := op.(opAuth); !ok {
+			s.mu.Lock()
+			name := s.name
+			s.mu.Unlock()
+			s.server.slowlog.add(args, elapsed, s.conn.RemoteAddr().String(), name)
+		}
 	}
 }
 
-func (s *Session) HandleOut() {
-	for message := range s.out {
-		_, err := s.conn.Write(message)
+// Runs a write command and propagates it to the replicas unless it failed.
+func (s *Session) dispatchWrite(store Storer, op any, args []string) []byte {
+	writes := s.server.repl.writes
+	writes.RLock()
+	defer writes.RUnlock()
+
+	reply := s.dispatch(store, op)
+	if len(reply) == 0 || reply[0] != '-' {
+		if offset := s.server.propagate(op, args); offset > 0 {
+			s.writeOffset = offset
+		}
+	}
+	return reply
+}
+
+// Runs a single command and returns its reply.
+func (s *Session) dispatch(store Storer, op any) []byte {
+	switch t := op.(type) {
+	case opSet:
+		// default ttl to none
+		ttl := int64(-1)
+		if t.ex != 0 {
+			ttl = time.Now().Unix() + t.ex
+		}
+		if t.exat != 0 {
+			ttl = t.exat
+		}
+		err := store.Set(s.ctx, t.key, t.value, ttl)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+	case opGet:
+		value, _, err := store.Get(s.ctx, t.key)
+		if err != nil && err.Error() == "key not found" {
+			return replyNil()
+		}
+		if err != nil {
+			return replyError(err)
+		}
+		return replyString(value)
+	case opDel:
+		num, err := store.Del(s.ctx, t.keys)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(num)
+	case opExists:
+		num, err := store.Exists(s.ctx, t.keys)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(num)
+	case opExpire:
+		res, err := store.Expire(s.ctx, t.key, t.ttl)
+		if err != nil {
+			// todo: make error readable
+			return replyError(err)
+		}
+		return replyInteger(res)
+	case opExpireAt:
+		res, err := store.Expire(s.ctx, t.key, t.at-time.Now().Unix())
+		if err != nil {
+			return replyError(err)
+		}
+		return replyInteger(res)
+	case opIncr:
+		err := store.Incr(s.ctx, t.key)
 		if err != nil {
-			log.Error().Err(err).Msgf("cant write message to session %s", s.id)
+			// todo: make error readable
+			return replyError(err)
+		}
+		return replyOK()
+	case opDecr:
+		err := store.Decr(s.ctx, t.key)
+		if err != nil {
+			return replyError(err)
+		}
+		return replyOK()
+	case opAuth:
+		if t.username == "" && s.acl.defaultUser() != nil {
+			return replyError(errors.New("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+		}
+		username := t.username
+		if username == "" {
+			username = "default"
+		}
+		user, err := s.acl.authenticate(username, t.password)
+		if err != nil {
+			s.acl.addLog("auth", "AUTH", username, s.clientInfo())
+			return replyError(err)
+		}
+		s.setUser(user)
+		return replyOK()
+	case opACL:
+		return s.handleACL(t)
+	case opClient:
+		return s.handleClient(t)
+	case opObject:
+		return s.handleObject(store, t)
+	case opMemory:
+		return s.handleMemory(store, t)
+	case opInfo:
+		return s.handleInfo(t)
+	case opSlowlog:
+		return s.handleSlowlog(t)
+	case opLatency:
+		return s.handleLatency(t)
+	case opMonitor:
+		return s.handleMonitor()
+	case opConfig:
+		return s.handleConfig(t)
+	case opPing:
+		if t.message != "" {
+			return replyString([]byte(t.message))
+		}
+		return []byte("+PONG\r\n")
+	case opReplicaOf:
+		return s.handleReplicaOf(t)
+	case opRole:
+		return s.handleRole()
+	case opReplconf:
+		return s.handleReplconf(t)
+	case opPsync:
+		return s.handlePsync(store, t)
+	case opSentinel:
+		return s.handleSentinel(t)
+	case opWait:
+		return s.handleWait(t)
+	case opWaitAof:
+		return s.handleWaitAof(t)
+	case opCluster:
+		return s.handleCluster(store, t)
+	case opDump:
+		return s.handleDump(store, t)
+	case opRestore:
+		return s.handleRestore(store, t)
+	case opMigrate:
+		return s.handleMigrate(store, t)
+	case opPfadd:
+		return s.handlePfadd(store, t)
+	case opPfcount:
+		return s.handlePfcount(store, t)
+	case opPfmerge:
+		return s.handlePfmerge(store, t)
+	case opGeoadd:
+		return s.handleGeoadd(store, t)
+	case opGeopos:
+		return s.handleGeopos(store, t)
+	case opGeodist:
+		return s.handleGeodist(store, t)
+	case opGeohash:
+		return s.handleGeohash(store, t)
+	case opGeosearch:
+		return s.handleGeosearch(store, t)
+	case opFunction:
+		return s.handleFunction(t)
+	case opFcall:
+		return s.handleFcall(store, t)
+	case opAsking:
+		if s.server.cluster == nil {
+			return replyError(errors.New("This instance has cluster support disabled"))
+		}
+		return replyOK()
+	}
+
+	return replyError(errors.New("unknown command"))
+}
+
+// Sets the read deadline for the idle timeout, unless the session is stopping.
+// Like redis, monitors and replicas are never idle.
+func (s *Session) armReadDeadline() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		s.conn.SetReadDeadline(time.Now())
+		return
+	}
+	if s.monitor || s.replica {
+		s.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	if timeout := s.server.options().Timeout; timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+func (s *Session) setUser(user *aclUser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user = user
+}
+
+func (s *Session) isUserDeleted() bool {
+	s.acl.mu.RLock()
+	defer s.acl.mu.RUnlock()
+
+	return s.user.deleted
+}
+
+// Describes the client for the ACL log.
+func (s *Session) clientInfo() string {
+	return fmt.Sprintf("id=%d addr=%s", s.id, s.conn.RemoteAddr())
+}
+
+// Stops the session after the commands already received have been processed.
+func (s *Session) Stop() {
+	s.cancel()
+}
+
+// Queues a reply. Sessions exceeding the output buffer limits are disconnected.
+func (s *Session) send(reply []byte) {
+	size := s.out.push(reply)
+
+	s.mu.Lock()
+	replica := s.replica
+	s.mu.Unlock()
+	// replicas are sent the whole stream, like redis they are not subject to the normal limits
+	if replica {
+		return
+	}
+
+	limit := s.server.options().OutputBufferLimit
+	if limit.Hard == 0 && limit.Soft == 0 {
+		return
+	}
+
+	if limit.Hard > 0 && size > limit.Hard {
+		log.Warn().Msgf("closing session %d, output buffer of %d bytes exceeds the hard limit", s.id, size)
+		s.kill()
+		return
+	}
+
+	s.mu.Lock()
+	if limit.Soft == 0 || size <= limit.Soft {
+		s.softLimitSince = time.Time{}
+		s.mu.Unlock()
+		return
+	}
+	if s.softLimitSince.IsZero() {
+		s.softLimitSince = time.Now()
+	}
+	exceeded := time.Since(s.softLimitSince) > limit.SoftDuration
+	s.mu.Unlock()
+
+	if exceeded {
+		log.Warn().Msgf("closing session %d, output buffer of %d bytes exceeds the soft limit", s.id, size)
+		s.kill()
+	}
+}
+
+// Asks HandleOut to write buffered replies to the connection.
+func (s *Session) flush() {
+	s.out.push(nil)
+}
+
+// Writes queued replies into a buffered writer, flushing when asked to.
+func (s *Session) HandleOut() {
+	writer := bufio.NewWriterSize(&countingWriter{Writer: s.conn, n: &s.server.stats.netOutput}, sessionBufferSize)
+
+	failed := false
+	for {
+		replies, open := s.out.pop()
+		for _, reply := range replies {
+			if failed {
+				break
+			}
+
+			var err error
+			if reply == nil {
+				err = writer.Flush()
+			} else {
+				_, err = writer.Write(reply)
+			}
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Error().Err(err).Msgf("cant write message to session %d", s.id)
+				}
+				failed = true
+				s.cancel()
+			}
+		}
+		if !open {
 			break
 		}
 	}
 
+	if !failed {
+		writer.Flush()
+	}
+
 	err := s.conn.Close()
-	if err != nil {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		log.Error().Err(err).Msg("error closing connection")
 	}
 }
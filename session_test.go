@@ -0,0 +1,156 @@
+package cider
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	input := "SET foo bar\r\n*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$11\r\nhello world\r\nGET foo\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+
+	want := [][]string{
+		{"SET", "foo", "bar"},
+		{"SET", "key", "hello world"},
+		{"GET", "foo"},
+	}
+
+	for _, w := range want {
+		args, err := readCommand(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Compare(args, w) != 0 {
+			t.Errorf("want: %v, got %v", w, args)
+		}
+	}
+
+	_, err := readCommand(reader)
+	if err != io.EOF {
+		t.Errorf("want: %v, got %v", io.EOF, err)
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	tcs := []string{
+		"*x\r\n",
+		"*1\r\n+foo\r\n",
+		"*1\r\n$-5\r\n",
+		"*1\r\n$3\r\nfoobar\r\n",
+		strings.Repeat("a", maxInlineSize+1) + "\r\n",
+	}
+
+	for _, tc := range tcs {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(tc)))
+		if _, ok := err.(protocolError); !ok {
+			t.Errorf("want protocol error for %.20q, got %v", tc, err)
+		}
+	}
+}
+
+func TestSessionPipeline(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "*3\r\n$3\r\nSET\r\n$5\r\nkey%02d\r\n$1\r\n%d\r\n", i%100, i%10)
+	}
+	sb.WriteString("GET key99\r\n")
+
+	_, err := client.conn.Write([]byte(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		reply, err := readTestReply(client.reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != "+OK\r\n" {
+			t.Fatalf("reply %d: want +OK, got %q", i, reply)
+		}
+	}
+
+	reply, err := readTestReply(client.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "$1\r\n9\r\n" {
+		t.Errorf("want: %q, got %q", "$1\r\n9\r\n", reply)
+	}
+
+	// malformed input is answered with an error and the connection is closed
+	if reply := client.do(t, "*1\r\n$x"); !strings.HasPrefix(reply, "-ERR Protocol error") {
+		t.Errorf("want protocol error, got %q", reply)
+	}
+	_, err = client.reader.ReadByte()
+	if err == nil {
+		t.Error("want connection to be closed")
+	}
+}
+
+func benchmarkPipeline(b *testing.B, depth int) {
+	server, err := NewServer(ServerOptions{
+		Listeners: []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = server.Listen()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addrs()[0].String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// redis-benchmark style SET commands encoded as RESP arrays
+	var batch []byte
+	for i := 0; i < depth; i++ {
+		batch = append(batch, "*3\r\n$3\r\nSET\r\n$16\r\nkey:__rand_int__\r\n$3\r\nxxx\r\n"...)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += depth {
+		_, err := conn.Write(batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < depth; j++ {
+			_, err := reader.ReadString('\n')
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
+
+func BenchmarkPipeline1(b *testing.B) {
+	benchmarkPipeline(b, 1)
+}
+
+func BenchmarkPipeline16(b *testing.B) {
+	benchmarkPipeline(b, 16)
+}
+
+func BenchmarkPipeline256(b *testing.B) {
+	benchmarkPipeline(b, 256)
+}
@@ -0,0 +1,175 @@
+package cider
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSlowlogLogSlowerThan = 10 * time.Millisecond
+	defaultSlowlogMaxLen        = 128
+	// Like redis, long commands and arguments are truncated in the slow log.
+	slowlogMaxArgs   = 32
+	slowlogMaxString = 128
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+// Bounded log of commands that took longer than a threshold, newest first.
+type slowlog struct {
+	mu *sync.Mutex
+	// read on every command, so kept outside the lock
+	threshold atomic.Int64
+	maxLen    int
+	nextID    int64
+	entries   []slowlogEntry
+}
+
+func newSlowlog(threshold time.Duration, maxLen int) *slowlog {
+	l := &slowlog{
+		mu: &sync.Mutex{},
+	}
+	l.configure(threshold, maxLen)
+	return l
+}
+
+// Changes the threshold and length, entries beyond the new length are dropped.
+func (l *slowlog) configure(threshold time.Duration, maxLen int) {
+	if threshold == 0 {
+		threshold = defaultSlowlogLogSlowerThan
+	}
+	if maxLen == 0 {
+		maxLen = defaultSlowlogMaxLen
+	}
+	l.threshold.Store(int64(threshold))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxLen = maxLen
+	if len(l.entries) > l.maxLen {
+		l.entries = l.entries[:l.maxLen]
+	}
+}
+
+// Records a command if it ran longer than the threshold.
+func (l *slowlog) add(args []string, d time.Duration, addr string, name string) {
+	threshold := time.Duration(l.threshold.Load())
+	if threshold < 0 || d < threshold {
+		return
+	}
+
+	logged := make([]string, 0, min(len(args), slowlogMaxArgs))
+	for i, arg := range args {
+		if i == slowlogMaxArgs-1 && len(args) > slowlogMaxArgs {
+			logged = append(logged, fmt.Sprintf("... (%d more arguments)", len(args)-i))
+			break
+		}
+		if len(arg) > slowlogMaxString {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxString], len(arg)-slowlogMaxString)
+		}
+		logged = append(logged, arg)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := slowlogEntry{
+		id:       l.nextID,
+		time:     time.Now(),
+		duration: d,
+		args:     logged,
+		addr:     addr,
+		name:     name,
+	}
+	l.nextID++
+
+	l.entries = append([]slowlogEntry{entry}, l.entries...)
+	if len(l.entries) > l.maxLen {
+		l.entries = l.entries[:l.maxLen]
+	}
+}
+
+// Returns up to count of the newest entries, all of them when count is negative.
+func (l *slowlog) get(count int) []slowlogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	entries := make([]slowlogEntry, count)
+	copy(entries, l.entries)
+	return entries
+}
+
+func (l *slowlog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+func (l *slowlog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = nil
+}
+
+func (s *Session) handleSlowlog(op opSlowlog) []byte {
+	log := s.server.slowlog
+
+	switch op.subcommand {
+	case "GET":
+		count := 10
+		if len(op.args) > 1 {
+			return replyError(errors.New("wrong number of arguments for SLOWLOG GET"))
+		}
+		if len(op.args) == 1 {
+			n, err := strconv.Atoi(op.args[0])
+			if err != nil || n < -1 {
+				return replyError(errors.New("count should be greater than or equal to -1"))
+			}
+			count = n
+		}
+
+		var replies [][]byte
+		for _, entry := range log.get(count) {
+			args := make([][]byte, 0, len(entry.args))
+			for _, arg := range entry.args {
+				args = append(args, replyString([]byte(arg)))
+			}
+			replies = append(replies, replyArray([][]byte{
+				replyInteger(entry.id),
+				replyInteger(entry.time.Unix()),
+				replyInteger(entry.duration.Microseconds()),
+				replyArray(args),
+				replyString([]byte(entry.addr)),
+				replyString([]byte(entry.name)),
+			}))
+		}
+		return replyArray(replies)
+
+	case "LEN":
+		return replyInteger(int64(log.len()))
+
+	case "RESET":
+		log.reset()
+		return replyOK()
+	}
+
+	return replyError(fmt.Errorf("unknown subcommand '%s'", strings.ToLower(op.subcommand)))
+}
@@ -0,0 +1,70 @@
+package cider
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowlog(t *testing.T) {
+	server := startTestServer(t, ServerOptions{
+		Listeners:            []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}},
+		SlowlogLogSlowerThan: time.Nanosecond,
+		SlowlogMaxLen:        2,
+	})
+	client := dialTestClient(t, "tcp", server.Addrs()[0].String())
+
+	client.do(t, "CLIENT SETNAME worker")
+	client.do(t, "SET foo bar")
+	client.do(t, "GET foo")
+
+	if reply := client.do(t, "SLOWLOG LEN"); reply != ":2\r\n" {
+		t.Errorf("want: :2, got %q", reply)
+	}
+
+	// newest first, the entry for SLOWLOG LEN is recorded after it replied
+	reply := client.do(t, "SLOWLOG GET 1")
+	if !strings.HasPrefix(reply, "*1\r\n*6\r\n:3\r\n") ||
+		!strings.Contains(reply, "*2\r\n$7\r\nSLOWLOG\r\n$3\r\nLEN\r\n") ||
+		!strings.HasSuffix(reply, "$6\r\nworker\r\n") {
+		t.Errorf("unexpected slowlog entry %q", reply)
+	}
+
+	if reply := client.do(t, "SLOWLOG RESET"); reply != "+OK\r\n" {
+		t.Errorf("want: +OK, got %q", reply)
+	}
+	if reply := client.do(t, "SLOWLOG LEN"); reply != ":1\r\n" {
+		t.Errorf("want: :1, got %q", reply)
+	}
+	if reply := client.do(t, "SLOWLOG GET x"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("want error, got %q", reply)
+	}
+}
+
+func TestSlowlogTruncate(t *testing.T) {
+	log := newSlowlog(time.Nanosecond, 10)
+
+	args := []string{"DEL"}
+	for i := 0; i < 40; i++ {
+		args = append(args, strings.Repeat("k", 200))
+	}
+	log.add(args, time.Millisecond, "127.0.0.1:1234", "")
+
+	entry := log.get(-1)[0]
+	if len(entry.args) != slowlogMaxArgs {
+		t.Errorf("want %d arguments, got %d", slowlogMaxArgs, len(entry.args))
+	}
+	if want := "... (10 more arguments)"; entry.args[slowlogMaxArgs-1] != want {
+		t.Errorf("want: %q, got %q", want, entry.args[slowlogMaxArgs-1])
+	}
+	if want := strings.Repeat("k", 128) + "... (72 more bytes)"; entry.args[1] != want {
+		t.Errorf("want: %q, got %q", want, entry.args[1])
+	}
+
+	// below the threshold or disabled
+	log.add(args, 0, "", "")
+	newSlowlog(-1, 10).add(args, time.Second, "", "")
+	if log.len() != 1 {
+		t.Errorf("want: 1, got %d", log.len())
+	}
+}
@@ -3,9 +3,10 @@ package cider
 import (
 	"context"
 	"errors"
-	"fmt"
+	"math"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,7 +17,7 @@ type Storer interface {
 	Set(ctx context.Context, key string, value []byte, ttl int64) (err error)
 	// Deletes keys. Returns the number of deleted keys.
 	Del(ctx context.Context, keys []string) (deleted int64, err error)
-	// Checks if keys exist in database. Returns the number of keys found.
+	// Checks if keys exist in database and have not expired. Returns the number of keys found.
 	Exists(ctx context.Context, keys []string) (found int64, err error)
 	// Expires a key after n seconds.
 	Expire(ctx context.Context, key string, ttl int64) (result int64, err error)
@@ -28,95 +29,634 @@ type Storer interface {
 	TTL(ctx context.Context, key string) (result int64, err error)
 }
 
-type store struct {
+// Memory accounting and object introspection of the store returned by NewStore. A Storer given in
+// ServerOptions may leave them out, maxmemory then can't be set and OBJECT and MEMORY USAGE fail.
+type memoryStorer interface {
+	Storer
+	// Sets the memory limit in bytes (0 for none), the eviction policy and how many keys are sampled per eviction.
+	SetMaxMemory(maxmemory int64, policy string, samples int) (err error)
+	// Gets the approximate memory used by keys and values in bytes.
+	UsedMemory() (used int64)
+	// Gets the approximate memory used by a key and its value in bytes.
+	MemoryUsage(ctx context.Context, key string) (bytes int64, err error)
+	// Gets the number of seconds since a key was last accessed.
+	IdleTime(ctx context.Context, key string) (seconds int64, err error)
+	// Gets the logarithmic access frequency counter of a key, only tracked with an LFU policy.
+	Freq(ctx context.Context, key string) (freq int64, err error)
+	// Gets the internal representation of a value: int, embstr or raw for strings, listpack or skiplist for sorted sets.
+	Encoding(ctx context.Context, key string) (encoding string, err error)
+}
+
+// Serialization of the store returned by NewStore, DUMP, RESTORE and MIGRATE fail without it.
+type dumpStorer interface {
+	Storer
+	// Serializes the value of a key in the DUMP format.
+	Dump(ctx context.Context, key string) (payload []byte, ttl int64, err error)
+	// Calls f with the DUMP payloads and ttls of the keys found, which can not change until it returns.
+	// The keys are deleted when f returns true.
+	Migrate(ctx context.Context, keys []string, f func(found []string, payloads [][]byte, ttls []int64) (del bool, err error)) (err error)
+	// Creates a key from a deserialized string value. Fails when the key exists unless replace is set.
+	// The idle time in seconds and the LFU counter of the key are set when not negative.
+	Restore(ctx context.Context, key string, value []byte, ttl int64, replace bool, idle int64, freq int64) (err error)
+}
+
+// Read-modify-write of a key as one operation, HyperLogLog commands fail without it.
+type updateStorer interface {
+	Storer
+	// Replaces the value of a key with the one returned by f, keeping its ttl, as one operation.
+	// f gets nil and false for a missing key, must not modify value and returns false to leave the key as is.
+	Update(ctx context.Context, key string, f func(value []byte, found bool) (updated []byte, write bool, err error)) (err error)
+}
+
+// Whole keyspace operations of the store returned by NewStore. Without them keys are
+// neither listed nor actively expired, INFO shows no keyspace and full resyncs fail.
+type keyspaceStorer interface {
+	Storer
+	// Gets key counts and keyspace statistics.
+	Stats() (stats StoreStats)
+	// Resets keyspace hits, misses, expired and evicted counters.
+	ResetStats()
+	// Removes a sample of expired keys. Returns the number of removed keys.
+	ActiveExpire(ctx context.Context) (expired int64)
+	// Calls f for every string key that has not expired until f returns false.
+	Range(ctx context.Context, f func(key string, value []byte, ttl int64) bool)
+	// Deletes every key.
+	Flush(ctx context.Context) (err error)
+}
+
+var (
+	errNoMemory   = errors.New("memory accounting is not supported by the store")
+	errNoDump     = errors.New("serialization is not supported by the store")
+	errNoUpdate   = errors.New("atomic updates are not supported by the store")
+	errNoKeyspace = errors.New("keyspace operations are not supported by the store")
+)
+
+// Gets the memory operations of a store.
+func memoryStoreOf(store Storer) (memoryStorer, error) {
+	ms, ok := store.(memoryStorer)
+	if !ok {
+		return nil, errNoMemory
+	}
+	return ms, nil
+}
+
+// Gets the serialization operations of a store.
+func dumpStoreOf(store Storer) (dumpStorer, error) {
+	ds, ok := store.(dumpStorer)
+	if !ok {
+		return nil, errNoDump
+	}
+	return ds, nil
+}
+
+// Gets the update operation of a store.
+func updateStoreOf(store Storer) (updateStorer, error) {
+	us, ok := store.(updateStorer)
+	if !ok {
+		return nil, errNoUpdate
+	}
+	return us, nil
+}
+
+// Gets the keyspace operations of a store.
+func keyspaceStoreOf(store Storer) (keyspaceStorer, error) {
+	ks, ok := store.(keyspaceStorer)
+	if !ok {
+		return nil, errNoKeyspace
+	}
+	return ks, nil
+}
+
+// Sets the memory limit of a store, which can only stay unlimited without memory accounting.
+func setMaxMemory(store Storer, maxmemory int64, policy string, samples int) error {
+	ms, err := memoryStoreOf(store)
+	if err != nil {
+		if maxmemory == 0 {
+			return nil
+		}
+		return err
+	}
+	return ms.SetMaxMemory(maxmemory, policy, samples)
+}
+
+// Gets the memory used by a store, 0 without memory accounting.
+func usedMemory(store Storer) int64 {
+	ms, ok := store.(memoryStorer)
+	if !ok {
+		return 0
+	}
+	return ms.UsedMemory()
+}
+
+// Gets the statistics of a store, empty without keyspace operations.
+func storeStats(store Storer) StoreStats {
+	ks, ok := store.(keyspaceStorer)
+	if !ok {
+		return StoreStats{}
+	}
+	return ks.Stats()
+}
+
+// Sorted set operations of the store returned by NewStore. A Storer given in
+// ServerOptions may leave them out, sorted set commands then fail with errNoZSets.
+type zsetStorer interface {
+	Storer
+	// Creates a key from a deserialized sorted set, like Restore.
+	RestoreZSet(ctx context.Context, key string, z *zset, ttl int64, replace bool, idle int64, freq int64) (err error)
+	// Calls f with the sorted set of a key under the lock of its shard. f must not keep z, modify it or call the store.
+	ReadZSet(ctx context.Context, key string, f func(z *zset) error) (err error)
+	// Calls f with the sorted set of a key to modify it in place, an empty one for a missing key. Empty sets are not stored.
+	UpdateZSet(ctx context.Context, key string, f func(z *zset) error) (err error)
+	// Replaces the value of a key with a sorted set, clearing its ttl.
+	SetZSet(ctx context.Context, key string, z *zset) (err error)
+	// Calls f for every sorted set that has not expired until f returns false.
+	RangeZSets(ctx context.Context, f func(key string, z *zset, ttl int64) bool)
+}
+
+var errNoZSets = errors.New("sorted sets are not supported by the store")
+
+// Gets the sorted set operations of a store.
+func zsetStoreOf(store Storer) (zsetStorer, error) {
+	zs, ok := store.(zsetStorer)
+	if !ok {
+		return nil, errNoZSets
+	}
+	return zs, nil
+}
+
+// Calls f for every key of a store that has not expired, sorted sets included, until f returns false.
+func rangeKeys(ctx context.Context, store Storer, f func(key string) bool) {
+	ks, ok := store.(keyspaceStorer)
+	if !ok {
+		return
+	}
+	more := true
+	ks.Range(ctx, func(key string, value []byte, ttl int64) bool {
+		more = f(key)
+		return more
+	})
+	if zs, ok := store.(zsetStorer); ok && more {
+		zs.RangeZSets(ctx, func(key string, z *zset, ttl int64) bool {
+			return f(key)
+		})
+	}
+}
+
+type StoreStats struct {
+	Keys int64
+	// sorted sets among Keys, the others are strings
+	ZSets      int64
+	Expires    int64
+	UsedMemory int64
+	MaxMemory  int64
+	Policy     string
+	Hits       int64
+	Misses     int64
+	Expired    int64
+	Evicted    int64
+}
+
+var (
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errBusyKey    = newCodedError("BUSYKEY", "Target key name already exists.")
+	errWrongType  = newCodedError("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+)
+
+// Number of independently locked parts of the keyspace, a power of two.
+const storeShards = 64
+
+// Part of the keyspace, keys are assigned to shards by the hash of their name.
+type shard struct {
 	mu *sync.RWMutex
 	db map[string]*item
+	// keys with a ttl, sampled by the volatile eviction policies and the active expire cycle
+	expires map[string]struct{}
+	// approximate memory used by keys and values of the shard
+	used int64
+	// number of sorted sets in db
+	zsets int
+}
+
+type store struct {
+	shards [storeShards]*shard
+	// guards the eviction policy and samples
+	mu      *sync.RWMutex
+	policy  string
+	samples int
+	// checked without a lock on every write
+	maxmemory atomic.Int64
+	// approximate memory used by keys and values of every shard
+	used atomic.Int64
+	// keyspace statistics
+	evicted atomic.Int64
+	hits    atomic.Int64
+	misses  atomic.Int64
+	expired atomic.Int64
+	// shard the active expire cycle visits next
+	expireCursor atomic.Uint32
 }
 
 func NewStore() *store {
-	return &store{
-		mu: &sync.RWMutex{},
-		db: make(map[string]*item),
+	s := &store{
+		mu:      &sync.RWMutex{},
+		policy:  "noeviction",
+		samples: defaultMaxMemorySamples,
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			mu:      &sync.RWMutex{},
+			db:      make(map[string]*item),
+			expires: make(map[string]struct{}),
+		}
 	}
+	return s
 }
 
-type item struct {
-	mu    *sync.RWMutex
-	value []byte
-	ttl   int64
+// FNV-1a hash of the key, computed without allocating.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h & (storeShards - 1))
 }
 
-func (item *item) setValue(value []byte) {
-	item.mu.Lock()
-	defer item.mu.Unlock()
+func (s *store) shard(key string) *shard {
+	return s.shards[shardIndex(key)]
+}
 
-	item.value = value
+// Locks the shards holding keys in index order, so concurrent multi-key operations
+// can not deadlock. The indexes of the locked shards are appended to indexes, which
+// callers can pass on the stack, and returned for unlockShards.
+func (s *store) lockShards(indexes []int, keys []string, write bool) []int {
+	// commands have few keys, an insertion sort avoids allocating
+	for _, key := range keys {
+		index := shardIndex(key)
+		i := len(indexes)
+		for i > 0 && indexes[i-1] > index {
+			i--
+		}
+		if i > 0 && indexes[i-1] == index {
+			continue
+		}
+		indexes = append(indexes, 0)
+		copy(indexes[i+1:], indexes[i:])
+		indexes[i] = index
+	}
+
+	for _, i := range indexes {
+		if write {
+			s.shards[i].mu.Lock()
+		} else {
+			s.shards[i].mu.RLock()
+		}
+	}
+	return indexes
 }
 
-func (item *item) setTTL(ttl int64) {
-	item.mu.Lock()
-	defer item.mu.Unlock()
+func (s *store) unlockShards(indexes []int, write bool) {
+	for _, i := range indexes {
+		if write {
+			s.shards[i].mu.Unlock()
+		} else {
+			s.shards[i].mu.RUnlock()
+		}
+	}
+}
+
+// Longest string reported as embstr, like redis.
+const embstrSizeLimit = 44
+
+// Internal representation of a value, reported by OBJECT ENCODING.
+type encoding uint8
+
+const (
+	encodingRaw encoding = iota
+	encodingEmbstr
+	// value held as an int64 instead of decimal bytes
+	encodingInt
+	// sorted sets, see zset
+	encodingListpack
+	encodingSkiplist
+)
 
-	item.ttl = ttl
+func (e encoding) String() string {
+	switch e {
+	case encodingEmbstr:
+		return "embstr"
+	case encodingInt:
+		return "int"
+	case encodingListpack:
+		return "listpack"
+	case encodingSkiplist:
+		return "skiplist"
+	}
+	return "raw"
 }
 
-// Returns value and ttl as copies.
-func (item *item) get() (value []byte, ttl int64) {
-	item.mu.RLock()
-	defer item.mu.RUnlock()
+// Value of a key. Value, number, encoding, zset and ttl are guarded by the lock of the shard holding the key.
+type item struct {
+	// raw and embstr values, nil for int
+	value    []byte
+	number   int64
+	encoding encoding
+	// sorted set, nil for strings
+	zset *zset
+	ttl  int64
+	size int64
+	// last access in unix milliseconds for LRU
+	access atomic.Int64
+	// logarithmic access counter and the minute it was last updated for LFU
+	freq     atomic.Uint32
+	freqTime atomic.Int64
+}
 
+// Returns a string value as bytes and the ttl, caller must hold the shard lock.
+func (item *item) get() (value []byte, ttl int64) {
+	if item.encoding == encodingInt {
+		return strconv.AppendInt(nil, item.number, 10), item.ttl
+	}
 	return item.value, item.ttl
 }
 
+// Serializes the value in the DUMP format. Caller holds the shard lock.
+func (item *item) dump() (payload []byte, ttl int64) {
+	if item.zset != nil {
+		return dumpZSet(item.zset), item.ttl
+	}
+	value, ttl := item.get()
+	return dumpValue(value), ttl
+}
+
+func (item *item) expired(now int64) bool {
+	return item.ttl != -1 && item.ttl <= now
+}
+
+// Parses the canonical decimal form of an int64, like redis "007" and "+7" are not integers.
+func parseInteger(value []byte) (int64, bool) {
+	if len(value) == 0 || len(value) > 20 {
+		return 0, false
+	}
+	// checked first so that most strings are rejected without parsing and formatting them
+	digits := value
+	if value[0] == '-' {
+		digits = value[1:]
+	}
+	if len(digits) == 0 || (digits[0] == '0' && len(value) > 1) {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Stores a value, as an int64 when it is the canonical decimal form of one.
+func (item *item) setValue(value []byte) {
+	if n, ok := parseInteger(value); ok {
+		item.value = nil
+		item.number = n
+		item.encoding = encodingInt
+		return
+	}
+
+	item.value = value
+	item.number = 0
+	item.encoding = encodingRaw
+	if len(value) <= embstrSizeLimit {
+		item.encoding = encodingEmbstr
+	}
+}
+
 func NewItem(value []byte, ttl int64) *item {
+	item := newItem(ttl)
+	item.setValue(value)
+	return item
+}
+
+func newZSetItem(z *zset, ttl int64) *item {
+	item := newItem(ttl)
+	item.zset = z
+	return item
+}
+
+func newItem(ttl int64) *item {
 
 	if ttl == 0 {
 		ttl = -1
 	}
 
-	return &item{
-		mu:    &sync.RWMutex{},
-		value: value,
-		ttl:   ttl,
+	now := time.Now()
+	item := &item{
+		ttl: ttl,
 	}
+	item.access.Store(now.UnixMilli())
+	item.freq.Store(lfuInitValue)
+	item.freqTime.Store(now.Unix() / 60)
+
+	return item
 }
 
 func (s *store) Get(ctx context.Context, key string) ([]byte, int64, error) {
-	s.mu.RLock()
-	item, ok := s.db[key]
-	s.mu.RUnlock()
+	sh := s.shard(key)
+	sh.mu.RLock()
+	item, ok := sh.db[key]
+	var value []byte
+	var ttl int64
+	sorted := false
+	if ok {
+		sorted = item.zset != nil
+		value, ttl = item.get()
+	}
+	sh.mu.RUnlock()
 	if !ok {
+		s.misses.Add(1)
 		return nil, 0, errors.New("key not found")
 	}
 
-	value, ttl := item.get()
-
-	if ttl != -1 && ttl <= time.Now().Unix() {
-		defer s.Del(ctx, []string{key})
+	now := time.Now()
+	if ttl != -1 && ttl <= now.Unix() {
+		s.misses.Add(1)
+		s.removeExpired(sh, key, item)
 		return []byte{}, 0, errors.New("key not found")
 	}
+	s.hits.Add(1)
+	item.touch(now)
+	if sorted {
+		return nil, 0, errWrongType
+	}
 
 	return value, ttl, nil
 }
 
 func (s *store) Set(ctx context.Context, key string, value []byte, ttl int64) error {
-	item := NewItem(value, ttl)
+	return s.put(key, NewItem(value, ttl), true)
+}
+
+func (s *store) Restore(ctx context.Context, key string, value []byte, ttl int64, replace bool, idle int64, freq int64) error {
+	return s.restore(key, NewItem(value, ttl), replace, idle, freq)
+}
+
+func (s *store) RestoreZSet(ctx context.Context, key string, z *zset, ttl int64, replace bool, idle int64, freq int64) error {
+	return s.restore(key, newZSetItem(z, ttl), replace, idle, freq)
+}
+
+func (s *store) restore(key string, item *item, replace bool, idle int64, freq int64) error {
+	now := time.Now()
+	if idle >= 0 {
+		item.access.Store(now.Add(-time.Duration(idle) * time.Second).UnixMilli())
+	}
+	if freq >= 0 {
+		item.freq.Store(uint32(freq))
+	}
+	return s.put(key, item, replace)
+}
+
+func (s *store) Update(ctx context.Context, key string, f func(value []byte, found bool) ([]byte, bool, error)) error {
+	// the new size is only known under the lock, so make room before like redis does for any write
+	if s.maxmemory.Load() > 0 {
+		err := s.evict(key, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	old, found := sh.db[key]
+	if found && old.expired(now.Unix()) {
+		s.remove(sh, key)
+		s.expired.Add(1)
+		found = false
+	}
+	var value []byte
+	ttl := int64(-1)
+	if found {
+		value, ttl = old.get()
+		s.hits.Add(1)
+		old.touch(now)
+		if old.zset != nil {
+			return errWrongType
+		}
+	} else {
+		s.misses.Add(1)
+	}
+
+	updated, write, err := f(value, found)
+	if err != nil || !write {
+		return err
+	}
+
+	item := NewItem(updated, ttl)
+	item.size = item.sizeOf(key)
+	delta := item.size
+	if found {
+		delta -= old.size
+		item.access.Store(old.access.Load())
+		item.freq.Store(old.freq.Load())
+		item.freqTime.Store(old.freqTime.Load())
+	}
+	sh.db[key] = item
+	sh.used += delta
+	s.used.Add(delta)
+	if ttl != -1 {
+		sh.expires[key] = struct{}{}
+	}
+	return nil
+}
+
+// Stores an item, failing with errBusyKey when the key exists unless replace is set.
+func (s *store) put(key string, item *item, replace bool) error {
+	item.size = item.sizeOf(key)
+	sh := s.shard(key)
+
+	// keys are evicted before the shard is locked, other shards are locked one at a time
+	if s.maxmemory.Load() > 0 {
+		sh.mu.RLock()
+		delta := item.size
+		if old, ok := sh.db[key]; ok {
+			delta -= old.size
+		}
+		sh.mu.RUnlock()
+
+		err := s.evict(key, delta)
+		if err != nil {
+			return err
+		}
+	}
 
-	s.mu.Lock()
-	s.db[key] = item
-	s.mu.Unlock()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	delta := item.size
+	if old, ok := sh.db[key]; ok {
+		if !replace && !old.expired(time.Now().Unix()) {
+			return errBusyKey
+		}
+		delta -= old.size
+		if old.zset != nil {
+			sh.zsets--
+		}
+	}
+	if item.zset != nil {
+		sh.zsets++
+	}
+	sh.db[key] = item
+	sh.used += delta
+	s.used.Add(delta)
+	if item.ttl != -1 {
+		sh.expires[key] = struct{}{}
+	} else {
+		delete(sh.expires, key)
+	}
 
 	return nil
 }
 
+// Removes a key found expired under the read lock, unless another command replaced it since.
+func (s *store) removeExpired(sh *shard, key string, item *item) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.db[key] == item && s.remove(sh, key) {
+		s.expired.Add(1)
+	}
+}
+
+// Removes a key, caller must hold the write lock of its shard.
+func (s *store) remove(sh *shard, key string) bool {
+	item, ok := sh.db[key]
+	if !ok {
+		return false
+	}
+	delete(sh.db, key)
+	delete(sh.expires, key)
+	sh.used -= item.size
+	s.used.Add(-item.size)
+	if item.zset != nil {
+		sh.zsets--
+	}
+	return true
+}
+
 func (s *store) Del(ctx context.Context, keys []string) (int64, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	var buf [16]int
+	locked := s.lockShards(buf[:0], keys, true)
+	defer s.unlockShards(locked, true)
 
 	deletes := 0
 	for _, key := range keys {
-		if _, ok := s.db[key]; ok {
-			delete(s.db, key)
+		if s.remove(s.shard(key), key) {
 			deletes++
 		}
 	}
@@ -124,12 +664,14 @@ func (s *store) Del(ctx context.Context, keys []string) (int64, error) {
 }
 
 func (s *store) Exists(ctx context.Context, keys []string) (int64, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	var buf [16]int
+	locked := s.lockShards(buf[:0], keys, false)
+	defer s.unlockShards(locked, false)
 
+	now := time.Now().Unix()
 	found := 0
 	for _, key := range keys {
-		if _, ok := s.db[key]; ok {
+		if item, ok := s.shard(key).db[key]; ok && !item.expired(now) {
 			found++
 		}
 	}
@@ -137,69 +679,349 @@ func (s *store) Exists(ctx context.Context, keys []string) (int64, error) {
 }
 
 func (s *store) Expire(ctx context.Context, key string, seconds int64) (int64, error) {
-	num, err := s.Exists(ctx, []string{key})
-	if err != nil {
-		return 0, err
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now().Unix()
+	item, ok := sh.db[key]
+	if !ok {
+		return 0, nil
 	}
-	if num == 0 {
-		return 0, err
+	if item.expired(now) {
+		s.remove(sh, key)
+		s.expired.Add(1)
+		return 0, nil
 	}
-
-	s.mu.RLock()
-	s.db[key].setTTL(time.Now().Unix() + seconds)
-	s.mu.RUnlock()
+	item.ttl = now + seconds
+	sh.expires[key] = struct{}{}
 
 	return 1, nil
 }
 
 func (s *store) Incr(ctx context.Context, key string) error {
-	val, ttl, err := s.Get(ctx, key)
-	if err != nil {
-		return err
+	return s.incrBy(key, 1)
+}
+
+func (s *store) Decr(ctx context.Context, key string) error {
+	return s.incrBy(key, -1)
+}
+
+// Adds delta to an integer value in place, keeping its ttl.
+func (s *store) incrBy(key string, delta int64) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	item, ok := sh.db[key]
+	now := time.Now()
+	if ok && item.expired(now.Unix()) {
+		s.remove(sh, key)
+		s.expired.Add(1)
+		ok = false
+	}
+	if !ok {
+		s.misses.Add(1)
+		return errors.New("key not found")
+	}
+	s.hits.Add(1)
+	item.touch(now)
+	if item.zset != nil {
+		return errWrongType
 	}
 
-	// todo: there must be a better way to do this, shifting?
-	number, err := strconv.ParseInt(string(val), 10, 64)
-	if err != nil {
-		return err
+	number := item.number
+	if item.encoding != encodingInt {
+		n, ok := parseInteger(item.value)
+		if !ok {
+			return errNotInteger
+		}
+		number = n
+	}
+	if (delta > 0 && number > math.MaxInt64-delta) || (delta < 0 && number < math.MinInt64-delta) {
+		return errors.New("increment or decrement would overflow")
 	}
 
-	number = number + 1
-	s.Set(ctx, key, []byte(fmt.Sprintf("%d", number)), ttl)
+	item.value = nil
+	item.number = number + delta
+	item.encoding = encodingInt
+	size := item.sizeOf(key)
+	sh.used += size - item.size
+	s.used.Add(size - item.size)
+	item.size = size
 
 	return nil
 }
 
-func (s *store) Decr(ctx context.Context, key string) error {
-	val, ttl, err := s.Get(ctx, key)
-	if err != nil {
+func (s *store) Encoding(ctx context.Context, key string) (string, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	item, ok := sh.db[key]
+	if !ok || item.expired(time.Now().Unix()) {
+		return "", errors.New("key not found")
+	}
+	if item.zset != nil {
+		return item.zset.encoding().String(), nil
+	}
+	return item.encoding.String(), nil
+}
+
+func (s *store) Dump(ctx context.Context, key string) ([]byte, int64, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	item, ok := sh.db[key]
+	now := time.Now()
+	if !ok || item.expired(now.Unix()) {
+		s.misses.Add(1)
+		return nil, 0, errors.New("key not found")
+	}
+	s.hits.Add(1)
+	item.touch(now)
+
+	payload, ttl := item.dump()
+	return payload, ttl, nil
+}
+
+// Moves keys elsewhere: the shards of the keys stay locked while f sends their
+// payloads, so no command can change them before they are deleted.
+func (s *store) Migrate(ctx context.Context, keys []string, f func(found []string, payloads [][]byte, ttls []int64) (bool, error)) error {
+	locked := s.lockShards(nil, keys, true)
+	defer s.unlockShards(locked, true)
+
+	now := time.Now()
+	var found []string
+	var payloads [][]byte
+	var ttls []int64
+	for _, key := range keys {
+		item, ok := s.shard(key).db[key]
+		if !ok || item.expired(now.Unix()) {
+			s.misses.Add(1)
+			continue
+		}
+		s.hits.Add(1)
+		item.touch(now)
+		payload, ttl := item.dump()
+		found = append(found, key)
+		payloads = append(payloads, payload)
+		ttls = append(ttls, ttl)
+	}
+
+	del, err := f(found, payloads, ttls)
+	if err != nil || !del {
 		return err
 	}
+	for _, key := range found {
+		s.remove(s.shard(key), key)
+	}
+	return nil
+}
+
+func (s *store) ReadZSet(ctx context.Context, key string, f func(z *zset) error) error {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	item, ok := sh.db[key]
+	now := time.Now()
+	if !ok || item.expired(now.Unix()) {
+		s.misses.Add(1)
+		return errors.New("key not found")
+	}
+	s.hits.Add(1)
+	item.touch(now)
+
+	if item.zset == nil {
+		return errWrongType
+	}
+	return f(item.zset)
+}
+
+func (s *store) UpdateZSet(ctx context.Context, key string, f func(z *zset) error) error {
+	// like Update the size is only known under the lock
+	if s.maxmemory.Load() > 0 {
+		err := s.evict(key, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+	item, found := sh.db[key]
+	if found && item.expired(now.Unix()) {
+		s.remove(sh, key)
+		s.expired.Add(1)
+		found = false
+	}
+	if !found {
+		s.misses.Add(1)
+		item = newZSetItem(&zset{}, -1)
+	} else {
+		s.hits.Add(1)
+		item.touch(now)
+		if item.zset == nil {
+			return errWrongType
+		}
+	}
 
-	// todo: there must be a better way to do this, shifting?
-	number, err := strconv.ParseInt(string(val), 10, 64)
+	err := f(item.zset)
 	if err != nil {
 		return err
 	}
+	if item.zset.len() == 0 {
+		s.remove(sh, key)
+		return nil
+	}
 
-	number = number - 1
-	s.Set(ctx, key, []byte(fmt.Sprintf("%d", number)), ttl)
-
+	if !found {
+		sh.zsets++
+	}
+	size := item.sizeOf(key)
+	delta := size - item.size
+	item.size = size
+	sh.db[key] = item
+	sh.used += delta
+	s.used.Add(delta)
 	return nil
 }
 
+func (s *store) SetZSet(ctx context.Context, key string, z *zset) error {
+	return s.put(key, newZSetItem(z, -1), true)
+}
+
+func (s *store) MemoryUsage(ctx context.Context, key string) (int64, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	item, ok := sh.db[key]
+	if !ok || item.expired(time.Now().Unix()) {
+		return 0, errors.New("key not found")
+	}
+	return item.size, nil
+}
+
 func (s *store) TTL(ctx context.Context, key string) (int64, error) {
-	_, ttl, err := s.Get(ctx, key)
-	if err != nil && err.Error() == "key not found" {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	item, ok := sh.db[key]
+	ttl := int64(-1)
+	if ok {
+		ttl = item.ttl
+		ok = !item.expired(time.Now().Unix())
+	}
+	sh.mu.RUnlock()
+	if !ok {
 		// The command returns -2 if the key does not exist.
 		return -2, nil
 	}
-	if err != nil {
-		return 0, err
-	}
 	if ttl <= 0 {
 		// The command returns -1 if the key exists but has no associated expire.
 		return -1, nil
 	}
 	return ttl, nil
 }
+
+func (s *store) Stats() StoreStats {
+	stats := StoreStats{
+		UsedMemory: s.used.Load(),
+		MaxMemory:  s.maxmemory.Load(),
+		Hits:       s.hits.Load(),
+		Misses:     s.misses.Load(),
+		Expired:    s.expired.Load(),
+		Evicted:    s.evicted.Load(),
+	}
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		stats.Keys += int64(len(sh.db))
+		stats.ZSets += int64(sh.zsets)
+		stats.Expires += int64(len(sh.expires))
+		sh.mu.RUnlock()
+	}
+
+	s.mu.RLock()
+	stats.Policy = s.policy
+	s.mu.RUnlock()
+
+	return stats
+}
+
+// Shards are visited one at a time, f must not call the store.
+func (s *store) Range(ctx context.Context, f func(key string, value []byte, ttl int64) bool) {
+	s.rangeItems(func(key string, item *item) bool {
+		if item.zset != nil {
+			return true
+		}
+		value, ttl := item.get()
+		return f(key, value, ttl)
+	})
+}
+
+// Shards are visited one at a time, f must not call the store.
+func (s *store) RangeZSets(ctx context.Context, f func(key string, z *zset, ttl int64) bool) {
+	s.rangeItems(func(key string, item *item) bool {
+		if item.zset == nil {
+			return true
+		}
+		return f(key, item.zset, item.ttl)
+	})
+}
+
+// Calls f with the items that have not expired under the lock of their shard.
+func (s *store) rangeItems(f func(key string, item *item) bool) {
+	now := time.Now().Unix()
+	for _, sh := range s.shards {
+		if !s.rangeShard(sh, now, f) {
+			return
+		}
+	}
+}
+
+func (s *store) rangeShard(sh *shard, now int64, f func(key string, item *item) bool) bool {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	for key, item := range sh.db {
+		if item.expired(now) {
+			continue
+		}
+		if !f(key, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *store) Flush(ctx context.Context) error {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.Unlock()
+		}
+	}()
+
+	for _, sh := range s.shards {
+		sh.db = make(map[string]*item)
+		sh.expires = make(map[string]struct{})
+		sh.used = 0
+		sh.zsets = 0
+	}
+	s.used.Store(0)
+	return nil
+}
+
+func (s *store) ResetStats() {
+	s.hits.Store(0)
+	s.misses.Store(0)
+	s.expired.Store(0)
+	s.evicted.Store(0)
+}
@@ -2,8 +2,10 @@ package cider
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
 	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -57,7 +59,7 @@ func TestSetDel(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, ok := store.db["key"]
+	_, ok := store.shard("key").db["key"]
 	if deletes != 1 || ok {
 		t.Errorf("number of deletes should be 1 and not %v", deletes)
 	}
@@ -118,6 +120,41 @@ func TestExpire(t *testing.T) {
 		t.Errorf("got: %d, want: %d", rep, 1)
 	}
 
+	// an expired key not removed yet is not given a new ttl
+	store.Set(ctx, "expired", []byte{0x01}, time.Now().Unix()-1)
+	rep, _ = store.Expire(ctx, "expired", 100)
+	if rep != 0 {
+		t.Errorf("got: %d, want: %d", rep, 0)
+	}
+	if found, _ := store.Exists(ctx, []string{"expired"}); found != 0 {
+		t.Errorf("want expired key to stay missing, got %d", found)
+	}
+}
+
+func TestGetExpiredReplaced(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	store.Set(ctx, "key", []byte("old"), time.Now().Unix()-1)
+	sh := store.shard("key")
+	sh.mu.RLock()
+	old := sh.db["key"]
+	sh.mu.RUnlock()
+
+	// a SET landing between the lookup of the expired value and its removal is kept
+	store.Set(ctx, "key", []byte("new"), -1)
+	store.removeExpired(sh, "key", old)
+	if value, _, err := store.Get(ctx, "key"); err != nil || string(value) != "new" {
+		t.Errorf("want new value, got %q %v", value, err)
+	}
+
+	store.Set(ctx, "key", []byte("old"), time.Now().Unix()-1)
+	if _, _, err := store.Get(ctx, "key"); err == nil {
+		t.Error("want expired key to be missing")
+	}
+	if stats := store.Stats(); stats.Keys != 0 || stats.Expired != 1 {
+		t.Errorf("want expired key removed, got %+v", stats)
+	}
 }
 
 func TestSetConcurrency(t *testing.T) {
@@ -232,6 +269,71 @@ func TestIncrIncr(t *testing.T) {
 	}
 }
 
+func TestEncoding(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	tests := []struct {
+		value    string
+		encoding string
+	}{
+		{value: "100", encoding: "int"},
+		{value: "-9223372036854775808", encoding: "int"},
+		{value: "9223372036854775808", encoding: "embstr"},
+		{value: "007", encoding: "embstr"},
+		{value: "+7", encoding: "embstr"},
+		{value: "", encoding: "embstr"},
+		{value: strings.Repeat("x", 44), encoding: "embstr"},
+		{value: strings.Repeat("x", 45), encoding: "raw"},
+	}
+
+	for _, test := range tests {
+		err := store.Set(ctx, "key", []byte(test.value), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoding, err := store.Encoding(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != test.encoding {
+			t.Errorf("%q: want %s, got %s", test.value, test.encoding, encoding)
+		}
+		// int encoded values read back unchanged
+		value, _, _ := store.Get(ctx, "key")
+		if string(value) != test.value {
+			t.Errorf("want %q, got %q", test.value, value)
+		}
+	}
+
+	// int encoded values take no space beyond the key
+	store.Set(ctx, "key", []byte("12345"), 0)
+	if used, want := store.UsedMemory(), itemSize("key", nil); used != want {
+		t.Errorf("want used memory %d, got %d", want, used)
+	}
+
+	// increments check for overflow and non integer values
+	store.Set(ctx, "key", []byte("x"), 0)
+	store.Set(ctx, "counter", []byte("9223372036854775806"), 0)
+	if err := store.Incr(ctx, "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Incr(ctx, "counter"); err == nil || err.Error() != "increment or decrement would overflow" {
+		t.Errorf("want overflow error, got %v", err)
+	}
+	if err := store.Incr(ctx, "key"); err != errNotInteger {
+		t.Errorf("want %v, got %v", errNotInteger, err)
+	}
+	store.Set(ctx, "key", []byte("007"), 0)
+	if err := store.Decr(ctx, "key"); err != errNotInteger {
+		t.Errorf("want %v, got %v", errNotInteger, err)
+	}
+
+	if _, err := store.Encoding(ctx, "missing"); err == nil {
+		t.Error("want error for a missing key")
+	}
+}
+
 func TestDecr(t *testing.T) {
 	ctx := context.Background()
 	store := NewStore()
@@ -305,3 +407,308 @@ func TestTTL(t *testing.T) {
 	}
 
 }
+
+func TestUsedMemory(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	store.Set(ctx, "key", []byte("value"), -1)
+	want := itemSize("key", []byte("value"))
+	if used := store.UsedMemory(); used != want {
+		t.Errorf("want: %d, got %d", want, used)
+	}
+
+	store.Set(ctx, "key", []byte("longer value"), -1)
+	want = itemSize("key", []byte("longer value"))
+	if used := store.UsedMemory(); used != want {
+		t.Errorf("want: %d, got %d", want, used)
+	}
+
+	store.Del(ctx, []string{"key"})
+	if used := store.UsedMemory(); used != 0 {
+		t.Errorf("want: %d, got %d", 0, used)
+	}
+}
+
+func TestMaxMemoryNoEviction(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	err := store.SetMaxMemory(itemSize("key1", []byte("value")), "noeviction", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Set(ctx, "key1", []byte("value"), -1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = store.Set(ctx, "key2", []byte("value"), -1)
+	if err != errOOM {
+		t.Errorf("want: %v, got %v", errOOM, err)
+	}
+
+	err = store.SetMaxMemory(0, "nosuchpolicy", 0)
+	if err == nil {
+		t.Error("want error for unknown policy")
+	}
+}
+
+func TestMaxMemoryLRU(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	size := itemSize("key1", []byte("value"))
+	err := store.SetMaxMemory(size*3, "allkeys-lru", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Set(ctx, "key1", []byte("value"), -1)
+	store.Set(ctx, "key2", []byte("value"), -1)
+	store.Set(ctx, "key3", []byte("value"), -1)
+
+	// key1 becomes the least recently used key
+	store.shard("key1").db["key1"].access.Store(time.Now().Add(-time.Hour).UnixMilli())
+
+	err = store.Set(ctx, "key4", []byte("value"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.shard("key1").db["key1"]; ok {
+		t.Error("want key1 to be evicted")
+	}
+	if stats := store.Stats(); stats.Keys != 3 || stats.Evicted != 1 {
+		t.Errorf("want 3 keys and 1 eviction, got %d and %d", stats.Keys, stats.Evicted)
+	}
+}
+
+func TestMaxMemoryVolatileTTL(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	size := itemSize("key1", []byte("value"))
+	err := store.SetMaxMemory(size*3, "volatile-ttl", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	store.Set(ctx, "key1", []byte("value"), -1)
+	store.Set(ctx, "key2", []byte("value"), now+100)
+	store.Set(ctx, "key3", []byte("value"), now+10)
+
+	err = store.Set(ctx, "key4", []byte("value"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.shard("key3").db["key3"]; ok {
+		t.Error("want key3 with the nearest expire to be evicted")
+	}
+
+	// only keys without a ttl are left besides key2, which is evicted next
+	err = store.Set(ctx, "key5", []byte("value"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Set(ctx, "key6", []byte("value"), -1)
+	if err != errOOM {
+		t.Errorf("want: %v, got %v", errOOM, err)
+	}
+}
+
+func TestObjectFreqIdleTime(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	store.Set(ctx, "key", []byte("value"), -1)
+
+	_, err := store.Freq(ctx, "key")
+	if err == nil {
+		t.Error("want error when LFU is not enabled")
+	}
+
+	idle, err := store.IdleTime(ctx, "key")
+	if err != nil || idle != 0 {
+		t.Errorf("want idle 0, got %d (%v)", idle, err)
+	}
+
+	store.SetMaxMemory(0, "allkeys-lfu", 0)
+	for i := 0; i < 100; i++ {
+		store.Get(ctx, "key")
+	}
+	freq, err := store.Freq(ctx, "key")
+	if err != nil {
+		t.Error(err)
+	}
+	if freq <= lfuInitValue {
+		t.Errorf("want counter above %d, got %d", lfuInitValue, freq)
+	}
+}
+
+func TestActiveExpire(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+
+	past := time.Now().Unix() - 1
+	for i := 0; i < 100; i++ {
+		store.Set(ctx, fmt.Sprintf("expired%d", i), []byte("value"), past)
+	}
+	store.Set(ctx, "volatile", []byte("value"), time.Now().Unix()+100)
+	store.Set(ctx, "persistent", []byte("value"), -1)
+
+	// most expired keys are sampled, so a cycle keeps going until few are left
+	removed := int64(0)
+	for i := 0; i < 10; i++ {
+		removed += store.ActiveExpire(ctx)
+	}
+	if removed != 100 {
+		t.Errorf("want 100 keys removed, got %d", removed)
+	}
+
+	stats := store.Stats()
+	if stats.Keys != 2 || stats.Expires != 1 || stats.Expired != 100 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRangeFlush(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+
+	store.Set(ctx, "foo", []byte("bar"), -1)
+	store.Set(ctx, "volatile", []byte("value"), time.Now().Unix()+100)
+	store.Set(ctx, "expired", []byte("value"), time.Now().Unix()-1)
+
+	keys := map[string]int64{}
+	store.Range(ctx, func(key string, value []byte, ttl int64) bool {
+		keys[key] = ttl
+		return true
+	})
+	if len(keys) != 2 || keys["foo"] != -1 || keys["volatile"] <= 0 {
+		t.Errorf("want foo and volatile, got %v", keys)
+	}
+
+	err := store.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.Stats(); stats.Keys != 0 || stats.UsedMemory != 0 {
+		t.Errorf("want empty store, got %+v", stats)
+	}
+}
+
+func TestStatsZSets(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+	limits := zsetLimitsOf(&ServerOptions{})
+	add := func(z *zset) error {
+		z.add("member", 1, limits)
+		return nil
+	}
+
+	store.Set(ctx, "string", []byte("value"), -1)
+	store.UpdateZSet(ctx, "a", add)
+	store.UpdateZSet(ctx, "a", add)
+	store.SetZSet(ctx, "string", &zset{})
+	store.SetZSet(ctx, "b", &zset{})
+	store.Set(ctx, "b", []byte("value"), -1)
+	store.UpdateZSet(ctx, "c", add)
+	store.Del(ctx, []string{"c"})
+	if stats := store.Stats(); stats.Keys != 3 || stats.ZSets != 2 {
+		t.Errorf("want 2 sorted sets among 3 keys, got %+v", stats)
+	}
+
+	store.Flush(ctx)
+	if stats := store.Stats(); stats.ZSets != 0 {
+		t.Errorf("want no sorted sets, got %+v", stats)
+	}
+}
+
+func TestMultiKeyConcurrency(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore()
+
+	// keys are locked in shard order, whatever order they are given in
+	keys := []string{"key1", "key2", "key3", "key4"}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			order := slices.Clone(keys)
+			if i%2 == 0 {
+				slices.Reverse(order)
+			}
+			for j := 0; j < 100; j++ {
+				store.Set(ctx, order[j%len(order)], []byte("value"), -1)
+				store.Exists(ctx, order)
+				store.Del(ctx, order)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stats := store.Stats(); stats.Keys != 0 || stats.UsedMemory != 0 {
+		t.Errorf("want empty store, got %+v", stats)
+	}
+}
+
+// Parallel load on keys spread over the keyspace, run with -cpu to vary the number of goroutines.
+func benchmarkStoreParallel(b *testing.B, reads int) {
+	ctx := context.Background()
+	store := NewStore()
+
+	const keys = 100000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key:%d", i)
+		store.Set(ctx, names[i], []byte("value"), -1)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := names[r.Intn(keys)]
+			if r.Intn(100) < reads {
+				store.Get(ctx, key)
+			} else {
+				store.Set(ctx, key, []byte("value"), -1)
+			}
+		}
+	})
+}
+
+func BenchmarkStoreSetParallel(b *testing.B) {
+	benchmarkStoreParallel(b, 0)
+}
+
+func BenchmarkStoreGetParallel(b *testing.B) {
+	benchmarkStoreParallel(b, 100)
+}
+
+func BenchmarkStoreMixedParallel(b *testing.B) {
+	benchmarkStoreParallel(b, 80)
+}
+
+func BenchmarkStoreDelExistsParallel(b *testing.B) {
+	ctx := context.Background()
+	store := NewStore()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			keys := []string{
+				fmt.Sprintf("key:%d", r.Intn(100000)),
+				fmt.Sprintf("key:%d", r.Intn(100000)),
+			}
+			store.Set(ctx, keys[0], []byte("value"), -1)
+			store.Exists(ctx, keys)
+			store.Del(ctx, keys)
+		}
+	})
+}
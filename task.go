@@ -40,3 +40,8 @@ func (t *task) Run() {
 		}
 	}()
 }
+
+func (t *task) Stop() {
+	close(t.stop)
+	log.Info().Msgf("stopped task %s", t.name)
+}
@@ -0,0 +1,175 @@
+package cider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+type TLSOptions struct {
+	// PEM encoded server certificate and private key.
+	CertFile string
+	KeyFile  string
+	// PEM encoded CA bundle used to verify client certificates.
+	CAFile string
+	// Minimum protocol version, TLSv1.2 or TLSv1.3. Defaults to TLSv1.2.
+	MinVersion string
+	// Cipher suite names as reported by crypto/tls, only used for TLSv1.2.
+	CipherSuites []string
+	// Client certificate policy: no, optional or yes (default when CAFile is set).
+	AuthClients string
+}
+
+type tlsConfig struct {
+	mu      *sync.RWMutex
+	opts    TLSOptions
+	current *tls.Config
+}
+
+// Creates a TLS configuration from certificate files. Certificates can be reloaded with Reload.
+func NewTLSConfig(opts TLSOptions) (*tlsConfig, error) {
+	c := &tlsConfig{
+		mu:   &sync.RWMutex{},
+		opts: opts,
+	}
+
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch strings.ToUpper(version) {
+	case "", "TLSV1.2":
+		return tls.VersionTLS12, nil
+	case "TLSV1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %s", version)
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseClientAuth(policy string, hasCA bool) (tls.ClientAuthType, error) {
+	switch strings.ToLower(policy) {
+	case "":
+		if hasCA {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "no":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "yes":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unsupported client auth policy %s", policy)
+}
+
+// Reads the certificate files again, new connections use the reloaded certificates.
+func (c *tlsConfig) Reload() error {
+	if c.opts.CertFile == "" || c.opts.KeyFile == "" {
+		return errors.New("TLS certificate and key files are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.opts.CertFile, c.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	version, err := parseTLSVersion(c.opts.MinVersion)
+	if err != nil {
+		return err
+	}
+
+	suites, err := parseCipherSuites(c.opts.CipherSuites)
+	if err != nil {
+		return err
+	}
+
+	auth, err := parseClientAuth(c.opts.AuthClients, c.opts.CAFile != "")
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if c.opts.CAFile != "" {
+		pem, err := os.ReadFile(c.opts.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.opts.CAFile)
+		}
+	}
+	if auth != tls.NoClientCert && pool == nil {
+		return errors.New("a CA file is required to authenticate clients")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		CipherSuites: suites,
+		ClientAuth:   auth,
+		ClientCAs:    pool,
+	}
+
+	c.mu.Lock()
+	c.current = config
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *tlsConfig) config() *tls.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.current
+}
+
+// Wraps a listener so accepted connections use TLS.
+func (c *tlsConfig) NewListener(inner net.Listener) net.Listener {
+	return tls.NewListener(inner, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.config(), nil
+		},
+	})
+}
+
+// Returns the common name of a verified client certificate, if any.
+func clientCertificateName(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
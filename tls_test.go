@@ -0,0 +1,205 @@
+package cider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func (c *testCertificate) write(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	t.Helper()
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSOptions(t *testing.T) {
+	_, err := parseTLSVersion("TLSv1.1")
+	if err == nil {
+		t.Error("want error for TLSv1.1")
+	}
+
+	_, err = parseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = parseCipherSuites([]string{"NOT_A_SUITE"})
+	if err == nil {
+		t.Error("want error for unknown cipher suite")
+	}
+
+	_, err = NewTLSConfig(TLSOptions{CertFile: "missing.crt", KeyFile: "missing.key"})
+	if err == nil {
+		t.Error("want error for missing certificate")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCertificate(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCertificate(t, "localhost", ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	client := newTestCertificate(t, "alice", ca)
+
+	config, err := NewTLSConfig(TLSOptions{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFile:     caFile,
+		MinVersion: "TLSv1.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener = config.NewListener(listener)
+	defer listener.Close()
+
+	names := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			names <- ""
+			return
+		}
+		defer conn.Close()
+
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			names <- ""
+			return
+		}
+		names <- clientCertificateName(tlsConn.ConnectionState())
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{client.tlsCertificate()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if name := <-names; name != "alice" {
+		t.Errorf("want: alice, got %s", name)
+	}
+
+	acl := NewACL()
+	acl.SetCertificateUsers(true)
+	if acl.certificateUser("alice") != nil {
+		t.Error("unknown users should not be mapped")
+	}
+	if acl.certificateUser("default") == nil {
+		t.Error("want default user to be mapped")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCertificate(t, "ca", nil)
+	first := newTestCertificate(t, "first", ca)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	config, err := NewTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestCertificate(t, "second", ca)
+	second.write(t, dir, "server")
+
+	err = config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := config.config().Certificates[0].Certificate[0]
+	if string(got) != string(second.der) {
+		t.Error("reloaded configuration should use the new certificate")
+	}
+}
@@ -0,0 +1,137 @@
+package cider
+
+import (
+	"errors"
+	"time"
+)
+
+// Records an offset acknowledged by a replica and wakes up sessions blocked in WAIT.
+func (r *replication) ack(s *Session, offset int64, aofOffset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	link, ok := r.replicas[s]
+	if !ok {
+		return
+	}
+	link.ackOffset = max(link.ackOffset, offset)
+	link.aofOffset = max(link.aofOffset, aofOffset)
+	link.ackTime = time.Now()
+
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+// Number of replicas that processed offset, or fsynced it when aof is set. Caller must hold mu.
+func (r *replication) countAcked(offset int64, aof bool) int64 {
+	n := int64(0)
+	for _, link := range r.replicas {
+		acked := link.ackOffset
+		if aof {
+			acked = link.aofOffset
+		}
+		if acked >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// Blocks until numreplicas replicas acknowledged the last write of the session
+// or the timeout expires, zero waits forever. Returns the number of replicas that did.
+func (s *Session) waitReplicas(numreplicas int64, timeout time.Duration, aof bool) int64 {
+	r := s.server.repl
+	offset := s.writeOffset
+
+	start := time.Now()
+	defer func() {
+		s.blocked = time.Since(start)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	asked := false
+	for {
+		r.mu.Lock()
+		n := r.countAcked(offset, aof)
+		acked := r.acked
+		replicas := len(r.replicas)
+		r.mu.Unlock()
+
+		if n >= numreplicas {
+			return n
+		}
+		// replicas acknowledge every second, ask them to do it right away
+		if !asked && replicas > 0 {
+			asked = true
+			r.writes.RLock()
+			r.feed(encodeCommand([]string{"REPLCONF", "GETACK", "*"}))
+			r.writes.RUnlock()
+		}
+
+		select {
+		case <-acked:
+			continue
+		case <-expired:
+		case <-s.ctx.Done():
+		}
+
+		r.mu.Lock()
+		n = r.countAcked(offset, aof)
+		r.mu.Unlock()
+		return n
+	}
+}
+
+func parseWaitArgs(numreplicas string, timeout string) (int64, time.Duration, error) {
+	n, err := parseConfigInt(numreplicas, 0)
+	if err != nil {
+		return 0, 0, errors.New("value is not an integer or out of range")
+	}
+	ms, err := parseConfigInt(timeout, 0)
+	if err != nil {
+		return 0, 0, errors.New("timeout is not an integer or out of range")
+	}
+	return n, time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *Session) handleWait(op opWait) []byte {
+	if s.server.repl.isReplica() {
+		return replyError(errors.New("WAIT cannot be used with replica instances."))
+	}
+	numreplicas, timeout, err := parseWaitArgs(op.numreplicas, op.timeout)
+	if err != nil {
+		return replyError(err)
+	}
+
+	return replyInteger(s.waitReplicas(numreplicas, timeout, false))
+}
+
+// There is no append only file, so no write is ever fsynced locally and cider
+// replicas never acknowledge fsynced offsets.
+func (s *Session) handleWaitAof(op opWaitAof) []byte {
+	if s.server.repl.isReplica() {
+		return replyError(errors.New("WAITAOF cannot be used with replica instances."))
+	}
+	numlocal, err := parseConfigInt(op.numlocal, 0)
+	if err != nil {
+		return replyError(errors.New("value is not an integer or out of range"))
+	}
+	if numlocal > 0 {
+		return replyError(errors.New("WAITAOF cannot be used when numlocal is set but appendonly is disabled."))
+	}
+	numreplicas, timeout, err := parseWaitArgs(op.numreplicas, op.timeout)
+	if err != nil {
+		return replyError(err)
+	}
+
+	return replyArray([][]byte{
+		replyInteger(0),
+		replyInteger(s.waitReplicas(numreplicas, timeout, true)),
+	})
+}
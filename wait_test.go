@@ -0,0 +1,56 @@
+package cider
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	listeners := []ListenerOptions{{Network: "tcp", Address: "127.0.0.1:0"}}
+	primary := startTestServer(t, ServerOptions{
+		Listeners:            listeners,
+		SlowlogLogSlowerThan: 100 * time.Millisecond,
+	})
+	replica := startTestServer(t, ServerOptions{
+		Listeners: listeners,
+		ReplicaOf: primary.Addrs()[0].String(),
+	})
+
+	p := dialTestClient(t, "tcp", primary.Addrs()[0].String())
+	r := dialTestClient(t, "tcp", replica.Addrs()[0].String())
+	waitForReply(t, r, "INFO replication", "master_link_status:up")
+
+	p.do(t, "SET foo bar")
+	if reply := p.do(t, "WAIT 1 2000"); reply != ":1\r\n" {
+		t.Errorf("want: 1, got %q", reply)
+	}
+	if reply := r.do(t, "GET foo"); reply != "$3\r\nbar\r\n" {
+		t.Errorf("want write to be on the replica once acknowledged, got %q", reply)
+	}
+
+	start := time.Now()
+	if reply := p.do(t, "WAIT 2 300"); reply != ":1\r\n" {
+		t.Errorf("want: 1, got %q", reply)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("want WAIT to block until the timeout, returned after %s", elapsed)
+	}
+	// time spent blocked is not execution time
+	if reply := p.do(t, "SLOWLOG LEN"); reply != ":0\r\n" {
+		t.Errorf("want empty slow log, got %q", reply)
+	}
+
+	if reply := p.do(t, "WAITAOF 1 0 0"); !strings.HasPrefix(reply, "-ERR WAITAOF cannot be used when numlocal is set") {
+		t.Errorf("want appendonly error, got %q", reply)
+	}
+	if reply := p.do(t, "WAITAOF 0 1 100"); reply != "*2\r\n:0\r\n:0\r\n" {
+		t.Errorf("want no fsynced replicas, got %q", reply)
+	}
+	if reply := p.do(t, "WAIT -1 0"); !strings.HasPrefix(reply, "-") {
+		t.Errorf("want error for negative numreplicas, got %q", reply)
+	}
+	if reply := r.do(t, "WAIT 1 0"); !strings.HasPrefix(reply, "-ERR WAIT cannot be used with replica instances") {
+		t.Errorf("want replica error, got %q", reply)
+	}
+}
@@ -0,0 +1,279 @@
+package cider
+
+import (
+	"math/rand"
+	"slices"
+	"unsafe"
+)
+
+// Sorted sets stay in the compact encoding up to these sizes, like the redis
+// zset-max-listpack-entries and zset-max-listpack-value parameters.
+const (
+	defaultZSetMaxListpackEntries = 128
+	defaultZSetMaxListpackValue   = 64
+)
+
+const (
+	skiplistMaxLevel = 32
+	// chance of a node to appear on the next level
+	skiplistP = 0.25
+)
+
+// Largest sorted set and member kept in the listpack encoding.
+type zsetLimits struct {
+	entries int
+	value   int
+}
+
+// Zero options mean the defaults, negative ones a limit of zero.
+func zsetLimitsOf(opts *ServerOptions) zsetLimits {
+	limits := zsetLimits{entries: defaultZSetMaxListpackEntries, value: defaultZSetMaxListpackValue}
+	if opts.ZSetMaxListpackEntries != 0 {
+		limits.entries = max(opts.ZSetMaxListpackEntries, 0)
+	}
+	if opts.ZSetMaxListpackValue != 0 {
+		limits.value = max(opts.ZSetMaxListpackValue, 0)
+	}
+	return limits
+}
+
+func (srv *Server) zsetLimits() zsetLimits {
+	return zsetLimitsOf(srv.options())
+}
+
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+var (
+	zsetEntrySize    = int64(unsafe.Sizeof(zsetEntry{}))
+	skiplistNodeSize = int64(unsafe.Sizeof(skiplistNode{}))
+)
+
+// Members ordered by score then member. Small sets are a sorted slice, reported
+// as listpack, larger ones a skiplist with a map from members to scores.
+type zset struct {
+	// listpack encoding, unused once list is set
+	entries []zsetEntry
+	// skiplist encoding
+	dict map[string]float64
+	list *skiplist
+	// approximate memory used by the members and the encoding
+	bytes int64
+}
+
+// Orders members by score, then lexicographically.
+func zsetBefore(score float64, member string, otherScore float64, otherMember string) bool {
+	return score < otherScore || (score == otherScore && member < otherMember)
+}
+
+// Creates a sorted set in the encoding fitting size members of at most maxLen bytes.
+func newZSet(size int, maxLen int, limits zsetLimits) *zset {
+	z := &zset{}
+	if size > limits.entries || maxLen > limits.value {
+		z.convert()
+	}
+	return z
+}
+
+func (z *zset) encoding() encoding {
+	if z.list != nil {
+		return encodingSkiplist
+	}
+	return encodingListpack
+}
+
+func (z *zset) len() int {
+	if z.list != nil {
+		return len(z.dict)
+	}
+	return len(z.entries)
+}
+
+// Gets the score of a member. The listpack encoding is searched linearly like redis.
+func (z *zset) score(member string) (float64, bool) {
+	if z.list != nil {
+		score, ok := z.dict[member]
+		return score, ok
+	}
+	for _, e := range z.entries {
+		if e.member == member {
+			return e.score, true
+		}
+	}
+	return 0, false
+}
+
+// Adds a member or updates its score, converting the set to a skiplist once it outgrows limits.
+func (z *zset) add(member string, score float64, limits zsetLimits) {
+	if z.list == nil {
+		i := slices.IndexFunc(z.entries, func(e zsetEntry) bool { return e.member == member })
+		if i >= 0 {
+			z.entries = slices.Delete(z.entries, i, i+1)
+			z.bytes -= zsetEntrySize + int64(len(member))
+		}
+		if len(z.entries)+1 > limits.entries || len(member) > limits.value {
+			z.convert()
+		}
+	}
+
+	if z.list != nil {
+		if old, ok := z.dict[member]; ok {
+			if old == score {
+				return
+			}
+			z.bytes -= z.list.delete(member, old)
+		} else {
+			z.bytes += mapEntryOverhead + int64(len(member))
+		}
+		z.dict[member] = score
+		z.bytes += z.list.insert(member, score)
+		return
+	}
+
+	i, _ := slices.BinarySearchFunc(z.entries, zsetEntry{member, score}, func(e zsetEntry, target zsetEntry) int {
+		if zsetBefore(e.score, e.member, target.score, target.member) {
+			return -1
+		}
+		return 1
+	})
+	z.entries = slices.Insert(z.entries, i, zsetEntry{member, score})
+	z.bytes += zsetEntrySize + int64(len(member))
+}
+
+// Moves the members to the skiplist encoding.
+func (z *zset) convert() {
+	z.dict = make(map[string]float64, len(z.entries))
+	z.list = newSkiplist()
+	z.bytes = 0
+	for _, e := range z.entries {
+		z.dict[e.member] = e.score
+		z.bytes += mapEntryOverhead + int64(len(e.member)) + z.list.insert(e.member, e.score)
+	}
+	z.entries = nil
+}
+
+// Calls f for the members scored in [min, max) in order, until f returns false.
+func (z *zset) rangeByScore(min float64, max float64, f func(member string, score float64) bool) {
+	if z.list != nil {
+		for node := z.list.first(min); node != nil && node.score < max; node = node.next[0] {
+			if !f(node.member, node.score) {
+				return
+			}
+		}
+		return
+	}
+	i, _ := slices.BinarySearchFunc(z.entries, min, func(e zsetEntry, min float64) int {
+		if e.score < min {
+			return -1
+		}
+		return 1
+	})
+	for _, e := range z.entries[i:] {
+		if e.score >= max || !f(e.member, e.score) {
+			return
+		}
+	}
+}
+
+// Calls f for every member in order, until f returns false.
+func (z *zset) each(f func(member string, score float64) bool) {
+	if z.list != nil {
+		for node := z.list.head.next[0]; node != nil; node = node.next[0] {
+			if !f(node.member, node.score) {
+				return
+			}
+		}
+		return
+	}
+	for _, e := range z.entries {
+		if !f(e.member, e.score) {
+			return
+		}
+	}
+}
+
+type skiplistNode struct {
+	member string
+	score  float64
+	// following node on each level of the node
+	next []*skiplistNode
+}
+
+type skiplist struct {
+	head  *skiplistNode
+	level int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// Finds the last node before member on every level.
+func (l *skiplist) search(member string, score float64) (update [skiplistMaxLevel]*skiplistNode) {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && zsetBefore(x.next[i].score, x.next[i].member, score, member) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return update
+}
+
+// Inserts a member that is not in the list. Returns the bytes used by its node.
+func (l *skiplist) insert(member string, score float64) int64 {
+	update := l.search(member, score)
+	level := randomLevel()
+	for ; l.level < level; l.level++ {
+		update[l.level] = l.head
+	}
+
+	node := &skiplistNode{member: member, score: score, next: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	return skiplistNodeSize + int64(level)*int64(unsafe.Sizeof(node))
+}
+
+// Removes a member with its current score. Returns the bytes freed by its node.
+func (l *skiplist) delete(member string, score float64) int64 {
+	update := l.search(member, score)
+	node := update[0].next[0]
+	if node == nil || node.member != member {
+		return 0
+	}
+	for i := 0; i < l.level; i++ {
+		if update[i].next[i] == node {
+			update[i].next[i] = node.next[i]
+		}
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	return skiplistNodeSize + int64(len(node.next))*int64(unsafe.Sizeof(node))
+}
+
+// Returns the first node scored at least min.
+func (l *skiplist) first(min float64) *skiplistNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].score < min {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}